@@ -0,0 +1,276 @@
+package main
+
+// Converts archives of raw NextBus reports between formats (a directory of
+// XML files, zip, tar, gzipped tar, and the columnar format of package
+// nbcolumnar), replacing the create_*_per_dir_of_xmls, convert_zip_to_*
+// and rename_to_dashed_date commands.
+//
+// Usage: archive_tool [flags] <command> [args]
+//
+// Commands:
+//   dirs          Archive each daily directory of XML files under --from
+//                 (named YYYYMMDD or YYYY-MM-DD, excluding today) to
+//                 --to/YYYY/MM/YYYY-MM-DD<--format>. An existing archive is
+//                 replaced only if the directory is newer.
+//   zips          Convert each zip file in --from (named YYYYMMDD.zip or
+//                 YYYY-MM-DD.zip) to YYYY-MM-DD<--format> in --to (defaults
+//                 to --from).
+//   convert IN OUT
+//                 Convert a single archive (or directory); the formats are
+//                 determined by the names.
+//   rename-dates  Rename the files in --from named YYYYMMDD<.ext> to
+//                 YYYY-MM-DD<.ext>.
+//
+// Example:
+//   archive_tool --from=/data/mbta/raw --to=/data/mbta/tars \
+//       --format=.tar.gz --parallel=4 dirs
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/jamessynge/transit_tools/nextbus/nbarchive"
+	"github.com/jamessynge/transit_tools/util"
+)
+
+var (
+	fromFlag = flag.String(
+		"from", "",
+		"Directory containing the daily directories, zip files or files "+
+			"to be renamed")
+	toFlag = flag.String(
+		"to", "",
+		"Directory into which to write the archives")
+	formatFlag = flag.String(
+		"format", ".tar.gz",
+		"Extension (and hence format) of the archives to be written; one of "+
+			strings.Join(nbarchive.SinkExtensions, ", "))
+	parallelFlag = flag.Int(
+		"parallel", runtime.NumCPU(),
+		"Number of archives to convert concurrently")
+	verifyFlag = flag.Bool(
+		"verify", true,
+		"Read back each archive written, and compare its entries (count and "+
+			"checksum) with the input")
+	timeNamesFlag = flag.Bool(
+		"time-names", true,
+		"Rename entries from <unix ms>.xml to <HHMMSS>.<mmm>.xml")
+	overwriteFlag = flag.Bool(
+		"overwrite", false,
+		"Replace existing archives, even if newer than their input")
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr,
+		"Usage: %s [flags] dirs|zips|rename-dates\n"+
+			"       %s [flags] convert <input> <output>\n",
+		os.Args[0], os.Args[0])
+	flag.PrintDefaults()
+	os.Exit(1)
+}
+
+func checkFormat() {
+	for _, ext := range nbarchive.SinkExtensions {
+		if *formatFlag == ext {
+			return
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Unsupported --format: %q\n", *formatFlag)
+	usage()
+}
+
+// Is pathA modified more recently than pathB?
+func isNewer(pathA, pathB string) bool {
+	statA, err := os.Stat(pathA)
+	if err != nil {
+		return false
+	}
+	statB, err := os.Stat(pathB)
+	return err == nil && statA.ModTime().After(statB.ModTime())
+}
+
+// Should input be converted to output?
+func needsConversion(input, output string) bool {
+	if !util.Exists(output) {
+		return true
+	}
+	if *overwriteFlag || isNewer(input, output) {
+		glog.Infof("Replacing older output: %s", output)
+		return true
+	}
+	glog.V(1).Infof("Already exists: %s", output)
+	return false
+}
+
+func dirJobs(fromDir, toDir string) ([]nbarchive.Job, error) {
+	infos, err := ioutil.ReadDir(fromDir)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	exclude := map[string]bool{
+		now.Format("2006-01-02"): true,
+		now.Format("20060102"):   true,
+	}
+	var jobs []nbarchive.Job
+	for _, info := range infos {
+		if !info.IsDir() || exclude[info.Name()] {
+			continue
+		}
+		yyyy, mm, dd := nbarchive.ParseDate(info.Name())
+		if yyyy == "" {
+			glog.Warningf("Unexpected directory name: %s", info.Name())
+			continue
+		}
+		input := filepath.Join(fromDir, info.Name())
+		output := nbarchive.DatedPath(toDir, yyyy, mm, dd, *formatFlag)
+		if needsConversion(input, output) {
+			jobs = append(jobs, nbarchive.Job{Input: input, Output: output})
+		}
+	}
+	return jobs, nil
+}
+
+func zipJobs(fromDir, toDir string) ([]nbarchive.Job, error) {
+	infos, err := ioutil.ReadDir(fromDir)
+	if err != nil {
+		return nil, err
+	}
+	var jobs []nbarchive.Job
+	for _, info := range infos {
+		if info.IsDir() || !strings.HasSuffix(info.Name(), ".zip") {
+			continue
+		}
+		base := strings.TrimSuffix(info.Name(), ".zip")
+		yyyy, mm, dd := nbarchive.ParseDate(base)
+		if yyyy == "" {
+			glog.Warningf("Unexpected zip file name: %s", info.Name())
+			continue
+		}
+		input := filepath.Join(fromDir, info.Name())
+		output := filepath.Join(toDir,
+			fmt.Sprintf("%s-%s-%s%s", yyyy, mm, dd, *formatFlag))
+		if output == input {
+			continue
+		}
+		if needsConversion(input, output) {
+			jobs = append(jobs, nbarchive.Job{Input: input, Output: output})
+		}
+	}
+	return jobs, nil
+}
+
+func runJobs(jobs []nbarchive.Job) int {
+	if len(jobs) == 0 {
+		return 0
+	}
+	options := nbarchive.Options{
+		TimeNames: *timeNamesFlag,
+		Verify:    *verifyFlag,
+	}
+	_, errs := nbarchive.RunJobs(jobs, options, *parallelFlag)
+	numFailed := 0
+	for _, err := range errs {
+		if err != nil {
+			numFailed++
+		}
+	}
+	glog.Infof("Converted %d of %d archives", len(jobs)-numFailed, len(jobs))
+	return numFailed
+}
+
+func renameDates(dir string) error {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		newName, ok := nbarchive.DashedDateName(info.Name())
+		if !ok {
+			continue
+		}
+		newPath := filepath.Join(dir, newName)
+		ext := filepath.Ext(newName)
+		if strings.HasSuffix(newName, ".tar.gz") {
+			ext = ".tar.gz"
+		}
+		for i := 1; util.Exists(newPath); i++ {
+			glog.Warningf("Already exists: %s", newPath)
+			newPath = filepath.Join(dir, fmt.Sprintf("%s (%d)%s",
+				strings.TrimSuffix(newName, ext), i, ext))
+		}
+		oldPath := filepath.Join(dir, info.Name())
+		glog.Infof("Renaming %s to %s", oldPath, newPath)
+		if err := os.Rename(oldPath, newPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func main() {
+	flag.Parse()
+	if flag.NArg() < 1 {
+		usage()
+	}
+	command := flag.Arg(0)
+	if command == "convert" {
+		if flag.NArg() != 3 {
+			usage()
+		}
+		output := flag.Arg(2)
+		result, err := nbarchive.Convert(flag.Arg(1), output, nbarchive.Options{
+			TimeNames: *timeNamesFlag,
+			Verify:    *verifyFlag,
+		})
+		if err != nil {
+			glog.Fatal(err)
+		}
+		glog.Infof("Wrote %d entries to %s in %s", result.NumEntries, output,
+			result.Duration)
+		return
+	}
+	if flag.NArg() != 1 || *fromFlag == "" {
+		usage()
+	}
+	var jobs []nbarchive.Job
+	var err error
+	switch command {
+	case "dirs":
+		if *toFlag == "" {
+			fmt.Fprintln(os.Stderr, "--to is required")
+			usage()
+		}
+		checkFormat()
+		jobs, err = dirJobs(*fromFlag, *toFlag)
+	case "zips":
+		toDir := *toFlag
+		if toDir == "" {
+			toDir = *fromFlag
+		}
+		checkFormat()
+		jobs, err = zipJobs(*fromFlag, toDir)
+	case "rename-dates":
+		err = renameDates(*fromFlag)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command: %q\n", command)
+		usage()
+	}
+	if err != nil {
+		glog.Fatal(err)
+	}
+	if numFailed := runJobs(jobs); numFailed > 0 {
+		glog.Errorf("Failed to convert %d archives", numFailed)
+		glog.Flush()
+		os.Exit(1)
+	}
+	glog.Flush()
+}
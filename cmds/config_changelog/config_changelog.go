@@ -0,0 +1,151 @@
+package main
+
+// Produces a change log of the semantic differences (routes added or removed,
+// stops moved or renamed, directions re-sequenced, paths changed, scheduled
+// trips added or removed) between consecutive config snapshots, as JSON
+// and/or as a human readable report.
+//
+// Example:
+//   config_changelog --route=77 --json=/tmp/77.json '/data/mbta/config/*/*/*/*'
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+
+	"github.com/golang/glog"
+
+	"github.com/jamessynge/transit_tools/nextbus/configfetch"
+	"github.com/jamessynge/transit_tools/util"
+)
+
+var (
+	routeFlag = flag.String(
+		"route", "",
+		"If set, only changes affecting the route with this tag are reported")
+	jsonFlag = flag.String(
+		"json", "",
+		"Path of file to which to write the change logs as JSON")
+	reportFlag = flag.String(
+		"report", "-",
+		"Path of file to which to write the human readable report ('-' for "+
+			"stdout, empty for none)")
+	skipEmptyFlag = flag.Bool(
+		"skip-empty", true,
+		"If true, pairs of snapshots without changes are omitted")
+)
+
+// Expands the globs to the config dirs (those with a routeConfig
+// subdirectory), in path order (i.e. time order for the directories created
+// by configfetch.PeriodicConfigFetcher).
+func findConfigDirs(globs []string) ([]string, error) {
+	var result []string
+	for _, glob := range globs {
+		matches, err := filepath.Glob(glob)
+		if err != nil {
+			return nil, err
+		}
+		for _, match := range matches {
+			if util.IsDirectory(filepath.Join(match, "routeConfig")) {
+				result = append(result, match)
+			}
+		}
+	}
+	util.SortPaths(result)
+	return result, nil
+}
+
+func createOutput(fp string) (*os.File, error) {
+	if fp == "-" {
+		return os.Stdout, nil
+	}
+	return os.Create(fp)
+}
+
+func main() {
+	flag.Parse()
+	ok := true
+	if flag.NArg() == 0 {
+		ok = false
+		glog.Error("No config directories specified")
+	}
+	if len(*jsonFlag) == 0 && len(*reportFlag) == 0 {
+		ok = false
+		glog.Error("Neither --json nor --report is set")
+	}
+	var configDirs []string
+	if ok {
+		var err error
+		configDirs, err = findConfigDirs(flag.Args())
+		if err != nil {
+			ok = false
+			glog.Errorf("Error expanding globs: %v", err)
+		} else if len(configDirs) < 2 {
+			ok = false
+			glog.Errorf("Need at least 2 config directories, found %d",
+				len(configDirs))
+		}
+	}
+	if !ok {
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	var report *os.File
+	if len(*reportFlag) > 0 {
+		var err error
+		report, err = createOutput(*reportFlag)
+		if err != nil {
+			glog.Fatal(err)
+		}
+	}
+
+	var logs []*configfetch.ConfigChangeLog
+	var prev *configfetch.ConfigSnapshot
+	for _, dir := range configDirs {
+		snapshot, err := configfetch.LoadConfigSnapshot(dir)
+		if err != nil {
+			glog.Warningf("Error(s) loading %s: %v", dir, err)
+			if snapshot == nil {
+				continue
+			}
+		}
+		if prev != nil {
+			changeLog := configfetch.DiffConfigSnapshots(prev, snapshot)
+			if len(*routeFlag) > 0 {
+				changeLog = changeLog.FilterByRoute(*routeFlag)
+			}
+			if len(changeLog.Changes) > 0 || !*skipEmptyFlag {
+				logs = append(logs, changeLog)
+				if report != nil {
+					if err := changeLog.WriteReport(report); err != nil {
+						glog.Fatal(err)
+					}
+				}
+			}
+		}
+		prev = snapshot
+	}
+	if report != nil && report != os.Stdout {
+		if err := report.Close(); err != nil {
+			glog.Fatal(err)
+		}
+	}
+
+	if len(*jsonFlag) > 0 {
+		f, err := createOutput(*jsonFlag)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		if err := configfetch.WriteConfigChangeLogsJSON(f, logs); err != nil {
+			glog.Fatal(err)
+		}
+		if f != os.Stdout {
+			if err := f.Close(); err != nil {
+				glog.Fatal(err)
+			}
+		}
+	}
+	glog.Infof("Compared %d config directories; %d with changes",
+		len(configDirs), len(logs))
+}
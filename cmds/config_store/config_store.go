@@ -0,0 +1,148 @@
+package main
+
+// Maintains a content-addressed store of config snapshots (see
+// configfetch.ConfigStore), in which files that are unchanged between
+// snapshots (ignoring the metadata comments added when fetched) are stored
+// just once.
+//
+// Examples:
+//   config_store --store=/data/mbta/config_store add '/data/mbta/config/*/*/*/*'
+//   config_store --store=/data/mbta/config_store list
+//   config_store --store=/data/mbta/config_store checkout 2013-03-01_0300 /tmp/cfg
+//   config_store --store=/data/mbta/config_store diff 2013-03-01_0300 2013-04-01_0300
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/golang/glog"
+
+	"github.com/jamessynge/transit_tools/nextbus/configfetch"
+	"github.com/jamessynge/transit_tools/util"
+)
+
+var (
+	storeFlag = flag.String(
+		"store", "",
+		"Root directory of the config store")
+	skipExistingFlag = flag.Bool(
+		"skip-existing", true,
+		"If true, add skips config dirs already in the store")
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: config_store --store=<dir> <command> <args>
+Commands:
+  add <config dir glob>...        Adds config dirs, named by their base names
+  list                            Lists the snapshots in the store
+  checkout <snapshot> <dir>       Writes the files of a snapshot to dir
+  diff <snapshot1> <snapshot2>    Lists the files that differ
+Flags:
+`)
+	flag.PrintDefaults()
+}
+
+func addDirs(store *configfetch.ConfigStore, globs []string) error {
+	var dirs []string
+	for _, glob := range globs {
+		matches, err := filepath.Glob(glob)
+		if err != nil {
+			return err
+		}
+		for _, match := range matches {
+			if util.IsDirectory(filepath.Join(match, "routeConfig")) {
+				dirs = append(dirs, match)
+			}
+		}
+	}
+	util.SortPaths(dirs)
+	totalBlobs := 0
+	for _, dir := range dirs {
+		name := filepath.Base(dir)
+		if *skipExistingFlag && store.HasSnapshot(name) {
+			glog.V(1).Infof("Skipping %s, already in the store", dir)
+			continue
+		}
+		_, newBlobs, err := store.AddDir(name, dir)
+		if err != nil {
+			return err
+		}
+		totalBlobs += newBlobs
+	}
+	glog.Infof("Added %d new blobs from %d config dirs", totalBlobs, len(dirs))
+	return nil
+}
+
+func diffSnapshots(store *configfetch.ConfigStore, name1, name2 string) error {
+	m1, err := store.ReadManifest(name1)
+	if err != nil {
+		return err
+	}
+	m2, err := store.ReadManifest(name2)
+	if err != nil {
+		return err
+	}
+	removed, added, changed := configfetch.DiffConfigManifests(m1, m2)
+	for _, rel := range removed {
+		fmt.Println("-", rel)
+	}
+	for _, rel := range added {
+		fmt.Println("+", rel)
+	}
+	for _, rel := range changed {
+		fmt.Println("M", rel)
+	}
+	return nil
+}
+
+func main() {
+	flag.Parse()
+	ok := true
+	if len(*storeFlag) == 0 {
+		ok = false
+		glog.Error("--store not set")
+	}
+	args := flag.Args()
+	if len(args) == 0 {
+		ok = false
+		glog.Error("No command specified")
+	} else {
+		wantArgs := map[string]int{"add": -1, "list": 0, "checkout": 2, "diff": 2}
+		n, known := wantArgs[args[0]]
+		if !known {
+			ok = false
+			glog.Errorf("Unknown command: %s", args[0])
+		} else if (n < 0 && len(args) < 2) || (n >= 0 && len(args)-1 != n) {
+			ok = false
+			glog.Errorf("Wrong number of arguments for %s", args[0])
+		}
+	}
+	if !ok {
+		usage()
+		os.Exit(1)
+	}
+
+	store, err := configfetch.OpenConfigStore(*storeFlag)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	switch args[0] {
+	case "add":
+		err = addDirs(store, args[1:])
+	case "list":
+		var names []string
+		names, err = store.ListSnapshots()
+		for _, name := range names {
+			fmt.Println(name)
+		}
+	case "checkout":
+		err = store.Checkout(args[1], args[2])
+	case "diff":
+		err = diffSnapshots(store, args[1], args[2])
+	}
+	if err != nil {
+		glog.Fatal(err)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+// Writes a GTFS static feed (zip) for an agency from a config directory
+// fetched by the config fetcher (i.e. with routeConfig and schedule
+// subdirectories).
+//
+// Example:
+//   config_to_gtfs --config=/data/mbta/config/2014/08/30/2014-08-30_0300 \
+//       --agency-name=MBTA --agency-url=http://www.mbta.com --output=/tmp/mbta.zip
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+
+	"github.com/golang/glog"
+
+	"github.com/jamessynge/transit_tools/nextbus"
+	"github.com/jamessynge/transit_tools/nextbus/gtfs"
+	"github.com/jamessynge/transit_tools/util"
+)
+
+var (
+	configDirFlag = flag.String(
+		"config", "",
+		"Config directory, with routeConfig and schedule subdirectories")
+	outputFlag = flag.String(
+		"output", "",
+		"Path of the GTFS zip file to write")
+	agencyTagFlag = flag.String(
+		"agency", "mbta",
+		"Tag (agency_id) of the agency")
+	agencyNameFlag = flag.String(
+		"agency-name", "",
+		"Name of the agency (defaults to --agency)")
+	agencyUrlFlag = flag.String(
+		"agency-url", "http://www.nextbus.com",
+		"URL of the agency's web site")
+	timezoneFlag = flag.String(
+		"timezone", "America/New_York",
+		"Time zone of the agency")
+	startDateFlag = flag.String(
+		"start-date", "",
+		"First date (yyyymmdd) of the service calendar; defaults to the "+
+			"earliest schedule class")
+	endDateFlag = flag.String(
+		"end-date", "",
+		"Last date (yyyymmdd) of the service calendar; defaults to a year "+
+			"after the start date")
+)
+
+func main() {
+	flag.Parse()
+	ok := true
+	if len(*configDirFlag) == 0 {
+		ok = false
+		glog.Error("--config not set")
+	} else if !util.IsDirectory(filepath.Join(*configDirFlag, "routeConfig")) {
+		ok = false
+		glog.Errorf("No routeConfig directory in %s", *configDirFlag)
+	}
+	if len(*outputFlag) == 0 {
+		ok = false
+		glog.Error("--output not set")
+	}
+	if !ok {
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	agency := nextbus.NewAgency(*agencyTagFlag)
+	err := nextbus.ParseRouteConfigsDir(
+		agency, filepath.Join(*configDirFlag, "routeConfig"))
+	if err != nil {
+		glog.Fatal(err)
+	}
+	exporter := gtfs.NewExporter(agency)
+	if len(*agencyNameFlag) > 0 {
+		exporter.AgencyName = *agencyNameFlag
+	}
+	exporter.AgencyUrl = *agencyUrlFlag
+	exporter.Timezone = *timezoneFlag
+	exporter.StartDate = *startDateFlag
+	exporter.EndDate = *endDateFlag
+	scheduleDir := filepath.Join(*configDirFlag, "schedule")
+	if util.IsDirectory(scheduleDir) {
+		if err := exporter.AddScheduleDir(scheduleDir); err != nil {
+			glog.Fatal(err)
+		}
+	} else {
+		glog.Warningf("No schedule directory in %s; the feed will have no trips",
+			*configDirFlag)
+	}
+	if err := exporter.WriteZipFile(*outputFlag); err != nil {
+		glog.Fatal(err)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+// Converts vehicle location CSV files (.csv or .csv.gz, as written by the
+// nextbus_fetcher) to the columnar format of package nbcolumnar. Each file
+// foo.csv.gz is converted to foo.vlc, either alongside it or, if --output is
+// set, in the corresponding location under --output.
+//
+// Example:
+//   csv_to_columnar --input=/data/mbta/processed --output=/data/mbta/columnar
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+
+	"github.com/jamessynge/transit_tools/nextbus"
+	"github.com/jamessynge/transit_tools/nextbus/nbcolumnar"
+	"github.com/jamessynge/transit_tools/util"
+)
+
+var (
+	inputFlag = flag.String(
+		"input", "",
+		"CSV file, or directory to search for CSV files")
+	outputFlag = flag.String(
+		"output", "",
+		"Directory into which to write the columnar files (mirroring the "+
+			"layout under --input); defaults to alongside the CSV files")
+	blockSizeFlag = flag.Int(
+		"block-size", nbcolumnar.DefaultBlockSize,
+		"Number of locations per block")
+	overwriteFlag = flag.Bool(
+		"overwrite", false,
+		"Replace existing columnar files")
+	verifyFlag = flag.Bool(
+		"verify", true,
+		"Read back each columnar file and compare it with the CSV file")
+)
+
+func columnarPath(csvPath string) string {
+	base := strings.TrimSuffix(strings.TrimSuffix(csvPath, ".gz"), ".csv")
+	if len(*outputFlag) > 0 {
+		if rel, err := filepath.Rel(*inputFlag, base); err == nil && rel != "." {
+			base = filepath.Join(*outputFlag, rel)
+		} else {
+			base = filepath.Join(*outputFlag, filepath.Base(base))
+		}
+	}
+	return base + nbcolumnar.Extension
+}
+
+func readCsvFile(csvPath string) ([]*nextbus.VehicleLocation, error) {
+	var result []*nextbus.VehicleLocation
+	fn := func(source string, record []string, recordNum int, err error) error {
+		if err != nil {
+			return err
+		}
+		vl, err := nextbus.CSVFieldsToVehicleLocation(record)
+		if err != nil {
+			glog.Warningf("Skipping record %d of %s: %v", recordNum+1, source, err)
+			return nil
+		}
+		result = append(result, vl)
+		return nil
+	}
+	_, err := util.ReadCsvFileToFn(csvPath, fn)
+	return result, err
+}
+
+func writeColumnarFile(
+	vls []*nextbus.VehicleLocation, filePath string) (err error) {
+	if err = os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return
+	}
+	tmpPath := filePath + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return
+	}
+	w := nbcolumnar.NewWriter(f)
+	w.BlockSize = *blockSizeFlag
+	err = w.WriteLocations(vls)
+	if err == nil {
+		err = w.Close()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, filePath)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+	}
+	return
+}
+
+func verifyColumnarFile(
+	vls []*nextbus.VehicleLocation, filePath string) error {
+	fn := func(source string, vl *nextbus.VehicleLocation, recordNum int,
+		err error) error {
+		if err != nil {
+			return err
+		}
+		if recordNum >= len(vls) {
+			return fmt.Errorf("More locations than in the CSV file")
+		}
+		expected := vls[recordNum]
+		if !expected.IsSameReportExceptTime(vl) || !expected.Time.Equal(vl.Time) {
+			return fmt.Errorf("Location %d differs\nExpected: %v\n  Actual: %v",
+				recordNum+1, expected.ToCSVFields(), vl.ToCSVFields())
+		}
+		return nil
+	}
+	numRecords, err := nbcolumnar.ReadVehicleLocationsFile(filePath, nil, fn)
+	if err == nil && numRecords != len(vls) {
+		err = fmt.Errorf("Read %d locations, expected %d", numRecords, len(vls))
+	}
+	return err
+}
+
+func convertFile(csvPath string) error {
+	outPath := columnarPath(csvPath)
+	if !*overwriteFlag && util.IsFile(outPath) {
+		glog.V(1).Infof("Skipping %s, already converted", csvPath)
+		return nil
+	}
+	vls, err := readCsvFile(csvPath)
+	if err != nil {
+		return err
+	}
+	if err := writeColumnarFile(vls, outPath); err != nil {
+		return err
+	}
+	if *verifyFlag {
+		if err := verifyColumnarFile(vls, outPath); err != nil {
+			os.Remove(outPath)
+			return fmt.Errorf("Verification of %s failed: %v", outPath, err)
+		}
+	}
+	glog.Infof("Wrote %d locations to %s", len(vls), outPath)
+	return nil
+}
+
+func isCsvFile(filePath string) bool {
+	return strings.HasSuffix(filePath, ".csv") ||
+		strings.HasSuffix(filePath, ".csv.gz")
+}
+
+func main() {
+	flag.Parse()
+	ok := true
+	if len(*inputFlag) == 0 {
+		ok = false
+		glog.Error("--input not set")
+	} else if !util.Exists(*inputFlag) {
+		ok = false
+		glog.Errorf("--input does not exist: %s", *inputFlag)
+	}
+	if *blockSizeFlag <= 0 {
+		ok = false
+		glog.Error("--block-size must be positive")
+	}
+	if !ok {
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	var csvPaths []string
+	walkFn := func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			glog.Warningf("Error walking %s: %v", path, err)
+			return nil
+		}
+		if !info.IsDir() && isCsvFile(path) {
+			csvPaths = append(csvPaths, path)
+		}
+		return nil
+	}
+	filepath.Walk(*inputFlag, walkFn)
+	glog.Infof("Found %d CSV files", len(csvPaths))
+
+	errs := util.NewErrors()
+	for _, csvPath := range csvPaths {
+		if err := convertFile(csvPath); err != nil {
+			glog.Errorf("Error converting %s: %v", csvPath, err)
+			errs.AddError(err)
+		}
+	}
+	if err := errs.ToError(); err != nil {
+		glog.Error("Some files failed to convert")
+		os.Exit(1)
+	}
+}
@@ -4,196 +4,24 @@ import (
 	"flag"
 	//	"fmt"
 	"encoding/csv"
-	"image"
 	"image/color"
-	"image/png"
 	"io"
 	"log"
-	"math"
-	"os"
 	"path/filepath"
-	"sort"
+	"time"
 
 	"github.com/jamessynge/transit_tools/geo"
+	"github.com/jamessynge/transit_tools/geom"
 	"github.com/jamessynge/transit_tools/nextbus"
+	"github.com/jamessynge/transit_tools/nextbus/configfetch"
+	"github.com/jamessynge/transit_tools/nextbus/nbimage"
 	"github.com/jamessynge/transit_tools/util"
 )
 
-type LocationCensus struct {
-	LatMin     float64
-	LonMin     float64
-	GeoWidth   float64
-	GeoHeight  float64
-	Width      int
-	Height     int
-	Data       [][]uint32
-	MaxVal     uint32
-	NumNonZero uint32
-}
-
-type IntensityCount struct {
-	Intensity, Count uint32
-}
-type IntensityCountSlice []IntensityCount
-
-func NewLocationCensus(min, max geo.Location, width, height int) *LocationCensus {
-	if min.Lat > max.Lat {
-		min.Lat, max.Lat = max.Lat, min.Lat
-	}
-	if min.Lon > max.Lon {
-		min.Lon, max.Lon = max.Lon, min.Lon
-	}
-	lc := &LocationCensus{
-		LatMin:    float64(min.Lat),
-		LonMin:    float64(min.Lon),
-		GeoWidth:  float64(max.Lon - min.Lon),
-		GeoHeight: float64(max.Lat - min.Lat),
-		Width:     width,
-		Height:    height,
-		Data:      make([][]uint32, height),
-	}
-	for rowIndex := range lc.Data {
-		lc.Data[rowIndex] = make([]uint32, width)
-	}
-	return lc
-}
-
-func (p *LocationCensus) LatitudeToRow(lat geo.Latitude) (row int) {
-	relative := float64(lat) - p.LatMin
-	frac := relative / p.GeoHeight
-	row = int(frac * float64(p.Height))
-	return
-}
-func (p *LocationCensus) LongitudeToColumn(lon geo.Longitude) (column int) {
-	relative := float64(lon) - p.LonMin
-	frac := relative / p.GeoWidth
-	column = int(frac * float64(p.Width))
-	return
-}
-func (p *LocationCensus) IncrementRC(row, column int) {
-	if 0 <= row && row < p.Height && 0 <= column && column < p.Width {
-		rowSlice := p.Data[row]
-		val := rowSlice[column] + 1
-		rowSlice[column] = val
-		if val == 1 {
-			p.NumNonZero++
-		}
-		if p.MaxVal < val {
-			p.MaxVal = val
-		}
-	}
-}
-func (p *LocationCensus) AddLocation(loc geo.Location) {
-	row := p.LatitudeToRow(loc.Lat)
-	column := p.LongitudeToColumn(loc.Lon)
-	p.IncrementRC(row, column)
-}
-func (p *LocationCensus) AddVehicleLocation(vl *nextbus.VehicleLocation) {
-	p.AddLocation(vl.Location)
-}
-func (p *LocationCensus) TotalSlots() int {
-	return p.Width * p.Height
-}
-func (p *LocationCensus) HistogramMap() (histogramMap map[uint32]uint32) {
-	histogramMap = make(map[uint32]uint32)
-	for _, rowSlice := range p.Data {
-		for _, count := range rowSlice {
-			histogramMap[count]++
-		}
-	}
-	return
-}
-func (p *LocationCensus) Histogram() IntensityCountSlice {
-	histogramMap := p.HistogramMap()
-	return MapToHistogram(histogramMap)
-}
-func (p *LocationCensus) HistogramAndCDF() (
-	histogram, cdf IntensityCountSlice) {
-	histogram = p.Histogram()
-	cdf = HistogramToCDF(histogram)
-	return
-}
-
-func (p IntensityCountSlice) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
-func (p IntensityCountSlice) Len() int      { return len(p) }
-func (p IntensityCountSlice) Less(i, j int) bool {
-	return p[i].Intensity < p[j].Intensity
-}
-
-func MapToHistogram(histogramMap map[uint32]uint32) (
-	histogram IntensityCountSlice) {
-	histogram = make(IntensityCountSlice, len(histogramMap))
-	var ndx int
-	for intensity, count := range histogramMap {
-		histogram[ndx] = IntensityCount{intensity, count}
-		ndx++
-	}
-	sort.Sort(histogram)
-	return
-}
-func HistogramToCDF(histogram IntensityCountSlice) (cdf IntensityCountSlice) {
-	cdf = make(IntensityCountSlice, len(histogram))
-	var cum uint32
-	for ndx, ic := range histogram {
-		cum = cum + ic.Count
-		cdf[ndx] = IntensityCount{ic.Intensity, cum}
-	}
-	return
-}
-func CDFToHEPalette(cdf IntensityCountSlice) (palette color.Palette) {
-	cdf_min := cdf[0].Count
-	cdf_max := cdf[len(cdf)-1].Count
-	denom := float64(cdf_max - cdf_min)
-	scale := 255
-	palette = make(color.Palette, cdf[len(cdf)-1].Intensity+1)
-	var ndx uint32
-	for _, ic := range cdf {
-		var c color.NRGBA
-		numer := float64(ic.Count - cdf_min)
-		if numer > 0 {
-			quo := numer / denom
-			raw := quo * float64(scale)
-			hv := int(math.Floor(raw + 0.5))
-			if hv > 255 {
-				hv = 255
-			}
-			c.A = 255
-			c.R = uint8(hv)
-		}
-		for ndx <= ic.Intensity {
-			palette[ndx] = c
-			ndx++
-		}
-	}
-	return
-}
-func ToImage(census *LocationCensus, palette color.Palette) image.Image {
-	img := image.NewNRGBA(image.Rect(0, 0, census.Width, census.Height))
-	for row, rowSlice := range census.Data {
-		for col, count := range rowSlice {
-			c := palette[count]
-			img.Set(col, census.Width-row, c)
-		}
-	}
-	return img
-}
-func LogHistogramAndCDF(histogram, cdf IntensityCountSlice) {
-	log.Printf("===== Histogram Table =====")
-	log.Printf("Index Intensity Count Percentage Cumulative%%")
-	lastCum := float64(cdf[len(cdf)-1].Count)
-	for ndx := range histogram {
-		intensity := histogram[ndx].Intensity
-		if intensity != cdf[ndx].Intensity {
-			log.Fatalf("ndx=%v  h=%#v  c=%#v", ndx, histogram[ndx], cdf[ndx])
-		}
-		count := float64(histogram[ndx].Count)
-		cum := float64(cdf[ndx].Count)
-		log.Printf("%5d%9d%7d %9.5f%%   %9.5f%%", ndx, intensity, histogram[ndx].Count,
-			count/lastCum*100, cum/lastCum*100)
-	}
-}
-
-func AddLocationsFileToCensus(filePath string, census *LocationCensus) (err error) {
+// Adds the location of each vehicle location report in the file to hist, and
+// extends [first, last] to include the time of each report.
+func AddLocationsFileToHist2D(filePath string, img *nbimage.Image,
+	hist *geom.Hist2D, first, last *time.Time) (err error) {
 	// Open the file for reading.
 	rc, err := util.OpenReadFile(filePath)
 	if err != nil {
@@ -226,7 +54,16 @@ func AddLocationsFileToCensus(filePath string, census *LocationCensus) (err erro
 			// debug later.
 			continue
 		}
-		census.AddVehicleLocation(vl)
+		pt := img.LocationToPoint(vl.Location)
+		if img.DataBounds.ContainsPoint(pt) {
+			hist.IncrementPt(pt)
+			if first.IsZero() || vl.Time.Before(*first) {
+				*first = vl.Time
+			}
+			if last.IsZero() || vl.Time.After(*last) {
+				*last = vl.Time
+			}
+		}
 	}
 	log.Printf("Processed %d records from: %s", numRecords, filePath)
 	return
@@ -248,10 +85,10 @@ var (
 
 	widthFlag = flag.Int(
 		"width", 256,
-		"Width of image")
+		"Maximum width of image")
 	heightFlag = flag.Int(
 		"height", 256,
-		"Height of image")
+		"Maximum height of image")
 
 	locationsGlobFlag = flag.String(
 		"locations", "",
@@ -264,9 +101,25 @@ var (
 	//		"locations", "",
 	//		"Path (glob) of locations csv file(s) to process")
 
+	allPathsFlag = flag.String(
+		"all-paths", "",
+		"Path of xml file with description of all paths to be drawn, or of a "+
+			"directory of routeConfig xml files (optional)")
+	configRootFlag = flag.String(
+		"config_root", "",
+		"Root of the config snapshots (a config store, or a directory tree "+
+			"created by the config fetcher); the paths of the configs in effect "+
+			"during the period of the locations are drawn (alternative to "+
+			"--all-paths)")
+	stopsFlag = flag.Bool(
+		"stops", false,
+		"Draw the stops (requires --all-paths to be a routeConfig directory, "+
+			"or --config_root, in which case the stops of the last config are "+
+			"drawn)")
+
 	outputImgFlag = flag.String(
 		"output", "",
-		"Image file to write")
+		"Image file to write (.png or .svg)")
 )
 
 func main() {
@@ -324,48 +177,87 @@ func main() {
 		}
 	}
 
+	var agency *nextbus.Agency
+	var history *configfetch.ConfigHistory
+	if len(*allPathsFlag) > 0 && len(*configRootFlag) > 0 {
+		ok = false
+		log.Print("Only one of --all-paths and --config_root may be set")
+	} else if len(*configRootFlag) > 0 {
+		history, err = configfetch.OpenConfigHistory(*configRootFlag, nil)
+		if err != nil {
+			ok = false
+			log.Printf("Unable to read --config_root %s: %v", *configRootFlag, err)
+		}
+	} else if len(*allPathsFlag) > 0 {
+		if util.IsDirectory(*allPathsFlag) {
+			agency = nextbus.NewAgency("")
+			err = nextbus.ParseRouteConfigsDir(agency, *allPathsFlag)
+		} else {
+			agency, err = nextbus.ReadPathsFromFile(*allPathsFlag)
+		}
+		if err != nil {
+			ok = false
+			log.Printf("Unable to read --all-paths %s: %v", *allPathsFlag, err)
+		}
+	}
+
 	if !ok {
 		flag.PrintDefaults()
 		return
 	}
 
-	minLoc := geo.Location{minLat, minLon}
-	maxLoc := geo.Location{maxLat, maxLon}
-	census := NewLocationCensus(minLoc, maxLoc, *widthFlag, *heightFlag)
+	region := geo.Rect{South: minLat, North: maxLat, West: minLon, East: maxLon}
+	img := nbimage.NewImageForRegion(region, *widthFlag, *heightFlag)
+	img.Background = color.Black
+	hist := img.NewHist2D()
 
+	var first, last time.Time
 	for _, filePath := range matchingLocationFilePaths {
-		err = AddLocationsFileToCensus(filePath, census)
+		err = AddLocationsFileToHist2D(filePath, img, hist, &first, &last)
+		if err != nil {
+			log.Printf("Error reading %s: %v", filePath, err)
+		}
 	}
 
 	log.Printf("NumNonZero: %d (%.2f %%)",
-		census.NumNonZero,
-		float64(census.NumNonZero)/float64(census.TotalSlots()))
-	log.Printf("MaxVal: %d", census.MaxVal)
+		hist.NumNonZero,
+		float64(hist.NumNonZero)*100/float64(hist.TotalSlots()))
+	log.Printf("MaxVal: %d", hist.MaxVal)
 
-	histogram, cdf := census.HistogramAndCDF()
-	log.Printf("Histogram len: %d", len(histogram))
-	log.Printf("      CDF len: %d", len(cdf))
-	if len(histogram) != len(cdf) {
-		log.Fatalf("Lengths should be the same")
-	}
-	LogHistogramAndCDF(histogram, cdf)
+	locationsColor := color.NRGBA{255, 0, 0, 255}
+	img.AddHist2D(hist, nbimage.HistEqualizedColors(hist, locationsColor))
+	img.AddLegend("Vehicle locations", locationsColor)
 
-	palette := CDFToHEPalette(cdf)
-	img := ToImage(census, palette)
-
-	f, err := os.Create(*outputImgFlag)
-	if err != nil {
-		log.Fatal(err)
+	var agencies []*nextbus.Agency
+	if history != nil && !first.IsZero() {
+		for _, i := range history.SnapshotsBetween(first, last) {
+			a, err := history.LoadAgency(i)
+			if err != nil {
+				log.Printf("Error(s) loading config %s: %v", history.Names[i], err)
+			}
+			agencies = append(agencies, a)
+		}
+		if len(agencies) > 0 {
+			agency = agencies[len(agencies)-1]
+		}
+	} else if agency != nil {
+		agencies = append(agencies, agency)
 	}
 
-	err = png.Encode(f, img)
-	if err != nil {
-		log.Fatal(err)
+	if agency != nil {
+		pathsColor := color.NRGBA{64, 192, 64, 255}
+		for _, a := range agencies {
+			img.AddPaths(a.GetPaths(), pathsColor, 1)
+		}
+		img.AddLegend("Paths", pathsColor)
+		if *stopsFlag {
+			stopsColor := color.NRGBA{255, 255, 0, 255}
+			img.AddStops(agency, stopsColor, 1)
+			img.AddLegend("Stops", stopsColor)
+		}
 	}
 
-	err = f.Close()
-	if err != nil {
+	if err = img.SaveToFile(*outputImgFlag); err != nil {
 		log.Fatal(err)
 	}
-	log.Printf("Wrote to %v", *outputImgFlag)
 }
@@ -3,13 +3,13 @@ package main
 import (
 	"flag"
 	"fmt"
-	"image"
 	"image/color"
-	"image/png"
 	"log"
 	"math"
 	"os"
 	"path/filepath"
+	"sort"
+	"time"
 
 	"github.com/jamessynge/transit_tools/fit"
 	"github.com/jamessynge/transit_tools/geo"
@@ -17,7 +17,11 @@ import (
 	"github.com/jamessynge/transit_tools/geom"
 	"github.com/jamessynge/transit_tools/nextbus"
 	"github.com/jamessynge/transit_tools/nextbus/busgeom"
-	"github.com/jamessynge/transit_tools/stats"
+	"github.com/jamessynge/transit_tools/nextbus/configfetch"
+	"github.com/jamessynge/transit_tools/nextbus/nbimage"
+	"github.com/jamessynge/transit_tools/nextbus/nbmatch"
+	"github.com/jamessynge/transit_tools/nextbus/nbnetwork"
+	"github.com/jamessynge/transit_tools/nextbus/nbshape"
 	"github.com/jamessynge/transit_tools/util"
 )
 
@@ -27,195 +31,9 @@ const (
 	twoPi  = math.Pi * 2
 )
 
-func saveImageToPng(img image.Image, file string) error {
-	if f, err := os.Create(file); err != nil {
-		return err
-	} else {
-		err = png.Encode(f, img)
-		if err2 := f.Close(); err == nil {
-			err = err2
-		}
-		if err == nil {
-			log.Printf("Wrote image to %s", file)
-		}
-		return err
-	}
-}
-
-type Image interface {
-	At(x, y int) color.Color
-	Bounds() image.Rectangle
-	ColorModel() color.Model
-	Set(x, y int, c color.Color)
-}
-
-// From rosettacode:
-func BresenhamLine(img Image, x0, y0, x1, y1 int, c color.Color) {
-	log.Printf("line from [%d, %d] to [%d, %d]", x0, y0, x1, y1)
-	// implemented straight from WP pseudocode
-	dx := x1 - x0
-	if dx < 0 {
-		dx = -dx
-	}
-	dy := y1 - y0
-	if dy < 0 {
-		dy = -dy
-	}
-	var sx, sy int
-	if x0 < x1 {
-		sx = 1
-	} else {
-		sx = -1
-	}
-	if y0 < y1 {
-		sy = 1
-	} else {
-		sy = -1
-	}
-	err := dx - dy
-
-	for {
-		log.Printf("       set [%d, %d] to %v", x0, y0, c)
-		img.Set(x0, y0, c)
-		if x0 == x1 && y0 == y1 {
-			break
-		}
-		e2 := 2 * err
-		if e2 > -dy {
-			err -= dy
-			x0 += sx
-		}
-		if e2 < dx {
-			err += dx
-			y0 += sy
-		}
-	}
-}
-
-func DrawRectangle(img Image, x0, y0, x1, y1 int, c color.Color) {
-	if x0 > x1 {
-		x0, x1 = x1, x0
-	}
-	if y0 > y1 {
-		y0, y1 = y1, y0
-	}
-	for x := x0; x <= x1; x++ {
-		img.Set(x, y0, c)
-		img.Set(x, y1, c)
-	}
-	for y := y0 + 1; y < y1; y++ {
-		img.Set(x0, y, c)
-		img.Set(x1, y, c)
-	}
-}
-
-// Image for region of map containing a path and location points.
-// Coordinates are meters.
-type MetricPathImage struct {
-	dataBounds geom.Rect
-	hist2d     *geom.Hist2D
-	img        Image
-}
-
-func NewMetricPathImage(dataBounds geom.Rect, scale float64) *MetricPathImage {
-	if scale <= 0 {
-		maxSide := dataBounds.Width()
-		if maxSide < dataBounds.Height() {
-			maxSide = dataBounds.Height()
-		}
-		scale = 1.0
-		maxBuckets := 4096.0
-		if maxSide > maxBuckets {
-			scale = maxBuckets / maxSide
-		}
-	}
-	log.Printf("Histogram data dim to bucket scale: %v", scale)
-	hist2d := geom.NewHist2D(
-		dataBounds, int(dataBounds.Width()*scale+0.5), int(dataBounds.Height()*scale+0.5))
-	log.Printf("Buckets: %d x %d", hist2d.BucketWidth, hist2d.BucketHeight)
-	return &MetricPathImage{
-		dataBounds: dataBounds,
-		hist2d:     hist2d,
-	}
-}
-
-func (p *MetricPathImage) DataPtToImageXY(pt geom.Point) (x, y int) {
-	return p.hist2d.DataPtToImageXY(pt)
-}
-
-func (p *MetricPathImage) DrawRect(r geom.Rect, c color.Color) {
-	if p.img == nil {
-		log.Fatal("img not yet initialized")
-	}
-	x0, y0 := p.hist2d.DataXYToImageXY(r.MinX, r.MinY)
-	x1, y1 := p.hist2d.DataXYToImageXY(r.MaxX, r.MaxY)
-	DrawRectangle(p.img, x0, y0, x1, y1, c)
-}
-
-func (p *MetricPathImage) DrawPolyline(points []geom.Point, c color.Color) {
-	if p.img == nil {
-		log.Fatal("img not yet initialized")
-	}
-	if len(points) < 2 {
-		return
-	}
-	lastX, lastY := p.DataPtToImageXY(points[0])
-	for n := 1; n < len(points); n++ {
-		x, y := p.DataPtToImageXY(points[n])
-		BresenhamLine(p.img, lastX, lastY, x, y, c)
-		lastX, lastY = x, y
-	}
-}
-
-func (p *MetricPathImage) IncrementPt(pt geom.Point) {
-	p.hist2d.IncrementPt(pt)
-}
-
-func (p *MetricPathImage) IncrementPoints(points interface{}) {
-	geom.VisitPoints(points, func(pt geom.Point) { p.IncrementPt(pt) })
-}
-
-func (p *MetricPathImage) HistToImage() {
-	hist1d, cdf := p.hist2d.CountsAndCDF()
-	geom.LogHistogramAndCDF(hist1d, cdf)
-
-	// Map the 1-d histogram buckets to colors.
-	cdfMin := cdf[0].Count
-	cdfMax := cdf[len(cdf)-1].Count
-	denom := float64(cdfMax - cdfMin)
-	scale := 255
-	i2c := make(map[geom.HistCount]color.Color)
-	for _, ic := range cdf {
-		var c color.NRGBA
-		numer := float64(ic.Count - cdfMin)
-		if numer > 0 {
-			quo := numer / denom
-			raw := quo * float64(scale)
-			hv := int(math.Floor(raw + 0.5))
-			if hv > 255 {
-				hv = 255
-			}
-			c.A = 255
-			c.R = uint8(hv)
-		}
-		i2c[ic.Intensity] = c
-	}
-	toColor := func(v geom.HistCount) color.Color {
-		return i2c[v]
-	}
-	p.img = p.hist2d.ToImage(toColor)
-}
-
-func createHistImage(
-	bounds geom.Rect, scale float64, reports []*busgeom.Report) *MetricPathImage {
-	mpi := NewMetricPathImage(bounds, scale)
-	mpi.IncrementPoints(reports)
-	mpi.HistToImage()
-	return mpi
-}
-
 func initReportsAndPathImage(
-	reports []*busgeom.Report, pathPoints []geom.Point, pathMargin float64) *MetricPathImage {
+	xf geogeom.CoordTransform, reports []*busgeom.Report,
+	pathPoints []geom.Point, pathMargin float64) *nbimage.Image {
 
 	rb := busgeom.ReportsBounds(reports)
 	log.Printf("Reports bounds: %s", rb)
@@ -234,27 +52,21 @@ func initReportsAndPathImage(
 	ib := rb.Union(epb)
 	log.Printf("Union bounds: %s", ib)
 
-	mpi := createHistImage(ib, 0.0, reports)
+	img := nbimage.NewImage(xf, ib, 0.0)
+	img.Background = color.Black
+	hist := img.NewHist2D()
+	geom.VisitPoints(reports, func(pt geom.Point) { hist.IncrementPt(pt) })
+	reportsColor := color.NRGBA{255, 0, 0, 255}
+	img.AddHist2D(hist, nbimage.HistEqualizedColors(hist, reportsColor))
+	img.AddLegend("Reports", reportsColor)
 
 	// Draw a border around the path points, then draw the path points.
-	mpi.DrawRect(pb, color.NRGBA{32, 128, 32, 255})
-	mpi.DrawPolyline(pathPoints, color.NRGBA{32, 255, 32, 255})
-
-	return mpi
-}
-
-func AngleWeight(angleBetween float64) float64 {
-	// 0 (good) to 1 (bad)
-	v := math.Min(halfPi, angleBetween) / halfPi
-	return 1 - v
-}
+	img.AddRect(pb, color.NRGBA{32, 128, 32, 255})
+	pathColor := color.NRGBA{32, 255, 32, 255}
+	img.AddPolyline(pathPoints, pathColor, 1)
+	img.AddLegend("Original path", pathColor)
 
-func DistanceWeight(distanceBetween float64) float64 {
-	// 0 (good) to 1 (bad)
-	if distanceBetween <= 0 {
-		return 1
-	}
-	return math.Min(1, 1/distanceBetween)
+	return img
 }
 
 func NearbyPathSegmentsAndDistances(
@@ -307,23 +119,13 @@ func Weight(seg *busgeom.PathSegment, report *busgeom.Report) float64 {
 }
 
 // Returns a map from path to a list of paths that might follow that path.
+// Path endpoints within 10 meters of each other are considered connected.
 func ConnectPaths(agency *nextbus.Agency) map[*nextbus.Path][]*nextbus.Path {
-	log.Panicf("Not yet implemented")
-	return nil
-}
-
-func PathLength(path []geom.Point) (length float64) {
-	for ndx := 1; ndx < len(path); ndx++ {
-		segLen := path[ndx-1].Distance(path[ndx])
-		length += segLen
-
-		//		log.Printf("Seg %d: %v -> %v  (direction %3d, length %d)",
-		//							 ndx, path[ndx-1], path[ndx],
-		//							 int(geom.ToDegrees(path[ndx-1].DirectionTo(path[ndx])) + 0.5), int(segLen + 0.5))
-
-		//		log.Printf("Seg %d length: %.1f,   total: %.1f", ndx-1, segLen, length)
+	g := nbnetwork.NewGraph(agency, 10)
+	if g == nil {
+		return nil
 	}
-	return
+	return g.ConnectedPaths()
 }
 
 // Divide up a path which probably has lots of long segments and some
@@ -334,61 +136,12 @@ func PathLength(path []geom.Point) (length float64) {
 // considerably longer than these odd stop segments, we smooth out the path.
 // Would probably be better if I generated variable length segments, shorter
 // near sharper corners, longer on long straight segments.
-func PartitionPath(path []geom.Point, targetSegLength float64) (
-	result []geom.Point) {
-	log.Printf("targetSegLength: %v", targetSegLength)
-	totalLength := PathLength(path)
-	log.Printf("totalLength: %v", totalLength)
-	numSegs := math.Ceil(totalLength / targetSegLength)
-	log.Printf("numSegs: %v", numSegs)
-	if numSegs < 2 {
+func PartitionPath(path []geom.Point, targetSegLength float64) []geom.Point {
+	pl := geom.Polyline(path)
+	if math.Ceil(pl.Length()/targetSegLength) < 2 {
 		return nil
 	}
-
-	adjustedTargetLength := totalLength / numSegs
-	log.Printf("adjustedTargetLength: %v", adjustedTargetLength)
-
-	result = make([]geom.Point, 0, int(numSegs)+1)
-	result = append(result, path[0])
-	startIndex, startFraction := 0, 0.0
-	for {
-		endIndex, endFraction, end := FindNextEnd(
-			path, adjustedTargetLength, startIndex, startFraction)
-		result = append(result, end)
-		if endIndex >= len(path) {
-			break
-		}
-		startIndex, startFraction = endIndex, endFraction
-	}
-	return result
-}
-
-func FindNextEnd(path []geom.Point, targetLength float64,
-	startIndex int, startFraction float64) (
-	endIndex int, endFraction float64, end geom.Point) {
-	//	log.Printf("
-	siLimit := len(path) - 1
-	for startIndex < siLimit {
-		fullSegLength := path[startIndex].Distance(path[startIndex+1])
-		remainingSegLength := (1 - startFraction) * fullSegLength
-		if remainingSegLength <= targetLength {
-			targetLength -= remainingSegLength
-			startIndex++
-			startFraction = 0
-			continue
-		}
-		// Ends here.
-		remainingSegLength -= targetLength
-
-		endIndex = startIndex
-		endFraction = (fullSegLength - remainingSegLength) / fullSegLength
-
-		delta := path[startIndex+1].Minus(path[startIndex])
-		end.X = path[startIndex].X + delta.X*endFraction
-		end.Y = path[startIndex].Y + delta.Y*endFraction
-		return
-	}
-	return siLimit + 1, 0, path[siLimit]
+	return pl.Resample(targetSegLength)
 }
 
 //// Originally broke into very short segments, but that seems too aggressive
@@ -423,260 +176,222 @@ func PartitionNBPathToSubSegments(
 	return
 }
 
-func FormatSeg(p *geom.DirectedSegment) string {
-	return fmt.Sprintf("{%.1f, %.1f} => {%.1f, %.1f}   (direction %d, length %.1f)",
-		p.Pt1.X, p.Pt1.Y, p.Pt2.X, p.Pt2.Y,
-		int(geom.ToDegrees(p.Direction.Direction())+0.5),
-		p.Length())
-}
+//func FitLinesForSubSegments(segs []*busgeom.PathSegment, maxDistance float64) {
+//	maxCandidateDistance := maxDistance * 5
+//	// Reports nearest to preceeding segments that might still be close enough.
+//	candidateReports := make(map[*Report]float64)
+//
+//	for segIndex, ss := range segs {
+//		// Eliminate candidates that are not close enough (on the assumption
+//		// that the path doesn't have many hairpins).
+//
+//
+//
+//	}
+//
+//
+//
+//}
 
-//func CosineSimilarity(a, b geom.Segment) {}
+// Loads the vehicle locations from the files.
+func LoadLocations(filePaths []string) (allVls []*nextbus.VehicleLocation) {
+	totalDiscardedRecords := 0
+	for _, filePath := range filePaths {
+		log.Printf("Will read from %q", filePath)
+		vls, numDiscardedRecords, errors :=
+			busgeom.ReadVehicleLocationsCsvFile(filePath)
 
-func FitLineForPathSegment(
-	seg *busgeom.PathSegment, weightFunc busgeom.WeightFunction3) geom.Line {
-	d2s := seg.MakeData2DSource(weightFunc)
-	if d2s.Len() == 0 {
-		log.Printf("TOO FEW REPORTS to compute a fit for segment: %#v", seg)
-		return nil
-	}
+		if len(errors) > 0 {
+			log.Printf("%d errors while reading file %v", len(errors), filePath)
+		}
 
-	line, err := fit.FitLineToPointsOR(d2s)
-	if err != nil {
-		log.Printf("Error fitting line for segment: %#v", seg)
-		log.Printf("    Error: %v", err)
-		return nil
+		allVls = append(allVls, vls...)
+		totalDiscardedRecords += numDiscardedRecords
 	}
+	log.Printf("Loaded %d total locations, and discarded %d records",
+		len(allVls), totalDiscardedRecords)
+	return
+}
 
-	if true { // DEBUG OUTPUT
-		pt1 := line.NearestPointTo(seg.Pt1)
-		pt2 := line.NearestPointTo(seg.Pt2)
-		newSeg := geom.NewDirectedSegment(pt1, pt2)
-		log.Printf("OLD SEG: %v", FormatSeg(seg.DirectedSegment))
-		log.Printf("NEW SEG: %v", FormatSeg(newSeg))
-
-		numReports := d2s.Len()
-		sumWeight := 0.0
-		for ndx := 0; ndx < numReports; ndx++ {
-			sumWeight += d2s.Weight(ndx)
+// Matches the track of each vehicle to the paths of the agency, and returns
+// the locations matched to each path (i.e. those we can trust to help
+// determine the location and direction of the path).
+func MatchLocations(allVls []*nextbus.VehicleLocation, agency *nextbus.Agency) (
+	pathLocations map[*nextbus.Path][]*nextbus.VehicleLocation, err error) {
+	matcher, err := nbmatch.NewMatcher(agency)
+	if err != nil {
+		return nil, err
+	}
+	matcher.MaxDistance = *maxDistanceFlag * 5
+	tm := nbmatch.NewTrackMatcher(matcher)
+	pathLocations = make(map[*nextbus.Path][]*nextbus.VehicleLocation)
+	numMatched := 0
+	for _, track := range nbmatch.SplitIntoTracks(allVls, *maxGapFlag) {
+		for _, match := range tm.MatchTrack(track) {
+			if match.Candidate != nil {
+				pathLocations[match.Path] = append(
+					pathLocations[match.Path], match.Report)
+				numMatched++
+			}
 		}
-
-		log.Printf("Computed from %d points with an average weight of %.2f\n\n",
-			numReports, sumWeight/float64(numReports))
 	}
-
-	return line
+	log.Printf("Matched %d of %d locations to %d paths",
+		numMatched, len(allVls), len(pathLocations))
+	return
 }
 
-func FitLineForSubSegment(
-	seg *busgeom.PathSegment,
-	maxBestDistance float64, maxDistance float64,
-	useAngleWeight bool,
-	report2distance map[*busgeom.Report]float64) geom.Line {
-	// First pick points within maxDistance meters of the segment.
-	reports := make([]*busgeom.Report, 0, len(report2distance))
-	weights := make([]float64, 0, len(report2distance))
-	sumWeight := 0.0
-	for report, distance := range report2distance {
-		if distance > maxDistance {
+// Matches the locations to the paths of the config in effect at the time of
+// each location, and returns the config in effect at the time of the last
+// location, along with the locations matched to each of its paths. Locations
+// matched to paths that aren't in the last config (i.e. paths that were
+// changed or removed) are dropped, as are the locations of earlier configs
+// that can't be loaded. Returns an error if the last config can't be loaded
+// or has no paths, and a nil agency if there are no locations during the
+// period covered by the configs.
+func MatchLocationsWithHistory(allVls []*nextbus.VehicleLocation,
+	history *configfetch.ConfigHistory) (
+	agency *nextbus.Agency,
+	pathLocations map[*nextbus.Path][]*nextbus.VehicleLocation, err error) {
+	bySnapshot := make(map[int][]*nextbus.VehicleLocation)
+	var indices []int
+	numTooEarly := 0
+	for _, vl := range allVls {
+		i, ok := history.SnapshotAt(vl.Time)
+		if !ok {
+			numTooEarly++
 			continue
 		}
-		weight := 1.0
-		if useAngleWeight {
-			angle, ok := seg.AngleBetween(report)
-			if !ok {
-				continue
-			}
-			weight *= AngleWeight(angle)
-		}
-		if distance > maxBestDistance {
-			weight *= DistanceWeight(distance)
+		if _, seen := bySnapshot[i]; !seen {
+			indices = append(indices, i)
 		}
-		reports = append(reports, report)
-		weights = append(weights, weight)
-		sumWeight += weight
+		bySnapshot[i] = append(bySnapshot[i], vl)
 	}
-	if len(reports) == 0 {
-		log.Printf("TOO FEW REPORTS to compute a fit for segment: %#v", seg)
-		return nil
+	if numTooEarly > 0 {
+		log.Printf("Discarded %d locations from before the first config",
+			numTooEarly)
 	}
-	lf := func() int { return len(reports) }
-	xf := func(n int) float64 { return reports[n].X }
-	yf := func(n int) float64 { return reports[n].Y }
-	wf := func(n int) float64 { return weights[n] }
-	d2s := &stats.Data2DSourceDelegate{Lf: lf, Xf: xf, Yf: yf, Wf: wf}
-	line, err := fit.FitLineToPointsOR(d2s)
+	if len(indices) == 0 {
+		return nil, nil, nil
+	}
+	sort.Ints(indices)
+	last := indices[len(indices)-1]
+	agency, err = history.LoadAgency(last)
 	if err != nil {
-		log.Printf("Error fitting line for segment: %#v", seg)
-		log.Printf("    Error: %v", err)
-		return nil
+		log.Printf("Error(s) loading config %s: %v", history.Names[last], err)
+		if agency == nil {
+			return nil, nil, err
+		}
 	}
-	pt1 := line.NearestPointTo(seg.Pt1)
-	pt2 := line.NearestPointTo(seg.Pt2)
-	newSeg := geom.NewDirectedSegment(pt1, pt2)
-
-	log.Printf("OLD SEG: %v", FormatSeg(seg.DirectedSegment))
-	log.Printf("NEW SEG: %v", FormatSeg(newSeg))
-	log.Printf("Computed from %d points with an average weight of %.2f\n\n",
-		len(reports), sumWeight/float64(len(reports)))
-	//	log.Print("\n\n")
-
-	return geom.LineFromTwoPoints(pt1, pt2)
-}
-
-// Given a sequence of points, produces a segment between each pair, computes
-// a linear fit for nearby points, and returns the linear fit corresponding
-// to each segment.
-
-func FitLinesForPath(
-	pathPts []geom.Point, reports []*busgeom.Report,
-	maxDistance float64) (result []geom.Line) {
-	// Make segments.
-	segs := busgeom.MakePathSegments(pathPts, nil)
-
-	// Link segments and nearby points.
-	busgeom.LinkReportsToSegments(reports, segs, maxDistance)
-
-	// Which route directions can we trust to help us with determining the segment
-	// direction (i.e. slope)?
-	dirTagsToTrust := busgeom.DetermineTrustworthyDirTags(reports, maxDistance)
-
-	// Fit a line for each segment of the path.
-	lastNdx := len(segs) - 1
-	for ndx, seg := range segs {
-		// What is the likely slope of the line we'll fit to the points near seg?
-		haveManyNearReports := (seg.NumNearReports() >= 50)
-		weightFunc := func(seg *busgeom.PathSegment,
-			report *busgeom.Report,
-			rns *busgeom.ReportNearSegment) (weight float64) {
-			if !dirTagsToTrust[report.DirTag] {
-				return 0
-			}
-			if rns.Distance > maxDistance {
-				return 0
-			}
-
-			weight = 1
-			if !rns.IsPerpendicular {
-				if haveManyNearReports {
-					weight *= 0.5
-				}
-				if ndx == 0 || ndx == lastNdx {
-					weight *= 0.5
-				}
-			}
-			return weight
+	pathLocations, err = MatchLocations(bySnapshot[last], agency)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to match locations to config %s: %v",
+			history.Names[last], err)
+	}
+	for _, i := range indices[:len(indices)-1] {
+		other, err := history.LoadAgency(i)
+		if err != nil {
+			log.Printf("Error(s) loading config %s: %v", history.Names[i], err)
 		}
-		reportsDirection, ok := seg.MedianWeightedReportDirection(weightFunc)
-		if !ok {
-			reportsDirection = seg.Direction
+		var otherPathLocations map[*nextbus.Path][]*nextbus.VehicleLocation
+		if other != nil {
+			otherPathLocations, err = MatchLocations(bySnapshot[i], other)
 		}
-
-		// Define function for weighting points when fitting a line to the points.
-
-		// TODO, maybe: For computing distance portion of weight, define a line that
-		// goes through the midpoint of seg, with the slope from direction, and
-		// compute distances between reports and that line.
-
-		// If the median reports direction is close to that of the segment, then
-		// we can use the IsPerpendicular value in rns.
-		trustIsPerpendicular := reportsDirection.AngleBetween(seg.Direction) < (pi / 8)
-
-		weightFunc = func(seg *busgeom.PathSegment,
-			report *busgeom.Report,
-			rns *busgeom.ReportNearSegment) (weight float64) {
-			// Ignore points from before the beginning of, or after the end of,
-			// the path.
-			if trustIsPerpendicular {
-				if ndx == 0 && rns.NearestPoint == seg.Pt1 {
-					return 0
-				}
-				if ndx == lastNdx && rns.NearestPoint == seg.Pt2 {
-					return 0
-				}
-			}
-
-			weight = 1
-
-			// Reports going the opposite direction are discarded, and those going
-			// "adrift" are given lower weight.
-			angleBetween := 0.0
-			if report.DirectionIsValid() {
-				angleBetween = reportsDirection.AngleBetween(report.Direction)
-				if angleBetween >= halfPi {
-					return 0
-				}
-				weight *= (1 - (angleBetween/halfPi)*0.3)
-			}
-
-			// Reports further away are given less weight.
-			if rns.Distance > maxDistance {
-				return 0
-			}
-			weight *= (1 - (rns.Distance/maxDistance)*0.3)
-
-			if trustIsPerpendicular && !rns.IsPerpendicular {
-				// Give less weight to those not perpendicular to the line segment
-				// (i.e. we can't draw a line perpendicular to the line segment that
-				// goes through the report point).
-				weight *= 0.5
+		if other == nil || err != nil {
+			log.Printf("Skipping %d locations of config %s: %v",
+				len(bySnapshot[i]), history.Names[i], err)
+			continue
+		}
+		numDropped := 0
+		for otherPath, vls := range otherPathLocations {
+			if path := agency.FindMatchingPath(otherPath); path != nil {
+				pathLocations[path] = append(pathLocations[path], vls...)
+			} else {
+				numDropped += len(vls)
 			}
-
-			return weight
 		}
+		log.Printf("Dropped %d locations matched to paths of config %s that "+
+			"aren't in config %s", numDropped, history.Names[i], history.Names[last])
+	}
+	return
+}
 
-		// Compute the line best fitting the points near the segment.
-
-		line := FitLineForPathSegment(seg, weightFunc)
-		if line == nil {
-			log.Printf("Unable to fit line to path segment #%d", ndx)
-			continue
+// Returns the fitter of the --line-fit method name.
+func makeLineFitter(name string) (fit.LineFitter, error) {
+	switch name {
+	case "orthogonal":
+		return fit.OrthogonalFitter{}, nil
+	case "huber":
+		return fit.NewHuberFitter(), nil
+	case "tukey":
+		return fit.NewTukeyFitter(), nil
+	case "ransac":
+		if !(*ransacThresholdFlag > 0) {
+			return nil, fmt.Errorf("--ransac-threshold must be positive")
 		}
-
-		result = append(result, line)
+		return fit.NewRANSACFitter(*ransacThresholdFlag), nil
 	}
-
-	return
+	return nil, fmt.Errorf("Unknown --line-fit method: %q", name)
 }
 
-//func FitLinesForSubSegments(segs []*busgeom.PathSegment, maxDistance float64) {
-//	maxCandidateDistance := maxDistance * 5
-//	// Reports nearest to preceeding segments that might still be close enough.
-//	candidateReports := make(map[*Report]float64)
-//
-//	for segIndex, ss := range segs {
-//		// Eliminate candidates that are not close enough (on the assumption
-//		// that the path doesn't have many hairpins).
-//
-//
-//
-//	}
-//
-//
-//
-//}
+// Corrects the shape of path based on the locations matched to it.
+func CorrectPath(corrector *nbshape.Corrector, agency *nextbus.Agency,
+	path *nextbus.Path, vls []*nextbus.VehicleLocation) (
+	*nbshape.Correction, error) {
+	log.Printf("Found path %d with %d waypoints", path.Index, len(path.WayPoints))
 
-func LoadReports(filePaths []string, agency *nextbus.Agency, xf geogeom.CoordTransform, minReports int) (allReports []*busgeom.Report) {
-	totalDiscardedRecords := 0
-	for _, filePath := range filePaths {
-		log.Printf("Will read from %q", filePath)
-		reports, numDiscardedReports, errors :=
-			busgeom.LoadReports(filePath, agency, xf)
+	// Create transform from lat-lon to meters, with the path waypoints in the
+	// positive x, positive y quadrant (just to ease debugging, though it may
+	// lower quality, compared to putting the center in the middle of the points).
+	// A transverse Mercator projection is used rather than a
+	// MetricCoordTransform because the latter is limited to 50km from its
+	// center, and some paths (e.g. of commuter rail) are much longer.
 
-		if len(errors) > 0 {
-			log.Printf("%d errors while reading file %v", len(errors), filePath)
-		}
+	minLoc, maxLoc := path.Bounds()
+	xf := geogeom.MakeLocalTransverseMercator(minLoc)
+	maxPt := xf.ToPoint(maxLoc)
+
+	log.Printf("Lat-Lon Bounds %v X %v   (%.1f X %.1f meters)",
+		minLoc, maxLoc, maxPt.Y, maxPt.X)
+
+	reports, numNoHeading := busgeom.MakeReports(vls, agency, xf)
+	log.Printf("Matched %d reports to path %d, and discarded %d without a heading",
+		len(reports), path.Index, numNoHeading)
 
-		allReports = append(allReports, reports...)
-		totalDiscardedRecords += numDiscardedReports
+	corrector.MinReports = 2 * len(path.WayPoints)
+	c, err := corrector.CorrectPath(path, reports, xf)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(*locationsImageFlag) > 0 {
+		// Transform the path waypoints into points in the euclidean, metric space
+		// centered on minLoc.
+		points := geogeom.LocationsCollectionToPoints(len(c.Original),
+			func(index int) geo.Location { return c.Original[index] }, xf)
+		fittedPoints := geogeom.LocationsCollectionToPoints(len(c.Corrected),
+			func(index int) geo.Location { return c.Corrected[index] }, xf)
+		img := initReportsAndPathImage(xf, reports, points, 20.0)
+		fittedColor := color.NRGBA{32, 32, 255, 255}
+		img.AddPolyline(fittedPoints, fittedColor, 1)
+		img.AddLegend("Fitted path", fittedColor)
+		if err := img.SaveToFile(*locationsImageFlag); err != nil {
+			log.Printf("Unable to save image: %v", err)
+		}
 	}
+	return c, nil
+}
 
-	log.Printf("Loaded %d total complete reports, and discarded %d records",
-		len(allReports), totalDiscardedRecords)
-	if len(allReports) < minReports {
-		log.Fatalf("Too few reports; need at least %d to do anything.",
-			minReports)
+func writeDisplacements(filePath string, corrections []*nbshape.Correction) error {
+	f, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	if err := nbshape.WriteDisplacementsCsv(f, corrections); err != nil {
+		f.Close()
+		return err
 	}
-	return allReports
+	log.Printf("Wrote displacements to %s", filePath)
+	return f.Close()
 }
 
 var (
@@ -687,15 +402,46 @@ var (
 	allPathsFlag = flag.String(
 		"all-paths", "",
 		"Path of xml file with description of all paths to be processed")
+	configRootFlag = flag.String(
+		"config_root", "",
+		"Root of the config snapshots (a config store, or a directory tree "+
+			"created by the config fetcher); locations are matched to the paths "+
+			"of the config in effect on their day, and the paths of the config "+
+			"in effect at the time of the last location are corrected "+
+			"(alternative to --all-paths)")
 	pathIndexFlag = flag.Int(
 		"path-index", -1,
-		"Index of path to process")
+		"Index of path to process; if not set, all paths are processed")
 	maxDistanceFlag = flag.Float64(
 		"max-distance", 20,
 		"Only points within this distance of the declared path will be used")
+	maxGapFlag = flag.Duration(
+		"max-gap", 5*time.Minute,
+		"Reports of a vehicle more than this far apart are matched separately")
+	lineFitFlag = flag.String(
+		"line-fit", "tukey",
+		"Method of fitting a line to the reports near each path segment: "+
+			"orthogonal (regression), huber, tukey or ransac (the robust methods "+
+			"discount outliers within --max-distance, such as GPS glitches)")
+	ransacThresholdFlag = flag.Float64(
+		"ransac-threshold", 5,
+		"With --line-fit=ransac, reports within this distance (meters) of a "+
+			"candidate line support it")
+	roundsFlag = flag.Int(
+		"rounds", 5,
+		"Number of rounds of fitting lines to the path segments")
 	locationsImageFlag = flag.String(
 		"locations-image", "",
-		"Path to image file to create based on locations")
+		"Path to image file (.png or .svg) to create based on locations "+
+			"(requires --path-index)")
+	correctedPathsFlag = flag.String(
+		"corrected-paths", "",
+		"Path of xml file (all-paths format) to which to write the paths, "+
+			"with the corrected shapes")
+	displacementsFlag = flag.String(
+		"displacements", "",
+		"Path of csv file to which to write the displacement of each vertex "+
+			"of the corrected paths")
 )
 
 func main() {
@@ -708,38 +454,50 @@ func main() {
 		ok = false
 		log.Print("--locations not set")
 	}
-	if len(*allPathsFlag) == 0 {
+	if len(*allPathsFlag) == 0 && len(*configRootFlag) == 0 {
+		ok = false
+		log.Print("Neither --all-paths nor --config_root is set")
+	} else if len(*allPathsFlag) > 0 && len(*configRootFlag) > 0 {
 		ok = false
-		log.Print("--all-paths not set")
-	} else if !util.IsFile(*allPathsFlag) {
+		log.Print("Only one of --all-paths and --config_root may be set")
+	} else if len(*allPathsFlag) > 0 && !util.IsFile(*allPathsFlag) {
 		ok = false
 		log.Printf("Not a file: %v", *allPathsFlag)
 	}
-	if *pathIndexFlag <= 0 {
+	lineFitter, err := makeLineFitter(*lineFitFlag)
+	if err != nil {
+		ok = false
+		log.Print(err)
+	}
+	if len(*locationsImageFlag) > 0 && *pathIndexFlag <= 0 {
 		ok = false
-		log.Print("--path-index not set")
+		log.Print("--locations-image requires --path-index")
 	}
 
 	var agency *nextbus.Agency
-	var path *nextbus.Path
+	var history *configfetch.ConfigHistory
 	var matchingLocationFilePaths []string
-	var err error
 	if ok {
-		// Read all-paths.xml to find path segments.
-		log.Printf("Reading paths from: %s", *allPathsFlag)
-		agency, err = nextbus.ReadPathsFromFile(*allPathsFlag)
-		if err != nil {
-			ok = false
-			log.Println(err)
-		} else if agency.NumPaths() == 0 {
-			ok = false
-			log.Printf("No paths in ", *allPathsFlag)
-		}
-
-		path = agency.GetPath(*pathIndexFlag)
-		if path == nil {
-			ok = false
-			log.Printf("--path-index %d is not valid", *pathIndexFlag)
+		if len(*allPathsFlag) > 0 {
+			// Read all-paths.xml to find path segments.
+			log.Printf("Reading paths from: %s", *allPathsFlag)
+			agency, err = nextbus.ReadPathsFromFile(*allPathsFlag)
+			if err != nil {
+				ok = false
+				log.Println(err)
+			} else if agency.NumPaths() == 0 {
+				ok = false
+				log.Printf("No paths in %s", *allPathsFlag)
+			} else if *pathIndexFlag > 0 && agency.GetPath(*pathIndexFlag) == nil {
+				ok = false
+				log.Printf("--path-index %d is not valid", *pathIndexFlag)
+			}
+		} else {
+			history, err = configfetch.OpenConfigHistory(*configRootFlag, nil)
+			if err != nil {
+				ok = false
+				log.Println(err)
+			}
 		}
 
 		matchingLocationFilePaths, err = filepath.Glob(*locationsGlobFlag)
@@ -757,93 +515,58 @@ func main() {
 		return
 	}
 
-	log.Printf("Found path %d with %d waypoints", path.Index, len(path.WayPoints))
-
-	// Create transform from lat-lon to meters, with the path waypoints in the
-	// positive x, positive y quadrant (just to ease debugging, though it may
-	// lower quality, compared to putting the center in the middle of the points).
-
-	minLoc, maxLoc := path.Bounds()
-	xf := geogeom.MakeMetricCoordTransform(minLoc)
-	maxPt := xf.ToPoint(maxLoc)
-
-	log.Printf("Lat-Lon Bounds %v X %v   (%.1f X %.1f meters)",
-		minLoc, maxLoc, maxPt.Y, maxPt.X)
-
-	// Transform the path waypoints into points in the euclidean, metric space
-	// centered on minLoc.
-	points := geogeom.LocationsCollectionToPoints(
-		len(path.WayPoints),
-		func(index int) geo.Location { return path.WayPoints[index].Location },
-		xf)
-	origPoints := points
-
-	//
-	//	// Quadtree bounds
-	//	qb := geom.NewRectWithBorder(
-	//			0, math.Ceil(maxPt.X), 0, math.Ceil(maxPt.Y), 20, 20)
-	//
-	//	log.Printf("Quadtree bounds: %#v", qb)
-	//
-	//	// Create quadtree, for path region, insert metric path subsegments.
-	//	qt := geom.NewQuadTree(qb)
-	//	for i := range subSegments {
-	//		qt.Insert(subSegments[i])
-	//	}
-	//
-	//	log.Printf("Inserted %d segments into quadtree", len(subSegments))
-
-	// Read specified vehicle location data, extracting just the location
-	// and heading. Transform location and heading to metric, and find the
-	// closest path subsegment(s) using the quadtree.
-
-	var allReports []*busgeom.Report = LoadReports(
-		matchingLocationFilePaths, agency, xf, 2*len(path.WayPoints))
-
-	mpi := initReportsAndPathImage(allReports, points, 20.0)
-
-	const maxRounds = 5
-	for round := 1; round <= maxRounds; round++ {
-		log.Println()
-		log.Println("##############################################################")
-		log.Println("Fitting round ", round)
-		log.Println()
-
-		lines := FitLinesForPath(points, allReports, *maxDistanceFlag)
-
-		// TODO Error checking length of lines
-
-		// TODO Merge lines that are nearly the same (perhaps apply regression to
-		// determine if the lines are similar enough to merge).
-
-		// TODO Ensure our lines are moving in the correct direction.
-
-		firstPt := lines[0].NearestPointTo(points[0])
-		newPoints := []geom.Point{firstPt}
-
-		for ndx := 1; ndx < len(lines); ndx++ {
-			pt, ok := lines[ndx-1].Intersection(lines[ndx])
-			if !ok {
-				log.Printf("Unable to intersect lines at segment %d", ndx)
-				log.Printf("Line1: %v", lines[ndx-1])
-				log.Printf("Line2: %v\n", lines[ndx])
-				continue
-			}
-			newPoints = append(newPoints, pt)
+	// Read specified vehicle location data, and match it to the paths.
+	allVls := LoadLocations(matchingLocationFilePaths)
+	var pathLocations map[*nextbus.Path][]*nextbus.VehicleLocation
+	if history == nil {
+		pathLocations, err = MatchLocations(allVls, agency)
+	} else {
+		agency, pathLocations, err = MatchLocationsWithHistory(allVls, history)
+		if err == nil && agency == nil {
+			log.Fatal("No locations during the period covered by the configs")
 		}
-		lastPt := lines[len(lines)-1].NearestPointTo(points[len(points)-1])
-		newPoints = append(newPoints, lastPt)
-
-		points = newPoints
+	}
+	if err != nil {
+		log.Fatalf("Unable to match the locations to the paths: %v", err)
 	}
 
-	mpi.DrawPolyline(points, color.NRGBA{32, 32, 255, 255})
-	saveImageToPng(mpi.img, *locationsImageFlag)
+	var paths []*nextbus.Path
+	if *pathIndexFlag > 0 {
+		path := agency.GetPath(*pathIndexFlag)
+		if path == nil {
+			log.Fatalf("--path-index %d is not valid", *pathIndexFlag)
+		}
+		paths = append(paths, path)
+	} else {
+		paths = agency.GetPaths()
+		sort.Sort(nextbus.PathsSlice(paths))
+	}
 
-	// TODO Compare paths
+	corrector := nbshape.NewCorrector()
+	corrector.MaxDistance = *maxDistanceFlag
+	corrector.LineFitter = lineFitter
+	corrector.Rounds = *roundsFlag
+	var corrections []*nbshape.Correction
+	for _, path := range paths {
+		c, err := CorrectPath(corrector, agency, path, pathLocations[path])
+		if err != nil {
+			log.Printf("Unable to correct path %d: %v", path.Index, err)
+			continue
+		}
+		corrections = append(corrections, c)
+	}
+	log.Printf("Corrected %d of %d paths", len(corrections), len(paths))
 
-	if len(points) != len(origPoints) {
-		log.Printf("Changed number of waypoints: %d  ->  %d", len(origPoints), len(points))
+	if len(*displacementsFlag) > 0 {
+		if err := writeDisplacements(*displacementsFlag, corrections); err != nil {
+			log.Printf("Unable to write displacements: %v", err)
+		}
+	}
+	if len(*correctedPathsFlag) > 0 {
+		nbshape.ApplyCorrections(agency, corrections)
+		if err := nextbus.WritePathsToFile(agency, *correctedPathsFlag); err != nil {
+			log.Printf("Unable to write corrected paths: %v", err)
+		}
 	}
 
 	//lastPt := points[len(points)-2]
@@ -905,33 +628,4 @@ func main() {
 	//	log.Printf("\n")
 	//
 	//	busgeom.MeasureRouteDirections(qt, 7, allReports)
-
-	//	if true { return }
-	//
-	//	// For now, choosing to take the first and last points of the path as given,
-	//	// and only determine new points in-between.
-	//	points := []geom.Point{subSegments[0].Segment.Pt1,}
-	//	var lastLine geom.Line
-	//
-	//	for ndx, seg := range subSegments {
-	//		line := FitLineForSubSegment(seg, 5, 100, false, seg2report2dist[seg])
-	//		if line == nil {
-	//			log.Printf("Unable to fit line to path segment %d", ndx)
-	//			continue
-	//		}
-	//		if lastLine != nil {
-	//			pt, ok := lastLine.Intersection(line)
-	//			if !ok {
-	//				log.Printf("Unable to intersect lines at segment %d", ndx)
-	//				log.Printf("Line1: %v", lastLine)
-	//				log.Printf("Line2: %v\n", line)
-	//				continue
-	//			}
-	//			points = append(points, pt)
-	//			lastPt := points[len(points)-2]
-	//			log.Printf("New seg: %v", FormatSeg(geom.NewDirectedSegment(lastPt, pt)))
-	//		}
-	//		lastLine = line
-	//	}
-
 }
@@ -0,0 +1,109 @@
+package main
+
+// Finds when vehicles entered and exited the geofences (garages, terminals,
+// etc.) described by a GeoJSON file, given the processed vehicle location CSV
+// files (.csv or .csv.gz, as written by the nextbus_fetcher). The events are
+// written as CSV (see nbgeofence.Event.ToCSVFields). The files are processed
+// in order of their paths (i.e. by date, for the standard layout), so that a
+// vehicle's state carries over from one day to the next.
+//
+// Example:
+//   geofence_events --geofences=mbta-garages.geojson \
+//       --locations=/data/mbta/locations/processed/2014 --output=events.csv
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/golang/glog"
+
+	"github.com/jamessynge/transit_tools/nextbus"
+	"github.com/jamessynge/transit_tools/nextbus/nbgeofence"
+	"github.com/jamessynge/transit_tools/nextbus/nblocations"
+	"github.com/jamessynge/transit_tools/util"
+)
+
+var (
+	geofencesFlag = flag.String(
+		"geofences", "",
+		"Path of the GeoJSON file of named polygons")
+	locationsFlag = flag.String(
+		"locations", "",
+		"Comma separated paths (globs) of CSV files, or directories to search "+
+			"for CSV files")
+	outputFlag = flag.String(
+		"output", "",
+		"File into which to write the events; defaults to stdout")
+)
+
+func readCsvFile(csvPath string) ([]*nextbus.VehicleLocation, error) {
+	var result []*nextbus.VehicleLocation
+	fn := func(source string, record []string, recordNum int, err error) error {
+		if err != nil {
+			return err
+		}
+		vl, err := nextbus.CSVFieldsToVehicleLocation(record)
+		if err != nil {
+			glog.Warningf("Skipping record %d of %s: %v", recordNum+1, source, err)
+			return nil
+		}
+		result = append(result, vl)
+		return nil
+	}
+	_, err := util.ReadCsvFileToFn(csvPath, fn)
+	return result, err
+}
+
+func main() {
+	flag.Parse()
+	if *geofencesFlag == "" || *locationsFlag == "" {
+		fmt.Fprintln(os.Stderr, "--geofences and --locations are required")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	set, err := nbgeofence.LoadGeoJSONFile(*geofencesFlag)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	var paths []string
+	nblocations.FindCsvLocationsFiles(*locationsFlag, func(path string) bool {
+		paths = append(paths, path)
+		return true
+	})
+	sort.Strings(paths)
+	if len(paths) == 0 {
+		glog.Fatalf("No CSV files found in --locations=%s", *locationsFlag)
+	}
+
+	var out io.Writer = os.Stdout
+	if *outputFlag != "" {
+		f, err := os.Create(*outputFlag)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		defer f.Close()
+		out = f
+	}
+	w := nbgeofence.NewCsvEventWriter(out)
+	tracker := nbgeofence.NewTracker(set)
+	numEvents := 0
+	for _, path := range paths {
+		vls, err := readCsvFile(path)
+		if err != nil {
+			glog.Errorf("Error reading %s: %v", path, err)
+		}
+		// The files are mostly in time order, but not entirely.
+		nextbus.SortVehicleLocationsByDateAndId(vls)
+		events := tracker.Insert(vls)
+		if err := w.Write(events); err != nil {
+			glog.Fatal(err)
+		}
+		glog.Infof("%s: %d locations, %d events", path, len(vls), len(events))
+		numEvents += len(events)
+	}
+	glog.Infof("Wrote %d events from %d files", numEvents, len(paths))
+	glog.Flush()
+}
@@ -0,0 +1,76 @@
+package main
+
+// Converts a GTFS static feed into a config directory (a routeConfig file per
+// route), and optionally an all-paths file, so that the tools that read
+// NextBus configs can be used with agencies that only publish GTFS.
+//
+// Example:
+//   gtfs_to_config --gtfs=/tmp/google_transit.zip --output=/tmp/config \
+//       --all-paths=/tmp/all-paths.xml
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+
+	"github.com/golang/glog"
+
+	"github.com/jamessynge/transit_tools/nextbus"
+	"github.com/jamessynge/transit_tools/nextbus/gtfs"
+	"github.com/jamessynge/transit_tools/util"
+)
+
+var (
+	gtfsFlag = flag.String(
+		"gtfs", "",
+		"Path of the GTFS zip file to read")
+	agencyTagFlag = flag.String(
+		"agency", "",
+		"Tag of the agency (defaults to the agency_id of the feed)")
+	outputFlag = flag.String(
+		"output", "",
+		"Directory into whose routeConfig subdirectory the routeConfig files "+
+			"are written")
+	allPathsFlag = flag.String(
+		"all-paths", "",
+		"Path of xml file to which to write all the paths (optional)")
+)
+
+func main() {
+	flag.Parse()
+	ok := true
+	if len(*gtfsFlag) == 0 {
+		ok = false
+		glog.Error("--gtfs not set")
+	} else if !util.IsFile(*gtfsFlag) {
+		ok = false
+		glog.Errorf("Not a file: %v", *gtfsFlag)
+	}
+	if len(*outputFlag) == 0 && len(*allPathsFlag) == 0 {
+		ok = false
+		glog.Error("Neither --output nor --all-paths is set")
+	}
+	if !ok {
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	agency, err := gtfs.ReadZipFile(*gtfsFlag, *agencyTagFlag)
+	if agency == nil {
+		glog.Fatal(err)
+	} else if err != nil {
+		glog.Warningf("Error(s) reading %s: %v", *gtfsFlag, err)
+	}
+	if len(*outputFlag) > 0 {
+		dirPath := filepath.Join(*outputFlag, "routeConfig")
+		if err := nextbus.WriteRouteConfigsDir(agency, dirPath); err != nil {
+			glog.Fatal(err)
+		}
+		glog.Infof("Wrote %d routeConfig files to %s", len(agency.Routes), dirPath)
+	}
+	if len(*allPathsFlag) > 0 {
+		if err := nextbus.WritePathsToFile(agency, *allPathsFlag); err != nil {
+			glog.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+// Writes a z/x/y pyramid of heatmap tiles (PNG images in the Web Mercator
+// projection, as used by web maps), and an index.html for viewing them
+// offline, from vehicle location CSV files. The layer is either the density
+// of the reports, from processed location files (.csv or .csv.gz, as written
+// by the nextbus_fetcher) or the leaves of a geo-partitioned directory (as
+// written by partition_locations), or the mean speed, from the samples
+// written by resample_tracks. The color scale is computed from all of the
+// pixels at each zoom level, so colors are consistent across the tiles.
+//
+// There is no delay layer yet: none of the tools computes the delay of a
+// vehicle relative to its schedule, so there are no files of delays to read.
+// Once there are, such a layer can be added in the same way as speed (i.e.
+// the mean of a value at each pixel).
+//
+// Example:
+//   heatmap_tiles --locations=/data/mbta/locations/processed/2014 \
+//       --max-zoom=16 --output=/data/mbta/heatmaps/2014
+//   heatmap_tiles --partitions=/data/mbta/partitioned \
+//       --region=42.33,-71.10,42.37,-71.04 --output=/tmp/downtown
+//   heatmap_tiles --layer=speed --locations=samples.csv --output=/tmp/speeds
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+
+	"github.com/jamessynge/transit_tools/geo"
+	"github.com/jamessynge/transit_tools/geo/geoimage"
+	"github.com/jamessynge/transit_tools/nextbus"
+	"github.com/jamessynge/transit_tools/nextbus/nblocations"
+	"github.com/jamessynge/transit_tools/util"
+)
+
+var (
+	locationsFlag = flag.String(
+		"locations", "",
+		"Comma separated paths (globs) of CSV files, or directories to search "+
+			"for CSV files")
+	partitionsFlag = flag.String(
+		"partitions", "",
+		"Directory of geo-partitioned locations (with a partitions.xml index); "+
+			"only the leaves overlapping --region are read (alternative to "+
+			"--locations, for --layer=density only)")
+	regionFlag = flag.String(
+		"region", "",
+		"Only locations within this region (south,west,north,east in degrees) "+
+			"are counted; defaults to all")
+	layerFlag = flag.String(
+		"layer", "density",
+		"density (of the reports) or speed (mean, in meters/second, of the "+
+			"samples written by resample_tracks)")
+	minZoomFlag = flag.Int(
+		"min-zoom", 10,
+		"Lowest zoom level of the tiles")
+	maxZoomFlag = flag.Int(
+		"max-zoom", 16,
+		"Highest zoom level of the tiles; each level up needs about 4 times "+
+			"as much memory")
+	tileSizeFlag = flag.Int(
+		"tile-size", 256,
+		"Width and height of the tiles, in pixels")
+	minCountFlag = flag.Uint(
+		"min-count", 3,
+		"For --layer=speed, pixels with fewer samples are left transparent")
+	speedRangeFlag = flag.String(
+		"speed-range", "",
+		"For --layer=speed, the speeds (min,max in meters/second) at the ends "+
+			"of the color scale; defaults to the 2nd and 98th percentiles")
+	titleFlag = flag.String(
+		"title", "",
+		"Title of the viewer page")
+	outputFlag = flag.String(
+		"output", "",
+		"Directory into which to write the tiles and index.html")
+)
+
+func usageError(msg string) {
+	fmt.Fprintln(os.Stderr, msg)
+	flag.PrintDefaults()
+	os.Exit(1)
+}
+
+// Parses a comma separated list of n floats.
+func parseFloats(s string, n int) ([]float64, error) {
+	fields := strings.Split(s, ",")
+	if len(fields) != n {
+		return nil, fmt.Errorf("Expected %d comma separated numbers: %q", n, s)
+	}
+	var result []float64
+	for _, f := range fields {
+		v, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, v)
+	}
+	return result, nil
+}
+
+func parseRegion(s string) (region geo.Rect, err error) {
+	v, err := parseFloats(s, 4)
+	if err != nil {
+		return
+	}
+	region = geo.Rect{
+		South: geo.Latitude(v[0]), West: geo.Longitude(v[1]),
+		North: geo.Latitude(v[2]), East: geo.Longitude(v[3]),
+	}
+	if !region.South.IsValid() || !region.North.IsValid() ||
+		!region.West.IsValid() || !region.East.IsValid() ||
+		region.South >= region.North || region.West >= region.East {
+		err = fmt.Errorf("Invalid region: %q", s)
+	}
+	return
+}
+
+func findFiles(region *geo.Rect) (paths []string) {
+	if *partitionsFlag != "" {
+		a := nblocations.ReadPartitionsIndex(*partitionsFlag)
+		var names []string
+		if region != nil {
+			names = a.FileNamesForRegion(region.West, region.East, region.South, region.North)
+		} else {
+			west, east, south, north := a.Region()
+			names = a.FileNamesForRegion(west, east, south, north)
+		}
+		for _, name := range names {
+			paths = append(paths, filepath.Join(*partitionsFlag, name))
+		}
+	} else {
+		nblocations.FindCsvLocationsFiles(*locationsFlag, func(path string) bool {
+			paths = append(paths, path)
+			return true
+		})
+	}
+	sort.Strings(paths)
+	return
+}
+
+// Returns a function which extracts the location and value (NaN for density)
+// from a CSV record.
+func makeRecordParser(layer string) func(record []string) (
+	geo.Location, float64, error) {
+	if layer == "speed" {
+		// See nbtrack.Sample.ToCSVFields.
+		return func(record []string) (loc geo.Location, speed float64, err error) {
+			if len(record) < 6 {
+				err = fmt.Errorf("Expected at least 6 fields, not %d", len(record))
+				return
+			}
+			if loc.Lat, err = geo.ParseLatitude(record[3]); err != nil {
+				return
+			}
+			if loc.Lon, err = geo.ParseLongitude(record[4]); err != nil {
+				return
+			}
+			speed, err = strconv.ParseFloat(record[5], 64)
+			return
+		}
+	}
+	return func(record []string) (geo.Location, float64, error) {
+		vl, err := nextbus.CSVFieldsToVehicleLocation(record)
+		if err != nil {
+			return geo.Location{}, 0, err
+		}
+		return vl.Location, 0, nil
+	}
+}
+
+func addCsvFile(csvPath string, pyramid *geoimage.TilePyramid, region *geo.Rect,
+	parse func([]string) (geo.Location, float64, error)) (numAdded int, err error) {
+	fn := func(source string, record []string, recordNum int, err error) error {
+		if err != nil {
+			return err
+		}
+		loc, v, err := parse(record)
+		if err != nil {
+			glog.Warningf("Skipping record %d of %s: %v", recordNum+1, source, err)
+			return nil
+		}
+		if region != nil && !(region.South <= loc.Lat && loc.Lat <= region.North &&
+			region.West <= loc.Lon && loc.Lon <= region.East) {
+			return nil
+		}
+		if pyramid.WithValues {
+			pyramid.AddValue(loc, v)
+		} else {
+			pyramid.Add(loc)
+		}
+		numAdded++
+		return nil
+	}
+	_, err = util.ReadCsvFileToFn(csvPath, fn)
+	return
+}
+
+func main() {
+	flag.Parse()
+	if (*locationsFlag == "") == (*partitionsFlag == "") {
+		usageError("One of --locations and --partitions is required")
+	}
+	if *outputFlag == "" {
+		usageError("--output is required")
+	}
+	if *layerFlag == "delay" {
+		usageError("--layer=delay isn't supported, as there are no delays " +
+			"to read; see the package comment")
+	}
+	if *layerFlag != "density" && *layerFlag != "speed" {
+		usageError("--layer must be density or speed")
+	}
+	if *layerFlag == "speed" && *partitionsFlag != "" {
+		// The partitions hold location reports, not the samples of
+		// resample_tracks, which are needed for the speeds.
+		usageError("--layer=speed requires --locations (of the samples " +
+			"written by resample_tracks), not --partitions")
+	}
+	var region *geo.Rect
+	if *regionFlag != "" {
+		r, err := parseRegion(*regionFlag)
+		if err != nil {
+			usageError(fmt.Sprintf("--region: %v", err))
+		}
+		region = &r
+	}
+	var speedRange []float64
+	if *speedRangeFlag != "" {
+		var err error
+		speedRange, err = parseFloats(*speedRangeFlag, 2)
+		if err != nil {
+			usageError(fmt.Sprintf("--speed-range: %v", err))
+		}
+	}
+	withValues := *layerFlag == "speed"
+	pyramid, err := geoimage.NewTilePyramid(
+		*minZoomFlag, *maxZoomFlag, *tileSizeFlag, withValues)
+	if err != nil {
+		usageError(err.Error())
+	}
+
+	paths := findFiles(region)
+	if len(paths) == 0 {
+		glog.Fatal("No CSV files found")
+	}
+	parse := makeRecordParser(*layerFlag)
+	total := 0
+	for _, path := range paths {
+		n, err := addCsvFile(path, pyramid, region, parse)
+		if err != nil {
+			glog.Errorf("Error reading %s: %v", path, err)
+		}
+		glog.Infof("%s: %d locations", path, n)
+		total += n
+	}
+	bounds, ok := pyramid.Bounds()
+	if !ok {
+		glog.Fatalf("No locations in %d files", len(paths))
+	}
+	glog.Infof("Read %d locations from %d files", total, len(paths))
+
+	if err := os.MkdirAll(*outputFlag, 0755); err != nil {
+		glog.Fatal(err)
+	}
+	config := &geoimage.ViewerConfig{
+		Title:    *titleFlag,
+		MinZoom:  *minZoomFlag,
+		MaxZoom:  *maxZoomFlag,
+		TileSize: *tileSizeFlag,
+		Bounds:   bounds,
+		Legends:  make(map[int][]geoimage.LegendStop),
+	}
+	var valueScale *geoimage.ValueScale
+	if withValues {
+		config.Units = "mean speed (m/s)"
+		// The same scale for all levels: the mean speed doesn't depend on the
+		// size of the pixels.
+		valueScale = geoimage.NewValueScale(
+			pyramid, *maxZoomFlag, 0.02, 0.98, geoimage.RedYellowGreenRamp)
+		if speedRange != nil {
+			valueScale.Min, valueScale.Max = speedRange[0], speedRange[1]
+		}
+		valueScale.MinCount = uint64(*minCountFlag)
+		config.Legends[-1] = valueScale.Legend(5)
+	} else {
+		config.Units = "reports per pixel"
+	}
+	for z := *minZoomFlag; z <= *maxZoomFlag; z++ {
+		var toColor geoimage.PixelColorer
+		if valueScale != nil {
+			toColor = valueScale.Color
+		} else {
+			scale := geoimage.NewEqualizedScale(pyramid, z, geoimage.HeatRamp)
+			config.Legends[z] = scale.Legend(5)
+			toColor = scale.Color
+		}
+		n, err := pyramid.WriteTiles(*outputFlag, z, toColor)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		glog.Infof("Wrote %d tiles at zoom level %d", n, z)
+	}
+	if err := geoimage.WriteViewer(*outputFlag, config); err != nil {
+		glog.Fatal(err)
+	}
+	glog.Infof("Wrote %s", filepath.Join(*outputFlag, "index.html"))
+	glog.Flush()
+}
@@ -8,15 +8,20 @@ go run cmds\locations_to_nearest_paths\locations_to_nearest_paths.go --alsologto
 
 import (
 	"flag"
+	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/golang/glog"
 
 	//	"github.com/jamessynge/transit_tools/geom"
 	"github.com/jamessynge/transit_tools/nextbus"
+	"github.com/jamessynge/transit_tools/nextbus/configfetch"
 	"github.com/jamessynge/transit_tools/nextbus/nbgeo"
+	"github.com/jamessynge/transit_tools/nextbus/nbmatch"
 	"github.com/jamessynge/transit_tools/util"
 )
 
@@ -32,6 +37,14 @@ var (
 	allPathsFlag = flag.String(
 		"all-paths", "",
 		"Path of xml file with description of all paths to be processed")
+	configRootFlag = flag.String(
+		"config_root", "",
+		"Root of the config snapshots (a config store, or a directory tree "+
+			"created by the config fetcher); each locations file is matched to "+
+			"the paths of the config in effect at the time of its first "+
+			"location, and the output for each config is written to a "+
+			"subdirectory of --output named after the config snapshot "+
+			"(alternative to --all-paths)")
 	outputDirFlag = flag.String(
 		"output", "",
 		"Path of directory into which location-path csv files are to be written")
@@ -42,8 +55,83 @@ var (
 		"parallel-workers", 0,
 		"Number of worker go routines to start for processing CSV records "+
 			"from a single file")
+	headingAwareFlag = flag.Bool(
+		"heading-aware", false,
+		"Match locations to paths using both distance and heading, rather than "+
+			"just the paths of the vehicle's route within a box")
+	maxDistanceFlag = flag.Float64(
+		"max-distance", 100,
+		"With --heading-aware, only paths within this many meters are matched")
+	maxPathsFlag = flag.Int(
+		"max-paths", 3,
+		"With --heading-aware, the maximum number of paths a location is "+
+			"matched to")
 )
 
+func makeFinder(agency *nextbus.Agency) (nbgeo.VLPathFinder, error) {
+	if *headingAwareFlag {
+		matcher, err := nbmatch.NewMatcher(agency)
+		if err != nil {
+			return nil, err
+		}
+		matcher.RestrictToRoute = true
+		matcher.MaxDistance = *maxDistanceFlag
+		matcher.MaxPaths = *maxPathsFlag
+		return matcher, nil
+	}
+	return nbgeo.NewRouteToQuadTreeMap(agency), nil
+}
+
+// Returns the time of the first valid location in the file (the files are
+// usually a day of locations, so all of a file is matched to the paths of one
+// config).
+func firstLocationTime(filePath string) (t time.Time, err error) {
+	_, err = util.ReadCsvFileToFn(filePath,
+		func(source string, record []string, recordNum int, err error) error {
+			if err != nil {
+				return err
+			}
+			vl, err := nextbus.CSVFieldsToVehicleLocation(record)
+			if err != nil {
+				return nil
+			}
+			t = vl.Time
+			return io.EOF
+		})
+	if err == nil && t.IsZero() {
+		err = fmt.Errorf("No valid locations in %s", filePath)
+	}
+	return
+}
+
+// Loads the config of snapshot i of the history, and prepares to write the
+// locations matched to its paths into a subdirectory of the output directory
+// (along with the paths, as path indices are specific to a config).
+func startSnapshot(history *configfetch.ConfigHistory, i int) (
+	nbgeo.VLPathFinder, *nbgeo.CsvOutputChanMap, error) {
+	agency, err := history.LoadAgency(i)
+	if err != nil {
+		glog.Warningf("Error(s) loading config %s: %v", history.Names[i], err)
+	}
+	if agency == nil || agency.NumPaths() == 0 {
+		return nil, nil, fmt.Errorf("No paths in config %s", history.Names[i])
+	}
+	outputDir := filepath.Join(*outputDirFlag, history.Names[i])
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return nil, nil, err
+	}
+	pathsFile := filepath.Join(outputDir, "all-paths.xml")
+	if err := nextbus.WritePathsToFile(agency, pathsFile); err != nil {
+		return nil, nil, err
+	}
+	finder, err := makeFinder(agency)
+	if err != nil {
+		return nil, nil, err
+	}
+	glog.Infof("Matching locations to the paths of config %s", history.Names[i])
+	return finder, nbgeo.NewCsvOutputChanMap(outputDir, *overwriteFlag, 0644), nil
+}
+
 func main() {
 	// Validate args.
 	flag.Parse()
@@ -54,9 +142,12 @@ func main() {
 		ok = false
 		glog.Error("--locations not set")
 	}
-	if len(*allPathsFlag) == 0 {
+	if len(*allPathsFlag) == 0 && len(*configRootFlag) == 0 {
+		ok = false
+		glog.Error("Neither --all-paths nor --config_root is set")
+	} else if len(*allPathsFlag) > 0 && len(*configRootFlag) > 0 {
 		ok = false
-		glog.Error("--all-paths not set")
+		glog.Error("Only one of --all-paths and --config_root may be set")
 	}
 	if len(*outputDirFlag) == 0 {
 		ok = false
@@ -68,7 +159,7 @@ func main() {
 
 	if ok {
 		// Are the values sensible?
-		if !util.IsFile(*allPathsFlag) {
+		if len(*allPathsFlag) > 0 && !util.IsFile(*allPathsFlag) {
 			ok = false
 			glog.Errorf("Not a file: %v", *allPathsFlag)
 		}
@@ -93,28 +184,13 @@ func main() {
 
 	util.InitGOMAXPROCS()
 
-	glog.Infof("Reading paths from: %s", *allPathsFlag)
-	agency, err := nextbus.ReadPathsFromFile(*allPathsFlag)
-	if err != nil {
-		glog.Fatal(err)
-	} else if agency.NumPaths() == 0 {
-		glog.Fatal("No paths in ", *allPathsFlag)
-	}
-	qtm := nbgeo.NewRouteToQuadTreeMap(agency)
-	//	qt := nbgeo.NewQuadTreeWithAgencyPaths(agency)
-
-	//	// Load quadtree with paths.  Would prefer to have min and max latitude
-	//	// for the agency, but instead will narrow the the bounds after inserting
-	//	// all the paths.
-	//	glog.Infof("Add paths to quadtree")
-	//	qt := geom.NewQuadTree(geom.NewRect(-180, +180, -90, 90))
-	//	for _, paths := range agency.Paths {
-	//		for _, path := range paths {
-	//			nbgeo.AddPathToQuadTreeAsSegs(path, qt)
-	//		}
-	//	}
-	//	qt.NarrowBounds()
-	//	glog.Infof("Reduced quadtree bounds to: %v", qt.Bounds())
+	var history *configfetch.ConfigHistory
+	if len(*configRootFlag) > 0 {
+		history, err = configfetch.OpenConfigHistory(*configRootFlag, nil)
+		if err != nil {
+			glog.Fatal(err)
+		}
+	}
 
 	if !util.Exists(*outputDirFlag) {
 		err := os.MkdirAll(*outputDirFlag, 0755)
@@ -123,25 +199,66 @@ func main() {
 		}
 	}
 
-	outputChans := nbgeo.NewCsvOutputChanMap(
-		*outputDirFlag, *overwriteFlag, 0644)
-	defer func() {
-		outputChans.CloseAll()
-		glog.Info("Closed all output files")
-	}()
-
 	//	inputPathChan := make(chan[]string, 100)
 	fileWG := &sync.WaitGroup{}
 
+	var finder nbgeo.VLPathFinder
+	var outputChans *nbgeo.CsvOutputChanMap
+	closeOutputs := func() {
+		if outputChans != nil {
+			fileWG.Wait()
+			outputChans.CloseAll()
+			glog.Info("Closed all output files")
+			outputChans = nil
+		}
+	}
+	defer closeOutputs()
+
+	if history == nil {
+		glog.Infof("Reading paths from: %s", *allPathsFlag)
+		agency, err := nextbus.ReadPathsFromFile(*allPathsFlag)
+		if err != nil {
+			glog.Fatal(err)
+		} else if agency.NumPaths() == 0 {
+			glog.Fatal("No paths in ", *allPathsFlag)
+		}
+		if finder, err = makeFinder(agency); err != nil {
+			glog.Fatal(err)
+		}
+		outputChans = nbgeo.NewCsvOutputChanMap(
+			*outputDirFlag, *overwriteFlag, 0644)
+	}
+	snapshotIndex := -1
+
 	// FOR NOW, processing one file at a time in order to simplify debugging.
 	for _, filePath := range matchingLocationFilePaths {
 		if filePath == *excludeFlag {
 			continue
 		}
+		if history != nil {
+			t, err := firstLocationTime(filePath)
+			if err != nil {
+				glog.Errorf("Skipping %s: %v", filePath, err)
+				continue
+			}
+			i, ok := history.SnapshotAt(t)
+			if !ok {
+				glog.Errorf("Skipping %s: no config in effect at %s", filePath, t)
+				continue
+			}
+			if i != snapshotIndex {
+				closeOutputs()
+				finder, outputChans, err = startSnapshot(history, i)
+				if err != nil {
+					glog.Fatal(err)
+				}
+				snapshotIndex = i
+			}
+		}
 		glog.Infof("Reading locations file:  %s", filePath)
 		fileWG.Add(1)
 		numRecords, err := nbgeo.LocationsFileToPerPathFiles(
-			qtm, filePath, outputChans, fileWG, *parallelWorkersFlag)
+			finder, filePath, outputChans, fileWG, *parallelWorkersFlag)
 		glog.Infof("Processed %6d locations from file: %s", numRecords, filePath)
 		if err != nil {
 			glog.Fatalf("Error while processing file: %s\n\tError: %v",
@@ -0,0 +1,152 @@
+package main
+
+// Exports vehicle location CSV files (.csv or .csv.gz: the daily files of the
+// fetcher, the leaf files of a partitioning, or the per-path files of
+// locations_to_nearest_paths) to Parquet files partitioned by date, for
+// loading with DuckDB or pandas. For example, after:
+//
+//   locations_to_parquet --input=/data/mbta/processed --output=/data/mbta/parquet
+//
+// the locations can be queried with:
+//
+//   SELECT * FROM read_parquet('/data/mbta/parquet/*/*.parquet',
+//                              hive_partitioning = true)
+//   WHERE date = '2014-05-01' AND route_tag = '39';
+//
+// The Parquet files of a CSV file are named for its path relative to --input
+// (e.g. the locations of 2014/05/2014-05-01.csv.gz are written to
+// date=yyyy-mm-dd/2014_05_2014-05-01.parquet).
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/jamessynge/transit_tools/nextbus/nbparquet"
+	"github.com/jamessynge/transit_tools/parquet"
+	"github.com/jamessynge/transit_tools/util"
+)
+
+var (
+	inputFlag = flag.String(
+		"input", "",
+		"CSV file, or directory to search for CSV files")
+	outputFlag = flag.String(
+		"output", "",
+		"Directory into which to write the Parquet files (in a subdirectory "+
+			"per date, named date=yyyy-mm-dd)")
+	timezoneFlag = flag.String(
+		"timezone", "America/New_York",
+		"Time zone in which to determine the date of each location")
+	codecFlag = flag.String(
+		"codec", "gzip",
+		"Compression of the Parquet files: gzip or none")
+	rowGroupSizeFlag = flag.Int(
+		"row-group-size", parquet.DefaultRowGroupSize,
+		"Maximum number of rows per row group")
+	overwriteFlag = flag.Bool(
+		"overwrite", false,
+		"Replace existing Parquet files")
+)
+
+func isCsvFile(filePath string) bool {
+	return strings.HasSuffix(filePath, ".csv") ||
+		strings.HasSuffix(filePath, ".csv.gz")
+}
+
+func main() {
+	flag.Parse()
+	ok := true
+	if len(*inputFlag) == 0 {
+		ok = false
+		glog.Error("--input not set")
+	} else if !util.Exists(*inputFlag) {
+		ok = false
+		glog.Errorf("--input does not exist: %s", *inputFlag)
+	}
+	if len(*outputFlag) == 0 {
+		ok = false
+		glog.Error("--output not set")
+	}
+	loc, err := time.LoadLocation(*timezoneFlag)
+	if err != nil {
+		ok = false
+		glog.Errorf("Invalid --timezone: %v", err)
+	}
+	var codec parquet.Codec
+	switch *codecFlag {
+	case "gzip":
+		codec = parquet.Gzip
+	case "none":
+		codec = parquet.Uncompressed
+	default:
+		ok = false
+		glog.Errorf("Invalid --codec: %s", *codecFlag)
+	}
+	if *rowGroupSizeFlag <= 0 {
+		ok = false
+		glog.Error("--row-group-size must be positive")
+	}
+	if !ok {
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	var csvPaths []string
+	walkFn := func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			glog.Warningf("Error walking %s: %v", path, err)
+			return nil
+		}
+		if !info.IsDir() && isCsvFile(path) {
+			csvPaths = append(csvPaths, path)
+		}
+		return nil
+	}
+	filepath.Walk(*inputFlag, walkFn)
+	glog.Infof("Found %d CSV files", len(csvPaths))
+
+	exporter := nbparquet.NewExporter(*outputFlag)
+	if util.IsDirectory(*inputFlag) {
+		exporter.InputDir = *inputFlag
+	}
+	exporter.Location = loc
+	exporter.Codec = codec
+	exporter.RowGroupSize = *rowGroupSizeFlag
+	exporter.Overwrite = *overwriteFlag
+
+	// Two CSV files with the same Parquet name would overwrite each other's
+	// files.
+	names := make(map[string]string)
+	for _, csvPath := range csvPaths {
+		name := exporter.ParquetName(csvPath)
+		if other, ok := names[name]; ok {
+			glog.Fatalf("%s and %s would both be exported to %s", other, csvPath,
+				name)
+		}
+		names[name] = csvPath
+	}
+
+	errs := util.NewErrors()
+	totalRows := 0
+	for _, csvPath := range csvPaths {
+		numRows, written, err := exporter.ExportCsvFile(csvPath)
+		if err != nil {
+			glog.Errorf("Error exporting %s: %v", csvPath, err)
+			errs.AddError(err)
+			continue
+		}
+		glog.Infof("Exported %d rows of %s to %d files", numRows, csvPath,
+			len(written))
+		totalRows += numRows
+	}
+	glog.Infof("Exported %d rows in total", totalRows)
+	if err := errs.ToError(); err != nil {
+		glog.Error("Some files failed to export")
+		os.Exit(1)
+	}
+}
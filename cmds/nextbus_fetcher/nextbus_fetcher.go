@@ -47,7 +47,10 @@ import (
 
 	"github.com/golang/glog"
 
+	"github.com/jamessynge/transit_tools/geo"
 	"github.com/jamessynge/transit_tools/nextbus/configfetch"
+	"github.com/jamessynge/transit_tools/nextbus/nbgeofence"
+	"github.com/jamessynge/transit_tools/nextbus/nblive"
 	"github.com/jamessynge/transit_tools/nextbus/nblocations"
 	"github.com/jamessynge/transit_tools/util"
 )
@@ -69,6 +72,28 @@ var setLogDirFlag = flag.Bool(
 	"Set --log_dir default value immediately after parsing flags so that "+
 		"messages are logged there immediately, and not after the file is rotated.")
 
+var liveAddressFlag = flag.String(
+	"live_address", "",
+	"If set (e.g. \":8080\"), address on which to serve the latest location "+
+		"of each vehicle (see package nblive).")
+var liveCenterFlag = flag.String(
+	"live_center", "42.358,-71.064",
+	"Latitude,longitude of the center of the agency's service area, used "+
+		"by --live_address to compute distances in meters.")
+var liveMaxAgeFlag = flag.Duration(
+	"live_max_age", 10*time.Minute,
+	"Vehicles not reported for this long are dropped from the live index.")
+
+var geofencesFlag = flag.String(
+	"geofences", "",
+	"If set, path of a GeoJSON file of named polygons (garages, terminals, "+
+		"etc.); vehicles entering and exiting them are recorded (see package "+
+		"nbgeofence).")
+var geofenceEventsFlag = flag.String(
+	"geofence_events", "",
+	"File to which --geofences events are appended as CSV; by default, "+
+		"geofence-events.csv in the agency directory.")
+
 var fetchIntervalFlag = flag.Float64(
 	"fetch_interval", 0,
 	"Seconds between fetches of vehicle locations")
@@ -267,6 +292,13 @@ func main() {
 		hiPriority: true,
 	}
 
+	if *liveAddressFlag != "" {
+		startLiveServer(configRootDir)
+	}
+	if *geofencesFlag != "" {
+		startGeofences(agencyDir)
+	}
+
 	// Start fetching, archiving and aggregating of vehicle locations.
 	interval := time.Duration(*fetchIntervalFlag*1000000) * time.Microsecond
 	stopFetchAndArchiveCh := make(chan chan bool, 1)
@@ -280,16 +312,8 @@ func main() {
 		[]int(configHours), stopPCFCh)
 	glog.Info("Started config fetcher.")
 
-	// TODO Start http server to report status (e.g. names of files currently
-	// being written to).  Maybe also use http server to change flags?
-	/*
-	   // Default Request Handler
-	   func defaultHandler(w http.ResponseWriter, r *http.Request) {
-	   	fmt.Fprintf(w, "<h1>Hello %s!</h1>", r.URL.Path[1:])
-	   }
-	   	http.HandleFunc("/", defaultHandler)
-	   	http.ListenAndServe(":8080", nil)
-	*/
+	// TODO Report status (e.g. names of files currently being written to) via
+	// the --live_address server.  Maybe also use it to change flags?
 
 	sig := <-signalChan
 	switch sig {
@@ -334,3 +358,79 @@ func main() {
 
 	os.Exit(0)
 }
+
+// Indexes the vehicle locations as they are aggregated, and serves the index
+// at --live_address. Stops are resolved using the latest config snapshot
+// under configRootDir, if there is one.
+func startLiveServer(configRootDir string) {
+	parts := strings.Split(*liveCenterFlag, ",")
+	if len(parts) != 2 {
+		glog.Fatalf("Invalid --live_center: %q", *liveCenterFlag)
+	}
+	lat, err1 := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	lon, err2 := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	center, err := geo.LocationFromFloat64s(lat, lon)
+	if err1 != nil || err2 != nil || err != nil {
+		glog.Fatalf("Invalid --live_center: %q", *liveCenterFlag)
+	}
+	index := nblive.NewVehicleIndex(center)
+	nblocations.WrapVehicleAggregator = func(
+		va nblocations.VehicleAggregator) nblocations.VehicleAggregator {
+		return nblive.MakeIndexingAggregator(va, index)
+	}
+	go func() {
+		for range time.Tick(time.Minute) {
+			if n := index.Expire(time.Now().Add(-*liveMaxAgeFlag)); n > 0 {
+				glog.V(1).Infof("Expired %d vehicles from the live index", n)
+			}
+		}
+	}()
+	agency, err := configfetch.LoadAgencyAt(configRootDir, time.Now())
+	if err != nil {
+		glog.Warningf("Error(s) loading the config from %s: %v", configRootDir, err)
+	}
+	if agency == nil {
+		glog.Warning("No config snapshot, so stops can't be resolved by the live server")
+	}
+	go func() {
+		glog.Infof("Serving live vehicle locations at %s", *liveAddressFlag)
+		err := http.ListenAndServe(*liveAddressFlag, nblive.NewHandler(index, agency))
+		glog.Errorf("Live server stopped: %v", err)
+	}()
+}
+
+// Records the vehicles entering and exiting the fences in --geofences.
+func startGeofences(agencyDir string) {
+	set, err := nbgeofence.LoadGeoJSONFile(*geofencesFlag)
+	if err != nil {
+		glog.Fatalf("Unable to load --geofences: %v", err)
+	}
+	eventsPath := *geofenceEventsFlag
+	if eventsPath == "" {
+		eventsPath = filepath.Join(agencyDir, "geofence-events.csv")
+	}
+	f, err := os.OpenFile(eventsPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		glog.Fatalf("Unable to open %s: %v", eventsPath, err)
+	}
+	w := nbgeofence.NewCsvEventWriter(f)
+	tracker := nbgeofence.NewTracker(set)
+	wrap := nblocations.WrapVehicleAggregator
+	nblocations.WrapVehicleAggregator = func(
+		va nblocations.VehicleAggregator) nblocations.VehicleAggregator {
+		if wrap != nil {
+			va = wrap(va)
+		}
+		return nbgeofence.MakeGeofenceAggregator(va, tracker,
+			func(events []nbgeofence.Event) {
+				for i := range events {
+					glog.V(1).Infof("Geofence event: %s", &events[i])
+				}
+				if err := w.Write(events); err != nil {
+					glog.Errorf("Error writing geofence events: %v", err)
+				}
+			})
+	}
+	glog.Infof("Tracking %d geofences from %s; events in %s",
+		len(set.Fences), *geofencesFlag, eventsPath)
+}
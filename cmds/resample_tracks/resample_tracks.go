@@ -0,0 +1,219 @@
+package main
+
+// Resamples the tracks of the vehicles in the processed vehicle location CSV
+// files (.csv or .csv.gz, as written by the nextbus_fetcher) at a fixed
+// interval, writing the samples as CSV (see nbtrack.Sample.ToCSVFields).
+// Each file is processed separately, with the reports of each vehicle in the
+// order in which they appear in the file, so that old reports which reappear
+// after newer ones are detected and dropped. If --all-paths is set, the
+// reports are matched to the paths, and interpolated along them.
+//
+// Example:
+//   resample_tracks --locations=/data/mbta/locations/processed/2014/01 \
+//       --all-paths=/data/mbta/all-paths.xml --interval=5s --smooth \
+//       --output=samples.csv --anomalies=anomalies.txt
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/jamessynge/transit_tools/nextbus"
+	"github.com/jamessynge/transit_tools/nextbus/nblocations"
+	"github.com/jamessynge/transit_tools/nextbus/nbmatch"
+	"github.com/jamessynge/transit_tools/nextbus/nbtrack"
+	"github.com/jamessynge/transit_tools/util"
+)
+
+var (
+	locationsFlag = flag.String(
+		"locations", "",
+		"Comma separated paths (globs) of CSV files, or directories to search "+
+			"for CSV files")
+	allPathsFlag = flag.String(
+		"all-paths", "",
+		"Path of xml file with description of all paths; if set, reports are "+
+			"interpolated along their matched paths")
+	outputFlag = flag.String(
+		"output", "",
+		"File into which to write the samples; defaults to stdout")
+	anomaliesFlag = flag.String(
+		"anomalies", "",
+		"File into which to write the dropped reports and teleports, one per line")
+	intervalFlag = flag.Duration(
+		"interval", 5*time.Second,
+		"Time between samples")
+	maxGapFlag = flag.Duration(
+		"max-gap", 5*time.Minute,
+		"Tracks are split where there are no reports for longer than this")
+	maxSpeedFlag = flag.Float64(
+		"max-speed", 35,
+		"Reports implying a speed (meters/second) greater than this since the "+
+			"previous report are teleports")
+	smoothFlag = flag.Bool(
+		"smooth", false,
+		"Smooth the resampled positions and speeds with a Kalman filter")
+)
+
+func readCsvFile(csvPath string) ([]*nextbus.VehicleLocation, error) {
+	var result []*nextbus.VehicleLocation
+	fn := func(source string, record []string, recordNum int, err error) error {
+		if err != nil {
+			return err
+		}
+		vl, err := nextbus.CSVFieldsToVehicleLocation(record)
+		if err != nil {
+			glog.Warningf("Skipping record %d of %s: %v", recordNum+1, source, err)
+			return nil
+		}
+		result = append(result, vl)
+		return nil
+	}
+	_, err := util.ReadCsvFileToFn(csvPath, fn)
+	return result, err
+}
+
+// Groups the reports by vehicle, preserving their order; returns the vehicle
+// ids in sorted order.
+func groupByVehicle(vls []*nextbus.VehicleLocation) (
+	ids []string, byVehicle map[string][]*nextbus.VehicleLocation) {
+	byVehicle = make(map[string][]*nextbus.VehicleLocation)
+	for _, vl := range vls {
+		if _, ok := byVehicle[vl.VehicleId]; !ok {
+			ids = append(ids, vl.VehicleId)
+		}
+		byVehicle[vl.VehicleId] = append(byVehicle[vl.VehicleId], vl)
+	}
+	sort.Strings(ids)
+	return
+}
+
+// Matches the cleaned pieces of the track to the paths, and resamples along
+// them.
+func resampleMatched(r *nbtrack.Resampler, tm *nbmatch.TrackMatcher,
+	vls []*nextbus.VehicleLocation) *nbtrack.Track {
+	pieces, anomalies := r.Clean(vls)
+	matched := make([][]nbmatch.Match, len(pieces))
+	for i, piece := range pieces {
+		matched[i] = tm.MatchTrack(piece)
+	}
+	track := r.ResampleMatchedPieces(matched)
+	track.Anomalies = anomalies
+	return track
+}
+
+func createOutput(filePath string) (io.Writer, func()) {
+	if filePath == "" {
+		return os.Stdout, func() {}
+	}
+	f, err := os.Create(filePath)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	return f, func() {
+		if err := f.Close(); err != nil {
+			glog.Fatal(err)
+		}
+	}
+}
+
+func main() {
+	flag.Parse()
+	if *locationsFlag == "" {
+		fmt.Fprintln(os.Stderr, "--locations is required")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	if *intervalFlag <= 0 {
+		fmt.Fprintln(os.Stderr, "--interval must be positive")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	r := nbtrack.NewResampler()
+	r.Interval = *intervalFlag
+	r.MaxGap = *maxGapFlag
+	r.MaxSpeed = *maxSpeedFlag
+	if *smoothFlag {
+		r.Smoothing = nbtrack.NewKalmanConfig()
+	}
+	var tm *nbmatch.TrackMatcher
+	if *allPathsFlag != "" {
+		agency, err := nextbus.ReadPathsFromFile(*allPathsFlag)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		matcher, err := nbmatch.NewMatcher(agency)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		tm = nbmatch.NewTrackMatcher(matcher)
+		tm.MaxSpeed = r.MaxSpeed
+	}
+
+	var paths []string
+	nblocations.FindCsvLocationsFiles(*locationsFlag, func(path string) bool {
+		paths = append(paths, path)
+		return true
+	})
+	sort.Strings(paths)
+	if len(paths) == 0 {
+		glog.Fatalf("No CSV files found in --locations=%s", *locationsFlag)
+	}
+
+	out, closeOut := createOutput(*outputFlag)
+	defer closeOut()
+	w := csv.NewWriter(out)
+	var anomaliesOut io.Writer
+	if *anomaliesFlag != "" {
+		var closeAnomalies func()
+		anomaliesOut, closeAnomalies = createOutput(*anomaliesFlag)
+		defer closeAnomalies()
+	}
+
+	numSamples, numAnomalies := 0, 0
+	for _, path := range paths {
+		vls, err := readCsvFile(path)
+		if err != nil {
+			glog.Errorf("Error reading %s: %v", path, err)
+		}
+		ids, byVehicle := groupByVehicle(vls)
+		fileSamples, fileAnomalies := 0, 0
+		for _, id := range ids {
+			var track *nbtrack.Track
+			if tm != nil {
+				track = resampleMatched(r, tm, byVehicle[id])
+			} else {
+				track = r.Resample(byVehicle[id], nil)
+			}
+			for _, s := range track.Samples {
+				if err := w.Write(s.ToCSVFields(id)); err != nil {
+					glog.Fatal(err)
+				}
+			}
+			if anomaliesOut != nil {
+				for _, a := range track.Anomalies {
+					fmt.Fprintln(anomaliesOut, a)
+				}
+			}
+			fileSamples += len(track.Samples)
+			fileAnomalies += len(track.Anomalies)
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			glog.Fatal(err)
+		}
+		glog.Infof("%s: %d locations of %d vehicles, %d samples, %d anomalies",
+			path, len(vls), len(ids), fileSamples, fileAnomalies)
+		numSamples += fileSamples
+		numAnomalies += fileAnomalies
+	}
+	glog.Infof("Wrote %d samples from %d files; %d anomalies",
+		numSamples, len(paths), numAnomalies)
+	glog.Flush()
+}
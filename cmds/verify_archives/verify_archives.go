@@ -0,0 +1,86 @@
+package main
+
+// Verifies the raw tars (.tar.gz) and location CSV files (.csv.gz) under an
+// agency root, reporting for each corrupt file the last good entry or record.
+// Optionally repairs corrupt files (keeping every recoverable entry, and
+// renaming the original with the suffix .corrupt), and writes a manifest
+// alongside each good file, so that later runs only need to compare
+// checksums.
+//
+// Example:
+//   verify_archives --root=/data/mbta --repair --write-manifests
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/jamessynge/transit_tools/nextbus/nbverify"
+)
+
+var (
+	rootFlag = flag.String(
+		"root", "",
+		"Agency root directory (or any directory) to search for files to verify")
+	repairFlag = flag.Bool(
+		"repair", false,
+		"Rewrite corrupt files with all of the recoverable entries or records")
+	writeManifestsFlag = flag.Bool(
+		"write-manifests", true,
+		"Write a manifest (checksum) alongside each good file")
+	useManifestsFlag = flag.Bool(
+		"use-manifests", true,
+		"For files with a manifest, only compare the checksum with the manifest")
+	minAgeFlag = flag.Duration(
+		"min-age", time.Hour,
+		"Skip files modified more recently than this (they may still be "+
+			"being written)")
+)
+
+func main() {
+	flag.Parse()
+	if *rootFlag == "" {
+		fmt.Fprintln(os.Stderr, "--root is required")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	files, err := nbverify.FindFiles(*rootFlag, *minAgeFlag)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	numCorrupt, numRepaired, numFailed := 0, 0, 0
+	for _, filePath := range files {
+		result := nbverify.Verify(filePath, *useManifestsFlag)
+		if !result.OK() {
+			numCorrupt++
+			fmt.Println(result)
+			if *repairFlag {
+				if result, err = nbverify.Repair(filePath); err != nil {
+					glog.Errorf("Unable to repair %s: %v", filePath, err)
+					numFailed++
+					continue
+				}
+				numRepaired++
+				// Describe the repaired file, for its manifest.
+				result = nbverify.Verify(filePath, false)
+			}
+		} else {
+			glog.V(1).Info(result)
+		}
+		if *writeManifestsFlag && result.OK() && !result.MatchedManifest {
+			if err := nbverify.WriteManifest(result); err != nil {
+				glog.Errorf("Unable to write manifest of %s: %v", filePath, err)
+				numFailed++
+			}
+		}
+	}
+	fmt.Printf("Verified %d files: %d corrupt, %d repaired\n",
+		len(files), numCorrupt, numRepaired)
+	glog.Flush()
+	if numFailed > 0 || numCorrupt > numRepaired {
+		os.Exit(1)
+	}
+}
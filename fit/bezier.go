@@ -0,0 +1,266 @@
+package fit
+
+// Least squares fitting of a cubic Bezier curve to points along a curved
+// section of road (e.g. a bend or a ramp), where a line doesn't fit well.
+// See "An Algorithm for Automatically Fitting Digitized Curves", P. J.
+// Schneider, in Graphics Gems (1990).
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/jamessynge/transit_tools/geom"
+	"github.com/jamessynge/transit_tools/stats"
+)
+
+// A cubic Bezier curve, from P[0] to P[3], with control points P[1] and P[2].
+type CubicBezier struct {
+	P [4]geom.Point
+}
+
+// The Bernstein basis polynomials of degree 3 at t.
+func bernstein3(t float64) [4]float64 {
+	s := 1 - t
+	return [4]float64{s * s * s, 3 * s * s * t, 3 * s * t * t, t * t * t}
+}
+
+func (c *CubicBezier) PointAt(t float64) geom.Point {
+	b := bernstein3(t)
+	var pt geom.Point
+	for k := range b {
+		pt.X += b[k] * c.P[k].X
+		pt.Y += b[k] * c.P[k].Y
+	}
+	return pt
+}
+
+// Returns the first and second derivatives of the curve at t.
+func (c *CubicBezier) derivatives(t float64) (d1, d2 geom.Point) {
+	s := 1 - t
+	p := c.P
+	d1.X = 3 * (s*s*(p[1].X-p[0].X) + 2*s*t*(p[2].X-p[1].X) + t*t*(p[3].X-p[2].X))
+	d1.Y = 3 * (s*s*(p[1].Y-p[0].Y) + 2*s*t*(p[2].Y-p[1].Y) + t*t*(p[3].Y-p[2].Y))
+	d2.X = 6 * (s*(p[2].X-2*p[1].X+p[0].X) + t*(p[3].X-2*p[2].X+p[1].X))
+	d2.Y = 6 * (s*(p[2].Y-2*p[1].Y+p[0].Y) + t*(p[3].Y-2*p[2].Y+p[1].Y))
+	return
+}
+
+// Direction (radians, as for geom.Point.DirectionTo) of the curve at t.
+func (c *CubicBezier) DirectionAt(t float64) float64 {
+	d1, _ := c.derivatives(t)
+	return math.Atan2(d1.Y, d1.X)
+}
+
+// Returns n+1 points evenly spaced in t, from P[0] to P[3].
+func (c *CubicBezier) ToPolyline(n int) geom.Polyline {
+	if n < 1 {
+		n = 1
+	}
+	result := make(geom.Polyline, n+1)
+	for i := range result {
+		result[i] = c.PointAt(float64(i) / float64(n))
+	}
+	return result
+}
+
+// Improves t, an estimate of the parameter of the point on the curve nearest
+// to pt, with a step of Newton's method.
+func (c *CubicBezier) newtonStep(pt geom.Point, t float64) float64 {
+	q := c.PointAt(t).Minus(pt)
+	d1, d2 := c.derivatives(t)
+	numerator := q.DotProduct(d1)
+	denominator := d1.DotProduct(d1) + q.DotProduct(d2)
+	if denominator == 0 {
+		return t
+	}
+	return math.Max(0, math.Min(1, t-numerator/denominator))
+}
+
+// A cubic Bezier curve fitted to points, with the parameter of the nearest
+// point on the curve, and the final robust weight, of each point.
+type BezierFit struct {
+	Curve   CubicBezier
+	Params  []float64
+	Weights []float64
+	FitDiagnostics
+}
+
+// Options for FitCubicBezier.
+type BezierFitter struct {
+	// If true, the curve starts and ends at the first and last points (e.g.
+	// vertices of a path); otherwise they're fitted too.
+	FixEndpoints bool
+	// Number of rounds of re-estimating the parameters of the points and
+	// refitting; defaults to 10.
+	Rounds int
+	// If not nil, the points are reweighted after each round, as for
+	// IRLSFitter (with the scale estimated from the median residual).
+	Weight RobustWeightFunc
+}
+
+// Initial parameters, proportional to the distance along the polyline
+// through the points (chord length parameterization).
+func chordLengthParams(data stats.Data2DSource) []float64 {
+	n := data.Len()
+	params := make([]float64, n)
+	for i := 1; i < n; i++ {
+		params[i] = params[i-1] + math.Hypot(
+			data.X(i)-data.X(i-1), data.Y(i)-data.Y(i-1))
+	}
+	if total := params[n-1]; total > 0 {
+		for i := range params {
+			params[i] /= total
+		}
+	}
+	return params
+}
+
+// Solves the linear system a·x = b (a is n by n) by Gaussian elimination with
+// partial pivoting; a and b are modified.
+func solveLinearSystem(a [][]float64, b []float64) ([]float64, error) {
+	n := len(b)
+	for col := 0; col < n; col++ {
+		pivot := col
+		for row := col + 1; row < n; row++ {
+			if math.Abs(a[row][col]) > math.Abs(a[pivot][col]) {
+				pivot = row
+			}
+		}
+		if a[pivot][col] == 0 {
+			return nil, fmt.Errorf("singular system")
+		}
+		a[col], a[pivot] = a[pivot], a[col]
+		b[col], b[pivot] = b[pivot], b[col]
+		for row := col + 1; row < n; row++ {
+			f := a[row][col] / a[col][col]
+			for k := col; k < n; k++ {
+				a[row][k] -= f * a[col][k]
+			}
+			b[row] -= f * b[col]
+		}
+	}
+	x := make([]float64, n)
+	for row := n - 1; row >= 0; row-- {
+		sum := b[row]
+		for k := row + 1; k < n; k++ {
+			sum -= a[row][k] * x[k]
+		}
+		x[row] = sum / a[row][row]
+	}
+	return x, nil
+}
+
+// Weighted least squares estimate of the control points, given the
+// parameters of the points.
+func (p *BezierFitter) solveControlPoints(
+	data stats.Data2DSource, params, weights []float64,
+	curve *CubicBezier) error {
+	// The unknowns are the control points free to move: all 4, or just P[1]
+	// and P[2]. The x and y coordinates are independent, sharing the matrix.
+	first, last := 0, 3
+	if p.FixEndpoints {
+		first, last = 1, 2
+	}
+	m := last - first + 1
+	a := make([][]float64, m)
+	for i := range a {
+		a[i] = make([]float64, m)
+	}
+	bx := make([]float64, m)
+	by := make([]float64, m)
+	for n, t := range params {
+		w := data.Weight(n) * weights[n]
+		if !(w > 0) {
+			continue
+		}
+		basis := bernstein3(t)
+		x, y := data.X(n), data.Y(n)
+		for k := 0; k < 4; k++ {
+			if k < first || k > last {
+				// A fixed control point; move its contribution to the right side.
+				x -= basis[k] * curve.P[k].X
+				y -= basis[k] * curve.P[k].Y
+			}
+		}
+		for i := first; i <= last; i++ {
+			for j := first; j <= last; j++ {
+				a[i-first][j-first] += w * basis[i] * basis[j]
+			}
+			bx[i-first] += w * basis[i] * x
+			by[i-first] += w * basis[i] * y
+		}
+	}
+	ay := make([][]float64, m)
+	for i := range a {
+		ay[i] = append([]float64(nil), a[i]...)
+	}
+	xs, err := solveLinearSystem(a, bx)
+	if err != nil {
+		return err
+	}
+	ys, err := solveLinearSystem(ay, by)
+	if err != nil {
+		return err
+	}
+	for i := first; i <= last; i++ {
+		curve.P[i] = geom.Point{X: xs[i-first], Y: ys[i-first]}
+	}
+	return nil
+}
+
+// FitCubicBezier fits a cubic Bezier curve to the points, which must be in
+// order along the curve. At least 4 points are required, even with
+// FixEndpoints: the endpoints don't constrain the inner control points, so
+// there must be at least 2 other points.
+func (p *BezierFitter) FitCubicBezier(data stats.Data2DSource) (*BezierFit, error) {
+	n := data.Len()
+	if n < 4 {
+		return nil, fmt.Errorf("not enough points: %d", n)
+	}
+	rounds := p.Rounds
+	if rounds <= 0 {
+		rounds = 10
+	}
+	fit := &BezierFit{Params: chordLengthParams(data), Weights: make([]float64, n)}
+	for i := range fit.Weights {
+		fit.Weights[i] = 1
+	}
+	curve := &fit.Curve
+	curve.P[0] = geom.Point{X: data.X(0), Y: data.Y(0)}
+	curve.P[3] = geom.Point{X: data.X(n - 1), Y: data.Y(n - 1)}
+	residuals := make([]float64, n)
+	prevRMS := math.Inf(1)
+	for round := 1; round <= rounds; round++ {
+		if err := p.solveControlPoints(data, fit.Params, fit.Weights, curve); err != nil {
+			return nil, err
+		}
+		for i := range fit.Params {
+			pt := geom.Point{X: data.X(i), Y: data.Y(i)}
+			fit.Params[i] = curve.newtonStep(pt, fit.Params[i])
+			residuals[i] = curve.PointAt(fit.Params[i]).Distance(pt)
+		}
+		if p.Weight != nil {
+			scale := medianResidual(data, residuals) / 0.6745
+			if scale > 0 {
+				for i, r := range residuals {
+					fit.Weights[i] = p.Weight(r / scale)
+				}
+			}
+		}
+		d := computeDiagnostics(data, residuals, fit.Weights)
+		fit.FitDiagnostics = d
+		fit.Iterations = round
+		if math.Abs(prevRMS-d.RMSResidual) <= 1e-9*(1+d.RMSResidual) {
+			fit.Converged = true
+			break
+		}
+		prevRMS = d.RMSResidual
+	}
+	return fit, nil
+}
+
+// FitCubicBezier fits a cubic Bezier curve to the points, which must be in
+// order along the curve, without robust reweighting.
+func FitCubicBezier(data stats.Data2DSource, fixEndpoints bool) (*BezierFit, error) {
+	return (&BezierFitter{FixEndpoints: fixEndpoints}).FitCubicBezier(data)
+}
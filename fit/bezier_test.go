@@ -0,0 +1,111 @@
+package fit
+
+import (
+	"math"
+	"testing"
+
+	"github.com/jamessynge/transit_tools/geom"
+)
+
+// Points along a quarter circle of radius 100 (a bend in a road), in order.
+func quarterCircle(n int, errorStdDev float64) geom.PointSlice {
+	var points geom.PointSlice
+	for i := 0; i < n; i++ {
+		a := float64(i) / float64(n-1) * math.Pi / 2
+		r := 100 + rng.NormFloat64()*errorStdDev
+		points = append(points, geom.Point{X: r * math.Cos(a), Y: r * math.Sin(a)})
+	}
+	return points
+}
+
+func TestCubicBezier(t *testing.T) {
+	c := CubicBezier{P: [4]geom.Point{{X: 0, Y: 0}, {X: 0, Y: 1}, {X: 1, Y: 1}, {X: 1, Y: 0}}}
+	if pt := c.PointAt(0.5); pt != (geom.Point{X: 0.5, Y: 0.75}) {
+		t.Errorf("PointAt(0.5) = %v", pt)
+	}
+	if d := c.DirectionAt(0); math.Abs(d-math.Pi/2) > 1e-12 {
+		t.Errorf("DirectionAt(0) = %v", d)
+	}
+	if d := c.DirectionAt(0.5); math.Abs(d) > 1e-12 {
+		t.Errorf("DirectionAt(0.5) = %v", d)
+	}
+	pl := c.ToPolyline(4)
+	if len(pl) != 5 || pl[0] != c.P[0] || pl[4] != c.P[3] || pl[2] != c.PointAt(0.5) {
+		t.Errorf("ToPolyline(4) = %v", pl)
+	}
+}
+
+func TestFitCubicBezier(t *testing.T) {
+	// A cubic Bezier approximates a quarter circle to within 0.1%.
+	points := quarterCircle(50, 0)
+	for _, fixEnds := range []bool{false, true} {
+		fit, err := FitCubicBezier(points, fixEnds)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fit.RMSResidual > 0.1 || fit.MaxResidual > 0.15 || fit.RSquared < 0.9999 {
+			t.Errorf("fixEnds %v: diagnostics %v", fixEnds, &fit.FitDiagnostics)
+		}
+		if fixEnds && (fit.Curve.P[0] != points[0] || fit.Curve.P[3] != points[49]) {
+			t.Errorf("Endpoints moved: %v", fit.Curve)
+		}
+		// The control points of the standard approximation are 55.2 along the
+		// tangents at the ends.
+		if c := fit.Curve.P[1]; math.Abs(c.X-100) > 1 || math.Abs(c.Y-55.2) > 1 {
+			t.Errorf("fixEnds %v: P[1] = %v", fixEnds, c)
+		}
+		for i := 1; i < len(fit.Params); i++ {
+			if fit.Params[i] < fit.Params[i-1] {
+				t.Errorf("Params not increasing: %v", fit.Params)
+				break
+			}
+		}
+	}
+
+	// A line doesn't fit the bend nearly as well.
+	lf, err := OrthogonalFitter{}.FitLine(points)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lf.RMSResidual < 5 {
+		t.Errorf("Line diagnostics %v", &lf.FitDiagnostics)
+	}
+
+	for _, fixEnds := range []bool{false, true} {
+		for n := 0; n < 4; n++ {
+			if _, err := FitCubicBezier(points[:n], fixEnds); err == nil {
+				t.Errorf("fixEnds %v: expected an error for %d points", fixEnds, n)
+			}
+		}
+		if _, err := FitCubicBezier(points[:4], fixEnds); err != nil {
+			t.Errorf("fixEnds %v: error for 4 points: %v", fixEnds, err)
+		}
+	}
+}
+
+func TestFitCubicBezierRobust(t *testing.T) {
+	points := quarterCircle(100, 1)
+	// GPS glitches, well off the bend.
+	for _, i := range []int{10, 30, 50, 70, 90} {
+		points[i].X += 40
+		points[i].Y += 40
+	}
+	plain, err := FitCubicBezier(points, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	robust, err := (&BezierFitter{
+		FixEndpoints: true, Weight: TukeyWeight(DefaultTukeyC)}).FitCubicBezier(points)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if robust.Inliers > 95 || robust.RMSResidual > 1.5 ||
+		robust.RMSResidual >= plain.RMSResidual {
+		t.Errorf("robust %v\nplain %v", &robust.FitDiagnostics, &plain.FitDiagnostics)
+	}
+	for _, i := range []int{10, 30, 50, 70, 90} {
+		if robust.Weights[i] != 0 {
+			t.Errorf("Outlier %d has weight %v", i, robust.Weights[i])
+		}
+	}
+}
@@ -0,0 +1,424 @@
+package fit
+
+// Robust fitting of lines to points, for data with outliers (e.g. GPS
+// glitches, or reports from vehicles on another route): RANSAC, and
+// iteratively reweighted orthogonal regression with Huber or Tukey weights.
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+
+	"github.com/jamessynge/transit_tools/geom"
+	"github.com/jamessynge/transit_tools/stats"
+)
+
+// Goodness-of-fit diagnostics. Residuals are the orthogonal distances from
+// the points to the fitted line or curve.
+type FitDiagnostics struct {
+	// Number of points with positive weight in the source data.
+	N int
+	// Number of those points used in the final fit (those with a positive
+	// robust weight, or within the RANSAC threshold).
+	Inliers int
+	// Sum of the final weights (source weight times robust weight).
+	WSum float64
+	// Weighted root mean square of the residuals of the inliers.
+	RMSResidual float64
+	// Largest residual of an inlier.
+	MaxResidual float64
+	// Median (unweighted) of the residuals of all N points; unlike the
+	// above, this reflects the outliers, but not unless they are common.
+	MedianResidual float64
+	// Fraction of the (weighted) variance of the inliers about their centroid
+	// which is explained by the fit; 1 is a perfect fit.
+	RSquared float64
+	// Number of iterations (reweightings or RANSAC samples) performed, and
+	// whether the fit converged before the iteration limit.
+	Iterations int
+	Converged  bool
+}
+
+func (d *FitDiagnostics) String() string {
+	return fmt.Sprintf(
+		"{N: %d; Inliers: %d; RMS: %.3g; Max: %.3g; Median: %.3g; R²: %.4f; Iterations: %d}",
+		d.N, d.Inliers, d.RMSResidual, d.MaxResidual, d.MedianResidual,
+		d.RSquared, d.Iterations)
+}
+
+// A line fitted to points, with the final robust weight (in [0, 1]) of each
+// point.
+type LineFit struct {
+	Line    *geom.TwoPointLine
+	Weights []float64
+	FitDiagnostics
+}
+
+// A method of fitting a line to weighted points.
+type LineFitter interface {
+	FitLine(data stats.Data2DSource) (*LineFit, error)
+}
+
+// A Data2DSource whose weights are those of another source multiplied by
+// robust weights.
+type reweightedSource struct {
+	stats.Data2DSource
+	weights []float64
+}
+
+func (p *reweightedSource) Weight(n int) float64 {
+	return p.Data2DSource.Weight(n) * p.weights[n]
+}
+
+func lineResidual(line *geom.TwoPointLine, data stats.Data2DSource, n int) float64 {
+	pt := geom.Point{X: data.X(n), Y: data.Y(n)}
+	return line.NearestPointTo(pt).Distance(pt)
+}
+
+func lineResiduals(line *geom.TwoPointLine, data stats.Data2DSource) []float64 {
+	residuals := make([]float64, data.Len())
+	for n := range residuals {
+		residuals[n] = lineResidual(line, data, n)
+	}
+	return residuals
+}
+
+// Weighted orthogonal regression of the points with positive robust weight.
+func fitLineWithWeights(
+	data stats.Data2DSource, weights []float64) (*geom.TwoPointLine, error) {
+	d2s := &reweightedSource{data, weights}
+	statistics := stats.ComputeData2DStats(d2s)
+	if !(statistics.WSum > 0) {
+		return nil, fmt.Errorf("no points with positive weight")
+	}
+	return OrthoRegrFitLineToStats(statistics)
+}
+
+// Median of the residuals of the points with positive weight in the source.
+func medianResidual(data stats.Data2DSource, residuals []float64) float64 {
+	var values []float64
+	for n, r := range residuals {
+		if data.Weight(n) > 0 {
+			values = append(values, r)
+		}
+	}
+	if len(values) == 0 {
+		return 0
+	}
+	lf := func() int { return len(values) }
+	vf := func(n int) float64 { return values[n] }
+	wf := func(n int) float64 { return 1 }
+	median, _ := stats.Data1DWeightedMedian(
+		&stats.Data1DSourceDelegate{L: lf, V: vf, W: wf})
+	return median
+}
+
+// computeDiagnostics fills in the diagnostics other than Iterations and
+// Converged, given the residuals and robust weights of the points.
+func computeDiagnostics(
+	data stats.Data2DSource, residuals, weights []float64) (d FitDiagnostics) {
+	d2s := &reweightedSource{data, weights}
+	var sumWRR stats.KahanSum
+	for n, r := range residuals {
+		if data.Weight(n) > 0 {
+			d.N++
+		}
+		w := d2s.Weight(n)
+		if !(w > 0) {
+			continue
+		}
+		d.Inliers++
+		d.WSum += w
+		sumWRR.Add(w * r * r)
+		if r > d.MaxResidual {
+			d.MaxResidual = r
+		}
+	}
+	d.MedianResidual = medianResidual(data, residuals)
+	if d.WSum > 0 {
+		meanSquare := sumWRR.Sum / d.WSum
+		d.RMSResidual = math.Sqrt(meanSquare)
+		statistics := stats.ComputeData2DStats(d2s)
+		if total := statistics.XVariance + statistics.YVariance; total > 0 {
+			d.RSquared = 1 - meanSquare/total
+		} else {
+			d.RSquared = 1
+		}
+	}
+	return
+}
+
+// ComputeLineFitDiagnostics returns the diagnostics of a line fitted (by any
+// method, e.g. FitLineToPointsOR) to all of the points.
+func ComputeLineFitDiagnostics(
+	data stats.Data2DSource, line *geom.TwoPointLine) FitDiagnostics {
+	weights := make([]float64, data.Len())
+	for n := range weights {
+		weights[n] = 1
+	}
+	d := computeDiagnostics(data, lineResiduals(line, data), weights)
+	d.Converged = true
+	return d
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Ordinary (non-robust) orthogonal regression; see FitLineToPointsOR.
+type OrthogonalFitter struct{}
+
+func (OrthogonalFitter) FitLine(data stats.Data2DSource) (*LineFit, error) {
+	line, err := FitLineToPointsOR(data)
+	if err != nil {
+		return nil, err
+	}
+	weights := make([]float64, data.Len())
+	for n := range weights {
+		weights[n] = 1
+	}
+	fit := &LineFit{Line: line, Weights: weights}
+	fit.FitDiagnostics = ComputeLineFitDiagnostics(data, line)
+	return fit, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// RANSAC (RANdom SAmple Consensus): repeatedly picks two points at random,
+// and counts the (weight of the) points within Threshold of the line through
+// them. The line with the most support is refined by orthogonal regression
+// of its inliers. Unlike regression, it tolerates a majority of outliers.
+type RANSACFitter struct {
+	// Points within this distance of a candidate line are inliers. Required.
+	Threshold float64
+	// Number of random samples; defaults to 200.
+	Iterations int
+	// Seed for the random number generator, so that results are repeatable.
+	Seed int64
+}
+
+func NewRANSACFitter(threshold float64) *RANSACFitter {
+	return &RANSACFitter{Threshold: threshold, Iterations: 200, Seed: 1}
+}
+
+func (p *RANSACFitter) inlierWeights(
+	line *geom.TwoPointLine, data stats.Data2DSource) (
+	residuals, weights []float64, support float64) {
+	residuals = lineResiduals(line, data)
+	weights = make([]float64, len(residuals))
+	for n, r := range residuals {
+		if r <= p.Threshold {
+			weights[n] = 1
+			support += data.Weight(n)
+		}
+	}
+	return
+}
+
+func (p *RANSACFitter) FitLine(data stats.Data2DSource) (*LineFit, error) {
+	if !(p.Threshold > 0) {
+		return nil, fmt.Errorf("RANSAC threshold must be positive: %v", p.Threshold)
+	}
+	var candidates []int
+	for n, limit := 0, data.Len(); n < limit; n++ {
+		if data.Weight(n) > 0 {
+			candidates = append(candidates, n)
+		}
+	}
+	if len(candidates) < 2 {
+		return nil, fmt.Errorf("not enough points: %d", len(candidates))
+	}
+	iterations := p.Iterations
+	if iterations <= 0 {
+		iterations = 200
+	}
+	rng := rand.New(rand.NewSource(p.Seed))
+	var best *geom.TwoPointLine
+	bestSupport := 0.0
+	samples := 0
+	for samples < iterations {
+		samples++
+		i := candidates[rng.Intn(len(candidates))]
+		j := candidates[rng.Intn(len(candidates))]
+		pt1 := geom.Point{X: data.X(i), Y: data.Y(i)}
+		pt2 := geom.Point{X: data.X(j), Y: data.Y(j)}
+		if pt1 == pt2 {
+			continue
+		}
+		line := geom.LineFromTwoPoints(pt1, pt2)
+		if _, _, support := p.inlierWeights(line, data); support > bestSupport {
+			best, bestSupport = line, support
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("all sampled points are coincident")
+	}
+
+	// Refine with orthogonal regression of the inliers, until the set of
+	// inliers no longer grows.
+	residuals, weights, support := p.inlierWeights(best, data)
+	for round := 0; round < 10; round++ {
+		line, err := fitLineWithWeights(data, weights)
+		if err != nil {
+			break
+		}
+		r, w, s := p.inlierWeights(line, data)
+		if s < support {
+			break
+		}
+		best, residuals, weights = line, r, w
+		if s == support {
+			break
+		}
+		support = s
+	}
+	fit := &LineFit{Line: best, Weights: weights}
+	fit.FitDiagnostics = computeDiagnostics(data, residuals, weights)
+	fit.Iterations = samples
+	fit.Converged = true
+	return fit, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Returns the robust weight, in [0, 1], of a point whose residual is u
+// times the scale of the residuals.
+type RobustWeightFunc func(u float64) float64
+
+// Tuning constants giving 95% efficiency for normally distributed errors.
+const (
+	DefaultHuberK = 1.345
+	DefaultTukeyC = 4.685
+)
+
+// Huber weights: 1 for residuals within k scales, then decreasing as k/|u|;
+// outliers keep some influence, so the fit converges to a unique solution.
+func HuberWeight(k float64) RobustWeightFunc {
+	return func(u float64) float64 {
+		if u = math.Abs(u); u <= k {
+			return 1
+		}
+		return k / u
+	}
+}
+
+// Tukey's biweight (bisquare): smoothly decreasing to zero at c scales;
+// points further away are ignored entirely. Needs a good initial fit.
+func TukeyWeight(c float64) RobustWeightFunc {
+	return func(u float64) float64 {
+		if u = math.Abs(u); u >= c {
+			return 0
+		}
+		v := u / c
+		v = 1 - v*v
+		return v * v
+	}
+}
+
+// Iteratively reweighted orthogonal regression: starting from an initial fit,
+// repeatedly weights each point (in addition to its weight in the source) by
+// the robust weight of its residual, and refits.
+type IRLSFitter struct {
+	Weight RobustWeightFunc
+	// Scale of the residuals (e.g. the expected GPS error, in meters). If
+	// zero, estimated in each iteration from the median absolute residual
+	// (MAD / 0.6745, which is the standard deviation for normal errors).
+	Scale float64
+	// Provides the initial fit; defaults to orthogonal regression. For Tukey
+	// weights, a RANSACFitter is a good choice if there are many outliers.
+	Initial LineFitter
+	// Defaults to 50.
+	MaxIterations int
+	// Stop when no robust weight changes by more than this; defaults to 1e-6.
+	Tolerance float64
+}
+
+func NewHuberFitter() *IRLSFitter {
+	return &IRLSFitter{Weight: HuberWeight(DefaultHuberK)}
+}
+
+// Tukey weights, starting from a Huber fit.
+func NewTukeyFitter() *IRLSFitter {
+	return &IRLSFitter{Weight: TukeyWeight(DefaultTukeyC), Initial: NewHuberFitter()}
+}
+
+func (p *IRLSFitter) scale(data stats.Data2DSource, residuals []float64) float64 {
+	if p.Scale > 0 {
+		return p.Scale
+	}
+	return medianResidual(data, residuals) / 0.6745
+}
+
+func (p *IRLSFitter) FitLine(data stats.Data2DSource) (*LineFit, error) {
+	if p.Weight == nil {
+		return nil, fmt.Errorf("IRLSFitter has no weight function")
+	}
+	initial := p.Initial
+	if initial == nil {
+		initial = OrthogonalFitter{}
+	}
+	fit, err := initial.FitLine(data)
+	if err != nil {
+		return nil, err
+	}
+	line := fit.Line
+	maxIterations := p.MaxIterations
+	if maxIterations <= 0 {
+		maxIterations = 50
+	}
+	tolerance := p.Tolerance
+	if tolerance <= 0 {
+		tolerance = 1e-6
+	}
+
+	residuals := lineResiduals(line, data)
+	weights := make([]float64, len(residuals))
+	iterations := 0
+	converged := false
+	for iterations < maxIterations {
+		scale := p.scale(data, residuals)
+		if !(scale > 0) {
+			// Most points are exactly on the line; treat those which aren't (allowing
+			// for rounding) as outliers.
+			statistics := stats.ComputeData2DStats(data)
+			epsilon := 1e-12 * (statistics.XStdDev + statistics.YStdDev)
+			for n, r := range residuals {
+				weights[n] = 0
+				if r <= epsilon {
+					weights[n] = 1
+				}
+			}
+			converged = true
+			break
+		}
+		maxChange := 0.0
+		for n, r := range residuals {
+			w := p.Weight(r / scale)
+			maxChange = math.Max(maxChange, math.Abs(w-weights[n]))
+			weights[n] = w
+		}
+		if iterations > 0 && maxChange <= tolerance {
+			converged = true
+			break
+		}
+		iterations++
+		next, err := fitLineWithWeights(data, weights)
+		if err != nil {
+			return nil, err
+		}
+		line = next
+		residuals = lineResiduals(line, data)
+	}
+	if !converged {
+		// The line was refit with the weights of the previous line's residuals;
+		// reweight, so that the weights and diagnostics are those of the line.
+		if scale := p.scale(data, residuals); scale > 0 {
+			for n, r := range residuals {
+				weights[n] = p.Weight(r / scale)
+			}
+		}
+	}
+	result := &LineFit{Line: line, Weights: weights}
+	result.FitDiagnostics = computeDiagnostics(data, residuals, weights)
+	result.Iterations = iterations
+	result.Converged = converged
+	return result, nil
+}
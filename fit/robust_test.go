@@ -0,0 +1,189 @@
+package fit
+
+import (
+	"math"
+	"testing"
+
+	"github.com/jamessynge/transit_tools/geom"
+)
+
+// Points along a line at the given angle (degrees) through (100, 200), with
+// normally distributed errors, plus outliers far from the line.
+func createPointsWithOutliers(
+	angle float64, n int, errorStdDev float64, numOutliers int) geom.PointSlice {
+	radians := angle * math.Pi / 180
+	cos, sin := math.Cos(radians), math.Sin(radians)
+	var points geom.PointSlice
+	for i := 0; i < n; i++ {
+		u := (rng.Float64() - 0.5) * 200
+		e := rng.NormFloat64() * errorStdDev
+		points = append(points, geom.Point{
+			X: 100 + u*cos - e*sin,
+			Y: 200 + u*sin + e*cos,
+		})
+	}
+	for i := 0; i < numOutliers; i++ {
+		// Offset perpendicular to the line, by 30 to 80.
+		u := (rng.Float64() - 0.5) * 200
+		e := 30 + rng.Float64()*50
+		points = append(points, geom.Point{
+			X: 100 + u*cos - e*sin,
+			Y: 200 + u*sin + e*cos,
+		})
+	}
+	return points
+}
+
+func angleError(line *geom.TwoPointLine, angle float64) float64 {
+	delta := math.Mod(line.Angle()*180/math.Pi-angle+360, 180)
+	return math.Min(delta, 180-delta)
+}
+
+func TestRobustLineFitters(t *testing.T) {
+	fitters := []struct {
+		name         string
+		fitter       LineFitter
+		maxAngleErr  float64
+		wantOutliers bool // Expect the outliers to be excluded.
+	}{
+		{"huber", NewHuberFitter(), 2, false},
+		{"tukey", NewTukeyFitter(), 0.5, true},
+		{"ransac", NewRANSACFitter(5), 0.5, true},
+		{"tukey+ransac", &IRLSFitter{
+			Weight: TukeyWeight(DefaultTukeyC), Initial: NewRANSACFitter(5)}, 0.5, true},
+	}
+	for _, angle := range []float64{0, 30, 89, 135} {
+		points := createPointsWithOutliers(angle, 200, 1, 40)
+
+		// Plain orthogonal regression is pulled well off by the outliers.
+		or, err := OrthogonalFitter{}.FitLine(points)
+		if err != nil {
+			t.Fatal(err)
+		}
+		offset := or.Line.NearestPointTo(geom.Point{X: 100, Y: 200}).Distance(
+			geom.Point{X: 100, Y: 200})
+		if offset < 3 {
+			t.Errorf("angle %v: expected outliers to affect OR fit; offset %v", angle, offset)
+		}
+
+		for _, f := range fitters {
+			fit, err := f.fitter.FitLine(points)
+			if err != nil {
+				t.Errorf("%s, angle %v: %v", f.name, angle, err)
+				continue
+			}
+			if e := angleError(fit.Line, angle); e > f.maxAngleErr {
+				t.Errorf("%s, angle %v: angle error %v; %v", f.name, angle, e, &fit.FitDiagnostics)
+			}
+			center := geom.Point{X: 100, Y: 200}
+			if d := fit.Line.NearestPointTo(center).Distance(center); d > 1 {
+				t.Errorf("%s, angle %v: line is %v from the center", f.name, angle, d)
+			}
+			if fit.N != 240 || len(fit.Weights) != 240 || !fit.Converged {
+				t.Errorf("%s, angle %v: diagnostics %v", f.name, angle, &fit.FitDiagnostics)
+			}
+			if f.wantOutliers {
+				if fit.Inliers < 190 || fit.Inliers > 200 {
+					t.Errorf("%s, angle %v: %d inliers", f.name, angle, fit.Inliers)
+				}
+				for i := 200; i < 240; i++ {
+					if fit.Weights[i] != 0 {
+						t.Errorf("%s, angle %v: outlier %d has weight %v",
+							f.name, angle, i, fit.Weights[i])
+						break
+					}
+				}
+				if fit.RMSResidual > 1.2 || fit.MaxResidual > 5 || fit.RSquared < 0.999 {
+					t.Errorf("%s, angle %v: diagnostics %v", f.name, angle, &fit.FitDiagnostics)
+				}
+			}
+			if fit.MedianResidual > 1.5 {
+				t.Errorf("%s, angle %v: diagnostics %v", f.name, angle, &fit.FitDiagnostics)
+			}
+		}
+	}
+}
+
+func TestRobustLineFitterErrors(t *testing.T) {
+	one := geom.PointSlice{{X: 1, Y: 1}}
+	same := geom.PointSlice{{X: 1, Y: 1}, {X: 1, Y: 1}, {X: 1, Y: 1}}
+	for _, fitter := range []LineFitter{
+		OrthogonalFitter{}, NewHuberFitter(), NewTukeyFitter(), NewRANSACFitter(1),
+	} {
+		if _, err := fitter.FitLine(one); err == nil {
+			t.Errorf("%T: expected an error for one point", fitter)
+		}
+	}
+	if _, err := NewRANSACFitter(1).FitLine(same); err == nil {
+		t.Errorf("Expected an error for coincident points")
+	}
+	if _, err := (&RANSACFitter{}).FitLine(same); err == nil {
+		t.Errorf("Expected an error for a zero threshold")
+	}
+	if _, err := (&IRLSFitter{}).FitLine(same); err == nil {
+		t.Errorf("Expected an error for a missing weight function")
+	}
+}
+
+func TestIRLSExactFit(t *testing.T) {
+	// Most points exactly on the line y = 2x + 1, so the scale is zero.
+	var points geom.PointSlice
+	for i := 0; i < 10; i++ {
+		points = append(points, geom.Point{X: float64(i), Y: float64(2*i + 1)})
+	}
+	points = append(points, geom.Point{X: 3, Y: 20})
+	fit, err := (&IRLSFitter{
+		Weight: TukeyWeight(DefaultTukeyC), Initial: NewRANSACFitter(0.1)}).FitLine(points)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fit.Inliers != 10 || fit.Weights[10] != 0 || fit.RMSResidual > 1e-9 {
+		t.Errorf("Diagnostics %v, weights %v", &fit.FitDiagnostics, fit.Weights)
+	}
+}
+
+func TestIRLSNotConverged(t *testing.T) {
+	points := createPointsWithOutliers(30, 200, 1, 40)
+	fitter := &IRLSFitter{Weight: TukeyWeight(DefaultTukeyC), MaxIterations: 1}
+	fit, err := fitter.FitLine(points)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fit.Converged || fit.Iterations != 1 {
+		t.Fatalf("Expected one iteration without converging: %v", &fit.FitDiagnostics)
+	}
+	// The weights and diagnostics are those of the returned line.
+	residuals := lineResiduals(fit.Line, points)
+	scale := medianResidual(points, residuals) / 0.6745
+	for n, r := range residuals {
+		if w := fitter.Weight(r / scale); w != fit.Weights[n] {
+			t.Fatalf("Weight %d is %v, expected %v", n, fit.Weights[n], w)
+		}
+	}
+	want := computeDiagnostics(points, residuals, fit.Weights)
+	if fit.RMSResidual != want.RMSResidual || fit.Inliers != want.Inliers {
+		t.Errorf("Diagnostics %v, expected %v", &fit.FitDiagnostics, &want)
+	}
+}
+
+func TestWeightFunctions(t *testing.T) {
+	huber := HuberWeight(2)
+	tukey := TukeyWeight(4)
+	tests := []struct {
+		u, huber, tukey float64
+	}{
+		{0, 1, 1},
+		{1, 1, 0.87890625},
+		{-2, 1, 0.5625},
+		{4, 0.5, 0},
+		{-8, 0.25, 0},
+	}
+	for _, test := range tests {
+		if h := huber(test.u); h != test.huber {
+			t.Errorf("huber(%v) = %v, expected %v", test.u, h, test.huber)
+		}
+		if w := tukey(test.u); math.Abs(w-test.tukey) > 1e-12 {
+			t.Errorf("tukey(%v) = %v, expected %v", test.u, w, test.tukey)
+		}
+	}
+}
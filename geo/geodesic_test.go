@@ -0,0 +1,204 @@
+package geo
+
+import (
+	"math"
+	"testing"
+)
+
+func dms(degrees, minutes, seconds float64) float64 {
+	if degrees < 0 {
+		return degrees - minutes/60 - seconds/3600
+	}
+	return degrees + minutes/60 + seconds/3600
+}
+
+func headingDiff(a, b HeadingF) float64 {
+	d := math.Abs(float64(a - b))
+	if d > 180 {
+		d = 360 - d
+	}
+	return d
+}
+
+// Test vectors from published references.
+var geodesicTests = []struct {
+	name           string
+	model          *EllipsoidalModel
+	loc1, loc2     Location
+	distance       Meters
+	initialHeading HeadingF
+	finalHeading   HeadingF
+}{
+	// Geoscience Australia's example, as used by
+	// http://www.movable-type.co.uk/scripts/latlong-vincenty.html (the
+	// final heading is the published reverse azimuth less 180°).
+	{
+		"Flinders Peak -> Buninyong",
+		WGS84.(*EllipsoidalModel),
+		Location{Latitude(dms(-37, 57, 3.72030)), Longitude(dms(144, 25, 29.52440))},
+		Location{Latitude(dms(-37, 39, 10.15610)), Longitude(dms(143, 55, 35.38390))},
+		54972.271,
+		HeadingF(dms(306, 52, 5.37)),
+		HeadingF(dms(307, 10, 25.07)),
+	},
+	// Lines (a), (b) and (c) of Vincenty (1975), table I.
+	{
+		"Vincenty (a), Bessel",
+		&EllipsoidalModel{A: 6377397.155, F: 1 / 299.1528128},
+		Location{Latitude(dms(55, 45, 0)), 0},
+		Location{Latitude(dms(-33, 26, 0)), Longitude(dms(108, 13, 0))},
+		14110526.170,
+		HeadingF(dms(96, 36, 8.79960)),
+		HeadingF(dms(137, 52, 22.01454)),
+	},
+	{
+		"Vincenty (b), International",
+		&EllipsoidalModel{A: 6378388, F: 1.0 / 297},
+		Location{Latitude(dms(37, 19, 54.95367)), 0},
+		Location{Latitude(dms(26, 7, 42.83946)), Longitude(dms(41, 28, 35.50729))},
+		4085966.703,
+		HeadingF(dms(95, 27, 59.63089)),
+		HeadingF(dms(118, 5, 58.96161)),
+	},
+	{
+		"Vincenty (c), International",
+		&EllipsoidalModel{A: 6378388, F: 1.0 / 297},
+		Location{Latitude(dms(35, 16, 11.24862)), 0},
+		Location{Latitude(dms(67, 22, 14.77638)), Longitude(dms(137, 47, 28.31435))},
+		8084823.839,
+		HeadingF(dms(15, 44, 23.74850)),
+		HeadingF(dms(144, 55, 39.92147)),
+	},
+}
+
+func TestEllipsoidalInverse(t *testing.T) {
+	for _, test := range geodesicTests {
+		d, h1, h2, ok := test.model.Inverse(test.loc1, test.loc2)
+		if !ok {
+			t.Errorf("%s: didn't converge", test.name)
+			continue
+		}
+		if math.Abs(float64(d-test.distance)) > 0.001 {
+			t.Errorf("%s: distance %.4f, expected %.3f", test.name, d, test.distance)
+		}
+		// Published headings are to 0.01" (about 3e-6°) or better.
+		if headingDiff(h1, test.initialHeading) > 3e-6 {
+			t.Errorf("%s: initial heading %.7f, expected %.7f",
+				test.name, h1, test.initialHeading)
+		}
+		if headingDiff(h2, test.finalHeading) > 3e-6 {
+			t.Errorf("%s: final heading %.7f, expected %.7f",
+				test.name, h2, test.finalHeading)
+		}
+	}
+}
+
+func TestEllipsoidalDirect(t *testing.T) {
+	for _, test := range geodesicTests {
+		loc, h2 := test.model.Direct(test.loc1, test.distance, test.initialHeading)
+		// 1e-8° is about 1mm.
+		if math.Abs(float64(loc.Lat-test.loc2.Lat)) > 1e-8 ||
+			math.Abs(float64(loc.Lon-test.loc2.Lon)) > 1e-8 {
+			t.Errorf("%s: destination %.9f, %.9f, expected %.9f, %.9f", test.name,
+				loc.Lat, loc.Lon, test.loc2.Lat, test.loc2.Lon)
+		}
+		if headingDiff(h2, test.finalHeading) > 3e-6 {
+			t.Errorf("%s: final heading %.7f, expected %.7f",
+				test.name, h2, test.finalHeading)
+		}
+	}
+}
+
+func TestEllipsoidalSpecialCases(t *testing.T) {
+	m := WGS84
+	loc := Location{42.35, -71.06}
+	if d, h := m.DistanceAndHeading(loc, loc); d != 0 || h != 0 {
+		t.Errorf("Coincident points: %v, %v", d, h)
+	}
+	// Along the equator; a quarter of the circumference.
+	d, h := m.DistanceAndHeading(Location{0, 0}, Location{0, 90})
+	expected := math.Pi / 2 * float64(EarthRadiusAtEquator)
+	if math.Abs(float64(d)-expected) > 0.001 || h != 90 {
+		t.Errorf("Equator: %v, %v, expected %v", d, h, expected)
+	}
+	// Pole to pole, along a meridian (from the WGS 84 meridian arc length).
+	d, h = m.DistanceAndHeading(Location{-90, 0}, Location{90, 0})
+	if math.Abs(float64(d)-20003931.4586) > 0.001 || h != 0 {
+		t.Errorf("Pole to pole: %v, %v", d, h)
+	}
+	// Nearly antipodal points don't converge, so fall back to the sphere.
+	if _, _, _, ok := m.(*EllipsoidalModel).Inverse(
+		Location{0, 0}, Location{0.5, 179.7}); ok {
+		t.Errorf("Expected nearly antipodal points to not converge")
+	}
+	d, _ = m.DistanceAndHeading(Location{0, 0}, Location{0.5, 179.7})
+	if d < 19900000 || d > 20010000 {
+		t.Errorf("Nearly antipodal distance: %v", d)
+	}
+	// Crossing the antimeridian.
+	dest := m.AtDistanceAndHeading(Location{0, 179.9}, 100000, 90)
+	if dest.Lon > -179.1 || dest.Lon < -179.3 {
+		t.Errorf("Crossing the antimeridian: %v", dest)
+	}
+}
+
+// The spherical model (the default) is within about 0.5% of the ellipsoid.
+func TestSphericalVsEllipsoidal(t *testing.T) {
+	boston := Location{42.3522, -71.0552}
+	for _, loc2 := range []Location{
+		{42.3601, -71.0589}, {41.8240, -71.4128}, {40.7506, -73.9935},
+		{42.6583, -71.1368}, {38.8977, -77.0365},
+	} {
+		ds, hs := Spherical.DistanceAndHeading(boston, loc2)
+		de, he := WGS84.DistanceAndHeading(boston, loc2)
+		if math.Abs(float64(ds-de)) > 0.005*float64(de) || headingDiff(hs, he) > 0.2 {
+			t.Errorf("%v: spherical %v, %v; ellipsoidal %v, %v",
+				loc2, ds, hs, de, he)
+		}
+	}
+}
+
+func TestLocationUsesGeodesic(t *testing.T) {
+	defer func(saved GeodesicModel) { Geodesic = saved }(Geodesic)
+	test := geodesicTests[0]
+	Geodesic = WGS84
+	d, h := test.loc1.DistanceAndHeadingTo(test.loc2)
+	if math.Abs(float64(d-test.distance)) > 0.001 ||
+		headingDiff(h, test.initialHeading) > 3e-6 {
+		t.Errorf("DistanceAndHeadingTo: %v, %v", d, h)
+	}
+	loc := test.loc1.AtDistanceAndHeading(test.distance, test.initialHeading)
+	if math.Abs(float64(loc.Lat-test.loc2.Lat)) > 1e-8 ||
+		math.Abs(float64(loc.Lon-test.loc2.Lon)) > 1e-8 {
+		t.Errorf("AtDistanceAndHeading: %v", loc)
+	}
+	Geodesic = Spherical
+	if d2, _ := test.loc1.DistanceAndHeadingTo(test.loc2); d2 == d {
+		t.Errorf("Geodesic model not used: %v", d2)
+	}
+}
+
+var (
+	benchLoc1 = Location{42.3522, -71.0552}
+	benchLoc2 = Location{42.6583, -71.1368}
+	benchSink Meters
+)
+
+func benchmarkInverse(b *testing.B, m GeodesicModel) {
+	for i := 0; i < b.N; i++ {
+		d, _ := m.DistanceAndHeading(benchLoc1, benchLoc2)
+		benchSink += d
+	}
+}
+
+func benchmarkDirect(b *testing.B, m GeodesicModel) {
+	for i := 0; i < b.N; i++ {
+		loc := m.AtDistanceAndHeading(benchLoc1, 35000, 350)
+		benchSink += Meters(loc.Lat)
+	}
+}
+
+func BenchmarkSphericalInverse(b *testing.B)   { benchmarkInverse(b, Spherical) }
+func BenchmarkEllipsoidalInverse(b *testing.B) { benchmarkInverse(b, WGS84) }
+func BenchmarkSphericalDirect(b *testing.B)    { benchmarkDirect(b, Spherical) }
+func BenchmarkEllipsoidalDirect(b *testing.B)  { benchmarkDirect(b, WGS84) }
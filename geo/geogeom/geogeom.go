@@ -98,7 +98,8 @@ func MakeNoOpCoordTransform() CoordTransform {
 }
 
 // Translation from Lat-Lon to a (small) flat region around a single Lat-Lon
-// point (i.e. a metro area).
+// point (i.e. a metro area). For larger regions, or where headings matter,
+// use a Projection (e.g. MakeLocalTransverseMercator).
 type MetricCoordTransform struct {
 	center geo.Location
 
@@ -0,0 +1,81 @@
+package geogeom
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/jamessynge/transit_tools/geo"
+)
+
+// A Projection is a CoordTransform whose points are in (projected) meters,
+// and which can report its distortions at any location. Unlike
+// MetricCoordTransform, the projections here are conformal (angles are
+// preserved locally), and are usable over regions of hundreds of kilometers.
+//
+// The HeadingTransform methods of a Projection assume the meridian
+// convergence at the center of the projection (zero along the central
+// meridian of a transverse Mercator projection); the error grows with the
+// distance from there (about 0.45° per 50 km east or west, at 45° latitude),
+// so for accurate headings use HeadingTransformAt.
+type Projection interface {
+	CoordTransform
+
+	// Returns the meridian convergence at loc, in degrees: the angle from
+	// true north clockwise to grid north (the direction of increasing Y).
+	ConvergenceAt(loc geo.Location) float64
+
+	// Returns the point scale factor at loc: the ratio of a short distance
+	// in the projected plane to the same distance on the earth's surface.
+	ScaleAt(loc geo.Location) float64
+
+	// Returns a HeadingTransform which corrects for the meridian convergence
+	// at loc.
+	HeadingTransformAt(loc geo.Location) HeadingTransform
+}
+
+// Converts headings to directions, correcting for the meridian convergence
+// (in degrees) at a location.
+type ConvergenceHeadingTransform struct {
+	Convergence float64
+}
+
+func (t ConvergenceHeadingTransform) GeoHeadingToDirection(
+	heading geo.HeadingInt) (direction float64, err error) {
+	if heading.IsValid() {
+		direction = t.ToDirection(float64(heading))
+	} else {
+		err = fmt.Errorf("Invalid geo.HeadingInt: %v", heading)
+	}
+	return
+}
+func (t ConvergenceHeadingTransform) ToDirection(heading float64) float64 {
+	return NoOpHeadingTransform{}.ToDirection(heading - t.Convergence)
+}
+func (t ConvergenceHeadingTransform) FromDirection(direction float64) float64 {
+	heading := NoOpHeadingTransform{}.FromDirection(direction) + t.Convergence
+	heading = math.Mod(heading, 360)
+	if heading < 0 {
+		heading += 360
+	}
+	return heading
+}
+
+// Returns lon - centralMeridian, normalized to [-180, 180).
+func longitudeOffset(lon geo.Longitude, centralMeridian float64) float64 {
+	d := math.Mod(float64(lon)-centralMeridian+180, 360)
+	if d < 0 {
+		d += 360
+	}
+	return d - 180
+}
+
+func validLocation(lat, lon float64) (geo.Location, error) {
+	if math.IsNaN(lat) || math.IsNaN(lon) {
+		return geo.Location{}, fmt.Errorf("Point outside of projection")
+	}
+	lon = math.Mod(lon+180, 360)
+	if lon < 0 {
+		lon += 360
+	}
+	return geo.LocationFromFloat64s(lat, lon-180)
+}
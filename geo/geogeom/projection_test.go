@@ -0,0 +1,218 @@
+package geogeom
+
+import (
+	"math"
+	"testing"
+
+	"github.com/jamessynge/transit_tools/geo"
+	"github.com/jamessynge/transit_tools/geom"
+)
+
+func loc(lat, lon float64) geo.Location {
+	return geo.Location{Lat: geo.Latitude(lat), Lon: geo.Longitude(lon)}
+}
+
+// Moves a short distance (meters) on the WGS 84 ellipsoid.
+func stepOnEllipsoid(from geo.Location, meters, heading float64) geo.Location {
+	phi := from.Lat.ToRadians()
+	e2 := wgs84F * (2 - wgs84F)
+	w := math.Sqrt(1 - e2*math.Sin(phi)*math.Sin(phi))
+	m := wgs84A * (1 - e2) / (w * w * w) // Meridional radius of curvature.
+	n := wgs84A / w                      // Prime vertical radius of curvature.
+	h := heading * math.Pi / 180
+	dLat := meters * math.Cos(h) / m
+	dLon := meters * math.Sin(h) / (n * math.Cos(phi))
+	return loc(float64(from.Lat)+dLat*180/math.Pi,
+		float64(from.Lon)+dLon*180/math.Pi)
+}
+
+func TestUTMKnownPoints(t *testing.T) {
+	tests := []struct {
+		loc               geo.Location
+		zone              int
+		easting, northing float64
+	}{
+		// Eiffel Tower.
+		{loc(48.8582, 2.2945), 31, 448251.8, 5411932.7},
+		// On the central meridian of zone 19, at the equator.
+		{loc(0, -69), 19, 500000, 0},
+		// Sydney Opera House (southern hemisphere).
+		{loc(-33.857, 151.215), 56, 334873, 6252266},
+	}
+	for _, test := range tests {
+		if zone := UTMZone(test.loc); zone != test.zone {
+			t.Errorf("UTMZone(%v) = %d, expected %d", test.loc, zone, test.zone)
+			continue
+		}
+		pt := MakeUTM(test.loc).ToPoint(test.loc)
+		if math.Abs(pt.X-test.easting) > 1 || math.Abs(pt.Y-test.northing) > 1 {
+			t.Errorf("UTM of %v = %v, expected (%v, %v)", test.loc, pt,
+				test.easting, test.northing)
+		}
+	}
+}
+
+func TestUTMZoneExceptions(t *testing.T) {
+	tests := []struct {
+		loc  geo.Location
+		zone int
+	}{
+		{loc(42.36, -71.06), 19},
+		{loc(60, 5), 32},  // Bergen.
+		{loc(78, 15), 33}, // Svalbard.
+		{loc(0, 180), 1},  // Wraps around.
+		{loc(0, -180), 1},
+		{loc(0, 179.9), 60},
+	}
+	for _, test := range tests {
+		if zone := UTMZone(test.loc); zone != test.zone {
+			t.Errorf("UTMZone(%v) = %d, expected %d", test.loc, zone, test.zone)
+		}
+	}
+	if _, err := MakeUTMZone(61, false); err == nil {
+		t.Errorf("Expected an error for zone 61")
+	}
+}
+
+func TestProjectionRoundTrip(t *testing.T) {
+	center := loc(42.358, -71.064)
+	projections := map[string]Projection{
+		"utm":   MakeUTM(center),
+		"local": MakeLocalTransverseMercator(center),
+		"web":   MakeWebMercator(),
+	}
+	for name, p := range projections {
+		for dLat := -3.0; dLat <= 3; dLat += 0.5 {
+			for dLon := -4.0; dLon <= 4; dLon += 0.5 {
+				l := loc(float64(center.Lat)+dLat, float64(center.Lon)+dLon)
+				got, err := p.FromPoint(p.ToPoint(l))
+				if err != nil {
+					t.Errorf("%s: FromPoint(ToPoint(%v)) error: %v", name, l, err)
+					continue
+				}
+				if math.Abs(float64(got.Lat-l.Lat)) > 1e-9 ||
+					math.Abs(float64(got.Lon-l.Lon)) > 1e-9 {
+					t.Errorf("%s: FromPoint(ToPoint(%v)) = %v", name, l, got)
+				}
+			}
+		}
+	}
+}
+
+// Unlike MetricCoordTransform, the local transverse Mercator works well
+// beyond 50 km from its center.
+func TestLocalTransverseMercator(t *testing.T) {
+	center := loc(42.358, -71.064)
+	p := MakeLocalTransverseMercator(center)
+	if pt := p.ToPoint(center); math.Abs(pt.X) > 1e-6 || math.Abs(pt.Y) > 1e-6 {
+		t.Errorf("ToPoint(center) = %v, expected origin", pt)
+	}
+	// Worcester (~60 km west) and Providence (~65 km south-southwest).
+	for _, l := range []geo.Location{loc(42.2626, -71.8023), loc(41.824, -71.4128)} {
+		pt := p.ToPoint(l)
+		distance, heading := geo.ToDistanceAndHeading(center, l)
+		projected := math.Hypot(pt.X, pt.Y)
+		// geo's distances use a spherical earth, so allow 0.5%.
+		if math.Abs(projected-distance) > distance*0.005 {
+			t.Errorf("Projected distance to %v is %v, expected ~%v",
+				l, projected, distance)
+		}
+		direction := math.Atan2(pt.Y, pt.X)
+		if d := p.FromDirection(direction) - heading; math.Abs(d) > 0.5 {
+			t.Errorf("Projected heading to %v is %v, expected ~%v", l,
+				p.FromDirection(direction), heading)
+		}
+		got, err := p.FromPoint(pt)
+		if err != nil || !got.SameLocation(l) &&
+			(math.Abs(float64(got.Lat-l.Lat)) > 1e-9 ||
+				math.Abs(float64(got.Lon-l.Lon)) > 1e-9) {
+			t.Errorf("FromPoint(%v) = %v, %v; expected %v", pt, got, err, l)
+		}
+	}
+	if _, err := p.FromPoint(geom.Point{X: 1000, Y: 2e7}); err == nil {
+		t.Errorf("Expected error for a point beyond the north pole")
+	}
+}
+
+// Projects short steps in several headings, and checks that the direction
+// and length of each step agree with HeadingTransformAt and ScaleAt.
+func TestProjectionDistortions(t *testing.T) {
+	center := loc(42.358, -71.064)
+	projections := map[string]Projection{
+		"utm":   MakeUTM(center),
+		"local": MakeLocalTransverseMercator(center),
+		"web":   MakeWebMercator(),
+	}
+	// Web Mercator isn't conformal, so headings and the scale are approximate.
+	tolerance := map[string]float64{"utm": 1e-4, "local": 1e-4, "web": 0.2}
+	scaleTolerance := map[string]float64{"utm": 1e-5, "local": 1e-5, "web": 0.007}
+	const meters = 1
+	for name, p := range projections {
+		for _, l := range []geo.Location{center, loc(41.5, -73.5), loc(43.5, -69)} {
+			from := p.ToPoint(l)
+			ht := p.HeadingTransformAt(l)
+			scale := p.ScaleAt(l)
+			for heading := 0.0; heading < 360; heading += 30 {
+				to := p.ToPoint(stepOnEllipsoid(l, meters, heading))
+				dx, dy := to.X-from.X, to.Y-from.Y
+				gotHeading := ht.FromDirection(math.Atan2(dy, dx))
+				d := math.Mod(gotHeading-heading+540, 360) - 180
+				if math.Abs(d) > tolerance[name] {
+					t.Errorf("%s at %v: heading %v projected to %v", name, l,
+						heading, gotHeading)
+				}
+				if got := math.Hypot(dx, dy) / meters; math.Abs(got-scale) > scaleTolerance[name]*scale {
+					t.Errorf("%s at %v: heading %v scale %v, expected %v", name, l,
+						heading, got, scale)
+				}
+				dir := ht.ToDirection(heading)
+				if d := math.Abs(math.Remainder(dir-math.Atan2(dy, dx), 2*math.Pi)); d > tolerance[name]*math.Pi/180 {
+					t.Errorf("%s at %v: ToDirection(%v) = %v, expected %v", name, l,
+						heading, dir, math.Atan2(dy, dx))
+				}
+			}
+		}
+	}
+}
+
+func TestWebMercator(t *testing.T) {
+	p := MakeWebMercator()
+	const extent = 20037508.342789244
+	tests := []struct {
+		loc  geo.Location
+		x, y float64
+	}{
+		{loc(0, 0), 0, 0},
+		{loc(0, 180), extent, 0},
+		{loc(WebMercatorMaxLatitude, -180), -extent, extent},
+		{loc(-90, 0), 0, -extent}, // Clamped.
+	}
+	for _, test := range tests {
+		pt := p.ToPoint(test.loc)
+		if math.Abs(pt.X-test.x) > 1e-3 || math.Abs(pt.Y-test.y) > 1e-3 {
+			t.Errorf("ToPoint(%v) = %v, expected (%v, %v)", test.loc, pt,
+				test.x, test.y)
+		}
+	}
+	// About sec(60°), reduced by the flattening of the ellipsoid.
+	if s := p.ScaleAt(loc(60, 0)); math.Abs(s-1.99497) > 1e-5 {
+		t.Errorf("ScaleAt(60°) = %v, expected 1.99497", s)
+	}
+}
+
+func TestConvergenceHeadingTransform(t *testing.T) {
+	ht := ConvergenceHeadingTransform{Convergence: 10}
+	// Grid north is 10° east of true north, so true heading 10° is straight up.
+	if dir := ht.ToDirection(10); math.Abs(dir-math.Pi/2) > 1e-12 {
+		t.Errorf("ToDirection(10) = %v, expected π/2", dir)
+	}
+	if h := ht.FromDirection(math.Pi / 2); math.Abs(h-10) > 1e-12 {
+		t.Errorf("FromDirection(π/2) = %v, expected 10", h)
+	}
+	if h := ht.FromDirection(math.Pi/2 + 0.5*math.Pi/180*30); math.Abs(h-355) > 1e-9 {
+		t.Errorf("FromDirection() = %v, expected 355", h)
+	}
+	if _, err := ht.GeoHeadingToDirection(geo.HeadingInt(-1)); err == nil {
+		t.Errorf("Expected error for invalid heading")
+	}
+}
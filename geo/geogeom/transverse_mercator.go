@@ -0,0 +1,265 @@
+package geogeom
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/jamessynge/transit_tools/geo"
+	"github.com/jamessynge/transit_tools/geom"
+)
+
+// WGS 84 ellipsoid.
+const (
+	wgs84A = float64(geo.EarthRadiusAtEquator)
+	wgs84F = 1 / 298.257223563
+)
+
+// Transverse Mercator projection of the WGS 84 ellipsoid, computed with
+// Krüger's series to sixth order in the third flattening, as described in
+// "Transverse Mercator with an accuracy of a few nanometers", C. F. F. Karney,
+// J. Geodesy 85(8), 475-485, 2011 (and as implemented by
+// http://www.movable-type.co.uk/scripts/latlong-utm-mgrs.html).
+//
+// The error of the series is under 5 nanometers within 3900 km of the central
+// meridian, which is far more than needed for transit data; the scale factor
+// is the practical limit. With k0 = 1, the scale factor at a distance d from
+// the central meridian is about 1 + d²/(2R²): 1.00003 at 50 km, 1.0005 at
+// 200 km and 1.003 at 500 km. FromPoint rejects points beyond the poles
+// (whose location would be more than 90° of longitude from the central
+// meridian).
+type TransverseMercator struct {
+	// Longitude (degrees) of the central meridian.
+	CentralMeridian float64
+	// Scale factor along the central meridian.
+	K0 float64
+	// Added to the projected coordinates (i.e. the projected coordinates of
+	// the point on the central meridian at the equator).
+	FalseEasting, FalseNorthing float64
+
+	// For HeadingTransform; see Projection.
+	ConvergenceHeadingTransform
+}
+
+// Series coefficients; these depend only on the ellipsoid.
+var (
+	tmE     float64    // Eccentricity.
+	tmA     float64    // 2π·tmA is the circumference of a meridian.
+	tmAlpha [7]float64 // Forward (1-based).
+	tmBeta  [7]float64 // Reverse (1-based).
+)
+
+func init() {
+	f := wgs84F
+	tmE = math.Sqrt(f * (2 - f))
+	n := f / (2 - f)
+	n2 := n * n
+	n3 := n * n2
+	n4 := n * n3
+	n5 := n * n4
+	n6 := n * n5
+	tmA = wgs84A / (1 + n) * (1 + n2/4 + n4/64 + n6/256)
+	tmAlpha = [7]float64{
+		0,
+		n/2 - 2*n2/3 + 5*n3/16 + 41*n4/180 - 127*n5/288 + 7891*n6/37800,
+		13*n2/48 - 3*n3/5 + 557*n4/1440 + 281*n5/630 - 1983433*n6/1935360,
+		61*n3/240 - 103*n4/140 + 15061*n5/26880 + 167603*n6/181440,
+		49561*n4/161280 - 179*n5/168 + 6601661*n6/7257600,
+		34729*n5/80640 - 3418889*n6/1995840,
+		212378941 * n6 / 319334400,
+	}
+	tmBeta = [7]float64{
+		0,
+		n/2 - 2*n2/3 + 37*n3/96 - n4/360 - 81*n5/512 + 96199*n6/604800,
+		n2/48 + n3/15 - 437*n4/1440 + 46*n5/105 - 1118711*n6/3870720,
+		17*n3/480 - 37*n4/840 - 209*n5/4480 + 5569*n6/90720,
+		4397*n4/161280 - 11*n5/504 - 830251*n6/7257600,
+		4583*n5/161280 - 108847*n6/3991680,
+		20648693 * n6 / 638668800,
+	}
+}
+
+// Conformal latitude (as tan) from geodetic latitude (as tan).
+func tmTauPrime(tau float64) float64 {
+	sigma := math.Sinh(tmE * math.Atanh(tmE*tau/math.Sqrt(1+tau*tau)))
+	return tau*math.Sqrt(1+sigma*sigma) - sigma*math.Sqrt(1+tau*tau)
+}
+
+// Computes the projection (without scaling or offsets) of the location, where
+// lambda is the longitude relative to the central meridian, and the
+// convergence (degrees) and scale factor (for k0 = 1).
+func tmForward(phi, lambda float64) (x, y, convergence, scale float64) {
+	tau := math.Tan(phi)
+	tauP := tmTauPrime(tau)
+	cosL := math.Cos(lambda)
+	xiP := math.Atan2(tauP, cosL)
+	etaP := math.Asinh(math.Sin(lambda) / math.Sqrt(tauP*tauP+cosL*cosL))
+
+	xi, eta := xiP, etaP
+	pP, qP := 1.0, 0.0
+	for j := 1; j <= 6; j++ {
+		j2 := 2 * float64(j)
+		s, c := math.Sincos(j2 * xiP)
+		sh, ch := math.Sinh(j2*etaP), math.Cosh(j2*etaP)
+		xi += tmAlpha[j] * s * ch
+		eta += tmAlpha[j] * c * sh
+		pP += j2 * tmAlpha[j] * c * ch
+		qP += j2 * tmAlpha[j] * s * sh
+	}
+	x = tmA * eta
+	y = tmA * xi
+
+	gammaP := math.Atan(tauP / math.Sqrt(1+tauP*tauP) * math.Tan(lambda))
+	gammaPP := math.Atan2(qP, pP)
+	convergence = (gammaP + gammaPP) * 180 / math.Pi
+
+	sinPhi := math.Sin(phi)
+	kP := math.Sqrt(1-tmE*tmE*sinPhi*sinPhi) * math.Sqrt(1+tau*tau) /
+		math.Sqrt(tauP*tauP+cosL*cosL)
+	kPP := tmA / wgs84A * math.Sqrt(pP*pP+qP*qP)
+	scale = kP * kPP
+	return
+}
+
+// The inverse of tmForward; returns the latitude and the longitude relative
+// to the central meridian, in radians.
+func tmInverse(x, y float64) (phi, lambda float64) {
+	eta := x / tmA
+	xi := y / tmA
+	xiP, etaP := xi, eta
+	for j := 1; j <= 6; j++ {
+		j2 := 2 * float64(j)
+		s, c := math.Sincos(j2 * xi)
+		xiP -= tmBeta[j] * s * math.Cosh(j2*eta)
+		etaP -= tmBeta[j] * c * math.Sinh(j2*eta)
+	}
+	sinhEtaP := math.Sinh(etaP)
+	sinXiP, cosXiP := math.Sincos(xiP)
+	tauP := sinXiP / math.Sqrt(sinhEtaP*sinhEtaP+cosXiP*cosXiP)
+
+	// Newton's method for the geodetic latitude with this conformal latitude.
+	e2 := tmE * tmE
+	tau := tauP
+	for i := 0; i < 10; i++ {
+		tauIP := tmTauPrime(tau)
+		delta := (tauP - tauIP) / math.Sqrt(1+tauIP*tauIP) *
+			(1 + (1-e2)*tau*tau) / ((1 - e2) * math.Sqrt(1+tau*tau))
+		tau += delta
+		if math.Abs(delta) < 1e-12 {
+			break
+		}
+	}
+	phi = math.Atan(tau)
+	lambda = math.Atan2(sinhEtaP, cosXiP)
+	return
+}
+
+func (p *TransverseMercator) forward(loc geo.Location) (
+	x, y, convergence, scale float64) {
+	lambda := longitudeOffset(loc.Lon, p.CentralMeridian) * math.Pi / 180
+	x, y, convergence, scale = tmForward(loc.Lat.ToRadians(), lambda)
+	x = p.K0*x + p.FalseEasting
+	y = p.K0*y + p.FalseNorthing
+	scale *= p.K0
+	return
+}
+
+func (p *TransverseMercator) ToPoint(loc geo.Location) geom.Point {
+	x, y, _, _ := p.forward(loc)
+	return geom.Point{X: x, Y: y}
+}
+
+func (p *TransverseMercator) FromPoint(pt geom.Point) (geo.Location, error) {
+	x := (pt.X - p.FalseEasting) / p.K0
+	y := (pt.Y - p.FalseNorthing) / p.K0
+	phi, lambda := tmInverse(x, y)
+	if math.Abs(lambda) > math.Pi/2 {
+		return geo.Location{}, fmt.Errorf(
+			"Point too far from central meridian: %v", pt)
+	}
+	return validLocation(phi*180/math.Pi, p.CentralMeridian+lambda*180/math.Pi)
+}
+
+func (p *TransverseMercator) ConvergenceAt(loc geo.Location) float64 {
+	_, _, convergence, _ := p.forward(loc)
+	return convergence
+}
+
+func (p *TransverseMercator) ScaleAt(loc geo.Location) float64 {
+	_, _, _, scale := p.forward(loc)
+	return scale
+}
+
+func (p *TransverseMercator) HeadingTransformAt(
+	loc geo.Location) HeadingTransform {
+	return ConvergenceHeadingTransform{p.ConvergenceAt(loc)}
+}
+
+// Returns a transverse Mercator projection centered on center: the central
+// meridian passes through center, the scale factor along it is 1, and center
+// is projected to (0, 0). This is a drop-in replacement for
+// MetricCoordTransform that is usable over whole regions (e.g. for commuter
+// rail); within 200 km of the central meridian, projected distances are
+// within 0.05% of true distances.
+func MakeLocalTransverseMercator(center geo.Location) Projection {
+	p := &TransverseMercator{
+		CentralMeridian: float64(center.Lon),
+		K0:              1,
+	}
+	_, y, _, _ := p.forward(center)
+	p.FalseNorthing = -y
+	return p
+}
+
+// The Universal Transverse Mercator zone of a location, 1 through 60,
+// including the exceptions for southwest Norway and Svalbard.
+func UTMZone(loc geo.Location) int {
+	lat, lon := float64(loc.Lat), longitudeOffset(loc.Lon, 0)
+	zone := int(math.Floor((lon+180)/6)) + 1
+	if zone > 60 {
+		zone = 60
+	}
+	if 56 <= lat && lat < 64 && 3 <= lon && lon < 12 {
+		return 32
+	}
+	if 72 <= lat && lat <= 84 && 0 <= lon && lon < 42 {
+		switch {
+		case lon < 9:
+			return 31
+		case lon < 21:
+			return 33
+		case lon < 33:
+			return 35
+		default:
+			return 37
+		}
+	}
+	return zone
+}
+
+// Returns the projection of a UTM zone (1 through 60) in either the northern
+// or southern hemisphere. Coordinates are easting and northing, in meters.
+// Within the zone (3° either side of the central meridian), the scale factor
+// is between 0.9996 and 1.0010.
+func MakeUTMZone(zone int, south bool) (Projection, error) {
+	if zone < 1 || zone > 60 {
+		return nil, fmt.Errorf("Invalid UTM zone: %d", zone)
+	}
+	p := &TransverseMercator{
+		CentralMeridian: float64(zone-1)*6 - 180 + 3,
+		K0:              0.9996,
+		FalseEasting:    500000,
+	}
+	if south {
+		p.FalseNorthing = 10000000
+	}
+	return p, nil
+}
+
+// Returns the UTM projection for the zone and hemisphere containing center,
+// with its HeadingTransform corrected for the convergence at center.
+func MakeUTM(center geo.Location) Projection {
+	p, _ := MakeUTMZone(UTMZone(center), center.Lat < 0)
+	tm := p.(*TransverseMercator)
+	tm.ConvergenceHeadingTransform.Convergence = tm.ConvergenceAt(center)
+	return tm
+}
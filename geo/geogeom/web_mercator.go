@@ -0,0 +1,60 @@
+package geogeom
+
+import (
+	"math"
+
+	"github.com/jamessynge/transit_tools/geo"
+	"github.com/jamessynge/transit_tools/geom"
+)
+
+// The limit of latitude of Web Mercator, at which the map is square.
+const WebMercatorMaxLatitude = 85.05112877980659
+
+// Web Mercator (EPSG:3857), the projection of web map tiles: the spherical
+// Mercator formulas applied to WGS 84 coordinates, with the sphere's radius
+// equal to the equatorial radius. X and Y range over ±20037508.34 (meters at
+// the equator); latitudes beyond ±WebMercatorMaxLatitude are clamped.
+//
+// Meridians are vertical, so the convergence is zero, but because the
+// ellipsoid is treated as a sphere the projection is not quite conformal:
+// headings are in error by up to 0.2°, and the north-south scale is up to
+// 0.7% greater than the east-west scale (ScaleAt). The scale is about
+// sec(latitude) (1.41 at 45°), so projected distances are not meters on the
+// ground.
+type WebMercator struct {
+	NoOpHeadingTransform
+}
+
+func (p WebMercator) ToPoint(loc geo.Location) geom.Point {
+	lat := math.Max(-WebMercatorMaxLatitude,
+		math.Min(WebMercatorMaxLatitude, float64(loc.Lat)))
+	phi := lat * math.Pi / 180
+	return geom.Point{
+		X: wgs84A * loc.Lon.ToRadians(),
+		Y: wgs84A * math.Log(math.Tan(math.Pi/4+phi/2)),
+	}
+}
+
+func (p WebMercator) FromPoint(pt geom.Point) (geo.Location, error) {
+	phi := 2*math.Atan(math.Exp(pt.Y/wgs84A)) - math.Pi/2
+	return validLocation(phi*180/math.Pi, pt.X/wgs84A*180/math.Pi)
+}
+
+func (p WebMercator) ConvergenceAt(loc geo.Location) float64 {
+	return 0
+}
+
+// Returns the east-west scale factor at loc.
+func (p WebMercator) ScaleAt(loc geo.Location) float64 {
+	sinPhi, cosPhi := math.Sincos(loc.Lat.ToRadians())
+	e2 := wgs84F * (2 - wgs84F)
+	return math.Sqrt(1-e2*sinPhi*sinPhi) / cosPhi
+}
+
+func (p WebMercator) HeadingTransformAt(loc geo.Location) HeadingTransform {
+	return p.NoOpHeadingTransform
+}
+
+func MakeWebMercator() Projection {
+	return WebMercator{}
+}
@@ -0,0 +1,199 @@
+package geoimage
+
+// Color scales for the tiles of a TilePyramid. The scale is computed from all
+// of the pixels at a zoom level, rather than per tile, so that a color means
+// the same thing on every tile at that level.
+
+import (
+	"fmt"
+	"image/color"
+	"math"
+
+	"github.com/jamessynge/transit_tools/stats"
+)
+
+// Colors at equally spaced points from 0 to 1, with linear interpolation
+// between them.
+type ColorRamp []color.NRGBA
+
+// From translucent dark red, through red and yellow, to white; the usual
+// heatmap colors.
+var HeatRamp = ColorRamp{
+	{96, 0, 0, 128},
+	{224, 0, 0, 208},
+	{255, 160, 0, 240},
+	{255, 255, 64, 255},
+	{255, 255, 255, 255},
+}
+
+// From red, through yellow, to green; e.g. for speeds (slow is red).
+var RedYellowGreenRamp = ColorRamp{
+	{215, 25, 28, 255},
+	{253, 174, 97, 255},
+	{255, 255, 153, 255},
+	{166, 217, 106, 255},
+	{26, 150, 65, 255},
+}
+
+// At returns the color at f, which is clamped to [0, 1].
+func (r ColorRamp) At(f float64) color.NRGBA {
+	if len(r) == 0 {
+		return color.NRGBA{}
+	}
+	if !(f > 0) {
+		return r[0]
+	} else if f >= 1 {
+		return r[len(r)-1]
+	}
+	pos := f * float64(len(r)-1)
+	i := int(pos)
+	frac := pos - float64(i)
+	a, b := r[i], r[i+1]
+	mix := func(u, v uint8) uint8 {
+		return uint8(math.Floor(float64(u) + (float64(v)-float64(u))*frac + 0.5))
+	}
+	return color.NRGBA{mix(a.R, b.R), mix(a.G, b.G), mix(a.B, b.B), mix(a.A, b.A)}
+}
+
+// A point of the legend of a color scale.
+type LegendStop struct {
+	// Position (0 to 1) along the ramp.
+	Fraction float64
+	// The count or value at that position.
+	Value float64
+	Color color.NRGBA
+}
+
+// CSS color of the stop, for the HTML viewer.
+func (s LegendStop) CSSColor() string {
+	return fmt.Sprintf("rgba(%d,%d,%d,%.3f)",
+		s.Color.R, s.Color.G, s.Color.B, float64(s.Color.A)/255)
+}
+
+// Histogram equalized colors for the counts of the pixels at a zoom level
+// (i.e. each color of the ramp is used for about the same number of pixels),
+// like CDFToHEPalette, but using a t-digest of the counts, so that a very
+// large maximum count doesn't require a very large palette.
+type EqualizedScale struct {
+	Ramp   ColorRamp
+	digest *stats.TDigest
+	// The colors of the counts seen so far; there are usually few distinct
+	// counts, and this is much faster than computing the CDF for each pixel.
+	colors map[uint64]color.NRGBA
+}
+
+// NewEqualizedScale returns the scale for the counts of the pixels at zoom
+// level z of p.
+func NewEqualizedScale(p *TilePyramid, z int, ramp ColorRamp) *EqualizedScale {
+	s := &EqualizedScale{
+		Ramp:   ramp,
+		digest: stats.NewTDigest(stats.DefaultTDigestCompression),
+		colors: make(map[uint64]color.NRGBA),
+	}
+	p.VisitPixels(z, func(count uint64, sum float64) {
+		s.digest.Add(float64(count))
+	})
+	return s
+}
+
+// Returns the fraction of the pixels with a count less than count, relative
+// to the fraction with a count less than the maximum; i.e. the least count is
+// at the start of the ramp, and the greatest at the end.
+func (s *EqualizedScale) fraction(count float64) float64 {
+	// The counts are integers, so subtracting 0.5 excludes those equal to count.
+	below := s.digest.CDF(count - 0.5)
+	belowMax := s.digest.CDF(s.digest.Max() - 0.5)
+	if math.IsNaN(below) || !(belowMax > 0) {
+		return 1
+	}
+	return below / belowMax
+}
+
+func (s *EqualizedScale) Color(count uint64, sum float64) color.Color {
+	c, ok := s.colors[count]
+	if !ok {
+		c = s.Ramp.At(s.fraction(float64(count)))
+		s.colors[count] = c
+	}
+	return c
+}
+
+// Legend returns the (approximate) counts at numStops equally spaced positions
+// along the ramp (at least 2).
+func (s *EqualizedScale) Legend(numStops int) (stops []LegendStop) {
+	if numStops < 2 {
+		numStops = 2
+	}
+	belowMax := s.digest.CDF(s.digest.Max() - 0.5)
+	for i := 0; i < numStops; i++ {
+		f := float64(i) / float64(numStops-1)
+		v := s.digest.Max()
+		if i < numStops-1 {
+			v = math.Max(s.digest.Min(), math.Floor(s.digest.Quantile(f*belowMax)+0.5))
+		}
+		stops = append(stops, LegendStop{Fraction: f, Value: v, Color: s.Ramp.At(f)})
+	}
+	return
+}
+
+// Colors for the mean value (sum / count) of the pixels, linear from Min to
+// Max; means outside that range get the color at the end of the ramp.
+// Pixels with fewer than MinCount locations are transparent, as their means
+// are unreliable.
+type ValueScale struct {
+	Min, Max float64
+	MinCount uint64
+	Ramp     ColorRamp
+}
+
+// NewValueScale returns a scale from the lowQ to highQ quantiles of the means
+// of the pixels at zoom level z of p, weighted by their counts (e.g. 0.02 and
+// 0.98, so that a few outliers don't compress the scale).
+func NewValueScale(p *TilePyramid, z int, lowQ, highQ float64,
+	ramp ColorRamp) *ValueScale {
+	digest := stats.NewTDigest(stats.DefaultTDigestCompression)
+	p.VisitPixels(z, func(count uint64, sum float64) {
+		digest.AddWeighted(sum/float64(count), float64(count))
+	})
+	s := &ValueScale{
+		Min:      digest.Quantile(lowQ),
+		Max:      digest.Quantile(highQ),
+		MinCount: 1,
+		Ramp:     ramp,
+	}
+	if math.IsNaN(s.Min) {
+		s.Min, s.Max = 0, 1
+	}
+	return s
+}
+
+func (s *ValueScale) Color(count uint64, sum float64) color.Color {
+	if count == 0 || count < s.MinCount {
+		return color.NRGBA{}
+	}
+	return s.Ramp.At(s.fraction(sum / float64(count)))
+}
+
+func (s *ValueScale) fraction(v float64) float64 {
+	if s.Max <= s.Min {
+		return 0.5
+	}
+	return (v - s.Min) / (s.Max - s.Min)
+}
+
+// Legend returns the values at numStops equally spaced positions along the
+// ramp (at least 2).
+func (s *ValueScale) Legend(numStops int) (stops []LegendStop) {
+	if numStops < 2 {
+		numStops = 2
+	}
+	for i := 0; i < numStops; i++ {
+		f := float64(i) / float64(numStops-1)
+		stops = append(stops, LegendStop{
+			Fraction: f,
+			Value:    s.Min + f*(s.Max-s.Min),
+			Color:    s.Ramp.At(f),
+		})
+	}
+	return
+}
@@ -0,0 +1,330 @@
+package geoimage
+
+// Support for rendering a density (or mean value) heatmap as a pyramid of
+// "slippy map" tiles: square images (usually 256x256 pixels) in the Web
+// Mercator projection, named z/x/y.png, where at zoom level z the world is
+// divided into 2^z by 2^z tiles, x increasing eastwards from the
+// antimeridian, and y increasing southwards from the north edge of the map
+// (about 85°N).
+//
+// Locations are counted in the pixels of the tiles at the maximum zoom level;
+// each pixel of a tile at a lower zoom level is the sum of the four pixels
+// under it at the next level, so the pyramid is consistent.
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/jamessynge/transit_tools/geo"
+	"github.com/jamessynge/transit_tools/geo/geogeom"
+	"github.com/jamessynge/transit_tools/geom"
+)
+
+// The highest zoom level supported (about 2cm per pixel at the equator).
+const MaxTileZoom = 30
+
+var webMercator = geogeom.MakeWebMercator()
+
+// Half the width of the Web Mercator plane (i.e. the X of the antimeridian).
+var webMercatorHalfWidth = webMercator.ToPoint(geo.Location{Lon: 180}).X
+
+type TileKey struct {
+	Z, X, Y int
+}
+
+func (k TileKey) String() string {
+	return fmt.Sprintf("%d/%d/%d", k.Z, k.X, k.Y)
+}
+
+// Returns the pixel of the world at zoom level z, for tiles of tileSize
+// pixels, containing loc.
+func worldPixel(loc geo.Location, z, tileSize int) (px, py int) {
+	pt := webMercator.ToPoint(loc)
+	worldSize := tileSize << uint(z)
+	scale := float64(worldSize) / (2 * webMercatorHalfWidth)
+	clamp := func(v float64) int {
+		i := int(math.Floor(v))
+		if i < 0 {
+			return 0
+		} else if i >= worldSize {
+			return worldSize - 1
+		}
+		return i
+	}
+	return clamp((pt.X + webMercatorHalfWidth) * scale),
+		clamp((webMercatorHalfWidth - pt.Y) * scale)
+}
+
+// TileKeyAt returns the key of the tile at zoom level z containing loc.
+func TileKeyAt(loc geo.Location, z int) TileKey {
+	px, py := worldPixel(loc, z, 1)
+	return TileKey{Z: z, X: px, Y: py}
+}
+
+// Bounds returns the region covered by the tile.
+func (k TileKey) Bounds() geo.Rect {
+	n := float64(int(1) << uint(k.Z))
+	toLocation := func(x, y int) geo.Location {
+		loc, _ := webMercator.FromPoint(geom.Point{
+			X: (float64(x)/n*2 - 1) * webMercatorHalfWidth,
+			Y: (1 - float64(y)/n*2) * webMercatorHalfWidth,
+		})
+		return loc
+	}
+	nw, se := toLocation(k.X, k.Y), toLocation(k.X+1, k.Y+1)
+	return geo.Rect{South: se.Lat, North: nw.Lat, West: nw.Lon, East: se.Lon}
+}
+
+// The cells of a tile, in row major order from the north-west corner.
+type tileCells struct {
+	counts []uint64
+	// Sums of the values added with the locations; nil if the pyramid doesn't
+	// have values.
+	sums []float64
+}
+
+// A TilePyramid counts locations (and optionally sums values, such as speeds,
+// at those locations) in the pixels of tiles at zoom levels MinZoom through
+// MaxZoom. Only the tiles containing locations are stored, but each of those
+// takes 8 (or with values, 16) bytes per pixel at the maximum zoom level, so
+// choose MaxZoom with care (e.g. a large city's transit network covers a few
+// thousand tiles at zoom level 15, and tens of thousands at 17).
+type TilePyramid struct {
+	MinZoom, MaxZoom int
+	// Width and height of the tiles, in pixels.
+	TileSize   int
+	WithValues bool
+	// Tiles at MaxZoom.
+	tiles map[TileKey]*tileCells
+	// Tiles at lower zoom levels, indexed by MaxZoom - z - 1; computed as
+	// needed, and discarded when locations are added.
+	derived []map[TileKey]*tileCells
+}
+
+func NewTilePyramid(minZoom, maxZoom, tileSize int, withValues bool) (
+	*TilePyramid, error) {
+	if minZoom < 0 || minZoom > maxZoom || maxZoom > MaxTileZoom {
+		return nil, fmt.Errorf(
+			"Invalid zoom levels %d to %d (must be within 0 to %d)",
+			minZoom, maxZoom, MaxTileZoom)
+	}
+	if tileSize < 2 || tileSize%2 != 0 {
+		return nil, fmt.Errorf("Invalid tile size: %d (must be even)", tileSize)
+	}
+	return &TilePyramid{
+		MinZoom:    minZoom,
+		MaxZoom:    maxZoom,
+		TileSize:   tileSize,
+		WithValues: withValues,
+		tiles:      make(map[TileKey]*tileCells),
+	}, nil
+}
+
+func (p *TilePyramid) newTileCells() *tileCells {
+	c := &tileCells{counts: make([]uint64, p.TileSize*p.TileSize)}
+	if p.WithValues {
+		c.sums = make([]float64, p.TileSize*p.TileSize)
+	}
+	return c
+}
+
+func (p *TilePyramid) add(loc geo.Location, value float64) {
+	px, py := worldPixel(loc, p.MaxZoom, p.TileSize)
+	key := TileKey{Z: p.MaxZoom, X: px / p.TileSize, Y: py / p.TileSize}
+	cells := p.tiles[key]
+	if cells == nil {
+		cells = p.newTileCells()
+		p.tiles[key] = cells
+	}
+	i := (py%p.TileSize)*p.TileSize + px%p.TileSize
+	cells.counts[i]++
+	if cells.sums != nil {
+		cells.sums[i] += value
+	}
+	p.derived = nil
+}
+
+// Add counts loc (e.g. of a vehicle location report).
+func (p *TilePyramid) Add(loc geo.Location) {
+	p.add(loc, 0)
+}
+
+// AddValue counts loc, and adds v to the sum of the values at loc (see
+// RenderTile); v is ignored if the pyramid doesn't have values, and the
+// location ignored if v is NaN.
+func (p *TilePyramid) AddValue(loc geo.Location, v float64) {
+	if math.IsNaN(v) {
+		return
+	}
+	p.add(loc, v)
+}
+
+// Returns the tiles at zoom level z, aggregating those at higher levels if
+// necessary.
+func (p *TilePyramid) level(z int) map[TileKey]*tileCells {
+	if z == p.MaxZoom {
+		return p.tiles
+	}
+	n := p.MaxZoom - z - 1
+	for len(p.derived) <= n {
+		children := p.tiles
+		if len(p.derived) > 0 {
+			children = p.derived[len(p.derived)-1]
+		}
+		p.derived = append(p.derived, p.aggregate(children))
+	}
+	return p.derived[n]
+}
+
+// Returns the tiles at the next lower zoom level: each pixel is the sum of
+// the four under it.
+func (p *TilePyramid) aggregate(children map[TileKey]*tileCells) (
+	parents map[TileKey]*tileCells) {
+	parents = make(map[TileKey]*tileCells)
+	half := p.TileSize / 2
+	for key, child := range children {
+		parentKey := TileKey{Z: key.Z - 1, X: key.X / 2, Y: key.Y / 2}
+		parent := parents[parentKey]
+		if parent == nil {
+			parent = p.newTileCells()
+			parents[parentKey] = parent
+		}
+		ox, oy := (key.X%2)*half, (key.Y%2)*half
+		for row := 0; row < p.TileSize; row++ {
+			base := (oy+row/2)*p.TileSize + ox
+			for col := 0; col < p.TileSize; col++ {
+				i := row*p.TileSize + col
+				if child.counts[i] == 0 {
+					continue
+				}
+				parent.counts[base+col/2] += child.counts[i]
+				if parent.sums != nil {
+					parent.sums[base+col/2] += child.sums[i]
+				}
+			}
+		}
+	}
+	return
+}
+
+// Tiles returns the keys of the tiles at zoom level z which contain
+// locations, sorted by X then Y.
+func (p *TilePyramid) Tiles(z int) (keys []TileKey) {
+	if z < p.MinZoom || z > p.MaxZoom {
+		return nil
+	}
+	for key := range p.level(z) {
+		keys = append(keys, key)
+	}
+	sort.Sort(tileKeySlice(keys))
+	return
+}
+
+// Bounds returns the region covered by the tiles at MaxZoom which contain
+// locations; ok is false if there are none.
+func (p *TilePyramid) Bounds() (bounds geo.Rect, ok bool) {
+	for key := range p.tiles {
+		b := key.Bounds()
+		if !ok {
+			bounds, ok = b, true
+			continue
+		}
+		bounds.South = geo.Latitude(math.Min(float64(bounds.South), float64(b.South)))
+		bounds.North = geo.Latitude(math.Max(float64(bounds.North), float64(b.North)))
+		bounds.West = geo.Longitude(math.Min(float64(bounds.West), float64(b.West)))
+		bounds.East = geo.Longitude(math.Max(float64(bounds.East), float64(b.East)))
+	}
+	return
+}
+
+// Calls fn with the count and sum of the values of each non-empty pixel of
+// the tiles at zoom level z.
+func (p *TilePyramid) VisitPixels(z int, fn func(count uint64, sum float64)) {
+	for _, cells := range p.level(z) {
+		for i, count := range cells.counts {
+			if count == 0 {
+				continue
+			}
+			var sum float64
+			if cells.sums != nil {
+				sum = cells.sums[i]
+			}
+			fn(count, sum)
+		}
+	}
+}
+
+// Maps the count and the sum of the values of a non-empty pixel to a color.
+type PixelColorer func(count uint64, sum float64) color.Color
+
+// RenderTile returns the image of the tile, with empty pixels transparent;
+// nil if the tile has no locations.
+func (p *TilePyramid) RenderTile(key TileKey, toColor PixelColorer) *image.NRGBA {
+	if key.Z < p.MinZoom || key.Z > p.MaxZoom {
+		return nil
+	}
+	cells := p.level(key.Z)[key]
+	if cells == nil {
+		return nil
+	}
+	img := image.NewNRGBA(image.Rect(0, 0, p.TileSize, p.TileSize))
+	for i, count := range cells.counts {
+		if count == 0 {
+			continue
+		}
+		var sum float64
+		if cells.sums != nil {
+			sum = cells.sums[i]
+		}
+		img.Set(i%p.TileSize, i/p.TileSize, toColor(count, sum))
+	}
+	return img
+}
+
+// WriteTiles writes the tiles at zoom level z to dir/z/x/y.png, returning the
+// number written.
+func (p *TilePyramid) WriteTiles(dir string, z int, toColor PixelColorer) (
+	numTiles int, err error) {
+	for _, key := range p.Tiles(z) {
+		img := p.RenderTile(key, toColor)
+		if err = writeTile(dir, key, img); err != nil {
+			return
+		}
+		numTiles++
+	}
+	return
+}
+
+func writeTile(dir string, key TileKey, img image.Image) (err error) {
+	fp := filepath.Join(dir, fmt.Sprint(key.Z), fmt.Sprint(key.X),
+		fmt.Sprintf("%d.png", key.Y))
+	if err = os.MkdirAll(filepath.Dir(fp), 0755); err != nil {
+		return
+	}
+	f, err := os.Create(fp)
+	if err != nil {
+		return
+	}
+	if err = png.Encode(f, img); err != nil {
+		f.Close()
+		return
+	}
+	return f.Close()
+}
+
+type tileKeySlice []TileKey
+
+func (p tileKeySlice) Len() int      { return len(p) }
+func (p tileKeySlice) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p tileKeySlice) Less(i, j int) bool {
+	if p[i].X != p[j].X {
+		return p[i].X < p[j].X
+	}
+	return p[i].Y < p[j].Y
+}
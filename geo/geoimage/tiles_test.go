@@ -0,0 +1,251 @@
+package geoimage
+
+import (
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jamessynge/transit_tools/geo"
+)
+
+var boston = geo.Location{Lat: 42.3601, Lon: -71.0589}
+
+func TestTileKeyAt(t *testing.T) {
+	for _, test := range []struct {
+		loc geo.Location
+		key TileKey
+	}{
+		{boston, TileKey{0, 0, 0}},
+		{boston, TileKey{1, 0, 0}},
+		{boston, TileKey{12, 1239, 1514}},
+		{boston, TileKey{15, 9916, 12119}},
+		{geo.Location{Lat: -33.8688, Lon: 151.2093}, TileKey{10, 942, 614}},
+		// Clamped to the edges of the map.
+		{geo.Location{Lat: 89, Lon: 180}, TileKey{2, 3, 0}},
+		{geo.Location{Lat: -89, Lon: -180}, TileKey{2, 0, 3}},
+	} {
+		if key := TileKeyAt(test.loc, test.key.Z); key != test.key {
+			t.Errorf("TileKeyAt(%v, %d) = %v, expected %v",
+				test.loc, test.key.Z, key, test.key)
+		}
+	}
+	b := TileKey{15, 9916, 12119}.Bounds()
+	if !(b.South <= boston.Lat && boston.Lat <= b.North &&
+		b.West <= boston.Lon && boston.Lon <= b.East) {
+		t.Errorf("Bounds %v don't contain %v", b, boston)
+	}
+	// At zoom level 15, tiles are 360/2^15 degrees of longitude wide.
+	if w := float64(b.East - b.West); math.Abs(w-360.0/32768) > 1e-9 {
+		t.Errorf("Tile width: %v", w)
+	}
+	if s := (TileKey{12, 1239, 1514}).String(); s != "12/1239/1514" {
+		t.Errorf("String: %q", s)
+	}
+}
+
+// Locations at each corner of a 40x40 grid, about 50 meters apart, centered on
+// Boston; the value of each is its row.
+func addGrid(p *TilePyramid) {
+	for row := 0; row < 40; row++ {
+		for col := 0; col < 40; col++ {
+			loc := geo.Location{
+				Lat: boston.Lat + geo.Latitude(float64(row-20)*0.00045),
+				Lon: boston.Lon + geo.Longitude(float64(col-20)*0.0006),
+			}
+			p.AddValue(loc, float64(row))
+		}
+	}
+}
+
+func TestTilePyramid(t *testing.T) {
+	if _, err := NewTilePyramid(5, 4, 256, false); err == nil {
+		t.Errorf("Expected an error for inverted zoom levels")
+	}
+	if _, err := NewTilePyramid(0, 4, 255, false); err == nil {
+		t.Errorf("Expected an error for an odd tile size")
+	}
+	p, err := NewTilePyramid(10, 17, 256, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addGrid(p)
+	p.AddValue(boston, math.NaN()) // Ignored.
+	var prevPixels int
+	for z := p.MaxZoom; z >= p.MinZoom; z-- {
+		var total uint64
+		var sum float64
+		pixels := 0
+		p.VisitPixels(z, func(count uint64, s float64) {
+			total += count
+			sum += s
+			pixels++
+		})
+		if total != 1600 || sum != 40*(39*40/2) {
+			t.Errorf("Zoom %d: total %d, sum %v", z, total, sum)
+		}
+		if z < p.MaxZoom && pixels > prevPixels {
+			t.Errorf("Zoom %d: %d pixels, more than %d", z, pixels, prevPixels)
+		}
+		prevPixels = pixels
+	}
+	// The grid is about 2km across, so it covers several tiles at level 17
+	// (about 225m wide), but only 1 or 2 each way at 14.
+	if n := len(p.Tiles(17)); n < 64 {
+		t.Errorf("Tiles at 17: %d", n)
+	}
+	if n := len(p.Tiles(14)); n < 1 || n > 4 {
+		t.Errorf("Tiles at 14: %v", p.Tiles(14))
+	}
+	if tiles := p.Tiles(10); !reflect.DeepEqual(tiles, []TileKey{{10, 309, 378}}) {
+		t.Errorf("Tiles at 10: %v", tiles)
+	}
+	if tiles := p.Tiles(9); tiles != nil {
+		t.Errorf("Tiles below MinZoom: %v", tiles)
+	}
+	bounds, ok := p.Bounds()
+	if !ok || bounds.South > boston.Lat-0.009 || bounds.North < boston.Lat+0.0085 ||
+		bounds.West > boston.Lon-0.012 || bounds.East < boston.Lon+0.0114 {
+		t.Errorf("Bounds: %v, %v", bounds, ok)
+	}
+
+	// Adding discards the aggregated levels.
+	p.Add(geo.Location{Lat: 42.5, Lon: -71.5})
+	if tiles := p.Tiles(10); len(tiles) != 2 {
+		t.Errorf("Tiles at 10 after Add: %v", tiles)
+	}
+}
+
+// A year of reports can put more than 2^32 in a pixel at the lower zoom
+// levels.
+func TestTilePyramidLargeCounts(t *testing.T) {
+	p, err := NewTilePyramid(10, 12, 256, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Add(boston)
+	for _, cells := range p.tiles {
+		for i := range cells.counts {
+			if cells.counts[i] > 0 {
+				cells.counts[i] = math.MaxUint32
+			}
+		}
+	}
+	p.Add(boston)
+	p.Add(geo.Location{Lat: boston.Lat + 0.0001, Lon: boston.Lon + 0.0001})
+	for z := p.MaxZoom; z >= p.MinZoom; z-- {
+		var total uint64
+		p.VisitPixels(z, func(count uint64, s float64) {
+			total += count
+		})
+		if total != math.MaxUint32+2 {
+			t.Errorf("Zoom %d: total %d, expected %d", z, total,
+				uint64(math.MaxUint32+2))
+		}
+	}
+}
+
+func TestColorScales(t *testing.T) {
+	ramp := ColorRamp{{0, 0, 0, 0}, {200, 100, 0, 255}}
+	if c := ramp.At(0.5); c != (color.NRGBA{100, 50, 0, 128}) {
+		t.Errorf("At(0.5) = %v", c)
+	}
+	if ramp.At(-1) != ramp[0] || ramp.At(2) != ramp[1] || ramp.At(math.NaN()) != ramp[0] {
+		t.Errorf("At outside [0, 1]")
+	}
+
+	p, _ := NewTilePyramid(0, 18, 256, true)
+	addGrid(p)
+	for i := 0; i < 99; i++ {
+		p.AddValue(boston, 100)
+	}
+
+	// Most pixels have a count of 1, so they get the low end of the ramp.
+	density := NewEqualizedScale(p, 18, HeatRamp)
+	low := density.Color(1, 0).(color.NRGBA)
+	high := density.Color(100, 0).(color.NRGBA)
+	if low.A >= high.A || high != HeatRamp[len(HeatRamp)-1] {
+		t.Errorf("Density colors: %v, %v", low, high)
+	}
+	legend := density.Legend(3)
+	if len(legend) != 3 || legend[0].Value != 1 || legend[2].Value != 100 ||
+		legend[2].CSSColor() != "rgba(255,255,255,1.000)" {
+		t.Errorf("Density legend: %v", legend)
+	}
+
+	values := NewValueScale(p, 18, 0, 1, RedYellowGreenRamp)
+	if values.Min != 0 || values.Max < 90 {
+		t.Errorf("Value scale: %+v", values)
+	}
+	values.Min, values.Max, values.MinCount = 0, 40, 2
+	if c := values.Color(2, 40); c != RedYellowGreenRamp.At(0.5) {
+		t.Errorf("Value color: %v", c)
+	}
+	if c := values.Color(1, 10); c != (color.NRGBA{}) {
+		t.Errorf("Expected transparent below MinCount: %v", c)
+	}
+	if legend := values.Legend(5); legend[1].Value != 10 {
+		t.Errorf("Value legend: %v", legend)
+	}
+}
+
+func TestWriteTilesAndViewer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p, _ := NewTilePyramid(12, 14, 128, false)
+	addGrid(p)
+	scale := NewEqualizedScale(p, 13, HeatRamp)
+	n, err := p.WriteTiles(dir, 13, scale.Color)
+	if err != nil || n != len(p.Tiles(13)) || n == 0 {
+		t.Fatalf("WriteTiles: %d, %v", n, err)
+	}
+	key := p.Tiles(13)[0]
+	f, err := os.Open(filepath.Join(dir, key.String()+".png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img, err := png.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != 128 || b.Dy() != 128 {
+		t.Errorf("Tile bounds: %v", b)
+	}
+
+	bounds, _ := p.Bounds()
+	config := &ViewerConfig{
+		Title:    "Test </script>",
+		MinZoom:  12,
+		MaxZoom:  14,
+		TileSize: 128,
+		Bounds:   bounds,
+		Units:    "reports",
+		Legends:  map[int][]LegendStop{13: scale.Legend(2)},
+	}
+	if err := WriteViewer(dir, config); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "index.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := string(data)
+	for _, s := range []string{`"tileSize":128`, `"13":[{"f":0`, `Test \u003c/script\u003e`} {
+		if !strings.Contains(page, s) {
+			t.Errorf("Viewer doesn't contain %s", s)
+		}
+	}
+	if strings.Contains(page, "/*CONFIG*/") || strings.Count(page, "</script>") != 1 {
+		t.Errorf("Viewer config not substituted correctly")
+	}
+}
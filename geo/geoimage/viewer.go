@@ -0,0 +1,238 @@
+package geoimage
+
+// A self-contained HTML page for viewing a tile pyramid written by
+// TilePyramid.WriteTiles: no map library or network access is needed, so the
+// directory can be copied anywhere and opened from the file system. Drag to
+// pan, and use the mouse wheel (or the buttons) to zoom.
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/jamessynge/transit_tools/geo"
+)
+
+type ViewerConfig struct {
+	Title            string
+	MinZoom, MaxZoom int
+	TileSize         int
+	// Initially, the viewer shows this region.
+	Bounds geo.Rect
+	// Of the legend values (e.g. "reports" or "m/s").
+	Units string
+	// Legend for each zoom level; if there is one for zoom level -1, it is used
+	// for the levels without their own.
+	Legends map[int][]LegendStop
+}
+
+type viewerLegendStop struct {
+	Fraction float64 `json:"f"`
+	Value    float64 `json:"v"`
+	Color    string  `json:"c"`
+}
+
+type viewerJSON struct {
+	Title    string                        `json:"title"`
+	MinZoom  int                           `json:"minZoom"`
+	MaxZoom  int                           `json:"maxZoom"`
+	TileSize int                           `json:"tileSize"`
+	Bounds   [4]float64                    `json:"bounds"` // S, W, N, E
+	Units    string                        `json:"units"`
+	Legends  map[string][]viewerLegendStop `json:"legends"`
+}
+
+func (c *ViewerConfig) toJSON() ([]byte, error) {
+	v := viewerJSON{
+		Title:    c.Title,
+		MinZoom:  c.MinZoom,
+		MaxZoom:  c.MaxZoom,
+		TileSize: c.TileSize,
+		Bounds: [4]float64{float64(c.Bounds.South), float64(c.Bounds.West),
+			float64(c.Bounds.North), float64(c.Bounds.East)},
+		Units:   c.Units,
+		Legends: make(map[string][]viewerLegendStop),
+	}
+	var zooms []int
+	for z := range c.Legends {
+		zooms = append(zooms, z)
+	}
+	sort.Ints(zooms)
+	for _, z := range zooms {
+		var stops []viewerLegendStop
+		for _, s := range c.Legends[z] {
+			stops = append(stops, viewerLegendStop{s.Fraction, s.Value, s.CSSColor()})
+		}
+		v.Legends[fmt.Sprint(z)] = stops
+	}
+	return json.Marshal(v)
+}
+
+// WriteViewer writes index.html, for viewing the tiles in dir.
+func WriteViewer(dir string, config *ViewerConfig) error {
+	data, err := config.toJSON()
+	if err != nil {
+		return err
+	}
+	// json.Marshal escapes <, > and &, so a "</script>" in the title can't end
+	// the script.
+	page := strings.Replace(viewerHtml, "/*CONFIG*/", string(data), 1)
+	return writeFileAtomically(filepath.Join(dir, "index.html"), []byte(page))
+}
+
+func writeFileAtomically(fp string, data []byte) error {
+	tmp := fp + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fp)
+}
+
+const viewerHtml = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Heatmap</title>
+<style>
+  html, body { margin: 0; height: 100%; font: 13px sans-serif; }
+  #map { position: absolute; top: 0; bottom: 0; left: 0; right: 0;
+         overflow: hidden; background: #222; cursor: grab; }
+  #map img { position: absolute; image-rendering: pixelated; user-select: none; }
+  .panel { position: absolute; background: rgba(255,255,255,0.85);
+           padding: 6px 8px; border-radius: 4px; }
+  #controls { top: 8px; left: 8px; }
+  #controls button { width: 28px; height: 28px; font-size: 16px; }
+  #legend { bottom: 8px; right: 8px; min-width: 220px; }
+  #bar { height: 12px; margin: 4px 0; }
+  #labels { display: flex; justify-content: space-between; }
+  #status { bottom: 8px; left: 8px; }
+</style>
+</head>
+<body>
+<div id="map"></div>
+<div id="controls" class="panel">
+  <div id="title"></div>
+  <button id="zoomIn">+</button> <button id="zoomOut">&minus;</button>
+</div>
+<div id="legend" class="panel">
+  <div id="bar"></div><div id="labels"></div><div id="units"></div>
+</div>
+<div id="status" class="panel"></div>
+<script>
+var cfg = /*CONFIG*/;
+var TS = cfg.tileSize;
+var map = document.getElementById('map');
+var z, cx, cy;  // Zoom level, and the world pixel at the center of the map.
+
+function worldSize(zoom) { return TS * Math.pow(2, zoom); }
+function project(lat, lon, zoom) {
+  var s = Math.sin(lat * Math.PI / 180), w = worldSize(zoom);
+  return [(lon + 180) / 360 * w,
+          (0.5 - Math.log((1 + s) / (1 - s)) / (4 * Math.PI)) * w];
+}
+function unproject(x, y, zoom) {
+  var w = worldSize(zoom), n = Math.PI - 2 * Math.PI * y / w;
+  return [180 / Math.PI * Math.atan(Math.sinh(n)), x / w * 360 - 180];
+}
+
+function render() {
+  var w = map.clientWidth, h = map.clientHeight;
+  var left = cx - w / 2, top = cy - h / 2, n = Math.pow(2, z);
+  var x0 = Math.floor(left / TS), x1 = Math.floor((left + w) / TS);
+  var y0 = Math.max(0, Math.floor(top / TS));
+  var y1 = Math.min(n - 1, Math.floor((top + h) / TS));
+  map.innerHTML = '';
+  for (var x = x0; x <= x1; x++) {
+    for (var y = y0; y <= y1; y++) {
+      var img = document.createElement('img');
+      img.style.left = Math.round(x * TS - left) + 'px';
+      img.style.top = Math.round(y * TS - top) + 'px';
+      img.style.width = img.style.height = TS + 'px';
+      img.onerror = function() { this.style.display = 'none'; };
+      img.draggable = false;
+      img.src = z + '/' + (((x % n) + n) % n) + '/' + y + '.png';
+      map.appendChild(img);
+    }
+  }
+  renderLegend();
+}
+
+function renderLegend() {
+  var stops = cfg.legends[String(z)] || cfg.legends['-1'] || [];
+  var colors = stops.map(function(s) { return s.c + ' ' + (s.f * 100) + '%'; });
+  document.getElementById('bar').style.background =
+      'linear-gradient(to right, ' + colors.join(', ') + ')';
+  document.getElementById('labels').innerHTML = stops.map(function(s) {
+    return '<span>' + (Math.abs(s.v) >= 100 ? s.v.toFixed(0) : s.v.toPrecision(3)) +
+        '</span>';
+  }).join('');
+  document.getElementById('units').textContent =
+      cfg.units + ' (zoom ' + z + ')';
+}
+
+function setZoom(newZoom, px, py) {
+  // Keep the point under (px, py) (relative to the center) in place.
+  newZoom = Math.max(cfg.minZoom, Math.min(cfg.maxZoom, newZoom));
+  if (newZoom == z) return;
+  var f = Math.pow(2, newZoom - z);
+  cx = (cx + px) * f - px;
+  cy = (cy + py) * f - py;
+  z = newZoom;
+  render();
+}
+
+function fitBounds() {
+  var b = cfg.bounds, w = map.clientWidth, h = map.clientHeight;
+  for (z = cfg.maxZoom; z > cfg.minZoom; z--) {
+    var sw = project(b[0], b[1], z), ne = project(b[2], b[3], z);
+    if (ne[0] - sw[0] <= w && sw[1] - ne[1] <= h) break;
+  }
+  var c = project((b[0] + b[2]) / 2, (b[1] + b[3]) / 2, z);
+  cx = c[0];
+  cy = c[1];
+}
+
+var drag = null;
+map.onmousedown = function(e) { drag = [e.clientX, e.clientY]; e.preventDefault(); };
+window.onmouseup = function() { drag = null; };
+window.onmousemove = function(e) {
+  var r = map.getBoundingClientRect();
+  var ll = unproject(cx - r.width / 2 + e.clientX - r.left,
+                     cy - r.height / 2 + e.clientY - r.top, z);
+  document.getElementById('status').textContent =
+      ll[0].toFixed(5) + ', ' + ll[1].toFixed(5);
+  if (!drag) return;
+  cx -= e.clientX - drag[0];
+  cy -= e.clientY - drag[1];
+  drag = [e.clientX, e.clientY];
+  render();
+};
+map.onwheel = function(e) {
+  e.preventDefault();
+  var r = map.getBoundingClientRect();
+  setZoom(z + (e.deltaY < 0 ? 1 : -1),
+          e.clientX - r.left - r.width / 2, e.clientY - r.top - r.height / 2);
+};
+document.getElementById('zoomIn').onclick = function() { setZoom(z + 1, 0, 0); };
+document.getElementById('zoomOut').onclick = function() { setZoom(z - 1, 0, 0); };
+window.onresize = render;
+
+document.title = cfg.title || document.title;
+document.getElementById('title').textContent = cfg.title;
+fitBounds();
+render();
+</script>
+</body>
+</html>
+`
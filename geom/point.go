@@ -96,7 +96,7 @@ func VisitPoints(points interface{}, fn func(pt Point)) {
 		}
 		sf, ok := et.FieldByName("Point")
 		if ok && !(sf.Anonymous && sf.Type == _typeof_Point) {
-			log.Fatal("Point field (%v) is not embedded in ", sf, et.String())
+			log.Fatalf("Point field (%v) is not embedded in %s", sf, et.String())
 		} else if !ok {
 			log.Fatal("Not a pointer, nor struct with embedded Point: ", et.String())
 		}
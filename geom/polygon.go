@@ -0,0 +1,278 @@
+package geom
+
+import (
+	"math"
+)
+
+// A Polygon is a closed ring of points; the edge from the last point back to
+// the first is implied (i.e. the first point should not be repeated at the
+// end). Either orientation is allowed, though Buffer and the results of Clip
+// and Circle are counter-clockwise (positive SignedArea).
+type Polygon []Point
+
+func (pg Polygon) Bounds() Rect {
+	return boundsOfPoints(pg)
+}
+
+func boundsOfPoints(points []Point) (bounds Rect) {
+	for i, pt := range points {
+		if i == 0 {
+			bounds = Rect{pt.X, pt.X, pt.Y, pt.Y}
+			continue
+		}
+		bounds.MinX = math.Min(bounds.MinX, pt.X)
+		bounds.MaxX = math.Max(bounds.MaxX, pt.X)
+		bounds.MinY = math.Min(bounds.MinY, pt.Y)
+		bounds.MaxY = math.Max(bounds.MaxY, pt.Y)
+	}
+	return
+}
+
+// Returns the edge from pg[i] to the following point.
+func (pg Polygon) Edge(i int) Segment {
+	return Segment{pg[i], pg[(i+1)%len(pg)]}
+}
+
+func (pg Polygon) Edges() []Segment {
+	result := make([]Segment, len(pg))
+	for i := range pg {
+		result[i] = pg.Edge(i)
+	}
+	return result
+}
+
+// Shoelace formula; positive if the points are counter-clockwise.
+func (pg Polygon) SignedArea() float64 {
+	area := 0.0
+	for i, pt := range pg {
+		next := pg[(i+1)%len(pg)]
+		area += pt.X*next.Y - next.X*pt.Y
+	}
+	return area / 2
+}
+
+// The area of a simple (not self-intersecting) polygon.
+func (pg Polygon) Area() float64 {
+	return math.Abs(pg.SignedArea())
+}
+
+func (pg Polygon) Perimeter() (perimeter float64) {
+	for i, pt := range pg {
+		perimeter += pt.Distance(pg[(i+1)%len(pg)])
+	}
+	return
+}
+
+// The centroid (center of mass) of a simple polygon.
+func (pg Polygon) Centroid() Point {
+	var cx, cy, a float64
+	for i, pt := range pg {
+		next := pg[(i+1)%len(pg)]
+		cross := pt.X*next.Y - next.X*pt.Y
+		cx += (pt.X + next.X) * cross
+		cy += (pt.Y + next.Y) * cross
+		a += cross
+	}
+	if a == 0 {
+		return pg.Bounds().Center()
+	}
+	return Point{cx / (3 * a), cy / (3 * a)}
+}
+
+func (pg Polygon) IsCounterClockwise() bool {
+	return pg.SignedArea() > 0
+}
+
+// Returns a copy with the points in the reverse order.
+func (pg Polygon) Reversed() Polygon {
+	result := make(Polygon, len(pg))
+	for i, pt := range pg {
+		result[len(pg)-1-i] = pt
+	}
+	return result
+}
+
+// ContainsPoint uses the non-zero winding rule, so that regions covered more
+// than once by a self-intersecting polygon (e.g. by the result of Buffer)
+// are inside. Points exactly on an edge may be either inside or outside.
+func (pg Polygon) ContainsPoint(pt Point) bool {
+	winding := 0
+	for i, a := range pg {
+		b := pg[(i+1)%len(pg)]
+		// Positive if pt is to the left of the line from a to b.
+		side := (b.X-a.X)*(pt.Y-a.Y) - (pt.X-a.X)*(b.Y-a.Y)
+		if a.Y <= pt.Y {
+			if b.Y > pt.Y && side > 0 {
+				winding++ // Upward crossing, to the right of pt.
+			}
+		} else if b.Y <= pt.Y && side < 0 {
+			winding-- // Downward crossing, to the right of pt.
+		}
+	}
+	return winding != 0
+}
+
+// Returns the distance from pt to the nearest edge (zero if on an edge,
+// whether pt is inside or outside).
+func (pg Polygon) DistanceToBoundary(pt Point) float64 {
+	distance := math.Inf(1)
+	for i, a := range pg {
+		distance = math.Min(distance, distanceToSegment(a, pg[(i+1)%len(pg)], pt))
+	}
+	return distance
+}
+
+// Returns a polygon approximating a circle with numPoints (at least 3)
+// vertices, all on the circle.
+func Circle(center Point, radius float64, numPoints int) Polygon {
+	if numPoints < 3 {
+		numPoints = 3
+	}
+	result := make(Polygon, numPoints)
+	for i := range result {
+		s, c := math.Sincos(2 * math.Pi * float64(i) / float64(numPoints))
+		result[i] = Point{center.X + radius*c, center.Y + radius*s}
+	}
+	return result
+}
+
+func RectPolygon(r Rect) Polygon {
+	return Polygon{{r.MinX, r.MinY}, {r.MaxX, r.MinY}, {r.MaxX, r.MaxY}, {r.MinX, r.MaxY}}
+}
+
+// Clip returns the part of pg inside clip, which must be convex, using the
+// Sutherland-Hodgman algorithm. If pg is not convex, the result may include
+// zero-width slivers along the edges of clip where pg has several separate
+// parts inside clip; these don't affect the area. Returns nil if there is no
+// overlap.
+func (pg Polygon) Clip(clip Polygon) Polygon {
+	if len(clip) < 3 {
+		return nil
+	}
+	if !clip.IsCounterClockwise() {
+		clip = clip.Reversed()
+	}
+	result := pg
+	if !result.IsCounterClockwise() {
+		result = result.Reversed()
+	}
+	for i, a := range clip {
+		if len(result) == 0 {
+			return nil
+		}
+		b := clip[(i+1)%len(clip)]
+		// Keep the parts to the left of the line from a to b.
+		side := func(pt Point) float64 {
+			return (b.X-a.X)*(pt.Y-a.Y) - (pt.X-a.X)*(b.Y-a.Y)
+		}
+		input := result
+		result = nil
+		prev := input[len(input)-1]
+		prevSide := side(prev)
+		for _, pt := range input {
+			ptSide := side(pt)
+			if ptSide >= 0 {
+				if prevSide < 0 {
+					result = append(result, interpolate(prev, pt, prevSide/(prevSide-ptSide)))
+				}
+				result = append(result, pt)
+			} else if prevSide >= 0 {
+				if prevSide > 0 {
+					result = append(result, interpolate(prev, pt, prevSide/(prevSide-ptSide)))
+				}
+			}
+			prev, prevSide = pt, ptSide
+		}
+	}
+	if len(result) < 3 {
+		return nil
+	}
+	return result
+}
+
+func (pg Polygon) ClipToRect(r Rect) Polygon {
+	return pg.Clip(RectPolygon(r))
+}
+
+// Buffer returns a counter-clockwise polygon whose boundary is distance
+// outside the boundary of pg (inside if distance is negative), with round
+// corners (each 90° of arc approximated by arcSegments segments). For convex
+// polygons the result is exact (apart from the approximation of the arcs);
+// for other polygons the boundary may self-intersect where the distance
+// exceeds half the width of a concavity (or of the polygon, if shrinking),
+// though ContainsPoint still correctly reports the points within distance.
+// Shrinking is only meaningful for distances less than the radius of the
+// largest circle inside the polygon; beyond that the result is garbage.
+func (pg Polygon) Buffer(distance float64, arcSegments int) Polygon {
+	if len(pg) < 3 {
+		return nil
+	}
+	ccw := pg
+	if !ccw.IsCounterClockwise() {
+		ccw = ccw.Reversed()
+	}
+	// The right side of each edge of a counter-clockwise polygon is outside.
+	return ccw.offsetRing(distance, arcSegments, false)
+}
+
+// Returns the ring offset to the right of each edge by distance (to the left
+// if negative), with round joins where the offset edges separate (e.g.
+// around the outside of a convex corner), and mitered joins where they cross.
+// If openEnds, then the ring is an out-and-back polyline, and its U-turns at
+// the two ends are capped with semicircles.
+func (ring Polygon) offsetRing(
+	distance float64, arcSegments int, openEnds bool) Polygon {
+	if arcSegments < 1 {
+		arcSegments = 1
+	}
+	n := len(ring)
+	normals := make([]Point, n) // Unit vectors to the right of each edge.
+	for i, a := range ring {
+		d := ring[(i+1)%n].Minus(a)
+		l := d.Length()
+		if l == 0 {
+			normals[i] = normals[(i+n-1)%n]
+			continue
+		}
+		normals[i] = Point{d.Y / l, -d.X / l}
+	}
+	var result Polygon
+	for j, v := range ring {
+		n1, n2 := normals[(j+n-1)%n], normals[j]
+		// Signed angle of the turn at v (positive to the left).
+		cross := n1.X*n2.Y - n1.Y*n2.X
+		dot := n1.DotProduct(n2)
+		theta := math.Atan2(cross, dot)
+		if openEnds && (j == 0 || j == n/2) || math.Abs(theta) > math.Pi-1e-9 {
+			// U-turn; go around the far side.
+			theta = math.Copysign(math.Pi, distance)
+		}
+		switch {
+		case math.Abs(theta) < 1e-9:
+			result = append(result, v.plusScaled(n2, distance))
+		case theta*distance > 0:
+			// The offset edges separate; join them with an arc centered on v.
+			steps := int(math.Ceil(math.Abs(theta) / (math.Pi / 2) * float64(arcSegments)))
+			for k := 0; k <= steps; k++ {
+				s, c := math.Sincos(theta * float64(k) / float64(steps))
+				r := Point{n1.X*c - n1.Y*s, n1.X*s + n1.Y*c}
+				result = append(result, v.plusScaled(r, distance))
+			}
+		case dot >= -0.5:
+			// The offset edges cross; the miter point is at their intersection.
+			result = append(result, v.plusScaled(
+				Point{n1.X + n2.X, n1.Y + n2.Y}, distance/(1+dot)))
+		default:
+			// A sharp inner corner, where the miter point would be far away;
+			// instead connect the offset edges via v, which makes a small loop
+			// (inside the buffer).
+			result = append(result, v.plusScaled(n1, distance), v,
+				v.plusScaled(n2, distance))
+		}
+	}
+	return result
+}
+
+func (p Point) plusScaled(v Point, s float64) Point {
+	return Point{p.X + v.X*s, p.Y + v.Y*s}
+}
@@ -0,0 +1,129 @@
+package geom
+
+import (
+	"math"
+	"testing"
+)
+
+// A U shape (concave), counter-clockwise; area 3*3 - 1*2 = 7.
+var testU = Polygon{{0, 0}, {3, 0}, {3, 3}, {2, 3}, {2, 1}, {1, 1}, {1, 3}, {0, 3}}
+
+func TestPolygonArea(t *testing.T) {
+	if a := testU.SignedArea(); a != 7 {
+		t.Errorf("SignedArea() = %v, expected 7", a)
+	}
+	if a := testU.Reversed().SignedArea(); a != -7 {
+		t.Errorf("Reversed().SignedArea() = %v, expected -7", a)
+	}
+	if p := testU.Perimeter(); p != 16 {
+		t.Errorf("Perimeter() = %v, expected 16", p)
+	}
+	square := RectPolygon(NewRect(1, 3, 2, 6))
+	if c := square.Centroid(); !c.NearlyEqual(Point{2, 4}) {
+		t.Errorf("Centroid() = %v, expected (2, 4)", c)
+	}
+	if b := testU.Bounds(); b != NewRect(0, 3, 0, 3) {
+		t.Errorf("Bounds() = %v", b)
+	}
+}
+
+func TestPolygonContainsPoint(t *testing.T) {
+	tests := []struct {
+		pt     Point
+		inside bool
+	}{
+		{Point{0.5, 0.5}, true},
+		{Point{0.5, 2.5}, true},
+		{Point{1.5, 0.5}, true},
+		{Point{1.5, 2}, false}, // In the notch.
+		{Point{2.5, 2.9}, true},
+		{Point{-1, 1}, false},
+		{Point{4, 1}, false},
+		{Point{1.5, 3.5}, false},
+	}
+	for _, test := range tests {
+		if got := testU.ContainsPoint(test.pt); got != test.inside {
+			t.Errorf("ContainsPoint(%v) = %v", test.pt, got)
+		}
+		if got := testU.Reversed().ContainsPoint(test.pt); got != test.inside {
+			t.Errorf("Reversed().ContainsPoint(%v) = %v", test.pt, got)
+		}
+	}
+	if d := testU.DistanceToBoundary(Point{1.5, 2}); !nearly(d, 0.5) {
+		t.Errorf("DistanceToBoundary = %v, expected 0.5", d)
+	}
+}
+
+func TestPolygonClip(t *testing.T) {
+	// Clip the U to its lower half; the result is a 3x1.5 rectangle, less the
+	// notch from y=1 to 1.5.
+	clipped := testU.ClipToRect(NewRect(-1, 4, -1, 1.5))
+	if a := clipped.Area(); !nearly(a, 4) {
+		t.Errorf("Area of clipped = %v, expected 4: %v", a, clipped)
+	}
+	if !clipped.IsCounterClockwise() {
+		t.Errorf("Clipped isn't counter-clockwise: %v", clipped)
+	}
+	// Clip the arms, which are separate parts inside the rectangle.
+	arms := testU.ClipToRect(NewRect(-1, 4, 2, 4))
+	if a := arms.Area(); !nearly(a, 2) {
+		t.Errorf("Area of arms = %v, expected 2: %v", a, arms)
+	}
+	if got := testU.ClipToRect(NewRect(5, 6, 5, 6)); got != nil {
+		t.Errorf("Clip outside = %v, expected nil", got)
+	}
+	// Two overlapping triangles.
+	tri := Polygon{{0, 0}, {4, 0}, {0, 4}}
+	got := tri.Clip(Polygon{{4, 4}, {0, 4}, {4, 0}}.Reversed())
+	if got != nil && got.Area() > 1e-9 {
+		t.Errorf("Triangles touching on an edge overlap: %v", got)
+	}
+	got = tri.Clip(RectPolygon(NewRect(1, 3, 1, 3)))
+	// The square less the triangle above x+y=4.
+	if a := got.Area(); !nearly(a, 4-2) {
+		t.Errorf("Area of clipped triangle = %v, expected 2: %v", a, got)
+	}
+}
+
+func TestPolygonBuffer(t *testing.T) {
+	square := RectPolygon(NewRect(0, 2, 0, 2))
+	grown := square.Reversed().Buffer(1, 16)
+	if !grown.IsCounterClockwise() {
+		t.Errorf("Buffer isn't counter-clockwise")
+	}
+	exact := 4 + 4*2 + math.Pi
+	if a := grown.Area(); math.Abs(a-exact) > 0.01 {
+		t.Errorf("Area of buffer = %v, expected ~%v", a, exact)
+	}
+	shrunk := square.Buffer(-0.5, 16)
+	if a := shrunk.SignedArea(); !nearly(a, 1) {
+		t.Errorf("Area of shrunken square = %v, expected 1: %v", a, shrunk)
+	}
+
+	// The concave U, grown by 0.25: the notch is narrowed.
+	buffer := testU.Buffer(0.25, 8)
+	for x := -1.0; x <= 4; x += 0.125 {
+		for y := -1.0; y <= 4; y += 0.125 {
+			pt := Point{x, y}
+			var d float64
+			if !testU.ContainsPoint(pt) {
+				d = testU.DistanceToBoundary(pt)
+			}
+			if d < 0.24 && !buffer.ContainsPoint(pt) ||
+				d > 0.25 && buffer.ContainsPoint(pt) {
+				t.Errorf("Buffer.ContainsPoint(%v) = %v, but distance is %v",
+					pt, buffer.ContainsPoint(pt), d)
+			}
+		}
+	}
+}
+
+func TestCircle(t *testing.T) {
+	c := Circle(Point{1, 1}, 2, 360)
+	if a := c.Area(); math.Abs(a-4*math.Pi) > 0.01 {
+		t.Errorf("Area of circle = %v", a)
+	}
+	if !c.ContainsPoint(Point{2.9, 1}) || c.ContainsPoint(Point{3.1, 1}) {
+		t.Errorf("Circle.ContainsPoint is wrong")
+	}
+}
@@ -0,0 +1,250 @@
+package geom
+
+import (
+	"math"
+)
+
+// A Polyline is a sequence of points connected by straight segments (e.g. a
+// projected nextbus.Path). Offsets are distances along the polyline from its
+// first point.
+type Polyline []Point
+
+// A position along a polyline: on the segment from pl[Index] to
+// pl[Index+1], at the fraction Fraction of its length (Index is the last
+// point, with Fraction 0, at the end of the polyline).
+type PolylinePosition struct {
+	Index    int
+	Fraction float64
+	Offset   float64
+	Point    Point
+}
+
+func (pl Polyline) Length() (length float64) {
+	for i := 1; i < len(pl); i++ {
+		length += pl[i-1].Distance(pl[i])
+	}
+	return
+}
+
+func (pl Polyline) Bounds() Rect {
+	return boundsOfPoints(pl)
+}
+
+// Returns the offset of each point (i.e. the first is 0, the last is the
+// length).
+func (pl Polyline) Offsets() []float64 {
+	result := make([]float64, len(pl))
+	for i := 1; i < len(pl); i++ {
+		result[i] = result[i-1] + pl[i-1].Distance(pl[i])
+	}
+	return result
+}
+
+func (pl Polyline) Segments() []Segment {
+	if len(pl) < 2 {
+		return nil
+	}
+	result := make([]Segment, len(pl)-1)
+	for i := range result {
+		result[i] = Segment{pl[i], pl[i+1]}
+	}
+	return result
+}
+
+// Returns the position at the offset, interpolating between points; offsets
+// before the start or beyond the end are clamped. pl must not be empty.
+func (pl Polyline) PositionAtOffset(offset float64) PolylinePosition {
+	if offset <= 0 || len(pl) == 1 {
+		return PolylinePosition{Point: pl[0]}
+	}
+	start := 0.0
+	for i := 0; i+1 < len(pl); i++ {
+		segLength := pl[i].Distance(pl[i+1])
+		if offset < start+segLength {
+			fraction := (offset - start) / segLength
+			return PolylinePosition{
+				Index:    i,
+				Fraction: fraction,
+				Offset:   offset,
+				Point:    interpolate(pl[i], pl[i+1], fraction),
+			}
+		}
+		start += segLength
+	}
+	return PolylinePosition{Index: len(pl) - 1, Offset: start, Point: pl[len(pl)-1]}
+}
+
+// Returns the point at the offset; see PositionAtOffset.
+func (pl Polyline) PointAtOffset(offset float64) Point {
+	return pl.PositionAtOffset(offset).Point
+}
+
+func interpolate(a, b Point, fraction float64) Point {
+	return Point{a.X + (b.X-a.X)*fraction, a.Y + (b.Y-a.Y)*fraction}
+}
+
+// Returns the fraction along the segment from a to b of the point on it
+// closest to pt.
+func closestFraction(a, b, pt Point) float64 {
+	dX, dY := b.X-a.X, b.Y-a.Y
+	lengthSquared := dX*dX + dY*dY
+	if lengthSquared == 0 {
+		return 0
+	}
+	r := ((pt.X-a.X)*dX + (pt.Y-a.Y)*dY) / lengthSquared
+	return math.Max(0, math.Min(1, r))
+}
+
+// Returns the distance from pt to the segment from a to b.
+func distanceToSegment(a, b, pt Point) float64 {
+	return pt.Distance(interpolate(a, b, closestFraction(a, b, pt)))
+}
+
+// Project finds the position on the polyline closest to pt, and the distance
+// from pt to it. Where several positions are equally close, returns the
+// first. pl must not be empty.
+func (pl Polyline) Project(pt Point) (pos PolylinePosition, distance float64) {
+	pos = PolylinePosition{Point: pl[0]}
+	distance = pt.Distance(pl[0])
+	start := 0.0
+	for i := 0; i+1 < len(pl); i++ {
+		segLength := pl[i].Distance(pl[i+1])
+		fraction := closestFraction(pl[i], pl[i+1], pt)
+		closest := interpolate(pl[i], pl[i+1], fraction)
+		if d := pt.Distance(closest); d < distance {
+			distance = d
+			pos = PolylinePosition{
+				Index:    i,
+				Fraction: fraction,
+				Offset:   start + fraction*segLength,
+				Point:    closest,
+			}
+		}
+		start += segLength
+	}
+	if pos.Fraction == 1 {
+		// Normalize to the start of the next segment.
+		pos.Index++
+		pos.Fraction = 0
+	}
+	return
+}
+
+// Returns the distance from pt to the closest point on the polyline.
+func (pl Polyline) DistanceToPoint(pt Point) float64 {
+	_, distance := pl.Project(pt)
+	return distance
+}
+
+// Returns the part of the polyline between the two offsets (clamped to the
+// polyline); empty if from >= to.
+func (pl Polyline) SubPolyline(from, to float64) Polyline {
+	if len(pl) == 0 || from >= to {
+		return nil
+	}
+	start, end := pl.PositionAtOffset(from), pl.PositionAtOffset(to)
+	result := Polyline{start.Point}
+	for i := start.Index + 1; i <= end.Index; i++ {
+		if !pl[i].NearlyEqual(result[len(result)-1]) {
+			result = append(result, pl[i])
+		}
+	}
+	if !end.Point.NearlyEqual(result[len(result)-1]) {
+		result = append(result, end.Point)
+	}
+	return result
+}
+
+// Simplify applies the Douglas-Peucker algorithm: the result contains a
+// subset of the points, including the first and last, such that no removed
+// point is further than tolerance from the result.
+func (pl Polyline) Simplify(tolerance float64) Polyline {
+	if len(pl) <= 2 {
+		return append(Polyline(nil), pl...)
+	}
+	keep := make([]bool, len(pl))
+	keep[0], keep[len(pl)-1] = true, true
+	type span struct{ first, last int }
+	stack := []span{{0, len(pl) - 1}}
+	for len(stack) > 0 {
+		s := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		maxDistance, maxIndex := -1.0, -1
+		for i := s.first + 1; i < s.last; i++ {
+			d := distanceToSegment(pl[s.first], pl[s.last], pl[i])
+			if d > maxDistance {
+				maxDistance, maxIndex = d, i
+			}
+		}
+		if maxIndex >= 0 && maxDistance > tolerance {
+			keep[maxIndex] = true
+			stack = append(stack, span{s.first, maxIndex}, span{maxIndex, s.last})
+		}
+	}
+	var result Polyline
+	for i, pt := range pl {
+		if keep[i] {
+			result = append(result, pt)
+		}
+	}
+	return result
+}
+
+// Resample returns points evenly spaced along the polyline, including its
+// first and last points, no more than maxSpacing apart. This smooths out
+// short segments (e.g. the jogs to the curb at stops in MBTA paths), while
+// preserving the length. If maxSpacing isn't positive (or is NaN), returns a
+// copy of the polyline.
+func (pl Polyline) Resample(maxSpacing float64) Polyline {
+	if len(pl) < 2 || !(maxSpacing > 0) {
+		return append(Polyline(nil), pl...)
+	}
+	length := pl.Length()
+	numSegs := math.Max(1, math.Ceil(length/maxSpacing))
+	spacing := length / numSegs
+	result := make(Polyline, 0, int(numSegs)+1)
+	result = append(result, pl[0])
+	// Walk along the polyline, rather than calling PointAtOffset for each
+	// point, to avoid quadratic behavior.
+	i, start := 0, 0.0
+	segLength := pl[0].Distance(pl[1])
+	for n := 1; n < int(numSegs); n++ {
+		offset := float64(n) * spacing
+		for offset > start+segLength && i+2 < len(pl) {
+			start += segLength
+			i++
+			segLength = pl[i].Distance(pl[i+1])
+		}
+		result = append(result, interpolate(pl[i], pl[i+1], (offset-start)/segLength))
+	}
+	return append(result, pl[len(pl)-1])
+}
+
+// Buffer returns a polygon (counter-clockwise) enclosing the points within
+// distance of the polyline (i.e. a corridor around a path), with round joins
+// and ends, each semicircle approximated by 2*arcSegments segments. As with
+// Polygon.Buffer, the result may self-intersect where the polyline turns back
+// on itself within 2*distance; it is still suitable for ContainsPoint, which
+// uses the non-zero winding rule.
+func (pl Polyline) Buffer(distance float64, arcSegments int) Polygon {
+	if len(pl) == 0 || distance <= 0 {
+		return nil
+	}
+	var simple Polyline
+	for _, pt := range pl {
+		if len(simple) == 0 || !pt.NearlyEqual(simple[len(simple)-1]) {
+			simple = append(simple, pt)
+		}
+	}
+	if len(simple) == 1 {
+		return Circle(simple[0], distance, 4*arcSegments)
+	}
+	// Follow the right side out, and the left side back, each as the outer
+	// boundary of a ring formed by going out and back along the polyline.
+	ring := make(Polygon, 0, 2*len(simple))
+	ring = append(ring, simple...)
+	for i := len(simple) - 2; i > 0; i-- {
+		ring = append(ring, simple[i])
+	}
+	return ring.offsetRing(distance, arcSegments, true)
+}
@@ -0,0 +1,180 @@
+package geom
+
+import (
+	"math"
+	"testing"
+)
+
+func nearly(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+// An L shape: 10 east, then 5 north.
+var testL = Polyline{{0, 0}, {10, 0}, {10, 5}}
+
+func TestPolylineLength(t *testing.T) {
+	if l := testL.Length(); l != 15 {
+		t.Errorf("Length() = %v, expected 15", l)
+	}
+	offsets := testL.Offsets()
+	if len(offsets) != 3 || offsets[1] != 10 || offsets[2] != 15 {
+		t.Errorf("Offsets() = %v", offsets)
+	}
+	if l := (Polyline{{1, 1}}).Length(); l != 0 {
+		t.Errorf("Length of single point = %v", l)
+	}
+}
+
+func TestPolylinePositionAtOffset(t *testing.T) {
+	tests := []struct {
+		offset float64
+		index  int
+		pt     Point
+	}{
+		{-1, 0, Point{0, 0}},
+		{0, 0, Point{0, 0}},
+		{2.5, 0, Point{2.5, 0}},
+		{10, 1, Point{10, 0}},
+		{12, 1, Point{10, 2}},
+		{15, 2, Point{10, 5}},
+		{99, 2, Point{10, 5}},
+	}
+	for _, test := range tests {
+		pos := testL.PositionAtOffset(test.offset)
+		if pos.Index != test.index || !pos.Point.NearlyEqual(test.pt) {
+			t.Errorf("PositionAtOffset(%v) = %+v, expected index %d, %v",
+				test.offset, pos, test.index, test.pt)
+		}
+	}
+}
+
+func TestPolylineProject(t *testing.T) {
+	tests := []struct {
+		pt       Point
+		offset   float64
+		distance float64
+		index    int
+	}{
+		{Point{3, 2}, 3, 2, 0},
+		{Point{-3, -4}, 0, 5, 0},
+		{Point{12, 4}, 14, 2, 1},
+		{Point{13, 9}, 15, 5, 2},
+		{Point{11, -1}, 10, math.Sqrt2, 1}, // The corner.
+	}
+	for _, test := range tests {
+		pos, distance := testL.Project(test.pt)
+		if !nearly(pos.Offset, test.offset) || !nearly(distance, test.distance) ||
+			pos.Index != test.index {
+			t.Errorf("Project(%v) = %+v, %v; expected offset %v, distance %v, index %d",
+				test.pt, pos, distance, test.offset, test.distance, test.index)
+		}
+		// Projecting onto the polyline, then finding that offset, should
+		// produce the same point.
+		if pt := testL.PointAtOffset(pos.Offset); !pt.NearlyEqual(pos.Point) {
+			t.Errorf("PointAtOffset(%v) = %v, expected %v", pos.Offset, pt, pos.Point)
+		}
+	}
+}
+
+func TestPolylineSubPolyline(t *testing.T) {
+	got := testL.SubPolyline(5, 12)
+	want := Polyline{{5, 0}, {10, 0}, {10, 2}}
+	if len(got) != len(want) {
+		t.Fatalf("SubPolyline(5, 12) = %v, expected %v", got, want)
+	}
+	for i := range got {
+		if !got[i].NearlyEqual(want[i]) {
+			t.Errorf("SubPolyline(5, 12) = %v, expected %v", got, want)
+		}
+	}
+	if got := testL.SubPolyline(3, 3); got != nil {
+		t.Errorf("SubPolyline(3, 3) = %v, expected nil", got)
+	}
+}
+
+func TestPolylineSimplify(t *testing.T) {
+	// A nearly straight line with a small wiggle, then a large detour.
+	pl := Polyline{{0, 0}, {1, 0.1}, {2, -0.1}, {3, 0}, {4, 5}, {5, 0}, {6, 0}}
+	got := pl.Simplify(0.5)
+	want := Polyline{{0, 0}, {3, 0}, {4, 5}, {5, 0}, {6, 0}}
+	if len(got) != len(want) {
+		t.Fatalf("Simplify(0.5) = %v, expected %v", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("Simplify(0.5) = %v, expected %v", got, want)
+		}
+	}
+	if got := pl.Simplify(0.01); len(got) != len(pl) {
+		t.Errorf("Simplify(0.01) = %v, expected all points", got)
+	}
+	if got := pl.Simplify(100); len(got) != 2 {
+		t.Errorf("Simplify(100) = %v, expected the end points", got)
+	}
+}
+
+func TestPolylineResample(t *testing.T) {
+	got := testL.Resample(4)
+	// 15 / 4 => 4 segments of 3.75.
+	want := Polyline{{0, 0}, {3.75, 0}, {7.5, 0}, {10, 1.25}, {10, 5}}
+	if len(got) != len(want) {
+		t.Fatalf("Resample(4) = %v, expected %v", got, want)
+	}
+	for i := range got {
+		if !got[i].NearlyEqual(want[i]) {
+			t.Errorf("Resample(4) = %v, expected %v", got, want)
+		}
+	}
+	if got := testL.Resample(100); len(got) != 2 {
+		t.Errorf("Resample(100) = %v, expected the end points", got)
+	}
+	for _, maxSpacing := range []float64{0, -1, math.NaN()} {
+		got := testL.Resample(maxSpacing)
+		if len(got) != len(testL) || got[len(got)-1] != testL[len(testL)-1] {
+			t.Errorf("Resample(%v) = %v, expected %v", maxSpacing, got, testL)
+		}
+	}
+}
+
+func TestPolylineBuffer(t *testing.T) {
+	buffer := testL.Buffer(1, 8)
+	if !buffer.IsCounterClockwise() {
+		t.Errorf("Buffer isn't counter-clockwise: %v", buffer)
+	}
+	// Exact area: the rectangles along each segment, the round ends, and a
+	// quarter circle around the outside of the corner, less the overlap of the
+	// rectangles inside the corner (a square, less another quarter circle).
+	exact := 2*15 + math.Pi - (1 - math.Pi/4)
+	// The arcs are approximated by chords, which reduces the area a little.
+	if a := buffer.Area(); math.Abs(a-exact) > 0.05 {
+		t.Errorf("Area of buffer = %v, expected ~%v", a, exact)
+	}
+	for x := -2.0; x <= 12; x += 0.25 {
+		for y := -2.0; y <= 7; y += 0.25 {
+			pt := Point{x, y}
+			d := testL.DistanceToPoint(pt)
+			if d < 0.95 && !buffer.ContainsPoint(pt) ||
+				d > 1.0 && buffer.ContainsPoint(pt) {
+				t.Errorf("Buffer.ContainsPoint(%v) = %v, but distance is %v",
+					pt, buffer.ContainsPoint(pt), d)
+			}
+		}
+	}
+}
+
+// A zig-zag which doubles back on itself, so that the buffer self-intersects.
+func TestPolylineBufferSharpTurns(t *testing.T) {
+	pl := Polyline{{0, 0}, {10, 0}, {0, 1}, {10, 2}}
+	buffer := pl.Buffer(1, 4)
+	for x := -2.0; x <= 12; x += 0.25 {
+		for y := -2.0; y <= 4; y += 0.25 {
+			pt := Point{x, y}
+			d := pl.DistanceToPoint(pt)
+			if d < 0.9 && !buffer.ContainsPoint(pt) ||
+				d > 1.0 && buffer.ContainsPoint(pt) {
+				t.Errorf("Buffer.ContainsPoint(%v) = %v, but distance is %v",
+					pt, buffer.ContainsPoint(pt), d)
+			}
+		}
+	}
+}
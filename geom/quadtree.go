@@ -3,6 +3,8 @@ package geom
 import (
 	"fmt"
 	"math"
+
+	"github.com/golang/glog"
 )
 
 // This is the minimal interface that needs to be implemented
@@ -40,16 +42,12 @@ type UniqueIder interface {
 	UniqueId() interface{}
 }
 
-//
-//type IntersectsBounder interface {
-//	IntersectBounder
-//	Intersecter
-//}
-//
-//type UniqueIdIntersectBounder interface {
-//	IntersectBounder
-//	UniqueIder
-//}
+// Optional interface for a datum whose shape has an interior (e.g. a polygon),
+// used by QuadTree.VisitPoint. Data that don't implement it are treated as
+// containing a point if they intersect the point's (empty) rectangle.
+type PointContainer interface {
+	ContainsPoint(pt Point) bool
+}
 
 type QuadTreeDatum interface {
 	IntersectBounder
@@ -66,10 +64,21 @@ type QuadTree interface {
 
 	Insert(datum IntersectBounder) (err error)
 
-	//	Remove(datum QuadTreeDatum) bool
+	// Removes all of the pieces of datum (which must be the value passed to
+	// Insert, and must be comparable, e.g. a pointer). Must be called before
+	// the shape of datum changes (e.g. before a vehicle's position is updated),
+	// as the shape determines where the pieces are. Returns false if not found.
+	Remove(datum IntersectBounder) bool
 
 	Visit(bounds Rect, visitor QuadTreeVisitor)
 
+	// Visits the data whose shape contains pt.
+	VisitPoint(pt Point, visitor QuadTreeVisitor)
+
+	// Returns up to k data (by UniqueId) nearest to pt, nearest first, whose
+	// distance (as computed by distFn) is at most maxDistance.
+	Nearest(pt Point, k int, maxDistance float64, distFn DistanceFn) []Neighbor
+
 	// Reduce the bounds of the quadtree based on the current contents.
 	NarrowBounds()
 }
@@ -88,6 +97,8 @@ type qtSearcher struct {
 	bounds         *Rect
 	alreadyVisited map[interface{}]bool
 	visitor        QuadTreeVisitor
+	// If true, bounds is a point, and data whose bounds touch it are visited.
+	pointSearch bool
 }
 
 type qtNode interface {
@@ -96,7 +107,12 @@ type qtNode interface {
 	Level() int
 	// bounds is the subset of datum.bounds within this node
 	Insert(bounds *Rect, datum QuadTreeDatum)
-	//	Remove(bounds *Rect, datum QuadTreeDatum) bool
+	// bounds is a superset of the bounds of the pieces of the datum within
+	// this node.
+	Remove(bounds *Rect, datum IntersectBounder) bool
+	IsEmpty() bool
+	LocalData() []*qtData
+	Kids() []qtNode
 	Visit(searcher *qtSearcher)
 	ReadyToSplit() bool
 	Split() qtNode // Create a new interior node with one or more leaves
@@ -188,9 +204,13 @@ func (t *quadtree) InsertFull(datum QuadTreeDatum) (err error) {
 	return
 }
 
-//func (t *quadtree) Remove(datum QuadTreeDatum) bool {
-//	panic("not yet implemented")
-//}
+func (t *quadtree) Remove(datum IntersectBounder) bool {
+	bounds, empty := datum.IntersectBounds(*t.root.Bounds())
+	if empty {
+		return false
+	}
+	return t.root.Remove(&bounds, datum)
+}
 
 func (t *quadtree) Visit(bounds Rect, visitor QuadTreeVisitor) {
 	s := qtSearcher{bounds: &bounds, visitor: visitor}
@@ -242,18 +262,54 @@ func isStrictSuperSet(a, b *Rect) bool {
 	return *a != *b
 }
 
+// Can a datum with these bounds be pushed down to kids?
+func (n *qtNodeCommon) isSplitable(bounds *Rect) bool {
+	return bounds.IsPoint() || isStrictSuperSet(&n.bounds, bounds)
+}
+
 func (n *qtNodeCommon) AddLocal(bounds *Rect, datum QuadTreeDatum) {
 	n.data = append(n.data, &qtData{*bounds, datum})
-	if bounds.IsPoint() || isStrictSuperSet(&n.bounds, bounds) {
-		// datum can be be pushed down to kids.
-		return
+	if !n.isSplitable(bounds) {
+		n.numNotSplitable++
 	}
-	n.numNotSplitable++
 }
 
-//func (n *qtNodeCommon) RemoveLocal(bounds *Rect, datum QuadTreeDatum) bool {
-//	panic("not yet implemented")
-//}
+// Returns the value passed to quadtree.Insert.
+func underlyingDatum(datum QuadTreeDatum) IntersectBounder {
+	if d, ok := datum.(*qtDatumDelegate); ok {
+		return d.IntersectBounder
+	}
+	return datum
+}
+
+func (n *qtNodeCommon) RemoveLocal(datum IntersectBounder) (removed bool) {
+	kept := n.data[:0]
+	for _, d := range n.data {
+		if underlyingDatum(d.datum) != datum {
+			kept = append(kept, d)
+			continue
+		}
+		removed = true
+		if !n.isSplitable(&d.bounds) {
+			n.numNotSplitable--
+		}
+	}
+	for i := len(kept); i < len(n.data); i++ {
+		n.data[i] = nil
+	}
+	n.data = kept
+	return
+}
+
+func (n *qtNodeCommon) LocalData() []*qtData {
+	return n.data
+}
+
+// Do the closed rectangles overlap (i.e. including touching edges)?
+func overlapsClosed(a, b *Rect) bool {
+	return a.MinX <= b.MaxX && b.MinX <= a.MaxX &&
+		a.MinY <= b.MaxY && b.MinY <= a.MaxY
+}
 
 func (n *qtNodeCommon) VisitLocal(s *qtSearcher) {
 	for _, d := range n.data {
@@ -297,9 +353,17 @@ func (n *qtLeaf) Insert(bounds *Rect, datum QuadTreeDatum) {
 	n.AddLocal(bounds, datum)
 }
 
-//func (n *qtLeaf) Remove(bounds *Rect, datum QuadTreeDatum) bool {
-//	return n.RemoveLocal(bounds, datum)
-//}
+func (n *qtLeaf) Remove(bounds *Rect, datum IntersectBounder) bool {
+	return n.RemoveLocal(datum)
+}
+
+func (n *qtLeaf) IsEmpty() bool {
+	return len(n.data) == 0
+}
+
+func (n *qtLeaf) Kids() []qtNode {
+	return nil
+}
 
 func (n *qtLeaf) Visit(s *qtSearcher) {
 	n.VisitLocal(s)
@@ -324,13 +388,9 @@ func (n *qtLeaf) ReadyToSplit() bool {
 			n.okToSplit = true
 		} else {
 			n.okToSplit = false
-			fmt.Printf("Not splitting degenerate node with %d data at level %d\n",
-				numSplitable, n.level)
-			fmt.Printf("Node bounds: %v\n\n", n.bounds)
-			fmt.Printf("xn: %v\n", xn)
-			fmt.Printf("yn: %v\n", yn)
-			fmt.Printf("n.bounds.MinX+xn*4: %v\n", n.bounds.MinX+xn*4)
-			fmt.Printf("n.bounds.MinY+yn*4: %v\n", n.bounds.MinY+yn*4)
+			glog.V(2).Infof(
+				"Not splitting degenerate node with %d data at level %d, bounds %v",
+				numSplitable, n.level, n.bounds)
 		}
 	}
 	return n.okToSplit
@@ -462,20 +522,44 @@ func (n *qtNonLeaf) Insert(bounds *Rect, datum QuadTreeDatum) {
 	n.InsertInQuadrant(nil, datum, kUpperRight)
 }
 
-//func (n *qtNonLeaf) Remove(bounds *Rect, datum QuadTreeDatum) (removed bool) {
-//	removed = n.qtNodeCommon.RemoveLocal(bounds, datum)
-//	for _, k := range n.kids {
-//		if k.Remove(bounds, datum) {
-//			removed = true
-//		}
-//	}
-//	return
-//}
+func (n *qtNonLeaf) Remove(bounds *Rect, datum IntersectBounder) bool {
+	removed := n.RemoveLocal(datum)
+	for q, k := range n.kids {
+		if k == nil || !overlapsClosed(bounds, k.Bounds()) {
+			continue
+		}
+		if k.Remove(bounds, datum) {
+			removed = true
+			if k.IsEmpty() {
+				// Prune, so that churn (e.g. moving vehicles) doesn't leave behind
+				// lots of empty nodes.
+				n.kids[q] = nil
+			}
+		}
+	}
+	return removed
+}
+
+func (n *qtNonLeaf) IsEmpty() bool {
+	if len(n.data) > 0 {
+		return false
+	}
+	for _, k := range n.kids {
+		if k != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func (n *qtNonLeaf) Kids() []qtNode {
+	return n.kids[:]
+}
 
 func (n *qtNonLeaf) Visit(s *qtSearcher) {
 	n.VisitLocal(s)
 	for _, k := range n.kids {
-		if k != nil {
+		if k != nil && overlapsClosed(k.Bounds(), s.bounds) {
 			k.Visit(s)
 		}
 	}
@@ -509,11 +593,6 @@ func (n *qtNonLeaf) NarrowBounds() qtNode {
 	return n
 }
 
-//func DatumBoundsIntersect(datum QuadTreeDatum, bounds *Rect) bool {
-//	_, empty := datum.IntersectBounds(*bounds)
-//	return !empty
-//}
-
 // If we haven't already visited d.datum and d.bounds overlaps with s.bounds,
 // call visitor.Visit.
 func (s *qtSearcher) maybeVisit(d *qtData) {
@@ -524,273 +603,23 @@ func (s *qtSearcher) maybeVisit(d *qtData) {
 	}
 	// Compare the datum's bounds within the current qtnode with the
 	// search bounds.
-	if !d.bounds.IntersectsP(s.bounds) {
+	if s.pointSearch {
+		if !overlapsClosed(&d.bounds, s.bounds) {
+			return
+		}
+	} else if !d.bounds.IntersectsP(s.bounds) {
 		// Definitely not overlapping.
 		return
 	}
+	datum := underlyingDatum(d.datum)
 	// Now a potentially more expensive test: ask the datum if it overlaps the
-	// search bounds.
-	if !d.datum.Intersects(*s.bounds) {
+	// search bounds (a PointContainer is instead asked by qtPointVisitor).
+	if _, ok := datum.(PointContainer); !(s.pointSearch && ok) &&
+		!d.datum.Intersects(*s.bounds) {
 		// Doesn't really overlap.
 		return
 	}
 	// Overlaps.
 	s.alreadyVisited[id] = true
-	s.visitor.Visit(d.datum)
-}
-
-////////////////////////////////////////////////////////////////////////////////
-
-/*
-
-
-
-type qtNode interface {
-	Bounds() *Rect
-	Center() Point
-	// bounds is the subset of datum.bounds within this node
-	Insert(bounds *Rect, datum QuadTreeDatum)
-	Remove(bounds *Rect, datum QuadTreeDatum) bool
-	Visit(searcher *qtSearcher)
-	ReadyToSplit() bool
-	Split() *qtNode  // Create a new interior node with one or more leaves
-}
-
-
-
-
-
-
-
-
-
-
-
-
-
-func NewQuadTree(bounds Rect) QuadTree {
-	return &quadtree{root:newQTNode(bounds)}
-}
-
-func (t *quadtree) Bounds() Rect {
-	return t.root.bounds
-}
-
-func (t *quadtree) Insert(datum QuadTreeDatum) (err error) {
-	bounds := datum.Bounds()
-	if !t.root.bounds.Contains(bounds) {
-		err = fmt.Errorf("%#v is not inside bounds %#v", bounds, t.root.bounds)
-		return
-	}
-	err = nil
-	if bounds.IsPoint() {
-		t.root.InsertPoint(&bounds, datum)
-	} else {
-		t.root.InsertArea(&bounds, sd)
-	}
-	return
-}
-
-func (t *quadtree) Remove(datum QuadTreeDatum) bool {
-	return false
-}
-
-func (t *quadtree) Visit(bounds Rect, visitor QuadTreeVisitor) {
-	pb := &bounds
-	if t.root.Intersects(pb) {
-		t.root.visit(pb, visitor)
-	}
-}
-
-type qtnode struct {
-	bounds  Rect
-	center  Point
-	level   uint
-	hasKids	bool
-	kids    [4]*qtnode
-	unsplitableData *qtdata
-	splitableData *qtsdata
-	splitableCount uint
-}
-
-
-func newQTNode(bounds Rect) *qtnode {
-	return &qtnode{bounds: bounds, center: bounds.Center()}
-}
-
-func (n *qtnode) Intersects(r *Rect) bool {
-	return r.IntersectsP(&n.bounds)
-}
-
-func (n *qtnode) Contains(r *Rect) bool {
-	return n.bounds.Contains(*r)
-}
-
-func isSplitable(datum QuadTreeDatum) bool {
-	_, ok := datum.(QuadTreeSplitableDatum)
-	return ok
-}
-
-// Which quadrants of the node does the rectangle r overlap?
-func (n *qtnode) OverlappingQuadrants(bounds *Rect) (
-		upperLeft, upperRight, lowerLeft, lowerRight bool,
-		count byte) {
-	cx, cy := n.center.X, n.center.Y
-	if cx < bounds.MaxX {
-		// Overlaps on the right.
-
-	if r.MinX >= p.X {
-		// Right only
-		if r.MinY >= p.Y {
-			// Upper-Right only
-			return false
-		} else if r.MaxY < p.Y {
-			// Lower-Right only
-			return false
-		}
-		return true
-	} else if r.MaxX < p.X {
-		// Left only
-		if r.MinY >= p.Y {
-			// Upper-Left only
-			return false
-		} else if r.MaxY < p.Y {
-			// Lower-Left only
-			return false
-		}
-		return true
-	} else {
-		return true
-	}
-
-
-
-// Given the axes through a point (i.e. the line X=p.X and the line Y=p.Y),
-// does one or both of those run through the rect?  Used to determine if
-// a datum (with bounds r) is in more than one child.
-func containsAnAxis(r *Rect, p *Point) bool {
-	if r.MinX >= p.X {
-		// Right only
-		if r.MinY >= p.Y {
-			// Upper-Right only
-			return false
-		} else if r.MaxY < p.Y {
-			// Lower-Right only
-			return false
-		}
-		return true
-	} else if r.MaxX < p.X {
-		// Left only
-		if r.MinY >= p.Y {
-			// Upper-Left only
-			return false
-		} else if r.MaxY < p.Y {
-			// Lower-Left only
-			return false
-		}
-		return true
-	} else {
-		return true
-	}
-
-
-
-
-
-
-	// Does the segment belong in a child node?
-	if newSeg.bounds.MaxX <= t.center.X {
-		if newSeg.bounds.MaxY <= t.center.Y {
-			return t.insertSegmentInQuadrant(kLowerLeft, newSeg)
-		} else if newSeg.bounds.MinY >= t.center.Y {
-			return t.insertSegmentInQuadrant(kUpperLeft, newSeg)
-		}
-	}
-	if newSeg.bounds.MinX >= t.center.X {
-		if newSeg.bounds.MaxY <= t.center.Y {
-			return t.insertSegmentInQuadrant(kLowerRight, newSeg)
-		} else if newSeg.bounds.MinY >= t.center.Y {
-			return t.insertSegmentInQuadrant(kUpperRight, newSeg)
-		}
-	}
-
-	if r.IsPoint() {
-		return r.MinX == p.X && r.MinY == p.Y
-	}
-	return r.MinX <= p.X && p.X < r.MaxX &&
-	       r.MinY <= p.Y && p.Y < r.MaxY
-}
-
-func (n *qtnode) SpansCenter(bounds *Rect) bool {
-
-	_, ok := datum.(QuadTreeSplitableDatum)
-	return ok
-}
-
-
-
-
-// Caller has ensured that this node CONTAINS bounds.
-func (n *qtnode) Insert(bounds *Rect, datum QuadTreeDatum) {
-	if n.hasKids {
-		for _, kid := range n.kids {
-			if kid != nil && kid.Contains(bounds) {
-				kid.Insert(bounds, datum)
-				return
-			}
-		}
-		if bounds.IsPoint() {
-			// Can't span multiple kids, so need to make a child and insert
-			n.MakeKids(bounds)
-			n.Insert(bounds, datum) // Tail recursion, which should now be able to insert.
-			return
-		}
-		// The datum MAY span multiple kids, or the appropriate kid doesn't exist.
-		if
-
-
-	}
-	// Either there are no kids, or the datum's bounds span multiple kids.
-	if
-
-
-
-	if bounds.IsPoint() {
-		// Can't span multiple kids, so need to make a child.
-
-
-}
-
-// Caller has ensured that bounds intersects this node.
-func (n *qtnode) visit(bounds *Rect, visitor QuadTreeVisitor) {
-	for pd := n.unsplitableData; pd != nil; pd = pd.next {
-		if bounds.IntersectsP(&pd.bounds) {
-			visitor.Visit(pd.data)
-		}
-	}
-	for pd := n.splitableData; pd != nil; pd = pd.next {
-		if bounds.IntersectsP(&pd.bounds) {
-			visitor.Visit(pd.data)
-		}
-	}
-	for _, kid := range n.kids {
-		if kid != nil && bounds.IntersectsP(&kid.bounds) {
-			kid.visit(bounds, visitor)
-		}
-	}
-}
-
-func newQTData(data QuadTreeDatum) *qtdata {
-	return &qtdata{
-		bounds: data.Bounds(),
-		data: data,
-	}
-}
-
-func newSQTData(data QuadTreeSplitableDatum) *qtsdata {
-	return &qtsdata{
-		bounds: data.Bounds(),
-		data: data,
-	}
+	s.visitor.Visit(datum)
 }
-*/
@@ -0,0 +1,117 @@
+package geom
+
+import (
+	"container/heap"
+)
+
+// Computes the distance from pt to the shape of datum. For the search to
+// be correct, the distance must not be less than the distance from pt to the
+// bounds of datum (as returned by IntersectBounds).
+type DistanceFn func(datum IntersectBounder, pt Point) float64
+
+type Neighbor struct {
+	Datum    IntersectBounder
+	Distance float64
+}
+
+// An entry in the priority queue of a nearest neighbor search: either a node
+// (to be expanded), or a datum (whose distance may not yet have been
+// computed, in which case distance is the lower bound based on its bounds).
+type qtCandidate struct {
+	distance  float64
+	node      qtNode
+	datum     QuadTreeDatum
+	evaluated bool
+}
+
+type qtCandidateHeap []*qtCandidate
+
+func (h qtCandidateHeap) Len() int           { return len(h) }
+func (h qtCandidateHeap) Less(i, j int) bool { return h[i].distance < h[j].distance }
+func (h qtCandidateHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *qtCandidateHeap) Push(x interface{}) {
+	*h = append(*h, x.(*qtCandidate))
+}
+
+func (h *qtCandidateHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return x
+}
+
+// Best-first search: candidates are examined in order of increasing (lower
+// bound on) distance, so a datum whose actual distance is popped from the
+// queue is nearer than everything not yet found.
+func (t *quadtree) Nearest(
+	pt Point, k int, maxDistance float64, distFn DistanceFn) []Neighbor {
+	var result []Neighbor
+	if k <= 0 {
+		return result
+	}
+	found := make(map[interface{}]bool)
+	h := &qtCandidateHeap{}
+	push := func(c *qtCandidate) {
+		if c.distance <= maxDistance {
+			heap.Push(h, c)
+		}
+	}
+	push(&qtCandidate{distance: t.root.Bounds().DistanceToPoint(pt), node: t.root})
+	for h.Len() > 0 && len(result) < k {
+		c := heap.Pop(h).(*qtCandidate)
+		if c.node != nil {
+			for _, d := range c.node.LocalData() {
+				if !found[d.datum.UniqueId()] {
+					push(&qtCandidate{distance: d.bounds.DistanceToPoint(pt), datum: d.datum})
+				}
+			}
+			for _, kid := range c.node.Kids() {
+				if kid != nil {
+					push(&qtCandidate{distance: kid.Bounds().DistanceToPoint(pt), node: kid})
+				}
+			}
+			continue
+		}
+		id := c.datum.UniqueId()
+		if found[id] {
+			// Another piece of the same object has already been found.
+			continue
+		}
+		datum := underlyingDatum(c.datum)
+		if !c.evaluated {
+			c.distance = distFn(datum, pt)
+			c.evaluated = true
+			push(c)
+			continue
+		}
+		found[id] = true
+		result = append(result, Neighbor{Datum: datum, Distance: c.distance})
+	}
+	return result
+}
+
+type qtPointVisitor struct {
+	pt      Point
+	visitor QuadTreeVisitor
+}
+
+func (v *qtPointVisitor) Visit(datum IntersectBounder) {
+	if pc, ok := datum.(PointContainer); ok && !pc.ContainsPoint(v.pt) {
+		return
+	}
+	v.visitor.Visit(datum)
+}
+
+func (t *quadtree) VisitPoint(pt Point, visitor QuadTreeVisitor) {
+	bounds := Rect{pt.X, pt.X, pt.Y, pt.Y}
+	s := qtSearcher{
+		bounds:         &bounds,
+		visitor:        &qtPointVisitor{pt, visitor},
+		alreadyVisited: make(map[interface{}]bool),
+		pointSearch:    true,
+	}
+	t.root.Visit(&s)
+}
@@ -3,6 +3,8 @@ package geom
 import (
 	"fmt"
 	"github.com/jamessynge/transit_tools/compare"
+	"math"
+	"math/rand"
 	"strings"
 	"testing"
 )
@@ -79,3 +81,236 @@ func TestQuadTreeNearestSegment(t *testing.T) {
 		compare.ExpectEqual(t.Error, expect, f)
 	}
 }
+
+func segmentDistance(ib IntersectBounder, pt Point) float64 {
+	datum := ib.(*TestQTDatum)
+	return newSQTSeg(datum.Segment, nil).DistToPoint(pt)
+}
+
+func neighborIds(neighbors []Neighbor) (ids []string) {
+	for _, n := range neighbors {
+		ids = append(ids, n.Datum.(*TestQTDatum).id)
+	}
+	return
+}
+
+func TestQuadTreeRemove(t *testing.T) {
+	tree := NewQuadTree(Rect{-100, 100, -100, 100})
+	var data []*TestQTDatum
+	// Enough data to split the root several times.
+	for i := 0; i < 200; i++ {
+		x := float64(i%20)*4 - 40
+		y := float64(i/20)*4 - 20
+		d := NewTestQTDatum(Point{x, y}, Point{x + 1, y + 1}, fmt.Sprint(i))
+		data = append(data, d)
+		tree.Insert(d)
+	}
+	horizontal := NewTestQTDatum(Point{-50, 1}, Point{50, 1}, "h")
+	tree.Insert(horizontal)
+	if !tree.Remove(horizontal) {
+		t.Errorf("Remove(horizontal) failed")
+	}
+	if tree.Remove(horizontal) {
+		t.Errorf("Remove(horizontal) succeeded twice")
+	}
+	for i := 0; i < len(data); i += 2 {
+		if !tree.Remove(data[i]) {
+			t.Errorf("Remove(%s) failed", data[i].id)
+		}
+	}
+	f := make(IdSet)
+	tree.Visit(tree.Bounds(), f)
+	expect := make(IdSet)
+	for i := 1; i < len(data); i += 2 {
+		expect[data[i].id] = true
+	}
+	compare.ExpectEqual(t.Error, expect, f)
+
+	// Removing everything leaves an empty tree, into which data can be inserted.
+	for i := 1; i < len(data); i += 2 {
+		tree.Remove(data[i])
+	}
+	if root := tree.(*quadtree).root; !root.IsEmpty() {
+		t.Errorf("Tree not empty after removing everything")
+	}
+	tree.Insert(data[0])
+	f = make(IdSet)
+	tree.Visit(tree.Bounds(), f)
+	compare.ExpectEqual(t.Error, SplitStringToSet("0"), f)
+}
+
+func TestQuadTreeNearest(t *testing.T) {
+	tree := NewQuadTree(Rect{-100, 100, -100, 100})
+	fillTestQuadTree(tree)
+
+	testCases := []struct {
+		name        string
+		pt          Point
+		k           int
+		maxDistance float64
+		ids         []string
+	}{
+		{"A", Point{0, 0}, 1, 100, []string{"0"}},
+		{"B", Point{8.6, 8.4}, 3, 100, []string{"8", "7", "9"}},
+		{"C", Point{-10, 5}, 2, 100, []string{"10", "0"}},
+		{"D", Point{-10, 5}, 2, 1, []string{"10"}},
+		{"E", Point{50, 50}, 5, 1, nil},
+		{"F", Point{0, 0}, 0, 100, nil},
+	}
+	for _, tc := range testCases {
+		neighbors := tree.Nearest(tc.pt, tc.k, tc.maxDistance, segmentDistance)
+		ids := neighborIds(neighbors)
+		if fmt.Sprint(ids) != fmt.Sprint(tc.ids) {
+			t.Errorf("Case %s: got %v, expected %v", tc.name, ids, tc.ids)
+		}
+		for i := 1; i < len(neighbors); i++ {
+			if neighbors[i-1].Distance > neighbors[i].Distance {
+				t.Errorf("Case %s: not sorted by distance: %v", tc.name, neighbors)
+			}
+		}
+	}
+}
+
+// A right triangle occupying the upper-left half of its bounds, so that
+// ContainsPoint differs from the bounds check.
+type TestTriangle struct {
+	bounds Rect
+	id     string
+}
+
+func (p *TestTriangle) IntersectBounds(r Rect) (Rect, bool) {
+	if !overlapsClosed(&p.bounds, &r) {
+		return Rect{}, true
+	}
+	return Rect{math.Max(r.MinX, p.bounds.MinX), math.Min(r.MaxX, p.bounds.MaxX),
+		math.Max(r.MinY, p.bounds.MinY), math.Min(r.MaxY, p.bounds.MaxY)}, false
+}
+
+// Contains the points above the diagonal from (MinX, MinY) to (MaxX, MaxY).
+func (p *TestTriangle) ContainsPoint(pt Point) bool {
+	return p.bounds.MinX <= pt.X && pt.Y <= p.bounds.MaxY &&
+		pt.Y-p.bounds.MinY >= pt.X-p.bounds.MinX
+}
+
+type triangleIds map[string]bool
+
+func (f triangleIds) Visit(ib IntersectBounder) {
+	f[ib.(*TestTriangle).id] = true
+}
+
+func TestQuadTreeVisitPoint(t *testing.T) {
+	tree := NewQuadTree(Rect{-100, 100, -100, 100})
+	tree.Insert(&TestTriangle{Rect{0, 10, 0, 10}, "a"})
+	tree.Insert(&TestTriangle{Rect{5, 15, 5, 15}, "b"})
+	tree.Insert(&TestTriangle{Rect{-50, 50, -50, 50}, "big"})
+
+	testCases := []struct {
+		pt  Point
+		ids string
+	}{
+		{Point{1, 2}, "a,big"},
+		{Point{2, 1}, ""},
+		{Point{6, 9}, "a,b,big"},
+		{Point{0, 0}, "a,big"},
+		{Point{14, 15}, "b,big"},
+		{Point{60, 60}, ""},
+	}
+	for _, tc := range testCases {
+		f := make(triangleIds)
+		tree.VisitPoint(tc.pt, f)
+		got := make(IdSet)
+		for id := range f {
+			got[id] = true
+		}
+		compare.ExpectEqual(t.Error, SplitStringToSet(tc.ids), got)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Benchmarks comparing QuadTree with SQTree.
+
+const benchmarkNumSegments = 10000
+
+func benchmarkSegments() []Segment {
+	r := rand.New(rand.NewSource(1))
+	segs := make([]Segment, benchmarkNumSegments)
+	for i := range segs {
+		pt := Point{r.Float64()*180 - 90, r.Float64()*180 - 90}
+		segs[i] = Segment{pt, Point{pt.X + r.Float64()*2, pt.Y + r.Float64()*2}}
+	}
+	return segs
+}
+
+func benchmarkPoints(n int) []Point {
+	r := rand.New(rand.NewSource(2))
+	pts := make([]Point, n)
+	for i := range pts {
+		pts[i] = Point{r.Float64()*180 - 90, r.Float64()*180 - 90}
+	}
+	return pts
+}
+
+func BenchmarkQuadTreeInsert(b *testing.B) {
+	segs := benchmarkSegments()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		tree := NewQuadTree(Rect{-100, 100, -100, 100})
+		for i, seg := range segs {
+			tree.Insert(&TestQTDatum{seg, fmt.Sprint(i)})
+		}
+	}
+}
+
+func BenchmarkSQTreeInsert(b *testing.B) {
+	segs := benchmarkSegments()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		tree := NewSQTree(Rect{-100, 100, -100, 100})
+		for i, seg := range segs {
+			tree.InsertSegment(seg, i)
+		}
+	}
+}
+
+func BenchmarkQuadTreeNearest(b *testing.B) {
+	tree := NewQuadTree(Rect{-100, 100, -100, 100})
+	for i, seg := range benchmarkSegments() {
+		tree.Insert(&TestQTDatum{seg, fmt.Sprint(i)})
+	}
+	pts := benchmarkPoints(1000)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		tree.Nearest(pts[n%len(pts)], 1, 5, segmentDistance)
+	}
+}
+
+func BenchmarkSQTreeNearestSegment(b *testing.B) {
+	tree := NewSQTree(Rect{-100, 100, -100, 100})
+	for i, seg := range benchmarkSegments() {
+		tree.InsertSegment(seg, i)
+	}
+	pts := benchmarkPoints(1000)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		tree.NearestSegment(pts[n%len(pts)], 5)
+	}
+}
+
+// Moves each of a set of points (e.g. vehicles) by removing and re-inserting.
+func BenchmarkQuadTreeMove(b *testing.B) {
+	tree := NewQuadTree(Rect{-100, 100, -100, 100})
+	pts := benchmarkPoints(1000)
+	data := make([]*TestQTDatum, len(pts))
+	for i, pt := range pts {
+		data[i] = &TestQTDatum{Segment{pt, pt}, fmt.Sprint(i)}
+		tree.Insert(data[i])
+	}
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		d := data[n%len(data)]
+		tree.Remove(d)
+		pt := Point{math.Mod(d.Pt1.X+90.01, 180) - 90, d.Pt1.Y}
+		d.Segment = Segment{pt, pt}
+		tree.Insert(d)
+	}
+}
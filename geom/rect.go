@@ -2,6 +2,7 @@ package geom
 
 import (
 	"fmt"
+	"math"
 )
 
 type Rect struct {
@@ -72,6 +73,13 @@ func (r Rect) Center() Point {
 	return Point{x, y}
 }
 
+// Distance from p to the nearest point of r (0 if p is inside r).
+func (r Rect) DistanceToPoint(p Point) float64 {
+	dx := math.Max(0, math.Max(r.MinX-p.X, p.X-r.MaxX))
+	dy := math.Max(0, math.Max(r.MinY-p.Y, p.Y-r.MaxY))
+	return math.Hypot(dx, dy)
+}
+
 // Produces the smallest axis-aligned rectangle rectangle that includes both
 // r and o.
 func (r Rect) Union(o Rect) Rect {
@@ -194,7 +194,6 @@ func (t *SQTree) Send(bounds Rect, c chan<- SQTreeDatum) {
 
 func (t *SQTree) NearestSegment(pt Point, maxDistance float64) (
 	seg Segment, data interface{}, distance float64) {
-	fmt.Printf("NearestSegment: pt=%v, maxDistance=%v\n", pt, maxDistance)
 	bounds := NewRectWithBorder(pt.X, pt.X, pt.Y, pt.Y, maxDistance, maxDistance)
 	closestDistance := math.MaxFloat64
 	var closestDatum SQTreeDatum
@@ -70,6 +70,34 @@ func (p *Agency) getOrAddRouteByTag(tag string) *Route {
 	}
 	return route
 }
+
+// The exported GetOrAdd functions support building an agency from sources
+// other than routeConfig files (e.g. GTFS feeds).
+
+// GetOrAddRoute returns the route with the tag, adding it if necessary.
+func (p *Agency) GetOrAddRoute(tag string) *Route {
+	return p.getOrAddRouteByTag(tag)
+}
+
+// GetOrAddStop returns the stop with the tag, adding it if necessary; returns
+// an error if the stop already exists with different values.
+func (p *Agency) GetOrAddStop(
+	tag, id, title string, latLon geo.Location) (*Stop, error) {
+	return p.stopFromDefinitionElem(&StopElement{
+		Tag:    tag,
+		StopId: id,
+		Title:  title,
+		Lat:    float64(latLon.Lat),
+		Lon:    float64(latLon.Lon),
+	})
+}
+
+// GetOrAddPath returns the path through the locations, adding it if there
+// is no such path yet.
+func (p *Agency) GetOrAddPath(geoLocations []geo.Location) *Path {
+	return p.getOrAddPathByLocations(geoLocations)
+}
+
 func (p *Agency) stopFromDefinitionElem(se *StopElement) (*Stop, error) {
 	// We don't truly need the title, but it should be present,
 	// and makes certain debugging easier.
@@ -191,12 +219,9 @@ func (p *Agency) getOrAddPathByLocations(geoLocations []geo.Location) *Path {
 		log.Panicf("There is already a path with index %d", p.lastPathIndex)
 	}
 	path := NewPath()
-	path.WayPoints = make([]*Location, len(geoLocations))
 	path.Hash = hash
 	path.Index = p.lastPathIndex
-	for i := range geoLocations {
-		path.WayPoints[i] = p.getOrAddLocation(geoLocations[i])
-	}
+	p.setPathWayPoints(path, geoLocations)
 	p.PathsByIndex[path.Index] = path
 	p.PathsByHash[hash] = append(p.PathsByHash[hash], path)
 	if len(p.PathsByHash[hash]) > 1 {
@@ -204,3 +229,54 @@ func (p *Agency) getOrAddPathByLocations(geoLocations []geo.Location) *Path {
 	}
 	return path
 }
+
+// Returns the path of the agency with the same waypoints as other (e.g. the
+// same path in the config of another day), or nil if there is none.
+func (p *Agency) FindMatchingPath(other *Path) *Path {
+	geoLocations := make([]geo.Location, len(other.WayPoints))
+	for i, location := range other.WayPoints {
+		geoLocations[i] = location.Location
+	}
+	for _, path := range p.PathsByHash[hashLocations(geoLocations)] {
+		if equalLocationSlices(path.WayPoints, geoLocations) {
+			return path
+		}
+	}
+	return nil
+}
+
+func (p *Agency) setPathWayPoints(path *Path, geoLocations []geo.Location) {
+	path.WayPoints = make([]*Location, len(geoLocations))
+	for i := range geoLocations {
+		location := p.getOrAddLocation(geoLocations[i])
+		location.Paths[path.Index] = path
+		path.WayPoints[i] = location
+	}
+}
+
+// Replaces the waypoints of an existing path (e.g. with a corrected shape),
+// keeping the index and routes of the path, and updating the agency's
+// indices of paths and locations.
+func (p *Agency) ReplacePathWayPoints(path *Path, geoLocations []geo.Location) {
+	if p.PathsByIndex[path.Index] != path {
+		log.Panicf("Path %d isn't a path of agency %s", path.Index, p.Tag)
+	}
+	for _, location := range path.WayPoints {
+		delete(location.Paths, path.Index)
+	}
+	oldPaths := p.PathsByHash[path.Hash]
+	for i, other := range oldPaths {
+		if other == path {
+			oldPaths = append(oldPaths[:i], oldPaths[i+1:]...)
+			break
+		}
+	}
+	if len(oldPaths) == 0 {
+		delete(p.PathsByHash, path.Hash)
+	} else {
+		p.PathsByHash[path.Hash] = oldPaths
+	}
+	path.Hash = hashLocations(geoLocations)
+	p.setPathWayPoints(path, geoLocations)
+	p.PathsByHash[path.Hash] = append(p.PathsByHash[path.Hash], path)
+}
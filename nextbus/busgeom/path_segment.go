@@ -44,9 +44,33 @@ func MakePathSegments(
 	return
 }
 
+// Returns the polyline through the segments (e.g. as produced by
+// MakePathSegments), assuming each starts where the previous ends.
+func PathSegmentsToPolyline(segs []*PathSegment) geom.Polyline {
+	if len(segs) == 0 {
+		return nil
+	}
+	result := make(geom.Polyline, 0, len(segs)+1)
+	result = append(result, segs[0].Pt1)
+	for _, seg := range segs {
+		result = append(result, seg.Pt2)
+	}
+	return result
+}
+
 func (p *PathSegment) UniqueId() interface{} {
 	return p.id
 }
+
+// Index of the segment within the path (i.e. of the waypoint at Pt1).
+func (p *PathSegment) Index() int {
+	return p.index
+}
+
+// Distance along the path from the start of the path to Pt1.
+func (p *PathSegment) OffsetFromStart() float64 {
+	return p.offsetFromStart
+}
 func (p *PathSegment) AngleBetween(report *Report) (angle float64, ok bool) {
 	if !report.DirectionIsValid() {
 		return
@@ -109,9 +109,10 @@ func NewReport(vl *nextbus.VehicleLocation, agency *nextbus.Agency,
 	return
 }
 
-func LoadReports(
-	filePath string, agency *nextbus.Agency, xf geogeom.CoordTransform) (
-	reports []*Report, discardedRecords int, errors []error) {
+// Reads the vehicle locations from a CSV file, skipping (but counting) those
+// records that can't be parsed.
+func ReadVehicleLocationsCsvFile(filePath string) (
+	vls []*nextbus.VehicleLocation, discardedRecords int, errors []error) {
 	crc, err := util.OpenReadCsvFile(filePath)
 	if err != nil {
 		errors = append(errors, err)
@@ -133,7 +134,7 @@ func LoadReports(
 				errors = append(errors, err)
 				log.Print(err)
 			}
-			return
+			break
 		}
 		fileRecords++
 		vl, err := nextbus.CSVFieldsToVehicleLocation(record)
@@ -148,6 +149,16 @@ func LoadReports(
 			// debug later.
 			continue
 		}
+		vls = append(vls, vl)
+	}
+	log.Printf("Finished reading %d records from %s", fileRecords, filePath)
+	return
+}
+
+// Creates reports for those vehicle locations that have a valid heading.
+func MakeReports(vls []*nextbus.VehicleLocation, agency *nextbus.Agency,
+	xf geogeom.CoordTransform) (reports []*Report, discardedRecords int) {
+	for _, vl := range vls {
 		report := NewReport(vl, agency, xf)
 		if !report.DirectionIsValid() {
 			discardedRecords++
@@ -158,8 +169,15 @@ func LoadReports(
 		}
 		reports = append(reports, report)
 	}
+	return
+}
 
-	log.Printf("Finished reading %d records from %s", fileRecords, filePath)
+func LoadReports(
+	filePath string, agency *nextbus.Agency, xf geogeom.CoordTransform) (
+	reports []*Report, discardedRecords int, errors []error) {
+	vls, discardedRecords, errors := ReadVehicleLocationsCsvFile(filePath)
+	reports, numNoHeading := MakeReports(vls, agency, xf)
+	discardedRecords += numNoHeading
 	return
 }
 
@@ -228,21 +246,6 @@ func MedianDistanceWeightedReportDirection(
 	return MedianWeightedReportDirection(report2weight)
 }
 
-func DetermineTrustworthyDirTags(
-	reportsWithNearSegs []*Report,
-	maxDistance float64) (dirTagsToTrust map[string]bool) {
-	// Choose Route Directions that mostly appear to have reports going in
-	// the same direction as the path.
-	dirTag2Stats := MeasureRouteDirections(reportsWithNearSegs, maxDistance)
-	dirTagsToTrust = make(map[string]bool)
-	for dirTag, rs := range dirTag2Stats {
-		if rs.Mean() < (math.Pi * 1 / 4) {
-			dirTagsToTrust[dirTag] = true
-		}
-	}
-	return
-}
-
 // MUST have at least one report.
 func ReportsBounds(reports []*Report) geom.Rect {
 	minX, minY := reports[0].X, reports[0].Y
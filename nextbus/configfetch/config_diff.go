@@ -0,0 +1,426 @@
+package configfetch
+
+// Support for a semantic comparison of two config snapshots (the result of
+// FetchAgencyConfig, etc.): rather than just deciding whether the files are
+// the same, both snapshots are parsed into a nextbus.Agency, and the changes
+// to routes, stops, directions, paths and scheduled trips are listed.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+
+	"github.com/jamessynge/transit_tools/nextbus"
+	"github.com/jamessynge/transit_tools/util"
+)
+
+// The parsed contents of a config directory.
+type ConfigSnapshot struct {
+	Dir    string
+	Agency *nextbus.Agency
+	// For each route tag, the set of scheduled trips (see tripKey).
+	Trips map[string]map[string]bool
+}
+
+// Identifies a scheduled trip well enough to notice additions and removals.
+func tripKey(re *nextbus.RouteElement, tr *nextbus.TrElement) string {
+	start := ""
+	for _, stop := range tr.Stops {
+		if stop.EpochTime >= 0 {
+			start = strconv.FormatInt(stop.EpochTime, 10)
+			break
+		}
+	}
+	return strings.Join(
+		[]string{re.ServiceClass, re.Direction, tr.BlockID, start}, "/")
+}
+
+// Lists the xml files in dir; returns nothing if dir doesn't exist.
+func listXmlFiles(dir string) []string {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var result []string
+	for _, info := range infos {
+		if !info.IsDir() && strings.HasSuffix(info.Name(), ".xml") {
+			result = append(result, filepath.Join(dir, info.Name()))
+		}
+	}
+	return result
+}
+
+// LoadConfigSnapshot parses the routeConfig and schedule files in dir.
+// Errors in individual files are logged and returned (combined), but don't
+// prevent the remaining files from being loaded.
+func LoadConfigSnapshot(dir string) (*ConfigSnapshot, error) {
+	if !util.IsDirectory(dir) {
+		return nil, fmt.Errorf("Not a directory: %s", dir)
+	}
+	errs := util.NewErrors()
+	p := &ConfigSnapshot{
+		Dir:    dir,
+		Agency: nextbus.NewAgency(filepath.Base(dir)),
+		Trips:  make(map[string]map[string]bool),
+	}
+	for _, fp := range listXmlFiles(filepath.Join(dir, "routeConfig")) {
+		if _, err := nextbus.ParseRouteConfigFile(p.Agency, fp); err != nil {
+			glog.Warningf("Error(s) parsing %s: %v", fp, err)
+			errs.AddError(err)
+		}
+	}
+	for _, fp := range listXmlFiles(filepath.Join(dir, "schedule")) {
+		data, err := ioutil.ReadFile(fp)
+		if err != nil {
+			errs.AddError(err)
+			continue
+		}
+		body, err := nextbus.UnmarshalNextbusXml(data)
+		if err != nil {
+			glog.Warningf("Error parsing %s: %v", fp, err)
+			errs.AddError(err)
+			continue
+		}
+		for _, re := range body.Routes {
+			trips := p.Trips[re.Tag]
+			if trips == nil {
+				trips = make(map[string]bool)
+				p.Trips[re.Tag] = trips
+			}
+			for _, tr := range re.Trips {
+				trips[tripKey(re, tr)] = true
+			}
+		}
+	}
+	glog.Infof("Loaded %d routes, %d stops and %d schedules from %s",
+		len(p.Agency.Routes), len(p.Agency.Stops), len(p.Trips), dir)
+	return p, errs.ToError()
+}
+
+type ConfigChangeKind string
+
+const (
+	RouteAdded            ConfigChangeKind = "RouteAdded"
+	RouteRemoved          ConfigChangeKind = "RouteRemoved"
+	RouteRenamed          ConfigChangeKind = "RouteRenamed"
+	RouteStopAdded        ConfigChangeKind = "RouteStopAdded"
+	RouteStopRemoved      ConfigChangeKind = "RouteStopRemoved"
+	StopMoved             ConfigChangeKind = "StopMoved"
+	StopRenamed           ConfigChangeKind = "StopRenamed"
+	DirectionAdded        ConfigChangeKind = "DirectionAdded"
+	DirectionRemoved      ConfigChangeKind = "DirectionRemoved"
+	DirectionRenamed      ConfigChangeKind = "DirectionRenamed"
+	DirectionStopsChanged ConfigChangeKind = "DirectionStopsChanged"
+	PathsAdded            ConfigChangeKind = "PathsAdded"
+	PathsRemoved          ConfigChangeKind = "PathsRemoved"
+	TripsAdded            ConfigChangeKind = "TripsAdded"
+	TripsRemoved          ConfigChangeKind = "TripsRemoved"
+)
+
+// A single change between two snapshots. Which fields are set depends upon
+// the Kind; for changes to stops, Routes lists the routes that serve the stop.
+type ConfigChange struct {
+	Kind      ConfigChangeKind `json:"kind"`
+	Route     string           `json:"route,omitempty"`
+	Direction string           `json:"direction,omitempty"`
+	Stop      string           `json:"stop,omitempty"`
+	Routes    []string         `json:"routes,omitempty"`
+	Old       string           `json:"old,omitempty"`
+	New       string           `json:"new,omitempty"`
+	// For StopMoved, the distance (meters) the stop moved.
+	Distance float64 `json:"distance,omitempty"`
+	// For PathsAdded, TripsRemoved, etc., the number added or removed.
+	Count int `json:"count,omitempty"`
+}
+
+// Does the change concern the route with tag routeTag?
+func (p *ConfigChange) AffectsRoute(routeTag string) bool {
+	if p.Route == routeTag {
+		return true
+	}
+	for _, tag := range p.Routes {
+		if tag == routeTag {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *ConfigChange) String() string {
+	var where string
+	if len(p.Route) > 0 {
+		where = "route " + p.Route
+	}
+	if len(p.Direction) > 0 {
+		where += ", direction " + p.Direction
+	}
+	if len(p.Stop) > 0 {
+		if len(where) > 0 {
+			where += ", "
+		}
+		where += "stop " + p.Stop
+		if len(p.Routes) > 0 {
+			where += " (routes " + strings.Join(p.Routes, ", ") + ")"
+		}
+	}
+	switch p.Kind {
+	case RouteAdded, RouteRemoved, RouteStopAdded, RouteStopRemoved,
+		DirectionAdded, DirectionRemoved:
+		if len(p.New) > 0 {
+			return fmt.Sprintf("%s: %s %q", p.Kind, where, p.New)
+		} else if len(p.Old) > 0 {
+			return fmt.Sprintf("%s: %s %q", p.Kind, where, p.Old)
+		}
+	case RouteRenamed, StopRenamed, DirectionRenamed:
+		return fmt.Sprintf("%s: %s %q -> %q", p.Kind, where, p.Old, p.New)
+	case StopMoved:
+		return fmt.Sprintf("%s: %s moved %.0fm, %s -> %s",
+			p.Kind, where, p.Distance, p.Old, p.New)
+	case DirectionStopsChanged:
+		return fmt.Sprintf("%s: %s\n\told: %s\n\tnew: %s",
+			p.Kind, where, p.Old, p.New)
+	case PathsAdded, PathsRemoved, TripsAdded, TripsRemoved:
+		return fmt.Sprintf("%s: %s, %d", p.Kind, where, p.Count)
+	}
+	return fmt.Sprintf("%s: %s", p.Kind, where)
+}
+
+// The changes between two snapshots.
+type ConfigChangeLog struct {
+	From    string          `json:"from"`
+	To      string          `json:"to"`
+	Changes []*ConfigChange `json:"changes"`
+}
+
+// FilterByRoute returns a change log with only those changes that affect the
+// route with tag routeTag.
+func (p *ConfigChangeLog) FilterByRoute(routeTag string) *ConfigChangeLog {
+	result := &ConfigChangeLog{From: p.From, To: p.To}
+	for _, c := range p.Changes {
+		if c.AffectsRoute(routeTag) {
+			result.Changes = append(result.Changes, c)
+		}
+	}
+	return result
+}
+
+// WriteConfigChangeLogsJSON writes the change logs as a JSON array.
+func WriteConfigChangeLogsJSON(w io.Writer, logs []*ConfigChangeLog) error {
+	data, err := json.MarshalIndent(logs, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// WriteReport writes the changes in a human readable form.
+func (p *ConfigChangeLog) WriteReport(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "Changes from %s to %s: %d\n",
+		p.From, p.To, len(p.Changes))
+	for _, c := range p.Changes {
+		if err != nil {
+			break
+		}
+		_, err = fmt.Fprintf(w, "  %s\n", c)
+	}
+	return err
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch m := m.(type) {
+	case map[string]*nextbus.Route:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]*nextbus.Stop:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]*nextbus.Direction:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]bool:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]map[string]bool:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	default:
+		glog.Fatalf("Unsupported map type: %T", m)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func unionOfKeys(a, b []string) []string {
+	seen := make(map[string]bool)
+	var result []string
+	for _, k := range append(append([]string(nil), a...), b...) {
+		if !seen[k] {
+			seen[k] = true
+			result = append(result, k)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+func stopTags(stops []*nextbus.Stop) string {
+	tags := make([]string, len(stops))
+	for i, stop := range stops {
+		tags[i] = stop.Tag
+	}
+	return strings.Join(tags, " ")
+}
+
+// Counts the members of a that aren't in b.
+func countMissing(a, b map[string]bool) (n int) {
+	for k := range a {
+		if !b[k] {
+			n++
+		}
+	}
+	return
+}
+
+func pathHashes(route *nextbus.Route) map[string]bool {
+	result := make(map[string]bool)
+	for _, path := range route.Paths {
+		result[strconv.FormatUint(path.Hash, 16)] = true
+	}
+	return result
+}
+
+// DiffConfigSnapshots returns the changes from snapshot a to snapshot b.
+func DiffConfigSnapshots(a, b *ConfigSnapshot) *ConfigChangeLog {
+	result := &ConfigChangeLog{From: a.Dir, To: b.Dir}
+	add := func(c *ConfigChange) {
+		result.Changes = append(result.Changes, c)
+	}
+	aRoutes, bRoutes := a.Agency.Routes, b.Agency.Routes
+	for _, tag := range unionOfKeys(sortedKeys(aRoutes), sortedKeys(bRoutes)) {
+		ar, br := aRoutes[tag], bRoutes[tag]
+		if ar == nil {
+			add(&ConfigChange{Kind: RouteAdded, Route: tag, New: br.Title})
+			continue
+		} else if br == nil {
+			add(&ConfigChange{Kind: RouteRemoved, Route: tag, Old: ar.Title})
+			continue
+		}
+		if ar.Title != br.Title {
+			add(&ConfigChange{
+				Kind: RouteRenamed, Route: tag, Old: ar.Title, New: br.Title})
+		}
+		diffRouteStops(tag, ar, br, add)
+		diffDirections(tag, ar, br, add)
+		ap, bp := pathHashes(ar), pathHashes(br)
+		if n := countMissing(bp, ap); n > 0 {
+			add(&ConfigChange{Kind: PathsAdded, Route: tag, Count: n})
+		}
+		if n := countMissing(ap, bp); n > 0 {
+			add(&ConfigChange{Kind: PathsRemoved, Route: tag, Count: n})
+		}
+	}
+	diffStops(a.Agency, b.Agency, add)
+
+	// Only compare the schedules of routes present in both snapshots (a
+	// missing schedule file probably indicates a failed fetch).
+	for _, tag := range sortedKeys(b.Trips) {
+		at, ok := a.Trips[tag]
+		if !ok {
+			continue
+		}
+		bt := b.Trips[tag]
+		if n := countMissing(bt, at); n > 0 {
+			add(&ConfigChange{Kind: TripsAdded, Route: tag, Count: n})
+		}
+		if n := countMissing(at, bt); n > 0 {
+			add(&ConfigChange{Kind: TripsRemoved, Route: tag, Count: n})
+		}
+	}
+	return result
+}
+
+func diffRouteStops(
+	routeTag string, ar, br *nextbus.Route, add func(*ConfigChange)) {
+	for _, tag := range unionOfKeys(sortedKeys(ar.Stops), sortedKeys(br.Stops)) {
+		as, bs := ar.Stops[tag], br.Stops[tag]
+		if as == nil {
+			add(&ConfigChange{
+				Kind: RouteStopAdded, Route: routeTag, Stop: tag, New: bs.Title})
+		} else if bs == nil {
+			add(&ConfigChange{
+				Kind: RouteStopRemoved, Route: routeTag, Stop: tag, Old: as.Title})
+		}
+	}
+}
+
+func diffDirections(
+	routeTag string, ar, br *nextbus.Route, add func(*ConfigChange)) {
+	keys := unionOfKeys(sortedKeys(ar.Directions), sortedKeys(br.Directions))
+	for _, tag := range keys {
+		ad, bd := ar.Directions[tag], br.Directions[tag]
+		if ad == nil {
+			add(&ConfigChange{Kind: DirectionAdded, Route: routeTag,
+				Direction: tag, New: bd.Title})
+			continue
+		} else if bd == nil {
+			add(&ConfigChange{Kind: DirectionRemoved, Route: routeTag,
+				Direction: tag, Old: ad.Title})
+			continue
+		}
+		if ad.Title != bd.Title {
+			add(&ConfigChange{Kind: DirectionRenamed, Route: routeTag,
+				Direction: tag, Old: ad.Title, New: bd.Title})
+		}
+		if oldStops, newStops := stopTags(ad.Stops), stopTags(bd.Stops); oldStops != newStops {
+			add(&ConfigChange{Kind: DirectionStopsChanged, Route: routeTag,
+				Direction: tag, Old: oldStops, New: newStops})
+		}
+	}
+}
+
+// Returns the tags of the routes that serve stop.
+func routesOfStop(stop *nextbus.Stop) []string {
+	var result []string
+	for tag := range stop.Routes {
+		result = append(result, tag)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// Stops are shared by routes, so changes to the stops themselves (rather than
+// to the routes that serve them) are reported just once.
+func diffStops(a, b *nextbus.Agency, add func(*ConfigChange)) {
+	for _, tag := range sortedKeys(b.Stops) {
+		as, bs := a.Stops[tag], b.Stops[tag]
+		if as == nil {
+			continue
+		}
+		routes := unionOfKeys(routesOfStop(as), routesOfStop(bs))
+		if as.Title != bs.Title {
+			add(&ConfigChange{Kind: StopRenamed, Stop: tag, Routes: routes,
+				Old: as.Title, New: bs.Title})
+		}
+		if as.Location != nil && bs.Location != nil &&
+			as.Location.Location != bs.Location.Location {
+			distance, _ := as.Location.DistanceAndHeadingTo(bs.Location.Location)
+			add(&ConfigChange{Kind: StopMoved, Stop: tag, Routes: routes,
+				Old: as.Location.Location.String(), New: bs.Location.Location.String(),
+				Distance: float64(distance)})
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package configfetch
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const routeConfig1 = `<?xml version="1.0" encoding="utf-8" ?>
+<body copyright="All data copyright MBTA 2013.">
+<route tag="77" title="77" latMin="42.39" latMax="42.42" lonMin="-71.15" lonMax="-71.11">
+<stop tag="1" title="Harvard" lat="42.3954" lon="-71.1188"/>
+<stop tag="2" title="Porter" lat="42.3884" lon="-71.1191"/>
+<stop tag="3" title="Arlington Center" lat="42.4154" lon="-71.1565"/>
+<direction tag="77_0" title="Outbound" name="Outbound" useForUI="true">
+<stop tag="1" /><stop tag="2" /><stop tag="3" />
+</direction>
+<path>
+<point lat="42.3954" lon="-71.1188"/>
+<point lat="42.3884" lon="-71.1191"/>
+</path>
+</route>
+</body>`
+
+// Stop 2 moved and renamed, stop 3 dropped from the direction and route,
+// a new direction and a new path.
+const routeConfig2 = `<?xml version="1.0" encoding="utf-8" ?>
+<body copyright="All data copyright MBTA 2013.">
+<route tag="77" title="77" latMin="42.39" latMax="42.42" lonMin="-71.15" lonMax="-71.11">
+<stop tag="1" title="Harvard" lat="42.3954" lon="-71.1188"/>
+<stop tag="2" title="Porter Square" lat="42.3885" lon="-71.1191"/>
+<direction tag="77_0" title="Outbound" name="Outbound" useForUI="true">
+<stop tag="2" /><stop tag="1" />
+</direction>
+<direction tag="77_1" title="Inbound" name="Inbound" useForUI="true">
+<stop tag="1" />
+</direction>
+<path>
+<point lat="42.3954" lon="-71.1188"/>
+<point lat="42.3885" lon="-71.1191"/>
+</path>
+</route>
+</body>`
+
+const routeConfig96 = `<?xml version="1.0" encoding="utf-8" ?>
+<body copyright="All data copyright MBTA 2013.">
+<route tag="96" title="96" latMin="42.39" latMax="42.42" lonMin="-71.15" lonMax="-71.11">
+<stop tag="2" title="Porter" lat="42.3884" lon="-71.1191"/>
+<direction tag="96_0" title="Outbound" name="Outbound" useForUI="true">
+<stop tag="2" />
+</direction>
+</route>
+</body>`
+
+const schedule1 = `<?xml version="1.0" encoding="utf-8" ?>
+<body copyright="All data copyright MBTA 2013.">
+<route tag="77" title="77" scheduleClass="20130323" serviceClass="MoTuWeThFr" direction="Outbound">
+<header><stop tag="1">Harvard</stop></header>
+<tr blockID="T77_1"><stop tag="1" epochTime="21600000">06:00:00</stop></tr>
+<tr blockID="T77_2"><stop tag="1" epochTime="-1">--</stop><stop tag="2" epochTime="22600000">06:16:40</stop></tr>
+</route>
+</body>`
+
+const schedule2 = `<?xml version="1.0" encoding="utf-8" ?>
+<body copyright="All data copyright MBTA 2013.">
+<route tag="77" title="77" scheduleClass="20130323" serviceClass="MoTuWeThFr" direction="Outbound">
+<header><stop tag="1">Harvard</stop></header>
+<tr blockID="T77_1"><stop tag="1" epochTime="21600000">06:00:00</stop></tr>
+<tr blockID="T77_3"><stop tag="1" epochTime="23600000">06:33:20</stop></tr>
+<tr blockID="T77_4"><stop tag="1" epochTime="24600000">06:50:00</stop></tr>
+</route>
+</body>`
+
+func writeConfigDir(t *testing.T, dir string, files map[string]string) {
+	for rel, contents := range files {
+		fp := filepath.Join(dir, rel)
+		if err := os.MkdirAll(filepath.Dir(fp), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fp, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDiffConfigSnapshots(t *testing.T) {
+	root, err := ioutil.TempDir("", "config_diff_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	dir1 := filepath.Join(root, "2013-03-01_0300")
+	dir2 := filepath.Join(root, "2013-04-01_0300")
+	writeConfigDir(t, dir1, map[string]string{
+		"routeConfig/77.xml": routeConfig1,
+		"routeConfig/96.xml": routeConfig96,
+		"schedule/77.xml":    schedule1,
+	})
+	writeConfigDir(t, dir2, map[string]string{
+		"routeConfig/77.xml": routeConfig2,
+		"schedule/77.xml":    schedule2,
+	})
+	s1, err := LoadConfigSnapshot(dir1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2, err := LoadConfigSnapshot(dir2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changeLog := DiffConfigSnapshots(s1, s2)
+	var kinds []string
+	for _, c := range changeLog.Changes {
+		kinds = append(kinds, string(c.Kind))
+	}
+	expected := []string{
+		"RouteStopRemoved", "DirectionStopsChanged", "DirectionAdded",
+		"PathsAdded", "PathsRemoved", "RouteRemoved",
+		"StopRenamed", "StopMoved", "TripsAdded", "TripsRemoved",
+	}
+	if strings.Join(kinds, " ") != strings.Join(expected, " ") {
+		t.Fatalf("Wrong changes:\n%v\nexpected:\n%v", kinds, expected)
+	}
+	moved := changeLog.Changes[7]
+	if moved.Stop != "2" || moved.Distance < 10 || moved.Distance > 12 ||
+		strings.Join(moved.Routes, ",") != "77,96" {
+		t.Errorf("Wrong StopMoved change: %#v", moved)
+	}
+	if c := changeLog.Changes[1]; c.Old != "1 2 3" || c.New != "2 1" {
+		t.Errorf("Wrong DirectionStopsChanged change: %#v", c)
+	}
+	if c := changeLog.Changes[8]; c.Count != 2 {
+		t.Errorf("Wrong TripsAdded change: %#v", c)
+	}
+	if c := changeLog.Changes[9]; c.Count != 1 {
+		t.Errorf("Wrong TripsRemoved change: %#v", c)
+	}
+
+	filtered := changeLog.FilterByRoute("96")
+	if len(filtered.Changes) != 3 {
+		t.Errorf("Expected 3 changes affecting route 96: %v", filtered.Changes)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteConfigChangeLogsJSON(&buf, []*ConfigChangeLog{changeLog}); err != nil {
+		t.Fatal(err)
+	}
+	var decoded []*ConfigChangeLog
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != 1 || len(decoded[0].Changes) != len(changeLog.Changes) ||
+		decoded[0].From != dir1 || decoded[0].Changes[7].Kind != StopMoved {
+		t.Errorf("Wrong JSON:\n%s", buf.String())
+	}
+
+	buf.Reset()
+	if err := changeLog.WriteReport(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"Changes from " + dir1 + " to " + dir2 + ": 10\n",
+		`StopRenamed: stop 2 (routes 77, 96) "Porter" -> "Porter Square"`,
+		"StopMoved: stop 2 (routes 77, 96) moved 11m",
+		"TripsAdded: route 77, 2",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("Report is missing %q:\n%s", want, buf.String())
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package configfetch
+
+// Loading of the agency config that was in effect at a given time, from the
+// history of config snapshots: either a tree of config directories created by
+// PeriodicConfigFetcher (<root>/2006/01/02/2006-01-02_1504), or a ConfigStore
+// whose snapshots are named the same way.
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/jamessynge/transit_tools/nextbus"
+	"github.com/jamessynge/transit_tools/util"
+)
+
+// Layout of the names of the directories created by PeriodicConfigFetcher,
+// which are in local time.
+const kSnapshotNameLayout = "2006-01-02_1504"
+
+// ParseSnapshotTime returns the time at which the snapshot with the name was
+// fetched, in the location loc.
+func ParseSnapshotTime(name string, loc *time.Location) (time.Time, error) {
+	return time.ParseInLocation(kSnapshotNameLayout, name, loc)
+}
+
+type ConfigHistory struct {
+	Root string
+	// Names of the snapshots, and the times at which they were fetched, in
+	// time order.
+	Names []string
+	Times []time.Time
+	// If Root is a config store, store is set; else dirs has the path of each
+	// snapshot directory.
+	store *ConfigStore
+	dirs  []string
+	// The most recently loaded agency, and the error(s) from loading it
+	// (processing is usually in time order, so the same snapshot is requested
+	// many times in a row).
+	cachedIndex  int
+	cachedAgency *nextbus.Agency
+	cachedErr    error
+}
+
+func isConfigStoreRoot(root string) bool {
+	return util.IsDirectory(filepath.Join(root, kBlobsDir)) &&
+		util.IsDirectory(filepath.Join(root, kManifestsDir))
+}
+
+// OpenConfigHistory finds the snapshots under root (a config store, or a
+// tree of config directories). The snapshot names are interpreted in loc
+// (time.Local if nil), i.e. the time zone in which the fetcher ran.
+func OpenConfigHistory(root string, loc *time.Location) (*ConfigHistory, error) {
+	if loc == nil {
+		loc = time.Local
+	}
+	p := &ConfigHistory{Root: root, cachedIndex: -1}
+	var names, dirs []string
+	if isConfigStoreRoot(root) {
+		p.store = &ConfigStore{Root: root}
+		var err error
+		if names, err = p.store.ListSnapshots(); err != nil {
+			return nil, err
+		}
+	} else if util.IsDirectory(root) {
+		walkFn := func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				glog.Warningf("Error walking %s: %v", path, err)
+				return nil
+			}
+			if !info.IsDir() {
+				return nil
+			}
+			if util.IsDirectory(filepath.Join(path, "routeConfig")) {
+				names = append(names, info.Name())
+				dirs = append(dirs, path)
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if err := filepath.Walk(root, walkFn); err != nil {
+			return nil, err
+		}
+	} else {
+		return nil, fmt.Errorf("Not a directory: %s", root)
+	}
+	for i, name := range names {
+		t, err := ParseSnapshotTime(name, loc)
+		if err != nil {
+			glog.Warningf("Ignoring snapshot with unexpected name: %s", name)
+			continue
+		}
+		p.Names = append(p.Names, name)
+		p.Times = append(p.Times, t)
+		if dirs != nil {
+			p.dirs = append(p.dirs, dirs[i])
+		}
+	}
+	if len(p.Names) == 0 {
+		return nil, fmt.Errorf("No config snapshots found in %s", root)
+	}
+	sort.Sort(p)
+	glog.Infof("Found %d config snapshots in %s, from %s to %s", len(p.Names),
+		root, p.Names[0], p.Names[len(p.Names)-1])
+	return p, nil
+}
+
+// Sorting into time order (directories aren't necessarily walked in time
+// order if the tree has been reorganized).
+func (p *ConfigHistory) Len() int {
+	return len(p.Names)
+}
+func (p *ConfigHistory) Less(i, j int) bool {
+	return p.Times[i].Before(p.Times[j])
+}
+func (p *ConfigHistory) Swap(i, j int) {
+	p.Names[i], p.Names[j] = p.Names[j], p.Names[i]
+	p.Times[i], p.Times[j] = p.Times[j], p.Times[i]
+	if p.dirs != nil {
+		p.dirs[i], p.dirs[j] = p.dirs[j], p.dirs[i]
+	}
+}
+
+// SnapshotAt returns the index of the snapshot in effect at time t (i.e. the
+// last one fetched at or before t), or false if t is before the first.
+func (p *ConfigHistory) SnapshotAt(t time.Time) (int, bool) {
+	i := sort.Search(len(p.Times), func(i int) bool {
+		return p.Times[i].After(t)
+	})
+	return i - 1, i > 0
+}
+
+// SnapshotsBetween returns the indices of the snapshots in effect at some
+// time in [start, end].
+func (p *ConfigHistory) SnapshotsBetween(start, end time.Time) []int {
+	first, ok := p.SnapshotAt(start)
+	if !ok {
+		first = 0
+	}
+	var result []int
+	for i := first; i < len(p.Times) && !p.Times[i].After(end); i++ {
+		result = append(result, i)
+	}
+	return result
+}
+
+// LoadAgency parses the routeConfig files of the snapshot with index i.
+// Errors in individual files are logged and returned (combined), but don't
+// prevent the remaining files from being loaded.
+func (p *ConfigHistory) LoadAgency(i int) (*nextbus.Agency, error) {
+	if i < 0 || i >= len(p.Names) {
+		return nil, fmt.Errorf("Invalid snapshot index: %d", i)
+	}
+	if i == p.cachedIndex {
+		return p.cachedAgency, p.cachedErr
+	}
+	agency := nextbus.NewAgency(p.Names[i])
+	errs := util.NewErrors()
+	if p.store != nil {
+		m, err := p.store.ReadManifest(p.Names[i])
+		if err != nil {
+			return nil, err
+		}
+		for _, rel := range m.Paths() {
+			if !strings.HasPrefix(rel, "routeConfig/") ||
+				!strings.HasSuffix(rel, ".xml") {
+				continue
+			}
+			data, err := p.store.ReadBlob(m.Files[rel])
+			if err == nil {
+				_, err = nextbus.ParseRouteConfigXml(agency, data)
+			}
+			if err != nil {
+				glog.Warningf("Error(s) parsing %s of %s: %v", rel, p.Names[i], err)
+				errs.AddError(err)
+			}
+		}
+	} else {
+		for _, fp := range listXmlFiles(filepath.Join(p.dirs[i], "routeConfig")) {
+			if _, err := nextbus.ParseRouteConfigFile(agency, fp); err != nil {
+				glog.Warningf("Error(s) parsing %s: %v", fp, err)
+				errs.AddError(err)
+			}
+		}
+	}
+	glog.Infof("Loaded %d routes and %d paths from snapshot %s",
+		len(agency.Routes), agency.NumPaths(), p.Names[i])
+	p.cachedIndex, p.cachedAgency, p.cachedErr = i, agency, errs.ToError()
+	return agency, p.cachedErr
+}
+
+// AgencyAt returns the agency config in effect at time t, and the index of
+// its snapshot.
+func (p *ConfigHistory) AgencyAt(t time.Time) (*nextbus.Agency, int, error) {
+	i, ok := p.SnapshotAt(t)
+	if !ok {
+		return nil, -1, fmt.Errorf("%s is before the first config snapshot (%s)",
+			t.Format(time.RFC3339), p.Names[0])
+	}
+	agency, err := p.LoadAgency(i)
+	return agency, i, err
+}
+
+// LoadAgencyAt is a convenience for loading a single agency config from the
+// history under root.
+func LoadAgencyAt(root string, t time.Time) (*nextbus.Agency, error) {
+	p, err := OpenConfigHistory(root, nil)
+	if err != nil {
+		return nil, err
+	}
+	agency, _, err := p.AgencyAt(t)
+	return agency, err
+}
@@ -0,0 +1,96 @@
+package configfetch
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestConfigHistory(t *testing.T) {
+	root, err := ioutil.TempDir("", "config_history_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	configRoot := filepath.Join(root, "config")
+	dir1 := filepath.Join(configRoot, "2013", "03", "01", "2013-03-01_0300")
+	dir2 := filepath.Join(configRoot, "2013", "04", "01", "2013-04-01_0300")
+	writeConfigDir(t, dir1, map[string]string{
+		"routeConfig/77.xml": routeConfig1,
+		"routeConfig/96.xml": routeConfig96,
+	})
+	writeConfigDir(t, dir2, map[string]string{
+		"routeConfig/77.xml": routeConfig2,
+	})
+	store, err := OpenConfigStore(filepath.Join(root, "store"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{dir2, dir1} {
+		if _, _, err := store.AddDir(filepath.Base(dir), dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, historyRoot := range []string{configRoot, store.Root} {
+		h, err := OpenConfigHistory(historyRoot, time.UTC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(h.Names) != 2 || h.Names[0] != "2013-03-01_0300" {
+			t.Fatalf("Wrong snapshots in %s: %v", historyRoot, h.Names)
+		}
+		if _, _, err := h.AgencyAt(
+			time.Date(2013, 3, 1, 2, 59, 0, 0, time.UTC)); err == nil {
+			t.Errorf("Expected an error before the first snapshot")
+		}
+		agency, i, err := h.AgencyAt(time.Date(2013, 3, 15, 0, 0, 0, 0, time.UTC))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i != 0 || len(agency.Routes) != 2 || agency.Stops["2"].Title != "Porter" {
+			t.Errorf("Wrong agency for March from %s: %d, %v", historyRoot, i,
+				agency.Routes)
+		}
+		agency, i, err = h.AgencyAt(time.Date(2013, 4, 1, 3, 0, 0, 0, time.UTC))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i != 1 || len(agency.Routes) != 1 ||
+			agency.Stops["2"].Title != "Porter Square" || agency.NumPaths() != 1 {
+			t.Errorf("Wrong agency for April from %s: %d, %v", historyRoot, i,
+				agency.Routes)
+		}
+		between := h.SnapshotsBetween(time.Date(2013, 3, 2, 0, 0, 0, 0, time.UTC),
+			time.Date(2013, 4, 2, 0, 0, 0, 0, time.UTC))
+		if len(between) != 2 {
+			t.Errorf("Wrong snapshots between: %v", between)
+		}
+	}
+}
+
+func TestConfigHistoryCachesErrors(t *testing.T) {
+	root, err := ioutil.TempDir("", "config_history_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	writeConfigDir(t, filepath.Join(root, "2013", "03", "01", "2013-03-01_0300"),
+		map[string]string{
+			"routeConfig/77.xml": routeConfig1,
+			"routeConfig/96.xml": "<body>not closed",
+		})
+	h, err := OpenConfigHistory(root, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The errors are returned by every load, not just the first.
+	for n := 0; n < 2; n++ {
+		agency, err := h.LoadAgency(0)
+		if err == nil || agency == nil || len(agency.Routes) != 1 {
+			t.Errorf("Load %d: %v, %v", n, agency, err)
+		}
+	}
+}
@@ -0,0 +1,318 @@
+package configfetch
+
+// A content-addressed store of config snapshots. Each file of a snapshot is
+// normalized (for xml files, the metadata comments are removed; see
+// removeXmlComments), and stored as a blob named by the SHA-256 hash of the
+// normalized contents, so the files that are the same in many snapshots are
+// stored just once. A manifest per snapshot maps the relative path of each
+// file to the hash of its contents. Layout of the store:
+//
+//   <root>/blobs/<first 2 hex digits of hash>/<hash>.gz
+//   <root>/manifests/<snapshot name>.json
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+
+	"github.com/jamessynge/transit_tools/util"
+)
+
+const (
+	kBlobsDir       = "blobs"
+	kManifestsDir   = "manifests"
+	kManifestSuffix = ".json"
+)
+
+type ConfigStore struct {
+	Root string
+}
+
+// Lists the files of a snapshot; the keys are relative paths using forward
+// slashes, and the values are the hashes of the normalized contents.
+type ConfigManifest struct {
+	Name  string            `json:"name"`
+	Files map[string]string `json:"files"`
+}
+
+// Paths of the files in the manifest, sorted.
+func (p *ConfigManifest) Paths() []string {
+	var result []string
+	for rel := range p.Files {
+		result = append(result, rel)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// OpenConfigStore opens (creating if necessary) the store rooted at root.
+func OpenConfigStore(root string) (*ConfigStore, error) {
+	for _, sub := range []string{kBlobsDir, kManifestsDir} {
+		if err := os.MkdirAll(filepath.Join(root, sub), 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &ConfigStore{Root: root}, nil
+}
+
+// Returns the normalized contents of a config file, i.e. without the
+// metadata that was added when the file was fetched.
+func normalizeConfigFile(rel string, data []byte) []byte {
+	if strings.HasSuffix(rel, ".xml") {
+		return removeXmlComments(data)
+	}
+	return data
+}
+
+func hashBlob(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Returns true if hash is a hex encoded SHA-256 hash, as made by hashBlob
+// (so it is safe to use as the name of a file).
+func isValidHash(hash string) bool {
+	if len(hash) != 2*sha256.Size {
+		return false
+	}
+	for _, c := range hash {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns an error if rel isn't a relative path (using forward slashes) that
+// stays within the directory of the snapshot; manifests are read from disk,
+// so their paths can't be trusted when checking out a snapshot.
+func checkManifestPath(rel string) error {
+	if len(rel) == 0 || strings.HasPrefix(rel, "/") ||
+		strings.Contains(rel, `\`) || filepath.IsAbs(filepath.FromSlash(rel)) ||
+		filepath.VolumeName(filepath.FromSlash(rel)) != "" {
+		return fmt.Errorf("Invalid path in manifest: %q", rel)
+	}
+	for _, part := range strings.Split(rel, "/") {
+		if part == "" || part == "." || part == ".." {
+			return fmt.Errorf("Invalid path in manifest: %q", rel)
+		}
+	}
+	return nil
+}
+
+func (p *ConfigStore) blobPath(hash string) string {
+	return filepath.Join(p.Root, kBlobsDir, hash[0:2], hash+".gz")
+}
+
+func (p *ConfigStore) manifestPath(name string) string {
+	return filepath.Join(p.Root, kManifestsDir, name+kManifestSuffix)
+}
+
+// Writes data to filePath via a temporary file, so that a partially written
+// file is never visible at filePath.
+func writeFileAtomically(filePath string, data []byte) error {
+	dir := filepath.Dir(filePath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	tmpPath := f.Name()
+	_, err = f.Write(data)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, filePath)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+	}
+	return err
+}
+
+// Stores the blob if not already present; returns true if it was added.
+func (p *ConfigStore) putBlob(hash string, data []byte) (bool, error) {
+	fp := p.blobPath(hash)
+	if util.IsFile(fp) {
+		return false, nil
+	}
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return false, err
+	}
+	if err := w.Close(); err != nil {
+		return false, err
+	}
+	return true, writeFileAtomically(fp, buf.Bytes())
+}
+
+// ReadBlob returns the (normalized) contents of the blob with the hash.
+func (p *ConfigStore) ReadBlob(hash string) ([]byte, error) {
+	if !isValidHash(hash) {
+		return nil, fmt.Errorf("Invalid hash: %q", hash)
+	}
+	f, err := os.Open(p.blobPath(hash))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// AddDir adds the files of the config directory dir to the store, as the
+// snapshot name (which may not contain path separators; the base name of the
+// directory, a timestamp, is a good choice). Returns the manifest and the
+// number of new blobs.
+func (p *ConfigStore) AddDir(name, dir string) (*ConfigManifest, int, error) {
+	if len(name) == 0 || strings.ContainsAny(name, `/\`) {
+		return nil, 0, fmt.Errorf("Invalid snapshot name: %q", name)
+	}
+	var doStop int32
+	rels, err := getDirDescendants(dir, &doStop)
+	if err != nil {
+		return nil, 0, err
+	}
+	m := &ConfigManifest{Name: name, Files: make(map[string]string)}
+	newBlobs := 0
+	for _, rel := range rels {
+		data, err := ioutil.ReadFile(filepath.Join(dir, rel))
+		if err != nil {
+			return nil, newBlobs, err
+		}
+		rel = filepath.ToSlash(rel)
+		data = normalizeConfigFile(rel, data)
+		hash := hashBlob(data)
+		added, err := p.putBlob(hash, data)
+		if err != nil {
+			return nil, newBlobs, err
+		}
+		if added {
+			newBlobs++
+		}
+		m.Files[rel] = hash
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, newBlobs, err
+	}
+	if err := writeFileAtomically(p.manifestPath(name), data); err != nil {
+		return nil, newBlobs, err
+	}
+	glog.Infof("Added snapshot %s with %d files (%d new blobs) from %s",
+		name, len(m.Files), newBlobs, dir)
+	return m, newBlobs, nil
+}
+
+// HasSnapshot returns true if the store has a snapshot with the name.
+func (p *ConfigStore) HasSnapshot(name string) bool {
+	return util.IsFile(p.manifestPath(name))
+}
+
+// ListSnapshots returns the names of the snapshots in the store, sorted
+// (i.e. in time order if named by timestamp).
+func (p *ConfigStore) ListSnapshots() ([]string, error) {
+	infos, err := ioutil.ReadDir(filepath.Join(p.Root, kManifestsDir))
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	for _, info := range infos {
+		if name := info.Name(); strings.HasSuffix(name, kManifestSuffix) {
+			result = append(result, strings.TrimSuffix(name, kManifestSuffix))
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// ReadManifest returns the manifest of the named snapshot. Returns an error
+// if the manifest has a path that is absolute or has a ".." component, or an
+// invalid hash.
+func (p *ConfigStore) ReadManifest(name string) (*ConfigManifest, error) {
+	if len(name) == 0 || strings.ContainsAny(name, `/\`) {
+		return nil, fmt.Errorf("Invalid snapshot name: %q", name)
+	}
+	data, err := ioutil.ReadFile(p.manifestPath(name))
+	if err != nil {
+		return nil, err
+	}
+	m := &ConfigManifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("Error parsing manifest %s: %v", name, err)
+	}
+	for rel, hash := range m.Files {
+		if err := checkManifestPath(rel); err != nil {
+			return nil, fmt.Errorf("Error in manifest %s: %v", name, err)
+		}
+		if !isValidHash(hash) {
+			return nil, fmt.Errorf("Error in manifest %s: invalid hash %q of %s",
+				name, hash, rel)
+		}
+	}
+	return m, nil
+}
+
+// Checkout writes the files of the named snapshot to dir, re-creating the
+// config directory (less the metadata comments). No file is written outside
+// of dir.
+func (p *ConfigStore) Checkout(name, dir string) error {
+	m, err := p.ReadManifest(name)
+	if err != nil {
+		return err
+	}
+	for _, rel := range m.Paths() {
+		if err := checkManifestPath(rel); err != nil {
+			return err
+		}
+		data, err := p.ReadBlob(m.Files[rel])
+		if err != nil {
+			return err
+		}
+		fp := filepath.Join(dir, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(fp), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(fp, data, 0644); err != nil {
+			return err
+		}
+	}
+	glog.Infof("Checked out snapshot %s (%d files) to %s", name, len(m.Files), dir)
+	return nil
+}
+
+// DiffConfigManifests returns the relative paths of the files only in a, only
+// in b, and in both but with different contents.
+func DiffConfigManifests(a, b *ConfigManifest) (removed, added, changed []string) {
+	for _, rel := range a.Paths() {
+		if hash, ok := b.Files[rel]; !ok {
+			removed = append(removed, rel)
+		} else if hash != a.Files[rel] {
+			changed = append(changed, rel)
+		}
+	}
+	for _, rel := range b.Paths() {
+		if _, ok := a.Files[rel]; !ok {
+			added = append(added, rel)
+		}
+	}
+	return
+}
@@ -0,0 +1,151 @@
+package configfetch
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfigStore(t *testing.T) {
+	root, err := ioutil.TempDir("", "config_store_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	// The snapshots differ only in the metadata comments of 77.xml, and in
+	// the contents of 96.xml.
+	comment1 := "\n<!-- Fetched at 2013-03-01 03:00 -->\n"
+	comment2 := "\n<!-- Fetched at 2013-04-01 03:00 -->\n"
+	dir1 := filepath.Join(root, "2013-03-01_0300")
+	dir2 := filepath.Join(root, "2013-04-01_0300")
+	writeConfigDir(t, dir1, map[string]string{
+		"routeConfig/77.xml": routeConfig1 + comment1,
+		"routeConfig/96.xml": routeConfig96 + comment1,
+		"schedule/77.xml":    schedule1,
+	})
+	writeConfigDir(t, dir2, map[string]string{
+		"routeConfig/77.xml": routeConfig1 + comment2,
+		"routeConfig/96.xml": routeConfig2,
+		"routeList.xml":      "<body/>",
+	})
+
+	store, err := OpenConfigStore(filepath.Join(root, "store"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m1, n1, err := store.AddDir("2013-03-01_0300", dir1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m2, n2, err := store.AddDir("2013-04-01_0300", dir2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n1 != 3 || n2 != 2 {
+		t.Errorf("Wrong number of new blobs: %d, %d", n1, n2)
+	}
+	if m1.Files["routeConfig/77.xml"] != m2.Files["routeConfig/77.xml"] {
+		t.Errorf("Normalized files should share a blob:\n%v\n%v", m1, m2)
+	}
+	if _, _, err := store.AddDir("a/b", dir1); err == nil {
+		t.Errorf("Expected an error for an invalid snapshot name")
+	}
+
+	names, err := store.ListSnapshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(names, " ") != "2013-03-01_0300 2013-04-01_0300" {
+		t.Errorf("Wrong snapshots: %v", names)
+	}
+	if !store.HasSnapshot(names[0]) || store.HasSnapshot("2013-05-01_0300") {
+		t.Errorf("HasSnapshot is wrong")
+	}
+
+	removed, added, changed := DiffConfigManifests(m1, m2)
+	if strings.Join(removed, " ") != "schedule/77.xml" ||
+		strings.Join(added, " ") != "routeList.xml" ||
+		strings.Join(changed, " ") != "routeConfig/96.xml" {
+		t.Errorf("Wrong diff: %v, %v, %v", removed, added, changed)
+	}
+
+	out := filepath.Join(root, "out")
+	if err := store.Checkout(names[0], out); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(out, "routeConfig", "77.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(removeXmlComments([]byte(routeConfig1+comment1))) {
+		t.Errorf("Wrong checked out contents:\n%s", data)
+	}
+	data, err = ioutil.ReadFile(filepath.Join(out, "schedule", "77.xml"))
+	if err != nil || string(data) != schedule1 {
+		t.Errorf("Wrong checked out contents (%v):\n%s", err, data)
+	}
+}
+
+func TestConfigStoreRejectsUnsafeManifests(t *testing.T) {
+	root, err := ioutil.TempDir("", "config_store_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	store, err := OpenConfigStore(filepath.Join(root, "store"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(root, "config")
+	writeConfigDir(t, dir, map[string]string{"routeList.xml": "<body/>"})
+	m, _, err := store.AddDir("good", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := m.Files["routeList.xml"]
+
+	for rel, hash := range map[string]string{
+		"../evil.xml":        hash,
+		"a/../../evil.xml":   hash,
+		"/tmp/evil.xml":      hash,
+		"a//evil.xml":        hash,
+		"routeList.xml":      "../../../../evil",
+		"routeConfig/77.xml": strings.ToUpper(hash),
+	} {
+		bad := &ConfigManifest{Name: "bad", Files: map[string]string{rel: hash}}
+		data, err := json.Marshal(bad)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(store.manifestPath("bad"), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.ReadManifest("bad"); err == nil {
+			t.Errorf("Expected an error reading a manifest with %q: %q", rel, hash)
+		}
+		out := filepath.Join(root, "out", "snapshot")
+		if err := store.Checkout("bad", out); err == nil {
+			t.Errorf("Expected an error checking out a manifest with %q: %q",
+				rel, hash)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "out", "evil.xml")); err == nil {
+		t.Errorf("Checkout wrote a file outside of its directory")
+	}
+
+	for _, hash := range []string{"", "ab", "../../../../etc/passwd", hash[1:]} {
+		if _, err := store.ReadBlob(hash); err == nil {
+			t.Errorf("Expected an error reading blob %q", hash)
+		}
+	}
+	if _, err := store.ReadBlob(hash); err != nil {
+		t.Errorf("Unable to read blob %s: %v", hash, err)
+	}
+	if _, err := store.ReadManifest("../store/manifests/good"); err == nil {
+		t.Errorf("Expected an error for an invalid snapshot name")
+	}
+}
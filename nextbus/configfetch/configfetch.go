@@ -184,7 +184,7 @@ func (p *state) fetchRouteList() (routeTags []string) {
 		}
 		glog.V(1).Infoln("Fetched list of", len(routeTags), "routes")
 	} else if !p.stop {
-		glog.Errorln("Failed to fetch route list for agency '%s'", p.agency)
+		glog.Errorf("Failed to fetch route list for agency '%s'", p.agency)
 	}
 	return
 }
@@ -272,7 +272,7 @@ func FetchAgencyConfig(agency, rootDir string,
 
 func PeriodicConfigFetcher(agency, rootDir string, fetcher util.HttpFetcher,
 	fetchHours []int, stopPCFCh chan chan bool) {
-	layout := filepath.Join("2006", "01", "02", "2006-01-02_1504")
+	layout := filepath.Join("2006", "01", "02", kSnapshotNameLayout)
 	if len(fetchHours) == 0 {
 		fetchHours = []int{5}
 	} else {
@@ -41,3 +41,14 @@ func (p *Direction) initFromElement(elem *DirectionElement) error {
 	}
 	return nil
 }
+
+// AppendStop adds the stop to the end of the direction's list of stops;
+// returns an error if the stop is already in the list.
+func (p *Direction) AppendStop(stop *Stop) error {
+	if _, ok := p.StopsIndex[stop.Tag]; ok {
+		return fmt.Errorf("stop %s is already in direction %s", stop.Tag, p.Tag)
+	}
+	p.StopsIndex[stop.Tag] = len(p.Stops)
+	p.Stops = append(p.Stops, stop)
+	return nil
+}
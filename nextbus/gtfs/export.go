@@ -0,0 +1,566 @@
+// Package gtfs converts between the nextbus Agency model (plus NextBus
+// schedules) and GTFS static feeds (https://gtfs.org/schedule/reference/).
+package gtfs
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/jamessynge/transit_tools/geo"
+	"github.com/jamessynge/transit_tools/nextbus"
+)
+
+const (
+	kDateLayout = "20060102"
+	// GTFS route_type of buses.
+	kRouteTypeBus = 3
+)
+
+// Produces a GTFS static feed from an agency's config (routes, stops, paths)
+// and its schedules. The paths of a route are pieces of the route shared
+// between directions and routes, so the shape of a trip is made by chaining
+// the paths nearest the stops of its direction; paths that aren't part of
+// any such shape become shapes of their own. Schedules list times only for
+// the timepoints of a trip, so stop_times has just those stops.
+type Exporter struct {
+	Agency *nextbus.Agency
+	// The route elements of the schedule files (one per service class and
+	// direction of a route).
+	Schedules []*nextbus.RouteElement
+	// Values for agency.txt.
+	AgencyName string
+	AgencyUrl  string
+	Timezone   string
+	// Dates (yyyymmdd) of the period covered by calendar.txt. By default the
+	// period starts at the earliest schedule class (which is the date at
+	// which the schedule took effect), and lasts a year.
+	StartDate string
+	EndDate   string
+}
+
+func NewExporter(agency *nextbus.Agency) *Exporter {
+	return &Exporter{
+		Agency:     agency,
+		AgencyName: agency.Tag,
+		AgencyUrl:  "http://www.nextbus.com",
+		Timezone:   "America/New_York",
+	}
+}
+
+// AddScheduleXml adds the schedule of a route (the response to
+// command=schedule).
+func (p *Exporter) AddScheduleXml(data []byte) error {
+	body, err := nextbus.UnmarshalNextbusXml(data)
+	if err != nil {
+		return err
+	}
+	if body.Error != nil {
+		return fmt.Errorf("Schedule contains an error: %v", body.Error)
+	}
+	p.Schedules = append(p.Schedules, body.Routes...)
+	return nil
+}
+
+// AddScheduleDir adds the schedules in the xml files of dirPath.
+func (p *Exporter) AddScheduleDir(dirPath string) error {
+	infos, err := ioutil.ReadDir(dirPath)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if info.IsDir() || !strings.HasSuffix(info.Name(), ".xml") {
+			continue
+		}
+		filePath := filepath.Join(dirPath, info.Name())
+		data, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			return err
+		}
+		if err := p.AddScheduleXml(data); err != nil {
+			return fmt.Errorf("Error parsing %s: %v", filePath, err)
+		}
+	}
+	return nil
+}
+
+var kDayAbbrevs = []string{"Mo", "Tu", "We", "Th", "Fr", "Sa", "Su"}
+
+var kServiceClassDays = map[string][7]bool{
+	"weekday":   {true, true, true, true, true, false, false},
+	"weekend":   {false, false, false, false, false, true, true},
+	"monday":    {true, false, false, false, false, false, false},
+	"tuesday":   {false, true, false, false, false, false, false},
+	"wednesday": {false, false, true, false, false, false, false},
+	"thursday":  {false, false, false, true, false, false, false},
+	"friday":    {false, false, false, false, true, false, false},
+	"saturday":  {false, false, false, false, false, true, false},
+	"sunday":    {false, false, false, false, false, false, true},
+}
+
+// ParseServiceClass returns the days of the week (Monday first) on which a
+// NextBus service class (e.g. "MoTuWeThFr", "Saturday") operates.
+func ParseServiceClass(serviceClass string) (days [7]bool, err error) {
+	if days, ok := kServiceClassDays[strings.ToLower(serviceClass)]; ok {
+		return days, nil
+	}
+	s := serviceClass
+	if len(s) == 0 || len(s)%2 != 0 {
+		return days, fmt.Errorf("Unknown service class: %q", serviceClass)
+	}
+	for ; len(s) > 0; s = s[2:] {
+		found := false
+		for i, abbrev := range kDayAbbrevs {
+			if strings.EqualFold(s[0:2], abbrev) {
+				days[i] = true
+				found = true
+				break
+			}
+		}
+		if !found {
+			return days, fmt.Errorf("Unknown service class: %q", serviceClass)
+		}
+	}
+	return days, nil
+}
+
+// FormatGtfsTime formats the milliseconds since the start of the service day
+// (as in the epochTime of schedule stops) as a GTFS time, which may exceed
+// 24:00:00 for trips after midnight.
+func FormatGtfsTime(ms int64) string {
+	secs := ms / 1000
+	return fmt.Sprintf("%02d:%02d:%02d", secs/3600, (secs/60)%60, secs%60)
+}
+
+// Returns the stop of the agency referred to by a schedule stop tag;
+// schedules sometimes add a suffix to the tag (e.g. "141_ar" for the arrival
+// at stop "141").
+func (p *Exporter) scheduleStop(tag string) *nextbus.Stop {
+	if stop := p.Agency.Stops[tag]; stop != nil {
+		return stop
+	}
+	if i := strings.LastIndex(tag, "_"); i > 0 {
+		return p.Agency.Stops[tag[0:i]]
+	}
+	return nil
+}
+
+func gtfsDirectionId(name string) string {
+	switch strings.ToLower(name) {
+	case "outbound":
+		return "0"
+	case "inbound":
+		return "1"
+	}
+	return ""
+}
+
+// Returns the (first, by tag) direction of the route with the name that is
+// used for the UI, or nil if there is none.
+func uiDirection(route *nextbus.Route, name string) *nextbus.Direction {
+	var tags []string
+	for tag, direction := range route.Directions {
+		if direction.Name == name && direction.UseForUI {
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) == 0 {
+		return nil
+	}
+	sort.Strings(tags)
+	return route.Directions[tags[0]]
+}
+
+// Returns the title of the direction of the route with the name that is used
+// for the UI, or else the name.
+func headsign(route *nextbus.Route, name string) string {
+	if direction := uiDirection(route, name); direction != nil {
+		return direction.Title
+	}
+	return name
+}
+
+func sortedRoutes(agency *nextbus.Agency) []*nextbus.Route {
+	var tags []string
+	for tag := range agency.Routes {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	result := make([]*nextbus.Route, len(tags))
+	for i, tag := range tags {
+		result[i] = agency.Routes[tag]
+	}
+	return result
+}
+
+func sortedStops(agency *nextbus.Agency) []*nextbus.Stop {
+	var tags []string
+	for tag := range agency.Stops {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	result := make([]*nextbus.Stop, len(tags))
+	for i, tag := range tags {
+		result[i] = agency.Stops[tag]
+	}
+	return result
+}
+
+func formatCoord(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// ShapeId returns the shape_id of the shape of a path.
+func ShapeId(path *nextbus.Path) string {
+	return "path_" + strconv.Itoa(path.Index)
+}
+
+// DirectionShapeId returns the shape_id of the shape of a direction (the
+// tags of directions are unique only within a route).
+func DirectionShapeId(direction *nextbus.Direction) string {
+	return "route_" + direction.Route.Tag + "_" + direction.Tag
+}
+
+// Returns the distance from the location to the nearest way point of the path.
+func distanceToPath(location *nextbus.Location, path *nextbus.Path) float64 {
+	result := math.Inf(1)
+	for _, wp := range path.WayPoints {
+		if d, _ := geo.ToDistanceAndHeading(location.Location, wp.Location); d < result {
+			result = d
+		}
+	}
+	return result
+}
+
+// Returns the way points of the shape of a direction: the paths of the route
+// nearest the stops of the direction, in the order in which the stops first
+// reach them, each oriented to start where the previous one ends. Returns
+// the paths used, or nil if the direction has no stops with locations or the
+// route no paths.
+func directionShape(direction *nextbus.Direction) (
+	shape []*nextbus.Location, paths []*nextbus.Path) {
+	used := make(map[*nextbus.Path]bool)
+	for _, stop := range direction.Stops {
+		if stop.Location == nil {
+			continue
+		}
+		var nearest *nextbus.Path
+		nearestDistance := math.Inf(1)
+		for _, path := range direction.Route.Paths {
+			if d := distanceToPath(stop.Location, path); d < nearestDistance {
+				nearest, nearestDistance = path, d
+			}
+		}
+		if nearest == nil || used[nearest] {
+			continue
+		}
+		used[nearest] = true
+		paths = append(paths, nearest)
+		wps := nearest.WayPoints
+		if len(wps) == 0 {
+			continue
+		}
+		// Orient the path to start near the end of the shape so far (or near
+		// the first stop).
+		from := stop.Location
+		if len(shape) > 0 {
+			from = shape[len(shape)-1]
+		}
+		dStart, _ := geo.ToDistanceAndHeading(from.Location, wps[0].Location)
+		dEnd, _ := geo.ToDistanceAndHeading(from.Location, wps[len(wps)-1].Location)
+		for i := range wps {
+			wp := wps[i]
+			if dEnd < dStart {
+				wp = wps[len(wps)-1-i]
+			}
+			if len(shape) > 0 && shape[len(shape)-1].SameLocation(wp.Location) {
+				continue
+			}
+			shape = append(shape, wp)
+		}
+	}
+	return
+}
+
+// Returns the directions used by the schedules, sorted by shape_id.
+func (p *Exporter) scheduledDirections() []*nextbus.Direction {
+	directions := make(map[string]*nextbus.Direction)
+	for _, re := range p.Schedules {
+		route := p.Agency.Routes[re.Tag]
+		if route == nil {
+			continue
+		}
+		if direction := uiDirection(route, re.Direction); direction != nil {
+			directions[DirectionShapeId(direction)] = direction
+		}
+	}
+	var ids []string
+	for id := range directions {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	result := make([]*nextbus.Direction, len(ids))
+	for i, id := range ids {
+		result[i] = directions[id]
+	}
+	return result
+}
+
+// Writes a GTFS file (a zip entry) with the header and records.
+func writeGtfsFile(zw *zip.Writer, name string, header []string,
+	records [][]string) error {
+	w, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	cw := csv.NewWriter(w)
+	cw.Write(header)
+	cw.WriteAll(records)
+	return cw.Error()
+}
+
+func (p *Exporter) agencyRecords() [][]string {
+	return [][]string{{p.Agency.Tag, p.AgencyName, p.AgencyUrl, p.Timezone}}
+}
+
+func (p *Exporter) routeRecords() (records [][]string) {
+	for _, route := range sortedRoutes(p.Agency) {
+		shortName := route.ShortTitle
+		if len(shortName) == 0 {
+			shortName = route.Title
+		}
+		records = append(records, []string{
+			route.Tag, p.Agency.Tag, shortName, route.Title,
+			strconv.Itoa(kRouteTypeBus), route.Color, route.OppColor,
+		})
+	}
+	return
+}
+
+func (p *Exporter) stopRecords() (records [][]string) {
+	for _, stop := range sortedStops(p.Agency) {
+		if stop.Location == nil {
+			glog.Warningf("Stop %s has no location, omitting", stop.Tag)
+			continue
+		}
+		records = append(records, []string{
+			stop.Tag, stop.Id, stop.Title,
+			formatCoord(float64(stop.Location.Lat)),
+			formatCoord(float64(stop.Location.Lon)),
+		})
+	}
+	return
+}
+
+func appendShapeRecords(records [][]string, shapeId string,
+	locations []*nextbus.Location) [][]string {
+	for i, location := range locations {
+		records = append(records, []string{
+			shapeId,
+			formatCoord(float64(location.Lat)),
+			formatCoord(float64(location.Lon)),
+			strconv.Itoa(i),
+		})
+	}
+	return records
+}
+
+// Returns the records of shapes.txt, and the shape_id of each direction that
+// has a shape.
+func (p *Exporter) shapeRecords() (
+	records [][]string, directionShapes map[*nextbus.Direction]string) {
+	directionShapes = make(map[*nextbus.Direction]string)
+	inShape := make(map[*nextbus.Path]bool)
+	for _, direction := range p.scheduledDirections() {
+		shape, paths := directionShape(direction)
+		if len(shape) < 2 {
+			continue
+		}
+		shapeId := DirectionShapeId(direction)
+		directionShapes[direction] = shapeId
+		records = appendShapeRecords(records, shapeId, shape)
+		for _, path := range paths {
+			inShape[path] = true
+		}
+	}
+	paths := p.Agency.GetPaths()
+	sort.Sort(nextbus.PathsSlice(paths))
+	for _, path := range paths {
+		if !inShape[path] {
+			records = appendShapeRecords(records, ShapeId(path), path.WayPoints)
+		}
+	}
+	return
+}
+
+// Returns the period covered by the calendar.
+func (p *Exporter) servicePeriod() (startDate, endDate string) {
+	startDate, endDate = p.StartDate, p.EndDate
+	if len(startDate) == 0 {
+		for _, re := range p.Schedules {
+			if _, err := time.Parse(kDateLayout, re.ScheduleClass); err == nil &&
+				(len(startDate) == 0 || re.ScheduleClass < startDate) {
+				startDate = re.ScheduleClass
+			}
+		}
+		if len(startDate) == 0 {
+			startDate = time.Now().Format(kDateLayout)
+		}
+	}
+	if len(endDate) == 0 {
+		if t, err := time.Parse(kDateLayout, startDate); err == nil {
+			endDate = t.AddDate(1, 0, -1).Format(kDateLayout)
+		}
+	}
+	return
+}
+
+func (p *Exporter) calendarRecords() (records [][]string) {
+	startDate, endDate := p.servicePeriod()
+	seen := make(map[string]bool)
+	var serviceClasses []string
+	for _, re := range p.Schedules {
+		if !seen[re.ServiceClass] {
+			seen[re.ServiceClass] = true
+			serviceClasses = append(serviceClasses, re.ServiceClass)
+		}
+	}
+	sort.Strings(serviceClasses)
+	for _, serviceClass := range serviceClasses {
+		days, err := ParseServiceClass(serviceClass)
+		if err != nil {
+			glog.Warningf("%v; trips of the class won't operate on any day", err)
+		}
+		record := []string{serviceClass}
+		for _, day := range days {
+			if day {
+				record = append(record, "1")
+			} else {
+				record = append(record, "0")
+			}
+		}
+		records = append(records, append(record, startDate, endDate))
+	}
+	return
+}
+
+// Returns the records of trips.txt and stop_times.txt. The ids of trips
+// include the index of the schedule entry, as a route may have several
+// entries with the same service class and direction.
+func (p *Exporter) tripRecords(directionShapes map[*nextbus.Direction]string) (
+	trips, stopTimes [][]string) {
+	numUnknownRoutes, numUnknownStops := 0, 0
+	for i, re := range p.Schedules {
+		route := p.Agency.Routes[re.Tag]
+		if route == nil {
+			numUnknownRoutes++
+			continue
+		}
+		directionId := gtfsDirectionId(re.Direction)
+		sign := headsign(route, re.Direction)
+		shapeId := directionShapes[uiDirection(route, re.Direction)]
+		for n, tr := range re.Trips {
+			tripId := strings.Join([]string{re.Tag, re.ServiceClass, re.Direction,
+				strconv.Itoa(i + 1), strconv.Itoa(n + 1)}, "_")
+			var times [][]string
+			for _, se := range tr.Stops {
+				if se.EpochTime < 0 {
+					// The trip doesn't serve this timepoint.
+					continue
+				}
+				stop := p.scheduleStop(se.Tag)
+				if stop == nil {
+					numUnknownStops++
+					continue
+				}
+				t := FormatGtfsTime(se.EpochTime)
+				times = append(times, []string{
+					tripId, t, t, stop.Tag, strconv.Itoa(len(times) + 1),
+				})
+			}
+			if len(times) < 2 {
+				glog.V(1).Infof("Omitting trip %s with %d stops", tripId, len(times))
+				continue
+			}
+			trips = append(trips, []string{
+				re.Tag, re.ServiceClass, tripId, sign, directionId, tr.BlockID,
+				shapeId,
+			})
+			stopTimes = append(stopTimes, times...)
+		}
+	}
+	if numUnknownRoutes > 0 || numUnknownStops > 0 {
+		glog.Warningf("Omitted %d schedules of unknown routes, and %d stop "+
+			"times of unknown stops", numUnknownRoutes, numUnknownStops)
+	}
+	return
+}
+
+// WriteZip writes the GTFS feed as a zip archive.
+func (p *Exporter) WriteZip(w io.Writer) error {
+	zw := zip.NewWriter(w)
+	shapes, directionShapes := p.shapeRecords()
+	trips, stopTimes := p.tripRecords(directionShapes)
+	files := []struct {
+		name    string
+		header  []string
+		records [][]string
+	}{
+		{"agency.txt", []string{
+			"agency_id", "agency_name", "agency_url", "agency_timezone"},
+			p.agencyRecords()},
+		{"routes.txt", []string{
+			"route_id", "agency_id", "route_short_name", "route_long_name",
+			"route_type", "route_color", "route_text_color"},
+			p.routeRecords()},
+		{"stops.txt", []string{
+			"stop_id", "stop_code", "stop_name", "stop_lat", "stop_lon"},
+			p.stopRecords()},
+		{"shapes.txt", []string{
+			"shape_id", "shape_pt_lat", "shape_pt_lon", "shape_pt_sequence"},
+			shapes},
+		{"calendar.txt", []string{
+			"service_id", "monday", "tuesday", "wednesday", "thursday", "friday",
+			"saturday", "sunday", "start_date", "end_date"},
+			p.calendarRecords()},
+		{"trips.txt", []string{
+			"route_id", "service_id", "trip_id", "trip_headsign", "direction_id",
+			"block_id", "shape_id"},
+			trips},
+		{"stop_times.txt", []string{
+			"trip_id", "arrival_time", "departure_time", "stop_id",
+			"stop_sequence"},
+			stopTimes},
+	}
+	for _, f := range files {
+		if err := writeGtfsFile(zw, f.name, f.header, f.records); err != nil {
+			return err
+		}
+	}
+	glog.Infof("Wrote GTFS feed with %d routes, %d stops, %d trips",
+		len(p.Agency.Routes), len(p.Agency.Stops), len(trips))
+	return zw.Close()
+}
+
+func (p *Exporter) WriteZipFile(filePath string) error {
+	f, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	if err := p.WriteZip(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
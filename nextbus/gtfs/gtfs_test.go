@@ -0,0 +1,414 @@
+package gtfs
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/jamessynge/transit_tools/geo"
+	"github.com/jamessynge/transit_tools/nextbus"
+)
+
+const testRouteConfig = `<?xml version="1.0" encoding="utf-8" ?>
+<body copyright="All data copyright MBTA 2013.">
+<route tag="76" title="76" color="9933cc" oppositeColor="ffffff"
+  latMin="42.3954299" latMax="42.4628099" lonMin="-71.29118" lonMax="-71.14248">
+<stop tag="141" title="Alewife Station Busway" lat="42.3954299" lon="-71.14248" stopId="00141"/>
+<stop tag="2480" title="Rt 2 Westbound Pedestrian Bridge" lat="42.3991199" lon="-71.1462" stopId="02480"/>
+<stop tag="85231" title="Lincoln Lab" lat="42.4628099" lon="-71.29118" stopId="85231"/>
+<direction tag="76_0_var0" title="Hanscom Civil Airport via Lexington Center" name="Outbound" useForUI="true">
+  <stop tag="141" />
+  <stop tag="2480" />
+  <stop tag="85231" />
+</direction>
+<direction tag="76_1_var0" title="Alewife Station via Lexington Center" name="Inbound" useForUI="true">
+  <stop tag="85231" />
+  <stop tag="2480" />
+  <stop tag="141" />
+</direction>
+<path>
+<point lat="42.3954299" lon="-71.14248"/>
+<point lat="42.3991199" lon="-71.1462"/>
+</path>
+<path>
+<point lat="42.3991199" lon="-71.1462"/>
+<point lat="42.4628099" lon="-71.29118"/>
+</path>
+</route>
+</body>`
+
+const testSchedule = `<?xml version="1.0" encoding="utf-8" ?>
+<body copyright="All data copyright MBTA 2014.">
+  <route tag="76" title="76" scheduleClass="20140830" serviceClass="MoTuWeThFr"
+         direction="Inbound">
+    <header>
+      <stop tag="85231">Lincoln Lab</stop>
+      <stop tag="2480">Rt 2</stop>
+      <stop tag="141_ar">Alewife Station Busway</stop>
+    </header>
+    <tr blockID="T350_173">
+      <stop tag="85231" epochTime="21600000">06:00:00</stop>
+      <stop tag="2480" epochTime="-1">--</stop>
+      <stop tag="141_ar" epochTime="23820000">06:37:00</stop>
+    </tr>
+    <tr blockID="T350_174">
+      <stop tag="85231" epochTime="86100000">23:55:00</stop>
+      <stop tag="2480" epochTime="86700000">24:05:00</stop>
+      <stop tag="141_ar" epochTime="88200000">24:30:00</stop>
+    </tr>
+  </route>
+  <route tag="76" title="76" scheduleClass="20140830" serviceClass="Saturday"
+         direction="Outbound">
+    <header>
+      <stop tag="141">Alewife Station Busway</stop>
+      <stop tag="85231">Lincoln Lab</stop>
+    </header>
+    <tr blockID="T350_1">
+      <stop tag="141" epochTime="25200000">07:00:00</stop>
+      <stop tag="85231" epochTime="27000000">07:30:00</stop>
+    </tr>
+  </route>
+</body>`
+
+func readZipCsv(t *testing.T, data []byte, name string) [][]string {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range zr.File {
+		if f.Name != name {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rc.Close()
+		records, err := csv.NewReader(rc).ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return records
+	}
+	t.Fatalf("No %s in zip", name)
+	return nil
+}
+
+func joinRecords(records [][]string) string {
+	var lines []string
+	for _, record := range records {
+		lines = append(lines, strings.Join(record, ","))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func exportTestFeed(t *testing.T) []byte {
+	agency := nextbus.NewAgency("mbta")
+	if _, err := nextbus.ParseRouteConfigXml(agency, []byte(testRouteConfig)); err != nil {
+		t.Fatal(err)
+	}
+	exporter := NewExporter(agency)
+	exporter.AgencyName = "MBTA"
+	if err := exporter.AddScheduleXml([]byte(testSchedule)); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := exporter.WriteZip(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestParseServiceClass(t *testing.T) {
+	for serviceClass, expected := range map[string]string{
+		"MoTuWeThFr": "1111100",
+		"SaSu":       "0000011",
+		"Saturday":   "0000010",
+		"weekday":    "1111100",
+	} {
+		days, err := ParseServiceClass(serviceClass)
+		s := ""
+		for _, day := range days {
+			if day {
+				s += "1"
+			} else {
+				s += "0"
+			}
+		}
+		if err != nil || s != expected {
+			t.Errorf("ParseServiceClass(%q) = %s, %v", serviceClass, s, err)
+		}
+	}
+	if _, err := ParseServiceClass("Holiday"); err == nil {
+		t.Errorf("Expected an error")
+	}
+}
+
+func TestExport(t *testing.T) {
+	data := exportTestFeed(t)
+	for name, expected := range map[string]string{
+		"agency.txt": "agency_id,agency_name,agency_url,agency_timezone\n" +
+			"mbta,MBTA,http://www.nextbus.com,America/New_York",
+		"routes.txt": "route_id,agency_id,route_short_name,route_long_name," +
+			"route_type,route_color,route_text_color\n" +
+			"76,mbta,76,76,3,9933cc,ffffff",
+		"stops.txt": "stop_id,stop_code,stop_name,stop_lat,stop_lon\n" +
+			"141,00141,Alewife Station Busway,42.3954299,-71.14248\n" +
+			"2480,02480,Rt 2 Westbound Pedestrian Bridge,42.3991199,-71.1462\n" +
+			"85231,85231,Lincoln Lab,42.4628099,-71.29118",
+		"shapes.txt": "shape_id,shape_pt_lat,shape_pt_lon,shape_pt_sequence\n" +
+			"route_76_76_0_var0,42.3954299,-71.14248,0\n" +
+			"route_76_76_0_var0,42.3991199,-71.1462,1\n" +
+			"route_76_76_0_var0,42.4628099,-71.29118,2\n" +
+			"route_76_76_1_var0,42.4628099,-71.29118,0\n" +
+			"route_76_76_1_var0,42.3991199,-71.1462,1\n" +
+			"route_76_76_1_var0,42.3954299,-71.14248,2",
+		"calendar.txt": "service_id,monday,tuesday,wednesday,thursday,friday," +
+			"saturday,sunday,start_date,end_date\n" +
+			"MoTuWeThFr,1,1,1,1,1,0,0,20140830,20150829\n" +
+			"Saturday,0,0,0,0,0,1,0,20140830,20150829",
+		"trips.txt": "route_id,service_id,trip_id,trip_headsign,direction_id," +
+			"block_id,shape_id\n" +
+			"76,MoTuWeThFr,76_MoTuWeThFr_Inbound_1_1," +
+			"Alewife Station via Lexington Center,1,T350_173,route_76_76_1_var0\n" +
+			"76,MoTuWeThFr,76_MoTuWeThFr_Inbound_1_2," +
+			"Alewife Station via Lexington Center,1,T350_174,route_76_76_1_var0\n" +
+			"76,Saturday,76_Saturday_Outbound_2_1," +
+			"Hanscom Civil Airport via Lexington Center,0,T350_1,route_76_76_0_var0",
+		"stop_times.txt": "trip_id,arrival_time,departure_time,stop_id," +
+			"stop_sequence\n" +
+			"76_MoTuWeThFr_Inbound_1_1,06:00:00,06:00:00,85231,1\n" +
+			"76_MoTuWeThFr_Inbound_1_1,06:37:00,06:37:00,141,2\n" +
+			"76_MoTuWeThFr_Inbound_1_2,23:55:00,23:55:00,85231,1\n" +
+			"76_MoTuWeThFr_Inbound_1_2,24:05:00,24:05:00,2480,2\n" +
+			"76_MoTuWeThFr_Inbound_1_2,24:30:00,24:30:00,141,3\n" +
+			"76_Saturday_Outbound_2_1,07:00:00,07:00:00,141,1\n" +
+			"76_Saturday_Outbound_2_1,07:30:00,07:30:00,85231,2",
+	} {
+		if actual := joinRecords(readZipCsv(t, data, name)); actual != expected {
+			t.Errorf("Wrong %s:\n%s\nexpected:\n%s", name, actual, expected)
+		}
+	}
+}
+
+// A route may have several schedule entries with the same service class and
+// direction (e.g. with different schedule classes); their trips need distinct
+// ids. Each trip is linked to the shape of its direction, which starts at the
+// first stop of the direction and ends at the last.
+func TestExportTripShapes(t *testing.T) {
+	agency := nextbus.NewAgency("mbta")
+	if _, err := nextbus.ParseRouteConfigXml(agency, []byte(testRouteConfig)); err != nil {
+		t.Fatal(err)
+	}
+	exporter := NewExporter(agency)
+	for i := 0; i < 2; i++ {
+		if err := exporter.AddScheduleXml([]byte(testSchedule)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	if err := exporter.WriteZip(&buf); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	// First and last points of each shape.
+	shapeEnds := make(map[string][2]string)
+	for _, record := range readZipCsv(t, data, "shapes.txt")[1:] {
+		point := record[1] + "," + record[2]
+		ends, ok := shapeEnds[record[0]]
+		if !ok {
+			ends[0] = point
+		}
+		ends[1] = point
+		shapeEnds[record[0]] = ends
+	}
+	stopPoints := make(map[string]string)
+	for _, record := range readZipCsv(t, data, "stops.txt")[1:] {
+		stopPoints[record[0]] = record[3] + "," + record[4]
+	}
+	directionEnds := map[string][2]string{
+		"0": {stopPoints["141"], stopPoints["85231"]},
+		"1": {stopPoints["85231"], stopPoints["141"]},
+	}
+
+	trips := readZipCsv(t, data, "trips.txt")
+	if len(trips) != 7 || trips[0][6] != "shape_id" {
+		t.Fatalf("Wrong trips:\n%s", joinRecords(trips))
+	}
+	tripIds := make(map[string]bool)
+	for _, record := range trips[1:] {
+		tripId, directionId, shapeId := record[2], record[4], record[6]
+		if tripIds[tripId] {
+			t.Errorf("Duplicate trip_id %s", tripId)
+		}
+		tripIds[tripId] = true
+		ends, ok := shapeEnds[shapeId]
+		if !ok {
+			t.Errorf("Trip %s has shape_id %q, which isn't in shapes.txt",
+				tripId, shapeId)
+		} else if ends != directionEnds[directionId] {
+			t.Errorf("Shape %s of trip %s runs from %s to %s, expected %s to %s",
+				shapeId, tripId, ends[0], ends[1], directionEnds[directionId][0],
+				directionEnds[directionId][1])
+		}
+	}
+	for _, record := range readZipCsv(t, data, "stop_times.txt")[1:] {
+		if !tripIds[record[0]] {
+			t.Errorf("Stop time of unknown trip: %v", record)
+		}
+	}
+}
+
+func TestImportExported(t *testing.T) {
+	data := exportTestFeed(t)
+	agency, err := ReadZip(bytes.NewReader(data), int64(len(data)), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if agency.Tag != "mbta" || len(agency.Routes) != 1 || len(agency.Stops) != 3 ||
+		agency.NumPaths() != 2 {
+		t.Fatalf("Wrong agency: %s, %d routes, %d stops, %d paths", agency.Tag,
+			len(agency.Routes), len(agency.Stops), agency.NumPaths())
+	}
+	route := agency.Routes["76"]
+	if route.Title != "76" || route.Color != "9933cc" || route.OppColor != "ffffff" ||
+		len(route.Stops) != 3 || !route.BoundsInitialized() {
+		t.Errorf("Wrong route: %#v", route)
+	}
+	if stop := agency.Stops["141"]; stop.Id != "00141" ||
+		stop.Title != "Alewife Station Busway" ||
+		stop.Location.Lat != 42.3954299 || stop.Location.Lon != -71.14248 {
+		t.Errorf("Wrong stop: %#v", stop)
+	}
+	expected := map[string]string{
+		"76_0_var0": "Outbound|Hanscom Civil Airport via Lexington Center|141 85231",
+		"76_1_var0": "Inbound|Alewife Station via Lexington Center|85231 2480 141",
+	}
+	if len(route.Directions) != len(expected) {
+		t.Errorf("Wrong directions: %v", route.Directions)
+	}
+	for tag, want := range expected {
+		direction := route.Directions[tag]
+		if direction == nil {
+			t.Errorf("Missing direction %s", tag)
+			continue
+		}
+		var stops []string
+		for _, stop := range direction.Stops {
+			stops = append(stops, stop.Tag)
+		}
+		got := direction.Name + "|" + direction.Title + "|" + strings.Join(stops, " ")
+		if got != want || !direction.UseForUI {
+			t.Errorf("Wrong direction %s: %s (UseForUI %v)", tag, got,
+				direction.UseForUI)
+		}
+	}
+	if path := agency.GetPath(2); path == nil || len(path.WayPoints) != 3 ||
+		path.WayPoints[2].Lat != 42.4628099 {
+		t.Errorf("Wrong path: %#v", path)
+	}
+
+	// The imported agency can be written as routeConfig, and parsed back.
+	var buf bytes.Buffer
+	if err := nextbus.WriteRouteConfig(route, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nextbus.ParseRouteConfigXml(
+		nextbus.NewAgency("mbta"), buf.Bytes()); err != nil {
+		t.Errorf("Unable to parse routeConfig of imported route: %v\n%s",
+			err, buf.String())
+	}
+}
+
+func TestImportShapesAndHeadsigns(t *testing.T) {
+	files := map[string]string{
+		"agency.txt": "agency_id,agency_name,agency_url,agency_timezone\n" +
+			"A,Agency,http://example.com,America/New_York\n",
+		"routes.txt": "\ufeffroute_id,route_short_name,route_long_name,route_type\n" +
+			"R1,1,Main St,3\n",
+		"stops.txt": "stop_id,stop_name,stop_lat,stop_lon,location_type\n" +
+			"S1,First,42.35,-71.07,0\n" +
+			"S2,Second,42.35,-71.06,\n" +
+			"S3,Third,42.36,-71.05,0\n" +
+			"P1,Station,42.36,-71.05,1\n",
+		"shapes.txt": "shape_id,shape_pt_lat,shape_pt_lon,shape_pt_sequence\n" +
+			"SH1,42.35,-71.06,2\n" +
+			"SH1,42.35,-71.07,1\n" +
+			"SH1,42.36,-71.05,3\n" +
+			"SH2,42.35,-71.07,1\n" +
+			"SH2,42.35,-71.06,2\n",
+		"trips.txt": "route_id,service_id,trip_id,trip_headsign,direction_id,shape_id\n" +
+			"R1,WK,T1,Third,0,SH1\n" +
+			"R1,WK,T2,Third,0,SH1\n" +
+			"R1,WK,T3,Second,0,SH2\n" +
+			"R1,WK,T4,,1,\n",
+		"stop_times.txt": "trip_id,arrival_time,departure_time,stop_id,stop_sequence\n" +
+			"T1,06:00:00,06:00:00,S1,1\n" +
+			"T1,06:10:00,06:10:00,S3,3\n" +
+			"T1,06:05:00,06:05:00,S2,2\n" +
+			"T2,07:00:00,07:00:00,S1,1\n" +
+			"T2,07:10:00,07:10:00,S3,2\n" +
+			"T3,08:00:00,08:00:00,S1,1\n" +
+			"T3,08:05:00,08:05:00,S2,2\n" +
+			"T4,09:00:00,09:00:00,S3,1\n" +
+			"T4,09:10:00,09:10:00,S1,2\n",
+	}
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, contents := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(contents))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	agency, err := ReadZip(bytes.NewReader(buf.Bytes()), int64(buf.Len()), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	route := agency.Routes["R1"]
+	if agency.Tag != "A" || route == nil || route.Title != "Main St" ||
+		route.ShortTitle != "1" || len(agency.Stops) != 3 {
+		t.Fatalf("Wrong agency: %#v", agency)
+	}
+	expected := map[string]string{
+		"R1_0_var0": "Outbound|Second|false|S1 S2",
+		"R1_0_var1": "Outbound|Third|true|S1 S2 S3",
+		"R1_1_var0": "Inbound|First|true|S3 S1",
+	}
+	for tag, want := range expected {
+		direction := route.Directions[tag]
+		if direction == nil {
+			t.Errorf("Missing direction %s", tag)
+			continue
+		}
+		var stops []string
+		for _, stop := range direction.Stops {
+			stops = append(stops, stop.Tag)
+		}
+		got := fmt.Sprintf("%s|%s|%v|%s", direction.Name, direction.Title,
+			direction.UseForUI, strings.Join(stops, " "))
+		if got != want {
+			t.Errorf("Wrong direction %s: %s", tag, got)
+		}
+	}
+	// The shapes are ordered by sequence, and deduped by location.
+	if agency.NumPaths() != 2 || len(route.Paths) != 2 {
+		t.Fatalf("Wrong paths: %d, %v", agency.NumPaths(), route.Paths)
+	}
+	if p := route.Paths[0]; len(p.WayPoints) != 3 || p.WayPoints[0].Lon != -71.07 ||
+		p.WayPoints[2].Lon != -71.05 {
+		t.Errorf("Wrong path: %v", p.WayPoints)
+	}
+	if agency.GetOrAddPath([]geo.Location{
+		{Lat: 42.35, Lon: -71.07}, {Lat: 42.35, Lon: -71.06}}) != route.Paths[1] {
+		t.Errorf("Path not deduped")
+	}
+}
@@ -0,0 +1,492 @@
+package gtfs
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+
+	"github.com/jamessynge/transit_tools/geo"
+	"github.com/jamessynge/transit_tools/nextbus"
+	"github.com/jamessynge/transit_tools/util"
+)
+
+// Reading a GTFS static feed into the nextbus Agency model. Each route gets
+// a direction per (direction_id, trip_headsign) of its trips, with the stops
+// of the longest trip of the direction; the most common direction of each
+// direction_id is marked for use in the UI. The shapes of the trips become
+// the paths of the routes; shapes that no trip uses become paths of no
+// route. Direction names are "Outbound" and "Inbound" for direction_id 0 and
+// 1, as produced by the Exporter.
+
+// The records of a GTFS file, with the index of each column.
+type gtfsTable struct {
+	name    string
+	columns map[string]int
+	records [][]string
+}
+
+// Returns the value of the named column of the record, or "" if the file
+// doesn't have the column.
+func (p *gtfsTable) get(record []string, column string) string {
+	if i, ok := p.columns[column]; ok && i < len(record) {
+		return strings.TrimSpace(record[i])
+	}
+	return ""
+}
+
+func (p *gtfsTable) requireColumns(columns ...string) error {
+	for _, column := range columns {
+		if _, ok := p.columns[column]; !ok {
+			return fmt.Errorf("%s has no %s column", p.name, column)
+		}
+	}
+	return nil
+}
+
+func readGtfsTable(f *zip.File) (*gtfsTable, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	cr := csv.NewReader(rc)
+	cr.FieldsPerRecord = -1
+	records, err := cr.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("Error reading %s: %v", f.Name, err)
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("%s is empty", f.Name)
+	}
+	t := &gtfsTable{
+		name:    f.Name,
+		columns: make(map[string]int),
+		records: records[1:],
+	}
+	for i, column := range records[0] {
+		if i == 0 {
+			column = strings.TrimPrefix(column, "\ufeff")
+		}
+		t.columns[strings.TrimSpace(column)] = i
+	}
+	return t, nil
+}
+
+func parseLocation(latStr, lonStr string) (geo.Location, error) {
+	lat, err := strconv.ParseFloat(latStr, 64)
+	if err != nil {
+		return geo.Location{}, err
+	}
+	lon, err := strconv.ParseFloat(lonStr, 64)
+	if err != nil {
+		return geo.Location{}, err
+	}
+	return geo.LocationFromFloat64s(lat, lon)
+}
+
+// An element of a sequence (of shape points or stop times).
+type sequenced struct {
+	seq   int
+	value string
+	loc   geo.Location
+}
+type sequencedSlice []sequenced
+
+func (p sequencedSlice) Len() int           { return len(p) }
+func (p sequencedSlice) Less(i, j int) bool { return p[i].seq < p[j].seq }
+func (p sequencedSlice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+type gtfsTrip struct {
+	id          string
+	routeId     string
+	headsign    string
+	directionId string
+	shapeId     string
+	stops       sequencedSlice
+}
+
+// Trips of a route with the same direction_id and headsign.
+type tripGroup struct {
+	directionId string
+	headsign    string
+	trips       []*gtfsTrip
+}
+
+func directionName(directionId string) string {
+	switch directionId {
+	case "0":
+		return "Outbound"
+	case "1":
+		return "Inbound"
+	}
+	return ""
+}
+
+type importer struct {
+	agency *nextbus.Agency
+	tables map[string]*gtfsTable
+	errs   util.Errors
+	// Locations of the points of each shape, in order.
+	shapes map[string][]geo.Location
+	trips  map[string]*gtfsTrip
+}
+
+func (p *importer) readRoutes() {
+	t := p.tables["routes.txt"]
+	for _, record := range t.records {
+		tag := t.get(record, "route_id")
+		if len(tag) == 0 {
+			continue
+		}
+		route := p.agency.GetOrAddRoute(tag)
+		route.ShortTitle = t.get(record, "route_short_name")
+		route.Title = t.get(record, "route_long_name")
+		if len(route.Title) == 0 {
+			route.Title = route.ShortTitle
+		}
+		if len(route.Title) == 0 {
+			route.Title = tag
+		}
+		if route.ShortTitle == route.Title {
+			route.ShortTitle = ""
+		}
+		route.Color = t.get(record, "route_color")
+		route.OppColor = t.get(record, "route_text_color")
+	}
+}
+
+func (p *importer) readStops() {
+	t := p.tables["stops.txt"]
+	for _, record := range t.records {
+		if lt := t.get(record, "location_type"); len(lt) > 0 && lt != "0" {
+			// A station, entrance or other location that isn't a stop.
+			continue
+		}
+		tag := t.get(record, "stop_id")
+		loc, err := parseLocation(t.get(record, "stop_lat"), t.get(record, "stop_lon"))
+		if err != nil {
+			p.errs.AddError(fmt.Errorf("Invalid location of stop %s: %v", tag, err))
+			continue
+		}
+		title := t.get(record, "stop_name")
+		if len(title) == 0 {
+			title = tag
+		}
+		_, err = p.agency.GetOrAddStop(tag, t.get(record, "stop_code"), title, loc)
+		if err != nil {
+			p.errs.AddError(err)
+		}
+	}
+}
+
+func (p *importer) readShapes() {
+	t, ok := p.tables["shapes.txt"]
+	if !ok {
+		return
+	}
+	points := make(map[string]sequencedSlice)
+	for _, record := range t.records {
+		id := t.get(record, "shape_id")
+		seq, err := strconv.Atoi(t.get(record, "shape_pt_sequence"))
+		if err != nil {
+			p.errs.AddError(fmt.Errorf("Invalid sequence in shape %s: %v", id, err))
+			continue
+		}
+		loc, err := parseLocation(
+			t.get(record, "shape_pt_lat"), t.get(record, "shape_pt_lon"))
+		if err != nil {
+			p.errs.AddError(fmt.Errorf("Invalid point in shape %s: %v", id, err))
+			continue
+		}
+		points[id] = append(points[id], sequenced{seq: seq, loc: loc})
+	}
+	for id, pts := range points {
+		sort.Sort(pts)
+		locations := make([]geo.Location, len(pts))
+		for i := range pts {
+			locations[i] = pts[i].loc
+		}
+		p.shapes[id] = locations
+	}
+}
+
+func (p *importer) readTrips() {
+	t := p.tables["trips.txt"]
+	for _, record := range t.records {
+		trip := &gtfsTrip{
+			id:          t.get(record, "trip_id"),
+			routeId:     t.get(record, "route_id"),
+			headsign:    t.get(record, "trip_headsign"),
+			directionId: t.get(record, "direction_id"),
+			shapeId:     t.get(record, "shape_id"),
+		}
+		if p.agency.Routes[trip.routeId] == nil {
+			p.errs.AddError(fmt.Errorf("Trip %s has unknown route %s",
+				trip.id, trip.routeId))
+			continue
+		}
+		p.trips[trip.id] = trip
+	}
+	t = p.tables["stop_times.txt"]
+	for _, record := range t.records {
+		trip := p.trips[t.get(record, "trip_id")]
+		if trip == nil {
+			continue
+		}
+		seq, err := strconv.Atoi(t.get(record, "stop_sequence"))
+		if err != nil {
+			p.errs.AddError(fmt.Errorf("Invalid stop_sequence in trip %s: %v",
+				trip.id, err))
+			continue
+		}
+		trip.stops = append(trip.stops,
+			sequenced{seq: seq, value: t.get(record, "stop_id")})
+	}
+	for _, trip := range p.trips {
+		sort.Sort(trip.stops)
+	}
+}
+
+// Groups the trips of each route by direction_id and headsign; the groups
+// of a route are ordered by direction_id, then headsign.
+func (p *importer) groupTrips() map[string][]*tripGroup {
+	groups := make(map[string]map[string]*tripGroup)
+	for _, trip := range p.trips {
+		byKey := groups[trip.routeId]
+		if byKey == nil {
+			byKey = make(map[string]*tripGroup)
+			groups[trip.routeId] = byKey
+		}
+		key := trip.directionId + "\x00" + trip.headsign
+		g := byKey[key]
+		if g == nil {
+			g = &tripGroup{directionId: trip.directionId, headsign: trip.headsign}
+			byKey[key] = g
+		}
+		g.trips = append(g.trips, trip)
+	}
+	result := make(map[string][]*tripGroup)
+	for routeId, byKey := range groups {
+		var keys []string
+		for key := range byKey {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			result[routeId] = append(result[routeId], byKey[key])
+		}
+	}
+	return result
+}
+
+// Returns the trip of the group with the most stops (the first by id if
+// there are several).
+func longestTrip(g *tripGroup) *gtfsTrip {
+	var longest *gtfsTrip
+	for _, trip := range g.trips {
+		if longest == nil || len(trip.stops) > len(longest.stops) ||
+			(len(trip.stops) == len(longest.stops) && trip.id < longest.id) {
+			longest = trip
+		}
+	}
+	return longest
+}
+
+func (p *importer) addDirections(route *nextbus.Route, groups []*tripGroup) {
+	// The group of each direction_id with the most trips is used for the UI.
+	mostTrips := make(map[string]*tripGroup)
+	for _, g := range groups {
+		if best := mostTrips[g.directionId]; best == nil ||
+			len(g.trips) > len(best.trips) {
+			mostTrips[g.directionId] = g
+		}
+	}
+	variants := make(map[string]int)
+	for _, g := range groups {
+		directionId := g.directionId
+		if len(directionId) == 0 {
+			directionId = "x"
+		}
+		tag := fmt.Sprintf("%s_%s_var%d", route.Tag, directionId,
+			variants[directionId])
+		variants[directionId]++
+		direction := route.GetOrAddDirection(tag)
+		direction.Name = directionName(g.directionId)
+		direction.UseForUI = mostTrips[g.directionId] == g
+		numSkipped := 0
+		for _, st := range longestTrip(g).stops {
+			stop := p.agency.Stops[st.value]
+			if stop == nil {
+				p.errs.AddError(fmt.Errorf("Direction %s has unknown stop %s",
+					tag, st.value))
+				continue
+			}
+			route.AddStop(stop)
+			if err := direction.AppendStop(stop); err != nil {
+				// The model doesn't support visiting a stop more than once.
+				numSkipped++
+			}
+		}
+		if numSkipped > 0 {
+			glog.V(1).Infof("Skipped %d repeated stops of direction %s",
+				numSkipped, tag)
+		}
+		direction.Title = g.headsign
+		if len(direction.Title) == 0 && len(direction.Stops) > 0 {
+			direction.Title = direction.Stops[len(direction.Stops)-1].Title
+		}
+		if len(direction.Title) == 0 {
+			direction.Title = tag
+		}
+	}
+}
+
+func (p *importer) addPaths() {
+	used := make(map[string]bool)
+	var tripIds []string
+	for id := range p.trips {
+		tripIds = append(tripIds, id)
+	}
+	sort.Strings(tripIds)
+	for _, id := range tripIds {
+		trip := p.trips[id]
+		locations, ok := p.shapes[trip.shapeId]
+		if !ok || len(locations) == 0 {
+			continue
+		}
+		used[trip.shapeId] = true
+		p.agency.Routes[trip.routeId].AddPath(p.agency.GetOrAddPath(locations))
+	}
+	var unused []string
+	for id := range p.shapes {
+		if !used[id] && len(p.shapes[id]) > 0 {
+			unused = append(unused, id)
+		}
+	}
+	sort.Strings(unused)
+	for _, id := range unused {
+		p.agency.GetOrAddPath(p.shapes[id])
+	}
+}
+
+// Sets the bounds of each route to include its stops and paths.
+func setRouteBounds(route *nextbus.Route) {
+	first := true
+	extend := func(loc geo.Location) {
+		if first {
+			route.LatMin, route.LatMax = loc.Lat, loc.Lat
+			route.LonMin, route.LonMax = loc.Lon, loc.Lon
+			first = false
+			return
+		}
+		if loc.Lat < route.LatMin {
+			route.LatMin = loc.Lat
+		}
+		if loc.Lat > route.LatMax {
+			route.LatMax = loc.Lat
+		}
+		if loc.Lon < route.LonMin {
+			route.LonMin = loc.Lon
+		}
+		if loc.Lon > route.LonMax {
+			route.LonMax = loc.Lon
+		}
+	}
+	for _, stop := range route.Stops {
+		extend(stop.Location.Location)
+	}
+	for _, path := range route.Paths {
+		for _, location := range path.WayPoints {
+			extend(location.Location)
+		}
+	}
+}
+
+// ReadZip reads a GTFS feed (zip archive) into a new Agency with the tag
+// agencyTag (if empty, the agency_id of the first agency of the feed).
+// Errors in individual records are logged and returned (combined), along
+// with the agency built from the valid records.
+func ReadZip(r io.ReaderAt, size int64, agencyTag string) (
+	*nextbus.Agency, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	p := &importer{
+		tables: make(map[string]*gtfsTable),
+		errs:   util.NewErrors(),
+		shapes: make(map[string][]geo.Location),
+		trips:  make(map[string]*gtfsTrip),
+	}
+	for _, f := range zr.File {
+		switch f.Name {
+		case "agency.txt", "routes.txt", "stops.txt", "shapes.txt", "trips.txt",
+			"stop_times.txt":
+			t, err := readGtfsTable(f)
+			if err != nil {
+				return nil, err
+			}
+			p.tables[f.Name] = t
+		}
+	}
+	required := [][]string{
+		{"routes.txt", "route_id"},
+		{"stops.txt", "stop_id", "stop_lat", "stop_lon"},
+		{"trips.txt", "route_id", "trip_id"},
+		{"stop_times.txt", "trip_id", "stop_id", "stop_sequence"},
+	}
+	for _, r := range required {
+		t, ok := p.tables[r[0]]
+		if !ok {
+			return nil, fmt.Errorf("Feed has no %s", r[0])
+		}
+		if err := t.requireColumns(r[1:]...); err != nil {
+			return nil, err
+		}
+	}
+	if t, ok := p.tables["agency.txt"]; ok && len(agencyTag) == 0 &&
+		len(t.records) > 0 {
+		agencyTag = t.get(t.records[0], "agency_id")
+		if len(agencyTag) == 0 {
+			agencyTag = t.get(t.records[0], "agency_name")
+		}
+	}
+	p.agency = nextbus.NewAgency(agencyTag)
+
+	p.readRoutes()
+	p.readStops()
+	p.readShapes()
+	p.readTrips()
+	for routeId, groups := range p.groupTrips() {
+		p.addDirections(p.agency.Routes[routeId], groups)
+	}
+	p.addPaths()
+	for _, route := range p.agency.Routes {
+		setRouteBounds(route)
+	}
+	glog.Infof("Read %d routes, %d directions, %d stops and %d paths from GTFS",
+		len(p.agency.Routes), len(p.agency.Directions), len(p.agency.Stops),
+		p.agency.NumPaths())
+	return p.agency, p.errs.ToError()
+}
+
+// ReadZipFile is like ReadZip, for a zip file.
+func ReadZipFile(filePath, agencyTag string) (*nextbus.Agency, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return ReadZip(f, info.Size(), agencyTag)
+}
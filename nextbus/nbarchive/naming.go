@@ -0,0 +1,59 @@
+package nbarchive
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+var unixMillisNameRE = regexp.MustCompile(`^(\d{10})(\d{3})\.xml$`)
+
+// TimeFileName converts the name of a raw report, if it is <NNNNNNNNNNNNN>.xml
+// (i.e. unix epoch milliseconds), to <HHMMSS>.<mmm>.xml (the local time of
+// day, with milliseconds); the directory part of the name is dropped, and
+// other names are returned unchanged.
+func TimeFileName(name string) string {
+	name = filepath.Base(name)
+	submatches := unixMillisNameRE.FindStringSubmatch(name)
+	if submatches == nil {
+		return name
+	}
+	epochSeconds, _ := strconv.ParseInt(submatches[1], 10, 64)
+	t := time.Unix(epochSeconds, 0)
+	return fmt.Sprintf("%02d%02d%02d.%v.xml",
+		t.Hour(), t.Minute(), t.Second(), submatches[2])
+}
+
+var dateRE = regexp.MustCompile(`^(\d{4})-?(\d{2})-?(\d{2})$`)
+
+// ParseDate parses a date of the form <YYYYMMDD> or <YYYY>-<MM>-<DD>,
+// returning empty strings if s isn't such a date.
+func ParseDate(s string) (yyyy, mm, dd string) {
+	submatches := dateRE.FindStringSubmatch(s)
+	if submatches == nil {
+		return "", "", ""
+	}
+	return submatches[1], submatches[2], submatches[3]
+}
+
+var datedNameRE = regexp.MustCompile(`^(20\d{2})(\d{2})(\d{2})(\..*)?$`)
+
+// DashedDateName converts a name of the form <YYYYMMDD><.ext> to
+// <YYYY>-<MM>-<DD><.ext>; returns false if name isn't of that form.
+func DashedDateName(name string) (string, bool) {
+	submatches := datedNameRE.FindStringSubmatch(name)
+	if submatches == nil {
+		return name, false
+	}
+	return fmt.Sprintf("%s-%s-%s%s",
+		submatches[1], submatches[2], submatches[3], submatches[4]), true
+}
+
+// DatedPath returns the path of the archive for a date:
+// dir/YYYY/MM/YYYY-MM-DD<ext>.
+func DatedPath(dir, yyyy, mm, dd, ext string) string {
+	return filepath.Join(dir, yyyy, mm,
+		fmt.Sprintf("%s-%s-%s%s", yyyy, mm, dd, ext))
+}
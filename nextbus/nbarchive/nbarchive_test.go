@@ -0,0 +1,200 @@
+package nbarchive
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/jamessynge/transit_tools/nextbus"
+	"github.com/jamessynge/transit_tools/nextbus/nbcolumnar"
+)
+
+func TestTimeFileName(t *testing.T) {
+	ms := time.Date(2014, 3, 4, 5, 6, 7, 0, time.Local).Unix()*1000 + 89
+	name := fmt.Sprintf("some/dir/%d.xml", ms)
+	if got, want := TimeFileName(name), "050607.089.xml"; got != want {
+		t.Errorf("TimeFileName(%q) = %q, want %q", name, got, want)
+	}
+	if got := TimeFileName("foo.xml"); got != "foo.xml" {
+		t.Errorf("TimeFileName(foo.xml) = %q", got)
+	}
+}
+
+func TestParseDate(t *testing.T) {
+	for _, s := range []string{"20140304", "2014-03-04"} {
+		yyyy, mm, dd := ParseDate(s)
+		if yyyy != "2014" || mm != "03" || dd != "04" {
+			t.Errorf("ParseDate(%q) = %q, %q, %q", s, yyyy, mm, dd)
+		}
+	}
+	if yyyy, _, _ := ParseDate("2014030"); yyyy != "" {
+		t.Errorf("ParseDate(2014030) = %q", yyyy)
+	}
+}
+
+func TestDashedDateName(t *testing.T) {
+	if got, ok := DashedDateName("20140304.tar.gz"); !ok || got != "2014-03-04.tar.gz" {
+		t.Errorf("DashedDateName(20140304.tar.gz) = %q, %v", got, ok)
+	}
+	if _, ok := DashedDateName("2014-03-04.tar.gz"); ok {
+		t.Errorf("DashedDateName(2014-03-04.tar.gz) should fail")
+	}
+	got := DatedPath("out", "2014", "03", "04", ".zip")
+	if want := filepath.Join("out", "2014", "03", "2014-03-04.zip"); got != want {
+		t.Errorf("DatedPath() = %q, want %q", got, want)
+	}
+}
+
+func makeXmlDir(t *testing.T, n int) string {
+	dir, err := ioutil.TempDir("", "nbarchive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		name := filepath.Join(dir, fmt.Sprintf("%d.xml", 1394000000000+i*10000))
+		body := fmt.Sprintf("<body><lastTime time=\"%d\"/></body>\n", i)
+		if err := ioutil.WriteFile(name, []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Not an XML file, so not included.
+	ioutil.WriteFile(filepath.Join(dir, "notes.txt"), []byte("x"), 0644)
+	return dir
+}
+
+func readEntries(t *testing.T, filePath string) []*Entry {
+	src, err := OpenSource(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	entries, err := ReadAllEntries(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func TestConvertRoundTrip(t *testing.T) {
+	dir := makeXmlDir(t, 5)
+	defer os.RemoveAll(dir)
+	original := readEntries(t, dir)
+	if len(original) != 5 {
+		t.Fatalf("Read %d entries from %s, expected 5", len(original), dir)
+	}
+	out := filepath.Join(dir, "out")
+	// dir -> tar.gz -> zip -> tar.
+	paths := []string{dir, filepath.Join(out, "a.tar.gz"),
+		filepath.Join(out, "b.zip"), filepath.Join(out, "c.tar")}
+	for i := 1; i < len(paths); i++ {
+		result, err := Convert(paths[i-1], paths[i], Options{Verify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.NumEntries != 5 {
+			t.Errorf("Converted %d entries to %s, expected 5", result.NumEntries,
+				paths[i])
+		}
+		entries := readEntries(t, paths[i])
+		if len(entries) != len(original) {
+			t.Fatalf("%s has %d entries, expected %d", paths[i], len(entries),
+				len(original))
+		}
+		for j, e := range entries {
+			if e.Name != original[j].Name || string(e.Body) != string(original[j].Body) {
+				t.Errorf("Entry %d of %s is %q, expected %q", j, paths[i], e.Name,
+					original[j].Name)
+			}
+		}
+	}
+}
+
+var timeNameRE = regexp.MustCompile(`^\d{6}\.\d{3}\.xml$`)
+
+func TestConvertTimeNames(t *testing.T) {
+	dir := makeXmlDir(t, 3)
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, "out.zip")
+	if _, err := Convert(dir, output, Options{TimeNames: true, Verify: true}); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range readEntries(t, output) {
+		if !timeNameRE.MatchString(e.Name) {
+			t.Errorf("Entry not renamed: %q", e.Name)
+		}
+	}
+}
+
+// Writes n vehicle location reports to a new directory, with two vehicles
+// moving north, each reporting in every report.
+func makeLocationsDir(t *testing.T, n int) string {
+	dir, err := ioutil.TempDir("", "nbarchive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		ms := int64(1394000000000 + i*20000)
+		body := "<body>\n"
+		for _, id := range []string{"0199", "0877"} {
+			body += fmt.Sprintf("<vehicle id=\"%s\" routeTag=\"64\" "+
+				"dirTag=\"64_1_var0\" lat=\"%.7f\" lon=\"-71.0991791\" "+
+				"secsSinceReport=\"5\" predictable=\"true\" heading=\"0\"/>\n",
+				id, 42.3685977+float64(i)*0.001)
+		}
+		body += fmt.Sprintf("<lastTime time=\"%d\"/>\n</body>\n", ms)
+		name := filepath.Join(dir, fmt.Sprintf("%d.xml", ms))
+		if err := ioutil.WriteFile(name, []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestConvertColumnar(t *testing.T) {
+	dir := makeLocationsDir(t, 4)
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, "out.vlc")
+	result, err := Convert(dir, output, Options{Verify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.NumEntries != 4 || result.NumLocations != 8 {
+		t.Errorf("Converted %d entries with %d locations, expected 4 and 8",
+			result.NumEntries, result.NumLocations)
+	}
+	var ids []string
+	n, err := nbcolumnar.ReadVehicleLocationsFile(output, nil,
+		func(source string, vl *nextbus.VehicleLocation, recordNum int,
+			err error) error {
+			if err == nil {
+				ids = append(ids, vl.VehicleId)
+			}
+			return err
+		})
+	if err != nil || n != 8 || len(ids) != 8 {
+		t.Errorf("Read %d locations (%v) from %s, error %v", n, ids, output, err)
+	}
+}
+
+func TestRunJobsFailure(t *testing.T) {
+	dir := makeXmlDir(t, 2)
+	defer os.RemoveAll(dir)
+	jobs := []Job{
+		{dir, filepath.Join(dir, "ok.tar")},
+		{filepath.Join(dir, "missing.zip"), filepath.Join(dir, "bad.tar")},
+	}
+	results, errs := RunJobs(jobs, Options{Verify: true}, 2)
+	if errs[0] != nil || results[0] == nil || results[0].NumEntries != 2 {
+		t.Errorf("Job 0: %v, %v", results[0], errs[0])
+	}
+	if errs[1] == nil {
+		t.Errorf("Job 1 should have failed")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "bad.tar")); err == nil {
+		t.Errorf("Output of failed job exists")
+	}
+}
@@ -0,0 +1,214 @@
+// Package nbarchive converts archives of raw NextBus reports between formats:
+// from a directory of XML files, a zip, or a tar (optionally gzipped), to a
+// tar, gzipped tar, zip, or the columnar format of package nbcolumnar. After
+// writing, the output can be read back and verified against the input.
+package nbarchive
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/jamessynge/transit_tools/nextbus"
+	"github.com/jamessynge/transit_tools/nextbus/nbcolumnar"
+)
+
+// Summary of a sequence of entries (names and bodies, in order), for
+// comparing the input and output of a conversion.
+type Digest struct {
+	NumEntries int
+	hash       hash.Hash
+}
+
+func NewDigest() *Digest {
+	return &Digest{hash: sha256.New()}
+}
+
+func (p *Digest) Add(entry *Entry) {
+	p.NumEntries++
+	body := sha256.Sum256(entry.Body)
+	io.WriteString(p.hash, entry.Name)
+	p.hash.Write([]byte{0})
+	p.hash.Write(body[:])
+}
+
+func (p *Digest) Sum() string {
+	return fmt.Sprintf("%x", p.hash.Sum(nil))
+}
+
+// Options of a conversion.
+type Options struct {
+	// If true, entries named <unix ms>.xml are renamed by TimeFileName.
+	TimeNames bool
+	// If true, the output is read back and compared with the input.
+	Verify bool
+}
+
+type Result struct {
+	Input, Output string
+	NumEntries    int
+	// Set for columnar output.
+	NumLocations int
+	Duration     time.Duration
+}
+
+// Copy adds the entries of src to sink, optionally renaming them; returns
+// the digest of the entries added. Doesn't close either.
+func Copy(src Source, sink Sink, timeNames bool) (*Digest, error) {
+	digest := NewDigest()
+	for {
+		entry, err := src.Next()
+		if err == io.EOF {
+			return digest, nil
+		} else if err != nil {
+			return digest, err
+		}
+		if timeNames {
+			entry.Name = TimeFileName(entry.Name)
+		}
+		if err := sink.Add(entry); err != nil {
+			return digest, err
+		}
+		digest.Add(entry)
+	}
+}
+
+// DigestSource returns the digest of the remaining entries of src.
+func DigestSource(src Source) (*Digest, error) {
+	digest := NewDigest()
+	for {
+		entry, err := src.Next()
+		if err == io.EOF {
+			return digest, nil
+		} else if err != nil {
+			return digest, err
+		}
+		digest.Add(entry)
+	}
+}
+
+func verifyEntries(output string, expected *Digest) error {
+	src, err := OpenSource(output)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	actual, err := DigestSource(src)
+	if err != nil {
+		return err
+	}
+	if actual.NumEntries != expected.NumEntries {
+		return fmt.Errorf("%s has %d entries, expected %d", output,
+			actual.NumEntries, expected.NumEntries)
+	}
+	if actual.Sum() != expected.Sum() {
+		return fmt.Errorf("Checksum of the entries of %s doesn't match the input",
+			output)
+	}
+	return nil
+}
+
+func verifyColumnar(output string, numLocations int) error {
+	// Fail on the first corrupt block, rather than skipping it.
+	n, err := nbcolumnar.ReadVehicleLocationsFile(output, nil,
+		func(source string, vl *nextbus.VehicleLocation, recordNum int,
+			err error) error {
+			return err
+		})
+	if err != nil {
+		return err
+	}
+	if n != numLocations {
+		return fmt.Errorf("%s has %d locations, expected %d", output, n,
+			numLocations)
+	}
+	return nil
+}
+
+// Convert converts the archive (or directory) input to output, whose format
+// is determined by its extension (see CreateSink).
+func Convert(input, output string, options Options) (*Result, error) {
+	start := time.Now()
+	result := &Result{Input: input, Output: output}
+	src, err := OpenSource(input)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	sink, err := CreateSink(output)
+	if err != nil {
+		return nil, err
+	}
+	digest, err := Copy(src, sink, options.TimeNames)
+	if err != nil {
+		sink.Abort()
+		return nil, fmt.Errorf("Error converting %s: %v", input, err)
+	}
+	if err := sink.Close(); err != nil {
+		return nil, fmt.Errorf("Error writing %s: %v", output, err)
+	}
+	result.NumEntries = digest.NumEntries
+	columnar, isColumnar := sink.(*ColumnarSink)
+	if isColumnar {
+		result.NumLocations = columnar.NumLocations()
+	}
+	if options.Verify {
+		if isColumnar {
+			err = verifyColumnar(output, result.NumLocations)
+		} else {
+			err = verifyEntries(output, digest)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Verification failed: %v", err)
+		}
+	}
+	result.Duration = time.Since(start)
+	return result, nil
+}
+
+// A conversion to be performed by RunJobs.
+type Job struct {
+	Input, Output string
+}
+
+// RunJobs performs the conversions with up to parallelism at a time,
+// returning the results in the order of the jobs (a nil result for a failed
+// job, with its error in errs).
+func RunJobs(jobs []Job, options Options, parallelism int) (
+	results []*Result, errs []error) {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	results = make([]*Result, len(jobs))
+	errs = make([]error, len(jobs))
+	ch := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < parallelism; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range ch {
+				job := jobs[i]
+				results[i], errs[i] = Convert(job.Input, job.Output, options)
+				if errs[i] != nil {
+					glog.Errorf("Failed to convert %s to %s: %v", job.Input,
+						job.Output, errs[i])
+				} else {
+					glog.Infof("Converted %s to %s (%d entries) in %s", job.Input,
+						job.Output, results[i].NumEntries, results[i].Duration)
+				}
+			}
+		}()
+	}
+	for i := range jobs {
+		ch <- i
+	}
+	close(ch)
+	wg.Wait()
+	return
+}
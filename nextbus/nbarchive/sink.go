@@ -0,0 +1,235 @@
+package nbarchive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+
+	"github.com/jamessynge/transit_tools/nextbus"
+	"github.com/jamessynge/transit_tools/nextbus/nbcolumnar"
+	"github.com/jamessynge/transit_tools/nextbus/nblocations"
+)
+
+// A destination for entries. The output is written to a temporary file, which
+// is renamed to the final path by Close, or removed by Abort (so an output
+// file exists only if it is complete).
+type Sink interface {
+	Add(entry *Entry) error
+	Close() error
+	Abort()
+}
+
+// The temporary file written by a sink.
+type sinkFile struct {
+	path    string
+	tmpPath string
+	f       *os.File
+	bw      *bufio.Writer
+}
+
+func createSinkFile(filePath string) (*sinkFile, error) {
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return nil, err
+	}
+	p := &sinkFile{path: filePath, tmpPath: filePath + ".in_progress"}
+	var err error
+	if p.f, err = os.Create(p.tmpPath); err != nil {
+		return nil, err
+	}
+	p.bw = bufio.NewWriterSize(p.f, 64*1024)
+	return p, nil
+}
+
+// Closes the file, and renames it if err (from closing the writers layered
+// on the file) is nil, else removes it.
+func (p *sinkFile) finish(err error) error {
+	if err == nil {
+		err = p.bw.Flush()
+	}
+	if err2 := p.f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(p.tmpPath, p.path)
+	}
+	if err != nil {
+		os.Remove(p.tmpPath)
+		return err
+	}
+	glog.V(1).Infof("Finished writing %s", p.path)
+	return nil
+}
+
+func (p *sinkFile) abort() {
+	p.f.Close()
+	os.Remove(p.tmpPath)
+}
+
+type tarSink struct {
+	file *sinkFile
+	gzip *gzip.Writer
+	tar  *tar.Writer
+}
+
+// CreateTarSink creates a tar file, gzipped if its name ends with .gz or
+// .tgz.
+func CreateTarSink(filePath string) (Sink, error) {
+	file, err := createSinkFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	p := &tarSink{file: file}
+	if isGzipped(filePath) {
+		p.gzip, _ = gzip.NewWriterLevel(file.bw, gzip.BestCompression)
+		p.tar = tar.NewWriter(p.gzip)
+	} else {
+		p.tar = tar.NewWriter(file.bw)
+	}
+	return p, nil
+}
+
+func (p *tarSink) Add(entry *Entry) error {
+	hdr := &tar.Header{
+		Name:    entry.Name,
+		Size:    int64(len(entry.Body)),
+		Mode:    entry.Mode,
+		ModTime: entry.ModTime,
+	}
+	if err := p.tar.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := p.tar.Write(entry.Body)
+	return err
+}
+
+func (p *tarSink) Close() error {
+	err := p.tar.Close()
+	if p.gzip != nil {
+		if err2 := p.gzip.Close(); err == nil {
+			err = err2
+		}
+	}
+	return p.file.finish(err)
+}
+
+func (p *tarSink) Abort() {
+	p.file.abort()
+}
+
+type zipSink struct {
+	file *sinkFile
+	zip  *zip.Writer
+}
+
+func CreateZipSink(filePath string) (Sink, error) {
+	file, err := createSinkFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return &zipSink{file: file, zip: zip.NewWriter(file.bw)}, nil
+}
+
+func (p *zipSink) Add(entry *Entry) error {
+	hdr := &zip.FileHeader{
+		Name:     entry.Name,
+		Method:   zip.Deflate,
+		Modified: entry.ModTime,
+	}
+	hdr.SetMode(os.FileMode(entry.Mode) & os.ModePerm)
+	w, err := p.zip.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(entry.Body)
+	return err
+}
+
+func (p *zipSink) Close() error {
+	return p.file.finish(p.zip.Close())
+}
+
+func (p *zipSink) Abort() {
+	p.file.abort()
+}
+
+// Parses the entries as vehicle location reports, and writes the locations
+// (aggregated as by the fetcher) in the columnar format.
+type ColumnarSink struct {
+	file       *sinkFile
+	writer     *nbcolumnar.Writer
+	aggregator nblocations.VehicleAggregator
+	// Number of entries that couldn't be parsed.
+	NumBadEntries int
+}
+
+func CreateColumnarSink(filePath string) (*ColumnarSink, error) {
+	file, err := createSinkFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return &ColumnarSink{
+		file:       file,
+		writer:     nbcolumnar.NewWriter(file.bw),
+		aggregator: nblocations.MakeVehicleAggregator(),
+	}, nil
+}
+
+func (p *ColumnarSink) Add(entry *Entry) error {
+	report, err := nextbus.ParseXmlVehicleLocations(entry.Body)
+	if err != nil {
+		glog.Warningf("Skipping entry %s: %v", entry.Name, err)
+		p.NumBadEntries++
+		return nil
+	}
+	var locations []*nextbus.VehicleLocation
+	for _, vl := range report.VehicleLocations {
+		if vl != nil {
+			locations = append(locations, vl)
+		}
+	}
+	p.aggregator.Insert(locations)
+	return p.writer.WriteLocations(p.aggregator.RemoveStaleReports())
+}
+
+// NumLocations returns the number of locations written so far.
+func (p *ColumnarSink) NumLocations() int {
+	return p.writer.NumLocations()
+}
+
+func (p *ColumnarSink) Close() error {
+	err := p.writer.WriteLocations(p.aggregator.Close())
+	if err == nil {
+		err = p.writer.Close()
+	}
+	return p.file.finish(err)
+}
+
+func (p *ColumnarSink) Abort() {
+	p.file.abort()
+}
+
+// Extensions of the supported output formats.
+var SinkExtensions = []string{".tar", ".tar.gz", ".tgz", ".zip",
+	nbcolumnar.Extension}
+
+// CreateSink creates a sink for the format indicated by the extension of
+// filePath (one of SinkExtensions).
+func CreateSink(filePath string) (Sink, error) {
+	switch {
+	case strings.HasSuffix(filePath, ".tar"), strings.HasSuffix(filePath, ".tar.gz"),
+		strings.HasSuffix(filePath, ".tgz"):
+		return CreateTarSink(filePath)
+	case strings.HasSuffix(filePath, ".zip"):
+		return CreateZipSink(filePath)
+	case strings.HasSuffix(filePath, nbcolumnar.Extension):
+		return CreateColumnarSink(filePath)
+	}
+	return nil, fmt.Errorf("Unsupported output format: %s", filePath)
+}
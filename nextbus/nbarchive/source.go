@@ -0,0 +1,211 @@
+package nbarchive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jamessynge/transit_tools/util"
+)
+
+// A file in an archive (or directory).
+type Entry struct {
+	Name    string
+	ModTime time.Time
+	Mode    int64
+	Body    []byte
+}
+
+// A source of entries, in order. Next returns io.EOF after the last entry.
+type Source interface {
+	Next() (*Entry, error)
+	Close() error
+}
+
+// The files of a directory (not its subdirectories) with a given suffix, in
+// name order.
+type dirSource struct {
+	dir   string
+	infos []os.FileInfo
+}
+
+// OpenDirSource returns a source of the files in dir whose names end with
+// suffix (e.g. ".xml"; all files if empty).
+func OpenDirSource(dir, suffix string) (Source, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	p := &dirSource{dir: dir}
+	for _, info := range infos {
+		if info.Mode().IsRegular() && strings.HasSuffix(info.Name(), suffix) {
+			p.infos = append(p.infos, info)
+		}
+	}
+	return p, nil
+}
+
+func (p *dirSource) Next() (*Entry, error) {
+	if len(p.infos) == 0 {
+		return nil, io.EOF
+	}
+	info := p.infos[0]
+	p.infos = p.infos[1:]
+	body, err := ioutil.ReadFile(filepath.Join(p.dir, info.Name()))
+	if err != nil {
+		return nil, err
+	}
+	return &Entry{
+		Name:    info.Name(),
+		ModTime: info.ModTime(),
+		Mode:    int64(info.Mode() & os.ModePerm),
+		Body:    body,
+	}, nil
+}
+
+func (p *dirSource) Close() error {
+	p.infos = nil
+	return nil
+}
+
+type zipSource struct {
+	r     *zip.ReadCloser
+	files []*zip.File
+}
+
+func OpenZipSource(filePath string) (Source, error) {
+	r, err := zip.OpenReader(filePath)
+	if err != nil {
+		return nil, err
+	}
+	p := &zipSource{r: r}
+	for _, f := range r.File {
+		if !f.FileInfo().IsDir() {
+			p.files = append(p.files, f)
+		}
+	}
+	return p, nil
+}
+
+func (p *zipSource) Next() (*Entry, error) {
+	if len(p.files) == 0 {
+		return nil, io.EOF
+	}
+	f := p.files[0]
+	p.files = p.files[1:]
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	body, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading zip entry %s: %v", f.Name, err)
+	}
+	return &Entry{
+		Name:    f.Name,
+		ModTime: f.Modified,
+		Mode:    int64(f.Mode() & os.ModePerm),
+		Body:    body,
+	}, nil
+}
+
+func (p *zipSource) Close() error {
+	return p.r.Close()
+}
+
+type tarSource struct {
+	rc io.ReadCloser
+	tr *tar.Reader
+}
+
+// OpenTarSource opens a tar file, decompressing it if its name ends with .gz
+// or .tgz.
+func OpenTarSource(filePath string) (Source, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return NewTarSource(f, isGzipped(filePath))
+}
+
+// NewTarSource returns a source of the entries of the tar stream read from
+// rc (which is closed by Close).
+func NewTarSource(rc io.ReadCloser, gzipped bool) (Source, error) {
+	if gzipped {
+		zrc, err := util.NewGzipReadCloser(rc)
+		if err != nil {
+			rc.Close()
+			return nil, err
+		}
+		rc = zrc
+	}
+	return &tarSource{rc: rc, tr: tar.NewReader(rc)}, nil
+}
+
+func (p *tarSource) Next() (*Entry, error) {
+	for {
+		header, err := p.tr.Next()
+		if err != nil {
+			return nil, err
+		}
+		if !header.FileInfo().Mode().IsRegular() {
+			continue
+		}
+		body, err := ioutil.ReadAll(p.tr)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading tar entry %s: %v",
+				header.Name, err)
+		}
+		return &Entry{
+			Name:    header.Name,
+			ModTime: header.ModTime,
+			Mode:    header.Mode,
+			Body:    body,
+		}, nil
+	}
+}
+
+func (p *tarSource) Close() error {
+	return p.rc.Close()
+}
+
+func isGzipped(filePath string) bool {
+	return strings.HasSuffix(filePath, ".gz") || strings.HasSuffix(filePath, ".tgz")
+}
+
+// OpenSource opens a directory of XML files, or a zip or tar (optionally
+// gzipped) archive, according to the type and name of filePath.
+func OpenSource(filePath string) (Source, error) {
+	if util.IsDirectory(filePath) {
+		return OpenDirSource(filePath, ".xml")
+	}
+	switch {
+	case strings.HasSuffix(filePath, ".zip"):
+		return OpenZipSource(filePath)
+	case strings.HasSuffix(filePath, ".tar"), strings.HasSuffix(filePath, ".tar.gz"),
+		strings.HasSuffix(filePath, ".tgz"):
+		return OpenTarSource(filePath)
+	}
+	return nil, fmt.Errorf("Unsupported source: %s", filePath)
+}
+
+// ReadAllEntries reads the remaining entries of the source.
+func ReadAllEntries(src Source) ([]*Entry, error) {
+	var result []*Entry
+	for {
+		entry, err := src.Next()
+		if err == io.EOF {
+			return result, nil
+		} else if err != nil {
+			return result, err
+		}
+		result = append(result, entry)
+	}
+}
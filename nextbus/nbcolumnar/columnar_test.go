@@ -0,0 +1,243 @@
+package nbcolumnar
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/jamessynge/transit_tools/geo"
+	"github.com/jamessynge/transit_tools/nextbus"
+	"github.com/jamessynge/transit_tools/util"
+)
+
+func makeLocations(n int) []*nextbus.VehicleLocation {
+	var result []*nextbus.VehicleLocation
+	t := util.UnixMillisToTime(1400000000123)
+	routes := []string{"1", "39", "57"}
+	for i := 0; i < n; i++ {
+		vl := &nextbus.VehicleLocation{
+			VehicleId: []string{"0123", "0456", "y1234"}[i%3],
+			RouteTag:  routes[(i/3)%len(routes)],
+			DirTag:    routes[(i/3)%len(routes)] + "_0_var0",
+			Time:      t.Add(time.Duration(i*997) * time.Millisecond),
+			Heading:   geo.HeadingInt((i * 37) % 360),
+		}
+		vl.Lat = geo.Latitude(42.3 + float64(i)*0.0000137)
+		vl.Lon = geo.Longitude(-71.1 - float64(i%50)*0.0001)
+		// Same precision as the feed.
+		vl.Lat = geo.Latitude(fromE7(toE7(float64(vl.Lat))))
+		vl.Lon = geo.Longitude(fromE7(toE7(float64(vl.Lon))))
+		if i%7 == 3 {
+			vl.DirTag = ""
+			vl.Heading = -1
+		}
+		result = append(result, vl)
+	}
+	return result
+}
+
+func writeLocations(
+	t *testing.T, vls []*nextbus.VehicleLocation, blockSize int) []byte {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.BlockSize = blockSize
+	if err := w.WriteLocations(vls); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func readLocations(t *testing.T, data []byte, filter *Filter) (
+	[]*nextbus.VehicleLocation, []error) {
+	var result []*nextbus.VehicleLocation
+	var errs []error
+	fn := func(source string, vl *nextbus.VehicleLocation, recordNum int,
+		err error) error {
+		if err != nil {
+			errs = append(errs, err)
+			return nil
+		}
+		if recordNum != len(result) {
+			t.Errorf("recordNum is %d, expected %d", recordNum, len(result))
+		}
+		result = append(result, vl)
+		return nil
+	}
+	n, err := ReadVehicleLocations(bytes.NewReader(data), "test", filter, fn)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if n != len(result) {
+		t.Errorf("numRecords is %d, expected %d", n, len(result))
+	}
+	return result, errs
+}
+
+func sameLocation(a, b *nextbus.VehicleLocation) bool {
+	return a.IsSameReportExceptTime(b) && a.Time.Equal(b.Time)
+}
+
+func TestRoundTrip(t *testing.T) {
+	vls := makeLocations(1000)
+	data := writeLocations(t, vls, 128)
+	actual, errs := readLocations(t, data, nil)
+	if len(errs) != 0 {
+		t.Fatalf("Unexpected errors: %v", errs)
+	}
+	if len(actual) != len(vls) {
+		t.Fatalf("Read %d locations, expected %d", len(actual), len(vls))
+	}
+	for i := range vls {
+		if !sameLocation(vls[i], actual[i]) {
+			t.Errorf("Location %d differs\nExpected: %v\n  Actual: %v",
+				i, vls[i].ToCSVFields(), actual[i].ToCSVFields())
+		}
+	}
+	// Much smaller than the CSV representation.
+	csvSize := 0
+	for _, vl := range vls {
+		for _, f := range vl.ToCSVFields() {
+			csvSize += len(f) + 1
+		}
+	}
+	if len(data)*3 > csvSize {
+		t.Errorf("Columnar size (%d) not much smaller than CSV size (%d)",
+			len(data), csvSize)
+	}
+}
+
+func TestEmpty(t *testing.T) {
+	data := writeLocations(t, nil, 10)
+	if string(data) != Magic {
+		t.Errorf("Unexpected data: %q", data)
+	}
+	actual, errs := readLocations(t, data, nil)
+	if len(actual) != 0 || len(errs) != 0 {
+		t.Errorf("Unexpected results: %v, %v", actual, errs)
+	}
+	if _, err := NewReader(bytes.NewReader([]byte("time,id\n"))); err != ErrBadMagic {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	vls := makeLocations(1000)
+	data := writeLocations(t, vls, 100)
+	filter := &Filter{
+		Start: vls[250].Time,
+		End:   vls[349].Time,
+	}
+	actual, errs := readLocations(t, data, filter)
+	if len(errs) != 0 {
+		t.Fatalf("Unexpected errors: %v", errs)
+	}
+	if len(actual) != 100 || !sameLocation(actual[0], vls[250]) ||
+		!sameLocation(actual[99], vls[349]) {
+		t.Errorf("Wrong locations for time filter: %d", len(actual))
+	}
+
+	// Blocks outside of the range are skipped.
+	r, err := NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	numMatched := 0
+	for {
+		info, err := r.NextBlock()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if info.NumLocations != 100 {
+			t.Errorf("Wrong block size: %d", info.NumLocations)
+		}
+		if filter.MatchesBlock(info) {
+			numMatched++
+		}
+	}
+	if numMatched != 2 {
+		t.Errorf("Expected 2 blocks to match, not %d", numMatched)
+	}
+
+	bounds := &geo.Rect{
+		South: vls[500].Lat,
+		North: vls[599].Lat,
+		West:  -180,
+		East:  180,
+	}
+	actual, errs = readLocations(t, data, &Filter{Bounds: bounds})
+	if len(errs) != 0 {
+		t.Fatalf("Unexpected errors: %v", errs)
+	}
+	if len(actual) != 100 || !sameLocation(actual[0], vls[500]) {
+		t.Errorf("Wrong locations for bounds filter: %d", len(actual))
+	}
+}
+
+func TestCorruptBlock(t *testing.T) {
+	vls := makeLocations(300)
+	data := writeLocations(t, vls, 100)
+	// Corrupt the last byte of the first block's columns (just before its CRC);
+	// blocks are encoded independently, so the first block ends where the
+	// encoding of just its locations ends.
+	firstBlockEnd := len(writeLocations(t, vls[:100], 100))
+	data[firstBlockEnd-5] ^= 0x55
+
+	actual, errs := readLocations(t, data, nil)
+	if len(errs) != 1 {
+		t.Fatalf("Expected 1 error, not: %v", errs)
+	}
+	if len(actual) != 200 || !sameLocation(actual[0], vls[100]) {
+		t.Errorf("Wrong locations after corrupt block: %d", len(actual))
+	}
+
+	// Truncation.
+	_, errs = readLocations(t, data[:len(data)-10], nil)
+	if len(errs) == 0 {
+		t.Errorf("Expected an error from truncated data")
+	}
+}
+
+func TestCorruptLengths(t *testing.T) {
+	withUvarint := func(prefix []byte, v uint64, suffix []byte) []byte {
+		b := append([]byte(nil), prefix...)
+		var scratch [binary.MaxVarintLen64]byte
+		b = append(b, scratch[:binary.PutUvarint(scratch[:], v)]...)
+		return append(b, suffix...)
+	}
+	magic := []byte(Magic)
+	for _, size := range []uint64{1 << 20, 1 << 40, math.MaxUint64} {
+		r, err := NewReader(bytes.NewReader(withUvarint(magic, size, []byte("abc"))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.NextBlock(); err == nil || err == io.EOF {
+			t.Errorf("Header length %d: expected an error, not %v", size, err)
+		}
+	}
+
+	// Replace the length of the columns of a valid block.
+	data := writeLocations(t, makeLocations(10), 100)
+	headerLen, n := binary.Uvarint(data[len(Magic):])
+	pos := len(Magic) + n + int(headerLen)
+	_, n = binary.Uvarint(data[pos:])
+	for _, size := range []uint64{1 << 20, 1 << 40, math.MaxUint64} {
+		r, err := NewReader(bytes.NewReader(withUvarint(data[:pos], size, data[pos+n:])))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.NextBlock(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.ReadBlock(); err == nil {
+			t.Errorf("Columns length %d: expected an error", size)
+		}
+	}
+}
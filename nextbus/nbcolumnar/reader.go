@@ -0,0 +1,376 @@
+package nbcolumnar
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/jamessynge/transit_tools/geo"
+	"github.com/jamessynge/transit_tools/nextbus"
+	"github.com/jamessynge/transit_tools/util"
+)
+
+var ErrBadMagic = errors.New("Not a columnar vehicle locations file")
+
+// Summary of a block, from its header.
+type BlockInfo struct {
+	NumLocations int
+	MinTimeMs    int64
+	MaxTimeMs    int64
+	Bounds       geo.Rect
+}
+
+func (p *BlockInfo) MinTime() time.Time {
+	return util.UnixMillisToTime(p.MinTimeMs)
+}
+
+func (p *BlockInfo) MaxTime() time.Time {
+	return util.UnixMillisToTime(p.MaxTimeMs)
+}
+
+// Selects the locations to be read; the zero value selects all. Blocks whose
+// time range or bounding box don't overlap the filter are skipped without
+// decoding their columns.
+type Filter struct {
+	// If not zero, locations before Start or after End are excluded.
+	Start, End time.Time
+	// If not nil, locations outside of Bounds are excluded.
+	Bounds *geo.Rect
+}
+
+func (p *Filter) timeMs() (startMs, endMs int64) {
+	startMs, endMs = -1<<63, 1<<63-1
+	if !p.Start.IsZero() {
+		startMs = util.TimeToUnixMillis(p.Start)
+	}
+	if !p.End.IsZero() {
+		endMs = util.TimeToUnixMillis(p.End)
+	}
+	return
+}
+
+// MatchesBlock returns true if some of the locations in the block may match.
+func (p *Filter) MatchesBlock(info *BlockInfo) bool {
+	if p == nil {
+		return true
+	}
+	startMs, endMs := p.timeMs()
+	if info.MaxTimeMs < startMs || info.MinTimeMs > endMs {
+		return false
+	}
+	if b := p.Bounds; b != nil {
+		r := &info.Bounds
+		if r.North < b.South || r.South > b.North ||
+			r.East < b.West || r.West > b.East {
+			return false
+		}
+	}
+	return true
+}
+
+// Matches returns true if the location matches.
+func (p *Filter) Matches(vl *nextbus.VehicleLocation) bool {
+	if p == nil {
+		return true
+	}
+	startMs, endMs := p.timeMs()
+	if ms := vl.UnixMilliseconds(); ms < startMs || ms > endMs {
+		return false
+	}
+	if b := p.Bounds; b != nil {
+		if vl.Lat < b.South || vl.Lat > b.North ||
+			vl.Lon < b.West || vl.Lon > b.East {
+			return false
+		}
+	}
+	return true
+}
+
+// Reads the blocks of a columnar file. Usage: call NextBlock, then either
+// ReadBlock or SkipBlock (or NextBlock again, which skips the columns of the
+// current block).
+type Reader struct {
+	r         *bufio.Reader
+	info      *BlockInfo
+	firstMs   int64
+	dict      []string
+	colsAhead bool // The current block's columns haven't been read yet.
+}
+
+// NewReader reads the magic string at the start of the file.
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(Magic))
+	if _, err := io.ReadFull(br, magic); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrBadMagic
+		}
+		return nil, err
+	}
+	if string(magic) != Magic {
+		return nil, ErrBadMagic
+	}
+	return &Reader{r: br}, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Upper bound on the length of a block header or of the columns of a block,
+// far larger than the writer produces, so that a corrupt length is detected.
+const kMaxSectionLength = 1 << 28
+
+// Reads a block header or the columns of a block. The buffer grows as the
+// bytes are read, so a corrupt length near the end of a file produces
+// io.ErrUnexpectedEOF, rather than first allocating a huge buffer.
+func (p *Reader) readSection(length uint64) ([]byte, error) {
+	if length > kMaxSectionLength {
+		return nil, fmt.Errorf("Corrupt block: section length %d is too large",
+			length)
+	}
+	var buf bytes.Buffer
+	if length < bytes.MinRead*16 {
+		buf.Grow(int(length))
+	}
+	if _, err := io.CopyN(&buf, p.r, int64(length)); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return buf.Bytes(), nil
+}
+
+// NextBlock reads the header of the next block; returns io.EOF if there are
+// no more blocks.
+func (p *Reader) NextBlock() (*BlockInfo, error) {
+	if p.colsAhead {
+		if err := p.SkipBlock(); err != nil {
+			return nil, err
+		}
+	}
+	p.info = nil
+	size, err := binary.ReadUvarint(p.r)
+	if err != nil {
+		return nil, err // io.EOF if at the end of the file.
+	}
+	header, err := p.readSection(size)
+	if err != nil {
+		return nil, err
+	}
+	hr := bytes.NewReader(header)
+	var vals [7]int64
+	count, err := binary.ReadUvarint(hr)
+	for i := 0; i < len(vals) && err == nil; i++ {
+		vals[i], err = binary.ReadVarint(hr)
+	}
+	numStrs, err2 := binary.ReadUvarint(hr)
+	if err == nil {
+		err = err2
+	}
+	if err != nil || numStrs > size {
+		return nil, fmt.Errorf("Corrupt block header: %v", err)
+	}
+	dict := make([]string, numStrs)
+	for i := range dict {
+		n, err := binary.ReadUvarint(hr)
+		if err != nil || n > uint64(hr.Len()) {
+			return nil, fmt.Errorf("Corrupt block dictionary: %v", err)
+		}
+		b := make([]byte, n)
+		hr.Read(b)
+		dict[i] = string(b)
+	}
+	p.info = &BlockInfo{
+		NumLocations: int(count),
+		MinTimeMs:    vals[0],
+		MaxTimeMs:    vals[0] + vals[1],
+		Bounds: geo.Rect{
+			South: geo.Latitude(fromE7(vals[3])),
+			North: geo.Latitude(fromE7(vals[4])),
+			West:  geo.Longitude(fromE7(vals[5])),
+			East:  geo.Longitude(fromE7(vals[6])),
+		},
+	}
+	p.firstMs = vals[0] + vals[2]
+	p.dict = dict
+	p.colsAhead = true
+	return p.info, nil
+}
+
+func (p *Reader) readColumns() ([]byte, error) {
+	if !p.colsAhead {
+		return nil, errors.New("No block header has been read")
+	}
+	p.colsAhead = false
+	size, err := binary.ReadUvarint(p.r)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if size > kMaxSectionLength {
+		// Checked here too, as adding the length of the CRC might overflow.
+		return nil, fmt.Errorf("Corrupt block: columns length %d is too large",
+			size)
+	}
+	return p.readSection(size + 4)
+}
+
+// SkipBlock skips the columns of the current block.
+func (p *Reader) SkipBlock() error {
+	_, err := p.readColumns()
+	return err
+}
+
+// ReadBlock decodes the locations of the current block.
+func (p *Reader) ReadBlock() ([]*nextbus.VehicleLocation, error) {
+	cols, err := p.readColumns()
+	if err != nil {
+		return nil, err
+	}
+	data, crc := cols[:len(cols)-4], cols[len(cols)-4:]
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(crc) {
+		return nil, errors.New("Block checksum mismatch")
+	}
+	// Each location takes at least 7 bytes.
+	if uint64(p.info.NumLocations) > uint64(len(data))/7 {
+		return nil, fmt.Errorf("Corrupt block: %d locations in %d bytes",
+			p.info.NumLocations, len(data))
+	}
+	cr := bytes.NewReader(data)
+	lookup := func() (string, error) {
+		i, err := binary.ReadUvarint(cr)
+		if err != nil {
+			return "", err
+		}
+		if i >= uint64(len(p.dict)) {
+			return "", fmt.Errorf("Invalid dictionary index: %d", i)
+		}
+		return p.dict[i], nil
+	}
+	result := make([]*nextbus.VehicleLocation, p.info.NumLocations)
+	ms, lat, lon := p.firstMs, int64(0), int64(0)
+	for n := range result {
+		vl := &nextbus.VehicleLocation{}
+		var dMs, heading, dLat, dLon int64
+		dMs, err = binary.ReadVarint(cr)
+		if err == nil {
+			vl.VehicleId, err = lookup()
+		}
+		if err == nil {
+			vl.RouteTag, err = lookup()
+		}
+		if err == nil {
+			vl.DirTag, err = lookup()
+		}
+		if err == nil {
+			heading, err = binary.ReadVarint(cr)
+		}
+		if err == nil {
+			dLat, err = binary.ReadVarint(cr)
+		}
+		if err == nil {
+			dLon, err = binary.ReadVarint(cr)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Corrupt location %d of block: %v", n, err)
+		}
+		ms += dMs
+		lat += dLat
+		lon += dLon
+		vl.Time = util.UnixMillisToTime(ms)
+		vl.Heading = geo.HeadingInt(heading)
+		vl.Lat = geo.Latitude(fromE7(lat))
+		vl.Lon = geo.Longitude(fromE7(lon))
+		result[n] = vl
+	}
+	return result, nil
+}
+
+// Process 1 location (or the error encountered when reading a block, in
+// which case vl is nil), in the manner of util.RecordProcessorFn.
+type LocationProcessorFn func(source string, vl *nextbus.VehicleLocation,
+	recordNum int, err error) error
+
+// ReadVehicleLocations passes the locations read from r that match the filter
+// (nil matches all) to fn. If fn returns non-nil, reading stops and that error
+// is returned (except for io.EOF, which is converted to nil). A corrupt block
+// is reported to fn, and reading continues with the next block if fn returns
+// nil (unless the corruption is in the framing of the blocks).
+func ReadVehicleLocations(r io.Reader, source string, filter *Filter,
+	fn LocationProcessorFn) (numRecords int, err error) {
+	reader, err := NewReader(r)
+	if err != nil {
+		return
+	}
+	for {
+		var info *BlockInfo
+		info, err = reader.NextBlock()
+		if err == io.EOF {
+			return numRecords, nil
+		} else if err != nil {
+			glog.Warningf("Error reading block header from %s\nError: %s",
+				source, err)
+			fn(source, nil, numRecords, err)
+			return
+		}
+		if !filter.MatchesBlock(info) {
+			if err = reader.SkipBlock(); err != nil {
+				fn(source, nil, numRecords, err)
+				return
+			}
+			continue
+		}
+		var vls []*nextbus.VehicleLocation
+		vls, err = reader.ReadBlock()
+		if err != nil {
+			glog.Warningf("Error reading block from %s\nError: %s", source, err)
+			if err == io.ErrUnexpectedEOF {
+				fn(source, nil, numRecords, err)
+				return numRecords, err
+			}
+			if err = fn(source, nil, numRecords, err); err != nil {
+				if err == io.EOF {
+					err = nil
+				}
+				return numRecords, err
+			}
+			continue
+		}
+		for _, vl := range vls {
+			if !filter.Matches(vl) {
+				continue
+			}
+			if err = fn(source, vl, numRecords, nil); err != nil {
+				if err == io.EOF {
+					err = nil
+				}
+				return numRecords, err
+			}
+			numRecords++
+		}
+	}
+}
+
+func ReadVehicleLocationsFile(filePath string, filter *Filter,
+	fn LocationProcessorFn) (numRecords int, err error) {
+	rc, err := util.OpenReadFile(filePath)
+	if err != nil {
+		glog.Warningf("Unable to open %s\nError: %s", filePath, err)
+		return
+	}
+	defer func() {
+		err2 := rc.Close()
+		if err == nil {
+			err = err2
+		}
+	}()
+	return ReadVehicleLocations(rc, filePath, filter, fn)
+}
@@ -123,7 +123,7 @@ func (p *CsvOutputChanMap) CloseAll() {
 }
 
 func locationsToPerPathFilesWorker(
-	qtm *RouteToQuadTreeMap,
+	finder VLPathFinder,
 	inputChan <-chan []string,
 	outputChans *CsvOutputChanMap,
 	workerWG *sync.WaitGroup) {
@@ -141,7 +141,7 @@ func locationsToPerPathFilesWorker(
 			// debug later.
 			continue
 		}
-		paths := qtm.VLToPaths(vl, 0.00067, 0.00042)
+		paths := finder.FindPaths(vl)
 		if len(paths) == 0 {
 			//			log.Printf("Did NOT match any paths: %v", vl)
 			err = outputChans.Write(-1, record)
@@ -160,7 +160,7 @@ func locationsToPerPathFilesWorker(
 }
 
 func LocationsFileToPerPathFiles(
-	qtm *RouteToQuadTreeMap,
+	finder VLPathFinder,
 	filePath string,
 	outputChans *CsvOutputChanMap,
 	fileWG *sync.WaitGroup,
@@ -176,7 +176,7 @@ func LocationsFileToPerPathFiles(
 	workerWG := &sync.WaitGroup{}
 	workerWG.Add(numWorkers)
 	for i := 0; i < numWorkers; i++ {
-		go locationsToPerPathFilesWorker(qtm, recordChan, outputChans, workerWG)
+		go locationsToPerPathFilesWorker(finder, recordChan, outputChans, workerWG)
 	}
 	numRecords, err = util.ReadCsvFileToChan(filePath, recordChan)
 	close(recordChan)
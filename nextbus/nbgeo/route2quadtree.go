@@ -9,6 +9,11 @@ import (
 	"github.com/jamessynge/transit_tools/nextbus"
 )
 
+// Finds the paths that a vehicle location report may be on.
+type VLPathFinder interface {
+	FindPaths(vl *nextbus.VehicleLocation) []*nextbus.Path
+}
+
 type RouteToQuadTreeMap struct {
 	agency *nextbus.Agency
 	rt2qt  map[string]geom.QuadTree
@@ -36,6 +41,13 @@ func NewRouteToQuadTreeMap(agency *nextbus.Agency) *RouteToQuadTreeMap {
 	return p
 }
 
+// FindPaths calls VLToPaths with tolerances of roughly 50 meters at the
+// latitude of Boston.
+func (p *RouteToQuadTreeMap) FindPaths(
+	vl *nextbus.VehicleLocation) []*nextbus.Path {
+	return p.VLToPaths(vl, 0.00067, 0.00042)
+}
+
 // Given a vehicle location and tolerances (dx, dy),
 func (p *RouteToQuadTreeMap) VLToPaths(
 	vl *nextbus.VehicleLocation, dx, dy float64) []*nextbus.Path {
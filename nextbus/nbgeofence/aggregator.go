@@ -0,0 +1,58 @@
+package nbgeofence
+
+import (
+	"encoding/csv"
+	"io"
+	"sync"
+
+	"github.com/jamessynge/transit_tools/nextbus"
+	"github.com/jamessynge/transit_tools/nextbus/nblocations"
+)
+
+// Receives the events produced from each batch of reports.
+type EventSink func(events []Event)
+
+// An aggregator that also passes the reports to a tracker.
+type geofenceAggregator struct {
+	nblocations.VehicleAggregator
+	tracker *Tracker
+	sink    EventSink
+}
+
+// MakeGeofenceAggregator returns an aggregator which passes the reports it
+// is given to both aggregator and tracker, and any resulting events to sink.
+func MakeGeofenceAggregator(aggregator nblocations.VehicleAggregator,
+	tracker *Tracker, sink EventSink) nblocations.VehicleAggregator {
+	return &geofenceAggregator{aggregator, tracker, sink}
+}
+
+func (p *geofenceAggregator) Insert(locations []*nextbus.VehicleLocation) {
+	p.VehicleAggregator.Insert(locations)
+	if events := p.tracker.Insert(locations); len(events) > 0 {
+		p.sink(events)
+	}
+}
+
+// Writes events as CSV records (see Event.ToCSVFields); safe for concurrent
+// use.
+type CsvEventWriter struct {
+	mu sync.Mutex
+	w  *csv.Writer
+}
+
+func NewCsvEventWriter(w io.Writer) *CsvEventWriter {
+	return &CsvEventWriter{w: csv.NewWriter(w)}
+}
+
+// Writes and flushes the events.
+func (p *CsvEventWriter) Write(events []Event) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := range events {
+		if err := p.w.Write(events[i].ToCSVFields()); err != nil {
+			return err
+		}
+	}
+	p.w.Flush()
+	return p.w.Error()
+}
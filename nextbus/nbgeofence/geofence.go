@@ -0,0 +1,226 @@
+// Package nbgeofence tests vehicle locations against named polygons
+// ("geofences"; e.g. garages, layover areas, terminals, downtown zones), read
+// from a GeoJSON file, and tracks when each vehicle enters and exits them.
+// This tells us, for example, when a bus is in the garage rather than in
+// service, which otherwise can only be guessed from an empty DirTag.
+//
+// The fences are projected (see geogeom.MakeLocalTransverseMercator) and
+// indexed in a quadtree, so that testing a location against many fences is
+// fast.
+package nbgeofence
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/jamessynge/transit_tools/geo"
+	"github.com/jamessynge/transit_tools/geo/geogeom"
+	"github.com/jamessynge/transit_tools/geom"
+)
+
+// A polygon with holes, as (lon, lat) rings; the first ring is the outer
+// boundary.
+type Rings [][]geo.Location
+
+type Fence struct {
+	// Unique within a Set.
+	Name string
+	// The kind of area (e.g. "garage", "layover", "terminal" or "zone");
+	// optional.
+	Kind string
+	// All of the properties of the GeoJSON feature.
+	Properties map[string]interface{}
+	// A location is inside the fence if it is inside any of the polygons.
+	Polygons []Rings
+}
+
+func (f *Fence) String() string {
+	if f.Kind == "" {
+		return f.Name
+	}
+	return fmt.Sprintf("%s (%s)", f.Name, f.Kind)
+}
+
+// A projected polygon of a fence, stored in the quadtree.
+type fencePolygon struct {
+	fence  *Fence
+	outer  geom.Polygon
+	holes  []geom.Polygon
+	bounds geom.Rect
+}
+
+func (p *fencePolygon) IntersectBounds(r geom.Rect) (geom.Rect, bool) {
+	b := p.bounds
+	if b.MinX < r.MinX {
+		b.MinX = r.MinX
+	}
+	if b.MaxX > r.MaxX {
+		b.MaxX = r.MaxX
+	}
+	if b.MinY < r.MinY {
+		b.MinY = r.MinY
+	}
+	if b.MaxY > r.MaxY {
+		b.MaxY = r.MaxY
+	}
+	if b.MinX > b.MaxX || b.MinY > b.MaxY {
+		return geom.Rect{}, true
+	}
+	return b, false
+}
+
+func (p *fencePolygon) Intersects(r geom.Rect) bool {
+	_, empty := p.IntersectBounds(r)
+	return !empty
+}
+
+// Each polygon is found separately (a fence with several polygons may be
+// visited more than once).
+func (p *fencePolygon) UniqueId() interface{} {
+	return p
+}
+
+func (p *fencePolygon) ContainsPoint(pt geom.Point) bool {
+	if !p.outer.ContainsPoint(pt) {
+		return false
+	}
+	for _, hole := range p.holes {
+		if hole.ContainsPoint(pt) {
+			return false
+		}
+	}
+	return true
+}
+
+// An immutable, indexed collection of fences; safe for concurrent use.
+type Set struct {
+	// Sorted by name.
+	Fences    []*Fence
+	byName    map[string]*Fence
+	transform geogeom.Projection
+	tree      geom.QuadTree
+}
+
+// NewSet indexes the fences, which must have unique, non-empty names, and at
+// least one polygon, each with at least 3 points in each ring.
+func NewSet(fences []*Fence) (*Set, error) {
+	s := &Set{byName: make(map[string]*Fence)}
+	var bounds geo.Rect
+	first := true
+	for _, f := range fences {
+		if f.Name == "" {
+			return nil, fmt.Errorf("Fence has no name")
+		}
+		if s.byName[f.Name] != nil {
+			return nil, fmt.Errorf("Duplicate fence name: %q", f.Name)
+		}
+		if len(f.Polygons) == 0 {
+			return nil, fmt.Errorf("Fence %q has no polygons", f.Name)
+		}
+		for _, rings := range f.Polygons {
+			if len(rings) == 0 {
+				return nil, fmt.Errorf("Fence %q has an empty polygon", f.Name)
+			}
+			for _, ring := range rings {
+				if len(ring) < 3 {
+					return nil, fmt.Errorf(
+						"Fence %q has a ring with only %d points", f.Name, len(ring))
+				}
+				for _, loc := range ring {
+					if first {
+						bounds = geo.Rect{
+							South: loc.Lat, North: loc.Lat, West: loc.Lon, East: loc.Lon}
+						first = false
+					} else {
+						if loc.Lat < bounds.South {
+							bounds.South = loc.Lat
+						} else if loc.Lat > bounds.North {
+							bounds.North = loc.Lat
+						}
+						if loc.Lon < bounds.West {
+							bounds.West = loc.Lon
+						} else if loc.Lon > bounds.East {
+							bounds.East = loc.Lon
+						}
+					}
+				}
+			}
+		}
+		s.byName[f.Name] = f
+		s.Fences = append(s.Fences, f)
+	}
+	sort.Sort(fencesByName(s.Fences))
+	if len(s.Fences) == 0 {
+		return s, nil
+	}
+	s.transform = geogeom.MakeLocalTransverseMercator(bounds.Center())
+	var polygons []*fencePolygon
+	var treeBounds geom.Rect
+	for _, f := range s.Fences {
+		for _, rings := range f.Polygons {
+			fp := &fencePolygon{fence: f, outer: s.project(rings[0])}
+			for _, hole := range rings[1:] {
+				fp.holes = append(fp.holes, s.project(hole))
+			}
+			fp.bounds = fp.outer.Bounds()
+			if len(polygons) == 0 {
+				treeBounds = fp.bounds
+			} else {
+				treeBounds = treeBounds.Union(fp.bounds)
+			}
+			polygons = append(polygons, fp)
+		}
+	}
+	s.tree = geom.NewQuadTree(treeBounds.AddBorder(1, 1))
+	for _, fp := range polygons {
+		if err := s.tree.Insert(fp); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *Set) project(ring []geo.Location) geom.Polygon {
+	result := make(geom.Polygon, len(ring))
+	for i, loc := range ring {
+		result[i] = s.transform.ToPoint(loc)
+	}
+	return result
+}
+
+// Returns the named fence, or nil if there is none.
+func (s *Set) Lookup(name string) *Fence {
+	return s.byName[name]
+}
+
+type fenceCollector struct {
+	found map[*Fence]bool
+}
+
+func (c *fenceCollector) Visit(ib geom.IntersectBounder) {
+	c.found[ib.(*fencePolygon).fence] = true
+}
+
+// Containing returns the fences containing loc, sorted by name.
+func (s *Set) Containing(loc geo.Location) []*Fence {
+	if s.tree == nil {
+		return nil
+	}
+	c := &fenceCollector{found: make(map[*Fence]bool)}
+	s.tree.VisitPoint(s.transform.ToPoint(loc), c)
+	if len(c.found) == 0 {
+		return nil
+	}
+	result := make([]*Fence, 0, len(c.found))
+	for f := range c.found {
+		result = append(result, f)
+	}
+	sort.Sort(fencesByName(result))
+	return result
+}
+
+type fencesByName []*Fence
+
+func (s fencesByName) Len() int           { return len(s) }
+func (s fencesByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+func (s fencesByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
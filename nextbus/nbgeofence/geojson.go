@@ -0,0 +1,135 @@
+package nbgeofence
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/jamessynge/transit_tools/geo"
+)
+
+// The subset of GeoJSON (RFC 7946) needed for geofences: a FeatureCollection
+// (or a single Feature) of Polygon or MultiPolygon features, each with a
+// "name" property, and optionally a "kind" property.
+type geoJsonObject struct {
+	Type       string                 `json:"type"`
+	Features   []*geoJsonObject       `json:"features"`
+	Geometry   *geoJsonObject         `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+
+	Coordinates json.RawMessage `json:"coordinates"`
+}
+
+// Positions are [longitude, latitude], optionally followed by an altitude.
+func toRing(positions [][]float64) ([]geo.Location, error) {
+	ring := make([]geo.Location, 0, len(positions))
+	for _, pos := range positions {
+		if len(pos) < 2 {
+			return nil, fmt.Errorf("Invalid position: %v", pos)
+		}
+		loc, err := geo.LocationFromFloat64s(pos[1], pos[0])
+		if err != nil {
+			return nil, err
+		}
+		ring = append(ring, loc)
+	}
+	// GeoJSON rings are closed (the last position repeats the first), but
+	// geom.Polygon implies the closing edge.
+	if n := len(ring); n > 1 && ring[0].SameLocation(ring[n-1]) {
+		ring = ring[:n-1]
+	}
+	return ring, nil
+}
+
+func toRings(polygon [][][]float64) (Rings, error) {
+	var rings Rings
+	for _, positions := range polygon {
+		ring, err := toRing(positions)
+		if err != nil {
+			return nil, err
+		}
+		rings = append(rings, ring)
+	}
+	return rings, nil
+}
+
+func featureToFence(feature *geoJsonObject) (*Fence, error) {
+	f := &Fence{Properties: feature.Properties}
+	f.Name, _ = feature.Properties["name"].(string)
+	f.Kind, _ = feature.Properties["kind"].(string)
+	if f.Name == "" {
+		return nil, fmt.Errorf("Feature has no name property")
+	}
+	g := feature.Geometry
+	if g == nil {
+		return nil, fmt.Errorf("Feature %q has no geometry", f.Name)
+	}
+	var polygons [][][][]float64
+	switch g.Type {
+	case "Polygon":
+		var polygon [][][]float64
+		if err := json.Unmarshal(g.Coordinates, &polygon); err != nil {
+			return nil, fmt.Errorf("Feature %q: %v", f.Name, err)
+		}
+		polygons = append(polygons, polygon)
+	case "MultiPolygon":
+		if err := json.Unmarshal(g.Coordinates, &polygons); err != nil {
+			return nil, fmt.Errorf("Feature %q: %v", f.Name, err)
+		}
+	default:
+		return nil, fmt.Errorf(
+			"Feature %q has unsupported geometry type %q", f.Name, g.Type)
+	}
+	for _, polygon := range polygons {
+		rings, err := toRings(polygon)
+		if err != nil {
+			return nil, fmt.Errorf("Feature %q: %v", f.Name, err)
+		}
+		f.Polygons = append(f.Polygons, rings)
+	}
+	return f, nil
+}
+
+// ParseGeoJSON returns the fences described by a GeoJSON FeatureCollection
+// or Feature.
+func ParseGeoJSON(data []byte) ([]*Fence, error) {
+	var obj geoJsonObject
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return nil, err
+	}
+	var features []*geoJsonObject
+	switch obj.Type {
+	case "FeatureCollection":
+		features = obj.Features
+	case "Feature":
+		features = append(features, &obj)
+	default:
+		return nil, fmt.Errorf("Unsupported GeoJSON type: %q", obj.Type)
+	}
+	var fences []*Fence
+	for _, feature := range features {
+		f, err := featureToFence(feature)
+		if err != nil {
+			return nil, err
+		}
+		fences = append(fences, f)
+	}
+	return fences, nil
+}
+
+// LoadGeoJSONFile reads the fences from a GeoJSON file, and indexes them.
+func LoadGeoJSONFile(filePath string) (*Set, error) {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	fences, err := ParseGeoJSON(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filePath, err)
+	}
+	s, err := NewSet(fences)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filePath, err)
+	}
+	return s, nil
+}
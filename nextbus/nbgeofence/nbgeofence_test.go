@@ -0,0 +1,218 @@
+package nbgeofence
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jamessynge/transit_tools/geo"
+	"github.com/jamessynge/transit_tools/nextbus"
+	"github.com/jamessynge/transit_tools/nextbus/nblocations"
+)
+
+// A garage with a hole (an office building), a downtown zone overlapping the
+// garage, and a terminal made of two polygons.
+const testGeoJSON = `{
+  "type": "FeatureCollection",
+  "features": [
+    {
+      "type": "Feature",
+      "properties": {"name": "garage", "kind": "garage", "capacity": 120},
+      "geometry": {
+        "type": "Polygon",
+        "coordinates": [
+          [[-71.10, 42.30], [-71.08, 42.30], [-71.08, 42.32], [-71.10, 42.32], [-71.10, 42.30]],
+          [[-71.095, 42.305], [-71.090, 42.305], [-71.090, 42.310], [-71.095, 42.310], [-71.095, 42.305]]
+        ]
+      }
+    },
+    {
+      "type": "Feature",
+      "properties": {"name": "downtown", "kind": "zone"},
+      "geometry": {
+        "type": "Polygon",
+        "coordinates": [
+          [[-71.085, 42.31], [-71.05, 42.31], [-71.05, 42.37], [-71.085, 42.37], [-71.085, 42.31]]
+        ]
+      }
+    },
+    {
+      "type": "Feature",
+      "properties": {"name": "terminal"},
+      "geometry": {
+        "type": "MultiPolygon",
+        "coordinates": [
+          [[[-71.20, 42.40], [-71.19, 42.40], [-71.19, 42.41], [-71.20, 42.40]]],
+          [[[-71.30, 42.40], [-71.29, 42.40], [-71.29, 42.41], [-71.30, 42.41]]]
+        ]
+      }
+    }
+  ]
+}`
+
+func loadTestSet(t *testing.T) *Set {
+	fences, err := ParseGeoJSON([]byte(testGeoJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSet(fences)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func loc(lat, lon float64) geo.Location {
+	return geo.Location{Lat: geo.Latitude(lat), Lon: geo.Longitude(lon)}
+}
+
+func fenceNames(fences []*Fence) string {
+	var names []string
+	for _, f := range fences {
+		names = append(names, f.Name)
+	}
+	return fmt.Sprint(names)
+}
+
+func TestParseGeoJSON(t *testing.T) {
+	s := loadTestSet(t)
+	if got := fenceNames(s.Fences); got != "[downtown garage terminal]" {
+		t.Errorf("Fences = %s", got)
+	}
+	garage := s.Lookup("garage")
+	if garage == nil || garage.Kind != "garage" || len(garage.Polygons) != 1 ||
+		len(garage.Polygons[0]) != 2 || len(garage.Polygons[0][0]) != 4 {
+		t.Fatalf("garage = %#v", garage)
+	}
+	if garage.Properties["capacity"] != 120.0 {
+		t.Errorf("Properties = %v", garage.Properties)
+	}
+	if terminal := s.Lookup("terminal"); len(terminal.Polygons) != 2 {
+		t.Errorf("terminal = %#v", terminal)
+	}
+
+	for _, bad := range []string{
+		`{"type": "Point", "coordinates": [1, 2]}`,
+		`{"type": "Feature", "properties": {}, "geometry": {"type": "Polygon", "coordinates": []}}`,
+		`{"type": "Feature", "properties": {"name": "x"}, "geometry": {"type": "LineString", "coordinates": [[1, 2], [3, 4]]}}`,
+		`{"type": "Feature", "properties": {"name": "x"}, "geometry": {"type": "Polygon", "coordinates": [[[1, 200], [3, 4], [5, 6]]]}}`,
+	} {
+		if _, err := ParseGeoJSON([]byte(bad)); err == nil {
+			t.Errorf("Expected error parsing %s", bad)
+		}
+	}
+}
+
+func TestNewSetErrors(t *testing.T) {
+	ring := []geo.Location{loc(0, 0), loc(0, 1), loc(1, 1)}
+	tests := [][]*Fence{
+		{{Name: "", Polygons: []Rings{{ring}}}},
+		{{Name: "a", Polygons: []Rings{{ring}}}, {Name: "a", Polygons: []Rings{{ring}}}},
+		{{Name: "a"}},
+		{{Name: "a", Polygons: []Rings{{ring[:2]}}}},
+	}
+	for i, fences := range tests {
+		if _, err := NewSet(fences); err == nil {
+			t.Errorf("tests[%d]: expected an error", i)
+		}
+	}
+	s, err := NewSet(nil)
+	if err != nil || s.Containing(loc(0, 0)) != nil {
+		t.Errorf("Empty set: %v, %v", s, err)
+	}
+}
+
+func TestContaining(t *testing.T) {
+	s := loadTestSet(t)
+	tests := []struct {
+		loc   geo.Location
+		names string
+	}{
+		{loc(42.302, -71.098), "[garage]"},
+		{loc(42.307, -71.092), "[]"}, // In the hole.
+		{loc(42.315, -71.082), "[downtown garage]"},
+		{loc(42.35, -71.06), "[downtown]"},
+		{loc(42.402, -71.195), "[terminal]"},
+		{loc(42.405, -71.295), "[terminal]"},
+		{loc(42.409, -71.199), "[]"}, // Outside the triangle.
+		{loc(40, -70), "[]"},
+	}
+	for _, test := range tests {
+		if got := fenceNames(s.Containing(test.loc)); got != test.names {
+			t.Errorf("Containing(%v) = %s, expected %s", test.loc, got, test.names)
+		}
+	}
+}
+
+func report(id string, l geo.Location, t time.Time) *nextbus.VehicleLocation {
+	return &nextbus.VehicleLocation{VehicleId: id, RouteTag: "1", Time: t, Location: l}
+}
+
+func eventsString(events []Event) string {
+	var parts []string
+	for _, e := range events {
+		parts = append(parts, e.Type.String()+":"+e.Fence.Name)
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestTracker(t *testing.T) {
+	tracker := NewTracker(loadTestSet(t))
+	t0 := time.Unix(1400000000, 0)
+	steps := []struct {
+		vl     *nextbus.VehicleLocation
+		events string
+	}{
+		{report("a", loc(42.302, -71.098), t0), "enter:garage"},
+		{report("a", loc(42.303, -71.097), t0.Add(10*time.Second)), ""},
+		// Into the overlap with downtown.
+		{report("a", loc(42.315, -71.082), t0.Add(20*time.Second)), "enter:downtown"},
+		// An old report is ignored.
+		{report("a", loc(40, -70), t0.Add(15*time.Second)), ""},
+		{report("a", loc(42.35, -71.06), t0.Add(30*time.Second)), "exit:garage"},
+		{report("a", loc(42.402, -71.195), t0.Add(40*time.Second)),
+			"exit:downtown enter:terminal"},
+		{report("b", loc(42.315, -71.082), t0), "enter:downtown enter:garage"},
+	}
+	for i, step := range steps {
+		if got := eventsString(tracker.Update(step.vl)); got != step.events {
+			t.Errorf("steps[%d]: events %q, expected %q", i, got, step.events)
+		}
+	}
+	if got := fenceNames(tracker.Inside("a")); got != "[terminal]" {
+		t.Errorf("Inside(a) = %s", got)
+	}
+	if got := fmt.Sprint(tracker.VehiclesInside("garage")); got != "[b]" {
+		t.Errorf("VehiclesInside(garage) = %s", got)
+	}
+}
+
+func TestGeofenceAggregatorAndCsv(t *testing.T) {
+	tracker := NewTracker(loadTestSet(t))
+	var buf bytes.Buffer
+	w := NewCsvEventWriter(&buf)
+	va := MakeGeofenceAggregator(nblocations.MakeVehicleAggregator(), tracker,
+		func(events []Event) {
+			if err := w.Write(events); err != nil {
+				t.Error(err)
+			}
+		})
+	t0 := time.Unix(1400000000, 0).UTC()
+	va.Insert([]*nextbus.VehicleLocation{
+		report("x", loc(42.302, -71.098), t0),
+		report("y", loc(40, -70), t0),
+	})
+	va.Insert([]*nextbus.VehicleLocation{
+		report("x", loc(40, -70), t0.Add(time.Minute)),
+	})
+	if va.GetVehicle("x") == nil {
+		t.Errorf("Reports not passed to the aggregator")
+	}
+	want := "1400000000000,20140513 165320,x,1,enter,garage,garage,42.302,-71.098\n" +
+		"1400000060000,20140513 165420,x,1,exit,garage,garage,40,-70\n"
+	if got := buf.String(); got != want {
+		t.Errorf("CSV events:\n%s\nexpected:\n%s", got, want)
+	}
+}
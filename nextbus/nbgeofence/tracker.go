@@ -0,0 +1,157 @@
+package nbgeofence
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jamessynge/transit_tools/nextbus"
+)
+
+type EventType int
+
+const (
+	Enter EventType = iota
+	Exit
+)
+
+func (t EventType) String() string {
+	switch t {
+	case Enter:
+		return "enter"
+	case Exit:
+		return "exit"
+	}
+	return fmt.Sprintf("EventType(%d)", int(t))
+}
+
+// A vehicle entering or exiting a fence, as determined from a report (the
+// first report inside the fence, or the first report outside it).
+type Event struct {
+	Type   EventType
+	Fence  *Fence
+	Report *nextbus.VehicleLocation
+}
+
+func (e *Event) String() string {
+	return fmt.Sprintf("%s %s %s at %s %v", e.Report.VehicleId, e.Type,
+		e.Fence, e.Report.Time.Format("20060102 150405"), e.Report.Location)
+}
+
+// Fields for a CSV file of events: unix milliseconds, time (as in the
+// processed location CSV files), vehicle id, route, event type, fence name,
+// fence kind, latitude and longitude.
+func (e *Event) ToCSVFields() []string {
+	vl := e.Report
+	return []string{
+		fmt.Sprintf("%d", vl.UnixMilliseconds()),
+		vl.Time.Format("20060102 150405"),
+		vl.VehicleId,
+		vl.RouteTag,
+		e.Type.String(),
+		e.Fence.Name,
+		e.Fence.Kind,
+		fmt.Sprint(vl.Lat),
+		fmt.Sprint(vl.Lon),
+	}
+}
+
+type vehicleState struct {
+	last   time.Time
+	inside []*Fence // Sorted by name.
+}
+
+// Tracks which fences each vehicle is inside; safe for concurrent use.
+type Tracker struct {
+	mu       sync.Mutex
+	set      *Set
+	vehicles map[string]*vehicleState
+}
+
+func NewTracker(set *Set) *Tracker {
+	return &Tracker{set: set, vehicles: make(map[string]*vehicleState)}
+}
+
+func (t *Tracker) Set() *Set {
+	return t.set
+}
+
+// Update returns the events caused by the report: exits (sorted by fence
+// name) and then entries. Reports older than the vehicle's latest report are
+// ignored (the aggregator sometimes sees old reports reappear). The first
+// report of a vehicle produces Enter events for the fences it is inside.
+func (t *Tracker) Update(vl *nextbus.VehicleLocation) []Event {
+	inside := t.set.Containing(vl.Location)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	state := t.vehicles[vl.VehicleId]
+	if state == nil {
+		state = &vehicleState{}
+		t.vehicles[vl.VehicleId] = state
+	} else if vl.Time.Before(state.last) {
+		return nil
+	}
+	state.last = vl.Time
+	var events []Event
+	// Both lists are sorted by name, so merge them.
+	was := state.inside
+	i, j := 0, 0
+	var entered []Event
+	for i < len(was) || j < len(inside) {
+		switch {
+		case j == len(inside) || i < len(was) && was[i].Name < inside[j].Name:
+			events = append(events, Event{Exit, was[i], vl})
+			i++
+		case i == len(was) || inside[j].Name < was[i].Name:
+			entered = append(entered, Event{Enter, inside[j], vl})
+			j++
+		default:
+			i++
+			j++
+		}
+	}
+	state.inside = inside
+	return append(events, entered...)
+}
+
+// Insert updates the tracker with the reports, in order, returning all of
+// the events.
+func (t *Tracker) Insert(locations []*nextbus.VehicleLocation) []Event {
+	var events []Event
+	for _, vl := range locations {
+		if vl != nil {
+			events = append(events, t.Update(vl)...)
+		}
+	}
+	return events
+}
+
+// Returns the fences the vehicle was inside at its latest report, sorted by
+// name.
+func (t *Tracker) Inside(vehicleId string) []*Fence {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if state := t.vehicles[vehicleId]; state != nil {
+		return append([]*Fence(nil), state.inside...)
+	}
+	return nil
+}
+
+// Returns the ids (sorted) of the vehicles inside the named fence at their
+// latest report; e.g. the buses in a garage.
+func (t *Tracker) VehiclesInside(name string) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var result []string
+	for id, state := range t.vehicles {
+		for _, f := range state.inside {
+			if f.Name == name {
+				result = append(result, id)
+				break
+			}
+		}
+	}
+	sort.Strings(result)
+	return result
+}
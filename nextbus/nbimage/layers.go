@@ -0,0 +1,102 @@
+package nbimage
+
+// Support for drawing NextBus objects (paths, stops and vehicle tracks).
+
+import (
+	"image/color"
+	"sort"
+
+	"github.com/jamessynge/transit_tools/geo"
+	"github.com/jamessynge/transit_tools/geom"
+	"github.com/jamessynge/transit_tools/nextbus"
+)
+
+// NewImageForAgency returns an Image covering all of the agency's paths,
+// plus a margin, no larger than maxWidth x maxHeight pixels. Returns nil if
+// the agency has no paths.
+func NewImageForAgency(agency *nextbus.Agency, margin geo.Meters,
+	maxWidth, maxHeight int) *Image {
+	min, max, ok := agency.GetPathBounds()
+	if !ok {
+		return nil
+	}
+	region := geo.Rect{South: min.Lat, North: max.Lat, West: min.Lon, East: max.Lon}
+	if margin > 0 {
+		region = region.Expand(margin)
+	}
+	return NewImageForRegion(region, maxWidth, maxHeight)
+}
+
+// PathToPoints returns the waypoints of path in the metric plane of the image.
+func (p *Image) PathToPoints(path *nextbus.Path) []geom.Point {
+	result := make([]geom.Point, len(path.WayPoints))
+	for i, loc := range path.WayPoints {
+		result[i] = p.Transform.ToPoint(loc.Location)
+	}
+	return result
+}
+
+// AddPath adds a line through the waypoints of path.
+func (p *Image) AddPath(path *nextbus.Path, c color.Color, width int) {
+	p.AddPolyline(p.PathToPoints(path), c, width)
+}
+
+// AddPaths adds each of the paths, in order of path index (so that the output
+// is the same each time).
+func (p *Image) AddPaths(paths []*nextbus.Path, c color.Color, width int) {
+	paths = append([]*nextbus.Path(nil), paths...)
+	sort.Sort(nextbus.PathsSlice(paths))
+	for _, path := range paths {
+		p.AddPath(path, c, width)
+	}
+}
+
+// AddStops adds a marker at the location of each stop of the agency.
+func (p *Image) AddStops(agency *nextbus.Agency, c color.Color, radius int) {
+	tags := make([]string, 0, len(agency.Stops))
+	for tag, stop := range agency.Stops {
+		if stop.Location != nil {
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+	for _, tag := range tags {
+		p.AddLocationMarker(agency.Stops[tag].Location.Location, c, radius)
+	}
+}
+
+// AddVehicleTrack adds a line through a time ordered sequence of reports for a
+// vehicle, with a small marker at each report.
+func (p *Image) AddVehicleTrack(
+	track []*nextbus.VehicleLocation, c color.Color, width int) {
+	points := make([]geom.Point, len(track))
+	for i, vl := range track {
+		points[i] = p.Transform.ToPoint(vl.Location)
+	}
+	p.AddPolyline(points, c, width)
+	for _, pt := range points {
+		p.AddMarker(pt, c, width+1)
+	}
+}
+
+// AddGeoRects adds the outlines of the regions (e.g. the leaf partitions of
+// the vehicle locations).
+func (p *Image) AddGeoRects(regions []geo.Rect, c color.Color) {
+	for _, r := range regions {
+		p.AddGeoRect(r, c)
+	}
+}
+
+// AddVehicleLocationDensity adds a layer showing the density of the reports,
+// in shades of c.
+func (p *Image) AddVehicleLocationDensity(
+	vls []*nextbus.VehicleLocation, c color.Color) {
+	hist := p.NewHist2D()
+	for _, vl := range vls {
+		pt := p.Transform.ToPoint(vl.Location)
+		if p.DataBounds.ContainsPoint(pt) {
+			hist.IncrementPt(pt)
+		}
+	}
+	p.AddHist2D(hist, HistEqualizedColors(hist, c))
+}
@@ -1,7 +1,503 @@
+// Package nbimage renders agency paths, stops, partition regions, densities of
+// vehicle locations and individual vehicle tracks onto raster (PNG) and vector
+// (SVG) images. Nothing is fetched from the network (i.e. there are no map
+// tiles), so the images can be produced on an air-gapped machine.
+//
+// Drawing happens in a conformal metric projection (see
+// geogeom.MakeLocalTransverseMercator), so that a meter is the same number of
+// pixels in both directions. Items are recorded as they are added, and only
+// rendered when the image is written, which allows the same Image to be
+// written both as PNG and as SVG.
 package nbimage
 
-import ()
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+
+	"github.com/jamessynge/transit_tools/geo"
+	"github.com/jamessynge/transit_tools/geo/geogeom"
+	"github.com/jamessynge/transit_tools/geom"
+)
+
+// Largest width or height (in pixels) we're willing to produce.
+const kMaxImageSide = 16384
 
 // Represents an area on the map, collects data drawn on that area.
 type Image struct {
+	// Transform from geographic coordinates to the metric plane.
+	Transform geogeom.CoordTransform
+	// Region of the metric plane covered by the image.
+	DataBounds geom.Rect
+	// Pixels per meter.
+	Scale float64
+	// Size of the image in pixels.
+	Width, Height int
+	// Color to fill the image with before drawing; if nil the background is
+	// transparent.
+	Background color.Color
+	// Draw a scale bar in the lower left corner?
+	ShowScaleBar bool
+
+	ops    []drawOp
+	legend []LegendEntry
+}
+
+// An entry in the legend, drawn in the upper left corner of the image.
+type LegendEntry struct {
+	Label string
+	Color color.Color
+}
+
+// NewImage returns an Image covering dataBounds (in the metric plane produced
+// by xf), with scale pixels per meter. If scale is <= 0, a scale is chosen so
+// that the longer side of the image is 4096 pixels or less, but with no more
+// than 1 pixel per meter.
+func NewImage(xf geogeom.CoordTransform, dataBounds geom.Rect, scale float64) *Image {
+	if scale <= 0 {
+		maxSide := math.Max(dataBounds.Width(), dataBounds.Height())
+		scale = 1.0
+		maxPixels := 4096.0
+		if maxSide > maxPixels {
+			scale = maxPixels / maxSide
+		}
+	}
+	width := int(math.Ceil(dataBounds.Width() * scale))
+	height := int(math.Ceil(dataBounds.Height() * scale))
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+	if width > kMaxImageSide || height > kMaxImageSide {
+		glog.Warningf("Image is very large: %d x %d pixels", width, height)
+	}
+	glog.V(1).Infof("NewImage: bounds %s, scale %v, %d x %d pixels",
+		dataBounds, scale, width, height)
+	return &Image{
+		Transform:    xf,
+		DataBounds:   dataBounds,
+		Scale:        scale,
+		Width:        width,
+		Height:       height,
+		Background:   color.White,
+		ShowScaleBar: true,
+	}
+}
+
+// NewImageForRegion returns an Image covering the geographic region, using
+// a metric projection centered on the region, and a scale chosen so that
+// the image is no larger than maxWidth x maxHeight pixels.
+func NewImageForRegion(region geo.Rect, maxWidth, maxHeight int) *Image {
+	region.Normalize()
+	xf := geogeom.MakeLocalTransverseMercator(region.Center())
+	bounds := geoRectToBounds(xf, region)
+	scale := 0.0
+	if maxWidth > 0 && maxHeight > 0 && bounds.Width() > 0 && bounds.Height() > 0 {
+		scale = math.Min(float64(maxWidth)/bounds.Width(),
+			float64(maxHeight)/bounds.Height())
+	}
+	return NewImage(xf, bounds, scale)
+}
+
+// Bounds (in the metric plane) of the four corners of the region.
+func geoRectToBounds(xf geogeom.CoordTransform, r geo.Rect) geom.Rect {
+	corners := []geom.Point{
+		xf.ToPoint(geo.Location{Lat: r.South, Lon: r.West}),
+		xf.ToPoint(geo.Location{Lat: r.South, Lon: r.East}),
+		xf.ToPoint(geo.Location{Lat: r.North, Lon: r.West}),
+		xf.ToPoint(geo.Location{Lat: r.North, Lon: r.East}),
+	}
+	return geom.PointsBounds(corners)
+}
+
+// ToPixel maps a point in the metric plane to image coordinates (x to the
+// right, y down).
+func (p *Image) ToPixel(pt geom.Point) (x, y float64) {
+	x = (pt.X - p.DataBounds.MinX) * p.Scale
+	y = (p.DataBounds.MaxY - pt.Y) * p.Scale
+	return
+}
+
+func (p *Image) toIntPixel(pt geom.Point) (x, y int) {
+	fx, fy := p.ToPixel(pt)
+	return int(math.Floor(fx)), int(math.Floor(fy))
+}
+
+// LocationToPoint maps a geographic location to the metric plane of the image.
+func (p *Image) LocationToPoint(loc geo.Location) geom.Point {
+	return p.Transform.ToPoint(loc)
+}
+
+// AddPolyline adds a line through the points, which are in the metric plane.
+// width is in pixels.
+func (p *Image) AddPolyline(points []geom.Point, c color.Color, width int) {
+	if len(points) < 2 {
+		return
+	}
+	p.ops = append(p.ops, &polylineOp{
+		points: append([]geom.Point(nil), points...),
+		color:  c,
+		width:  width,
+	})
+}
+
+// AddLocations adds a line through the geographic locations.
+func (p *Image) AddLocations(locations []geo.Location, c color.Color, width int) {
+	points := geogeom.LocationsCollectionToPoints(
+		len(locations),
+		func(index int) geo.Location { return locations[index] },
+		p.Transform)
+	p.AddPolyline(points, c, width)
+}
+
+// AddRect adds the outline of a rectangle in the metric plane.
+func (p *Image) AddRect(r geom.Rect, c color.Color) {
+	p.ops = append(p.ops, &rectOp{rect: r, color: c})
+}
+
+// AddGeoRect adds the outline of a geographic region (e.g. a partition of
+// the vehicle locations); the outline is the bounding box of the projected
+// corners of the region.
+func (p *Image) AddGeoRect(r geo.Rect, c color.Color) {
+	p.AddRect(geoRectToBounds(p.Transform, r), c)
+}
+
+// AddMarker adds a filled circle (radius in pixels) centered at pt.
+func (p *Image) AddMarker(pt geom.Point, c color.Color, radius int) {
+	p.ops = append(p.ops, &markerOp{pt: pt, color: c, radius: radius})
+}
+
+// AddLocationMarker adds a filled circle centered at the geographic location.
+func (p *Image) AddLocationMarker(loc geo.Location, c color.Color, radius int) {
+	p.AddMarker(p.LocationToPoint(loc), c, radius)
+}
+
+// NewHist2D returns a histogram covering the same region as the image, with
+// a bucket per pixel, ready to be filled and then passed to AddHist2D.
+func (p *Image) NewHist2D() *geom.Hist2D {
+	return geom.NewHist2D(p.DataBounds, p.Width, p.Height)
+}
+
+// AddHist2D adds a layer with the densities in hist, using toColor to map
+// a count to a color (e.g. HistEqualizedColors). Buckets that map to a
+// transparent color leave the items drawn earlier visible.
+func (p *Image) AddHist2D(
+	hist *geom.Hist2D, toColor func(v geom.HistCount) color.Color) {
+	layer := image.NewNRGBA(image.Rect(0, 0, p.Width, p.Height))
+	for y := 0; y < p.Height; y++ {
+		dataY := p.DataBounds.MaxY - (float64(y)+0.5)/p.Scale
+		row := hist.YToRow(dataY)
+		if row < 0 || row >= hist.BucketHeight {
+			continue
+		}
+		rowSlice := hist.Data[row]
+		for x := 0; x < p.Width; x++ {
+			dataX := p.DataBounds.MinX + (float64(x)+0.5)/p.Scale
+			column := hist.XToColumn(dataX)
+			if column < 0 || column >= hist.BucketWidth {
+				continue
+			}
+			layer.Set(x, y, toColor(rowSlice[column]))
+		}
+	}
+	p.ops = append(p.ops, &layerOp{layer})
+}
+
+// HistEqualizedColors returns a function mapping the counts in hist to
+// shades of c, using histogram equalization so that the full range of
+// shades is used, no matter how skewed the distribution of counts. The
+// lowest count (usually zero) maps to transparent.
+func HistEqualizedColors(
+	hist *geom.Hist2D, c color.Color) func(v geom.HistCount) color.Color {
+	counts, cdf := hist.CountsAndCDF()
+	if glog.V(1) {
+		geom.LogHistogramAndCDF(counts, cdf)
+	}
+	base := color.NRGBAModel.Convert(c).(color.NRGBA)
+	i2c := make(map[geom.HistCount]color.Color)
+	if len(cdf) > 0 {
+		cdfMin := cdf[0].Count
+		cdfMax := cdf[len(cdf)-1].Count
+		denom := float64(cdfMax - cdfMin)
+		for _, ic := range cdf {
+			var result color.NRGBA
+			numer := float64(ic.Count - cdfMin)
+			if numer > 0 {
+				hv := int(math.Floor(numer/denom*255 + 0.5))
+				if hv > 255 {
+					hv = 255
+				}
+				result = base
+				result.A = uint8(hv)
+			}
+			i2c[ic.Intensity] = result
+		}
+	}
+	return func(v geom.HistCount) color.Color {
+		if c, ok := i2c[v]; ok {
+			return c
+		}
+		return color.Transparent
+	}
+}
+
+// AddLegend adds an entry to the legend.
+func (p *Image) AddLegend(label string, c color.Color) {
+	p.legend = append(p.legend, LegendEntry{Label: label, Color: c})
+}
+
+// ToImage renders the items added so far into a new raster image.
+func (p *Image) ToImage() *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, p.Width, p.Height))
+	if p.Background != nil {
+		draw.Draw(img, img.Bounds(), image.NewUniform(p.Background),
+			image.ZP, draw.Src)
+	}
+	for _, op := range p.ops {
+		op.drawRaster(img, p)
+	}
+	p.drawRasterDecorations(img)
+	return img
+}
+
+// WritePNG renders the image and writes it to w in PNG format.
+func (p *Image) WritePNG(w io.Writer) error {
+	return png.Encode(w, p.ToImage())
+}
+
+// SaveToFile writes the image to filePath, as SVG if the file has the
+// extension .svg, else as PNG.
+func (p *Image) SaveToFile(filePath string) error {
+	if len(filePath) == 0 {
+		return fmt.Errorf("No output file specified")
+	}
+	if dir := filepath.Dir(filePath); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	f, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	if strings.ToLower(filepath.Ext(filePath)) == ".svg" {
+		err = p.WriteSVG(f)
+	} else {
+		err = p.WritePNG(f)
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		glog.Infof("Wrote image to %s", filePath)
+	}
+	return err
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Items added to an Image, rendered when the image is written.
+type drawOp interface {
+	drawRaster(img *image.NRGBA, p *Image)
+	drawSVG(w *svgWriter, p *Image)
+}
+
+type polylineOp struct {
+	points []geom.Point
+	color  color.Color
+	width  int
+}
+
+func (op *polylineOp) drawRaster(img *image.NRGBA, p *Image) {
+	lastX, lastY := p.toIntPixel(op.points[0])
+	for n := 1; n < len(op.points); n++ {
+		x, y := p.toIntPixel(op.points[n])
+		DrawThickLine(img, lastX, lastY, x, y, op.width, op.color)
+		lastX, lastY = x, y
+	}
+}
+
+func (op *polylineOp) drawSVG(w *svgWriter, p *Image) {
+	w.polyline(p, op.points, op.color, op.width)
+}
+
+type rectOp struct {
+	rect  geom.Rect
+	color color.Color
+}
+
+func (op *rectOp) drawRaster(img *image.NRGBA, p *Image) {
+	x0, y0 := p.toIntPixel(geom.Point{X: op.rect.MinX, Y: op.rect.MaxY})
+	x1, y1 := p.toIntPixel(geom.Point{X: op.rect.MaxX, Y: op.rect.MinY})
+	DrawRectangle(img, x0, y0, x1, y1, op.color)
+}
+
+func (op *rectOp) drawSVG(w *svgWriter, p *Image) {
+	x0, y0 := p.ToPixel(geom.Point{X: op.rect.MinX, Y: op.rect.MaxY})
+	x1, y1 := p.ToPixel(geom.Point{X: op.rect.MaxX, Y: op.rect.MinY})
+	w.rect(x0, y0, x1-x0, y1-y0, op.color, nil)
+}
+
+type markerOp struct {
+	pt     geom.Point
+	color  color.Color
+	radius int
+}
+
+func (op *markerOp) drawRaster(img *image.NRGBA, p *Image) {
+	x, y := p.toIntPixel(op.pt)
+	FillDisc(img, x, y, op.radius, op.color)
+}
+
+func (op *markerOp) drawSVG(w *svgWriter, p *Image) {
+	x, y := p.ToPixel(op.pt)
+	w.circle(x, y, float64(op.radius), op.color)
+}
+
+type layerOp struct {
+	layer *image.NRGBA
+}
+
+func (op *layerOp) drawRaster(img *image.NRGBA, p *Image) {
+	draw.Draw(img, img.Bounds(), op.layer, image.ZP, draw.Over)
+}
+
+func (op *layerOp) drawSVG(w *svgWriter, p *Image) {
+	w.image(op.layer)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Legend and scale bar.
+
+const (
+	kDecorationMargin = 8
+	kLegendRowHeight  = kGlyphHeight + 6
+	kSwatchWidth      = 12
+)
+
+var (
+	decorationBackground = color.NRGBA{255, 255, 255, 224}
+	decorationForeground = color.NRGBA{0, 0, 0, 255}
+)
+
+// Size of the legend box, in pixels.
+func (p *Image) legendSize() (width, height int) {
+	if len(p.legend) == 0 {
+		return
+	}
+	maxText := 0
+	for _, entry := range p.legend {
+		if w := TextWidth(entry.Label); w > maxText {
+			maxText = w
+		}
+	}
+	width = 4 + kSwatchWidth + 4 + maxText + 4
+	height = 4 + len(p.legend)*kLegendRowHeight
+	return
+}
+
+// NiceScaleBarLength returns the largest length (meters) no greater than
+// maxMeters that is 1, 2 or 5 times a power of 10.
+func NiceScaleBarLength(maxMeters float64) float64 {
+	if maxMeters <= 0 {
+		return 0
+	}
+	pow := math.Pow(10, math.Floor(math.Log10(maxMeters)))
+	for _, m := range []float64{5, 2, 1} {
+		if m*pow <= maxMeters {
+			return m * pow
+		}
+	}
+	return pow
+}
+
+// FormatMeters formats a distance for display on a scale bar.
+func FormatMeters(meters float64) string {
+	if meters >= 1000 {
+		return fmt.Sprintf("%g km", meters/1000)
+	}
+	return fmt.Sprintf("%g m", meters)
+}
+
+// Length (in meters and pixels) of the scale bar; the bar is no longer than
+// a quarter of the image width.
+func (p *Image) scaleBarSize() (meters float64, pixels int) {
+	if !p.ShowScaleBar || p.Scale <= 0 {
+		return
+	}
+	meters = NiceScaleBarLength(float64(p.Width) / 4 / p.Scale)
+	pixels = int(meters*p.Scale + 0.5)
+	if pixels < 2 {
+		return 0, 0
+	}
+	return
+}
+
+func (p *Image) drawRasterDecorations(img *image.NRGBA) {
+	if w, h := p.legendSize(); w > 0 {
+		x0, y0 := kDecorationMargin, kDecorationMargin
+		FillRectangle(img, x0, y0, x0+w, y0+h, decorationBackground)
+		DrawRectangle(img, x0, y0, x0+w, y0+h, decorationForeground)
+		for n, entry := range p.legend {
+			y := y0 + 4 + n*kLegendRowHeight
+			FillRectangle(img, x0+4, y, x0+4+kSwatchWidth, y+kGlyphHeight, entry.Color)
+			DrawText(img, x0+4+kSwatchWidth+4, y, entry.Label, decorationForeground)
+		}
+	}
+	if meters, pixels := p.scaleBarSize(); pixels > 0 {
+		label := FormatMeters(meters)
+		x0 := kDecorationMargin
+		y1 := p.Height - kDecorationMargin
+		y0 := y1 - kGlyphHeight - 10
+		boxWidth := pixels
+		if tw := TextWidth(label); tw > boxWidth {
+			boxWidth = tw
+		}
+		FillRectangle(img, x0, y0, x0+boxWidth+8, y1, decorationBackground)
+		DrawText(img, x0+4, y0+2, label, decorationForeground)
+		barY := y1 - 4
+		DrawThickLine(img, x0+4, barY, x0+4+pixels, barY, 2, decorationForeground)
+		DrawThickLine(img, x0+4, barY-3, x0+4, barY, 1, decorationForeground)
+		DrawThickLine(img, x0+4+pixels, barY-3, x0+4+pixels, barY, 1,
+			decorationForeground)
+	}
+}
+
+func (p *Image) drawSVGDecorations(w *svgWriter) {
+	if width, height := p.legendSize(); width > 0 {
+		x0, y0 := float64(kDecorationMargin), float64(kDecorationMargin)
+		w.rect(x0, y0, float64(width), float64(height),
+			decorationForeground, decorationBackground)
+		for n, entry := range p.legend {
+			y := y0 + 4 + float64(n*kLegendRowHeight)
+			w.rect(x0+4, y, kSwatchWidth, kGlyphHeight, nil, entry.Color)
+			w.text(x0+4+kSwatchWidth+4, y+kGlyphHeight, entry.Label,
+				decorationForeground)
+		}
+	}
+	if meters, pixels := p.scaleBarSize(); pixels > 0 {
+		label := FormatMeters(meters)
+		x0 := float64(kDecorationMargin)
+		y1 := float64(p.Height - kDecorationMargin)
+		y0 := y1 - kGlyphHeight - 10
+		boxWidth := math.Max(float64(pixels), float64(TextWidth(label)))
+		w.rect(x0, y0, boxWidth+8, y1-y0, nil, decorationBackground)
+		w.text(x0+4, y0+2+kGlyphHeight, label, decorationForeground)
+		barY := y1 - 4
+		left, right := x0+4, x0+4+float64(pixels)
+		w.line(left, barY, right, barY, decorationForeground, 2)
+		w.line(left, barY-3, left, barY, decorationForeground, 1)
+		w.line(right, barY-3, right, barY, decorationForeground, 1)
+	}
 }
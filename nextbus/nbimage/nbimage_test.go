@@ -0,0 +1,135 @@
+package nbimage
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+	"testing"
+
+	"github.com/jamessynge/transit_tools/geo"
+	"github.com/jamessynge/transit_tools/geo/geogeom"
+	"github.com/jamessynge/transit_tools/geom"
+)
+
+func TestBresenhamLineEndpoints(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 10, 10))
+	c := color.NRGBA{255, 0, 0, 255}
+	BresenhamLine(img, 1, 2, 8, 6, c)
+	for _, pt := range []image.Point{{1, 2}, {8, 6}} {
+		if img.NRGBAAt(pt.X, pt.Y) != c {
+			t.Errorf("Pixel %v not set", pt)
+		}
+	}
+	count := 0
+	for y := 0; y < 10; y++ {
+		for x := 0; x < 10; x++ {
+			if img.NRGBAAt(x, y) == c {
+				count++
+			}
+		}
+	}
+	// One pixel per column for a shallow line.
+	if count != 8 {
+		t.Errorf("Expected 8 pixels set, not %d", count)
+	}
+}
+
+func TestNiceScaleBarLength(t *testing.T) {
+	tests := []struct {
+		max, expected float64
+	}{
+		{0, 0},
+		{1, 1},
+		{1.9, 1},
+		{2.5, 2},
+		{9, 5},
+		{730, 500},
+		{1999, 1000},
+		{24000, 20000},
+	}
+	for _, test := range tests {
+		actual := NiceScaleBarLength(test.max)
+		if actual != test.expected {
+			t.Errorf("NiceScaleBarLength(%v) = %v, expected %v",
+				test.max, actual, test.expected)
+		}
+	}
+	if s := FormatMeters(500); s != "500 m" {
+		t.Errorf("FormatMeters(500) = %q", s)
+	}
+	if s := FormatMeters(2000); s != "2 km" {
+		t.Errorf("FormatMeters(2000) = %q", s)
+	}
+}
+
+func makeTestImage() *Image {
+	xf := geogeom.MakeMetricCoordTransform(geo.Location{Lat: 42.35, Lon: -71.06})
+	bounds := geom.NewRect(-500, 500, -250, 250)
+	p := NewImage(xf, bounds, 0.5)
+	p.AddPolyline([]geom.Point{{X: -400, Y: 0}, {X: 0, Y: 100}, {X: 400, Y: 0}},
+		color.NRGBA{0, 0, 255, 255}, 2)
+	p.AddRect(geom.NewRect(-100, 100, -100, 100), color.NRGBA{0, 128, 0, 255})
+	p.AddMarker(geom.Point{X: 0, Y: 0}, color.NRGBA{255, 0, 0, 255}, 3)
+	hist := p.NewHist2D()
+	for i := 0; i < 10; i++ {
+		hist.IncrementPt(geom.Point{X: 200, Y: -200})
+	}
+	p.AddHist2D(hist, HistEqualizedColors(hist, color.NRGBA{255, 0, 255, 255}))
+	p.AddLegend("Path 1", color.NRGBA{0, 0, 255, 255})
+	return p
+}
+
+func TestImageToPNG(t *testing.T) {
+	p := makeTestImage()
+	if p.Width != 500 || p.Height != 250 {
+		t.Fatalf("Wrong size: %d x %d", p.Width, p.Height)
+	}
+	var buf bytes.Buffer
+	if err := p.WritePNG(&buf); err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds().Dx() != 500 || img.Bounds().Dy() != 250 {
+		t.Errorf("Wrong decoded size: %v", img.Bounds())
+	}
+	// The marker at the origin is in the center of the image.
+	r, g, b, _ := img.At(250, 125).RGBA()
+	if r != 0xffff || g != 0 || b != 0 {
+		t.Errorf("Expected red at the center, not %v", img.At(250, 125))
+	}
+	// The density layer is at (200, -200) => pixel (350, 224).
+	r, g, b, _ = img.At(350, 224).RGBA()
+	if r != 0xffff || g != 0 || b != 0xffff {
+		t.Errorf("Expected magenta at the density, not %v", img.At(350, 224))
+	}
+}
+
+func TestImageToSVG(t *testing.T) {
+	p := makeTestImage()
+	var buf bytes.Buffer
+	if err := p.WriteSVG(&buf); err != nil {
+		t.Fatal(err)
+	}
+	s := buf.String()
+	for _, want := range []string{
+		`<svg xmlns="http://www.w3.org/2000/svg"`,
+		`width="500" height="250"`,
+		`<polyline fill="none" stroke="#0000ff" stroke-width="2"`,
+		`points="50.0,125.0 250.0,75.0 450.0,125.0"`,
+		`<rect x="200.0" y="75.0" width="100.0" height="100.0" stroke="#008000"`,
+		`<circle cx="250.0" cy="125.0" r="3.0"`,
+		`xlink:href="data:image/png;base64,`,
+		`>Path 1</text>`,
+		`>200 m</text>`,
+		"</svg>",
+	} {
+		if !strings.Contains(s, want) {
+			t.Errorf("SVG is missing %q", want)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package nbimage
+
+// Simple drawing primitives for raster images.
+
+import (
+	"image"
+	"image/color"
+)
+
+// The subset of the draw.Image interface needed by the functions below.
+type Drawable interface {
+	At(x, y int) color.Color
+	Bounds() image.Rectangle
+	ColorModel() color.Model
+	Set(x, y int, c color.Color)
+}
+
+// Calls fn for each pixel on the line from [x0, y0] to [x1, y1] (inclusive).
+// From rosettacode, implemented straight from the Wikipedia pseudocode.
+func visitLinePixels(x0, y0, x1, y1 int, fn func(x, y int)) {
+	dx := x1 - x0
+	if dx < 0 {
+		dx = -dx
+	}
+	dy := y1 - y0
+	if dy < 0 {
+		dy = -dy
+	}
+	var sx, sy int
+	if x0 < x1 {
+		sx = 1
+	} else {
+		sx = -1
+	}
+	if y0 < y1 {
+		sy = 1
+	} else {
+		sy = -1
+	}
+	err := dx - dy
+
+	for {
+		fn(x0, y0)
+		if x0 == x1 && y0 == y1 {
+			break
+		}
+		e2 := 2 * err
+		if e2 > -dy {
+			err -= dy
+			x0 += sx
+		}
+		if e2 < dx {
+			err += dx
+			y0 += sy
+		}
+	}
+}
+
+// BresenhamLine draws a one pixel wide line from [x0, y0] to [x1, y1].
+func BresenhamLine(img Drawable, x0, y0, x1, y1 int, c color.Color) {
+	visitLinePixels(x0, y0, x1, y1, func(x, y int) { img.Set(x, y, c) })
+}
+
+// DrawThickLine draws a line width pixels wide from [x0, y0] to [x1, y1].
+func DrawThickLine(img Drawable, x0, y0, x1, y1, width int, c color.Color) {
+	if width <= 1 {
+		BresenhamLine(img, x0, y0, x1, y1, c)
+		return
+	}
+	radius := width / 2
+	visitLinePixels(x0, y0, x1, y1, func(x, y int) {
+		FillDisc(img, x, y, radius, c)
+	})
+}
+
+// DrawRectangle draws the outline of the rectangle with corners [x0, y0]
+// and [x1, y1].
+func DrawRectangle(img Drawable, x0, y0, x1, y1 int, c color.Color) {
+	if x0 > x1 {
+		x0, x1 = x1, x0
+	}
+	if y0 > y1 {
+		y0, y1 = y1, y0
+	}
+	for x := x0; x <= x1; x++ {
+		img.Set(x, y0, c)
+		img.Set(x, y1, c)
+	}
+	for y := y0 + 1; y < y1; y++ {
+		img.Set(x0, y, c)
+		img.Set(x1, y, c)
+	}
+}
+
+// FillRectangle fills the rectangle with corners [x0, y0] and [x1, y1],
+// blending c with the existing contents if c isn't opaque.
+func FillRectangle(img Drawable, x0, y0, x1, y1 int, c color.Color) {
+	if x0 > x1 {
+		x0, x1 = x1, x0
+	}
+	if y0 > y1 {
+		y0, y1 = y1, y0
+	}
+	for y := y0; y <= y1; y++ {
+		for x := x0; x <= x1; x++ {
+			blend(img, x, y, c)
+		}
+	}
+}
+
+// FillDisc fills the circle of the given radius centered at [cx, cy].
+func FillDisc(img Drawable, cx, cy, radius int, c color.Color) {
+	if radius <= 0 {
+		img.Set(cx, cy, c)
+		return
+	}
+	r2 := radius * radius
+	for dy := -radius; dy <= radius; dy++ {
+		for dx := -radius; dx <= radius; dx++ {
+			if dx*dx+dy*dy <= r2 {
+				img.Set(cx+dx, cy+dy, c)
+			}
+		}
+	}
+}
+
+// Sets the pixel at [x, y] to c drawn over the existing color.
+func blend(img Drawable, x, y int, c color.Color) {
+	if !(image.Point{x, y}).In(img.Bounds()) {
+		return
+	}
+	sr, sg, sb, sa := c.RGBA()
+	if sa == 0xffff {
+		img.Set(x, y, c)
+		return
+	} else if sa == 0 {
+		return
+	}
+	dr, dg, db, da := img.At(x, y).RGBA()
+	// Porter-Duff "over", with alpha-premultiplied 16-bit components.
+	a := 0xffff - sa
+	img.Set(x, y, color.RGBA64{
+		R: uint16(sr + dr*a/0xffff),
+		G: uint16(sg + dg*a/0xffff),
+		B: uint16(sb + db*a/0xffff),
+		A: uint16(sa + da*a/0xffff),
+	})
+}
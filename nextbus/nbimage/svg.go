@@ -0,0 +1,146 @@
+package nbimage
+
+// Support for writing an Image as SVG. Density layers are embedded as PNG
+// data URIs, so the SVG file is self-contained.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+
+	"github.com/jamessynge/transit_tools/geom"
+)
+
+type svgWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (w *svgWriter) printf(format string, args ...interface{}) {
+	if w.err != nil {
+		return
+	}
+	_, w.err = fmt.Fprintf(w.w, format, args...)
+}
+
+// Returns the SVG paint and opacity for c; nil is "none".
+func svgPaint(c color.Color) (paint string, opacity float64) {
+	if c == nil {
+		return "none", 1
+	}
+	nc := color.NRGBAModel.Convert(c).(color.NRGBA)
+	if nc.A == 0 {
+		return "none", 1
+	}
+	return fmt.Sprintf("#%02x%02x%02x", nc.R, nc.G, nc.B), float64(nc.A) / 255
+}
+
+func (w *svgWriter) strokeAttrs(c color.Color, width int) string {
+	paint, opacity := svgPaint(c)
+	if width < 1 {
+		width = 1
+	}
+	s := fmt.Sprintf(`stroke="%s" stroke-width="%d"`, paint, width)
+	if opacity < 1 {
+		s += fmt.Sprintf(` stroke-opacity="%.3f"`, opacity)
+	}
+	return s
+}
+
+func (w *svgWriter) fillAttrs(c color.Color) string {
+	paint, opacity := svgPaint(c)
+	s := fmt.Sprintf(`fill="%s"`, paint)
+	if opacity < 1 {
+		s += fmt.Sprintf(` fill-opacity="%.3f"`, opacity)
+	}
+	return s
+}
+
+func (w *svgWriter) polyline(
+	p *Image, points []geom.Point, c color.Color, width int) {
+	w.printf(`<polyline fill="none" %s stroke-linejoin="round" points="`,
+		w.strokeAttrs(c, width))
+	for n, pt := range points {
+		x, y := p.ToPixel(pt)
+		if n > 0 {
+			w.printf(" ")
+		}
+		w.printf("%.1f,%.1f", x, y)
+	}
+	w.printf("\"/>\n")
+}
+
+func (w *svgWriter) line(x0, y0, x1, y1 float64, c color.Color, width int) {
+	w.printf(`<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" %s/>`+"\n",
+		x0, y0, x1, y1, w.strokeAttrs(c, width))
+}
+
+func (w *svgWriter) rect(x, y, width, height float64, stroke, fill color.Color) {
+	strokeAttrs := `stroke="none"`
+	if stroke != nil {
+		strokeAttrs = w.strokeAttrs(stroke, 1)
+	}
+	w.printf(`<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" %s %s/>`+"\n",
+		x, y, width, height, strokeAttrs, w.fillAttrs(fill))
+}
+
+func (w *svgWriter) circle(x, y, radius float64, c color.Color) {
+	if radius < 1 {
+		radius = 1
+	}
+	w.printf(`<circle cx="%.1f" cy="%.1f" r="%.1f" stroke="none" %s/>`+"\n",
+		x, y, radius, w.fillAttrs(c))
+}
+
+// y is the baseline of the text.
+func (w *svgWriter) text(x, y float64, s string, c color.Color) {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	w.printf(`<text x="%.1f" y="%.1f" font-family="monospace" font-size="%d" %s>%s</text>`+"\n",
+		x, y, kGlyphHeight+2, w.fillAttrs(c), buf.String())
+}
+
+func (w *svgWriter) image(img image.Image) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		if w.err == nil {
+			w.err = err
+		}
+		return
+	}
+	b := img.Bounds()
+	w.printf(`<image x="%d" y="%d" width="%d" height="%d" `+
+		`preserveAspectRatio="none" xlink:href="data:image/png;base64,%s"/>`+"\n",
+		b.Min.X, b.Min.Y, b.Dx(), b.Dy(),
+		base64.StdEncoding.EncodeToString(buf.Bytes()))
+}
+
+// WriteSVG writes the image to out in SVG format. Lines, rectangles and
+// markers are written as vector elements, and density layers as embedded PNG
+// images.
+func (p *Image) WriteSVG(out io.Writer) error {
+	w := &svgWriter{w: bufio.NewWriter(out)}
+	w.printf(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+	w.printf(`<svg xmlns="http://www.w3.org/2000/svg" `+
+		`xmlns:xlink="http://www.w3.org/1999/xlink" `+
+		`width="%d" height="%d" viewBox="0 0 %d %d">`+"\n",
+		p.Width, p.Height, p.Width, p.Height)
+	if p.Background != nil {
+		w.rect(0, 0, float64(p.Width), float64(p.Height), nil, p.Background)
+	}
+	for _, op := range p.ops {
+		op.drawSVG(w, p)
+	}
+	p.drawSVGDecorations(w)
+	w.printf("</svg>\n")
+	if w.err != nil {
+		return w.err
+	}
+	return w.w.Flush()
+}
@@ -0,0 +1,24 @@
+package nblive
+
+import (
+	"github.com/jamessynge/transit_tools/nextbus"
+	"github.com/jamessynge/transit_tools/nextbus/nblocations"
+)
+
+// An aggregator that also inserts the reports into an index.
+type indexingAggregator struct {
+	nblocations.VehicleAggregator
+	index *VehicleIndex
+}
+
+// MakeIndexingAggregator returns an aggregator which passes the reports it
+// is given to both aggregator and index.
+func MakeIndexingAggregator(aggregator nblocations.VehicleAggregator,
+	index *VehicleIndex) nblocations.VehicleAggregator {
+	return &indexingAggregator{aggregator, index}
+}
+
+func (p *indexingAggregator) Insert(locations []*nextbus.VehicleLocation) {
+	p.VehicleAggregator.Insert(locations)
+	p.index.Insert(locations)
+}
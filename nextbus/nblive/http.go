@@ -0,0 +1,198 @@
+package nblive
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/golang/glog"
+
+	"github.com/jamessynge/transit_tools/geo"
+	"github.com/jamessynge/transit_tools/nextbus"
+	"github.com/jamessynge/transit_tools/util"
+)
+
+// The JSON representation of a vehicle in responses.
+type vehicleJson struct {
+	Id        string   `json:"id"`
+	Route     string   `json:"route"`
+	Direction string   `json:"dir"`
+	Time      int64    `json:"time_ms"`
+	Lat       float64  `json:"lat"`
+	Lon       float64  `json:"lon"`
+	Heading   int      `json:"heading"`
+	Meters    *float64 `json:"meters,omitempty"`
+}
+
+func toVehicleJson(vl *nextbus.VehicleLocation) *vehicleJson {
+	return &vehicleJson{
+		Id:        vl.VehicleId,
+		Route:     vl.RouteTag,
+		Direction: vl.DirTag,
+		Time:      util.TimeToUnixMillis(vl.Time),
+		Lat:       float64(vl.Lat),
+		Lon:       float64(vl.Lon),
+		Heading:   int(vl.Heading),
+	}
+}
+
+func toVehicleJsons(vds []VehicleDistance) []*vehicleJson {
+	result := make([]*vehicleJson, len(vds))
+	for i := range vds {
+		result[i] = toVehicleJson(vds[i].Vehicle)
+		result[i].Meters = &vds[i].Meters
+	}
+	return result
+}
+
+// Serves the contents of a VehicleIndex as JSON. Endpoints:
+//
+//	/vehicles                        All vehicles, sorted by id.
+//	/vehicles?south=&north=&west=&east=
+//	                                 Vehicles inside the rectangle.
+//	/vehicles/near?lat=&lon=&meters=
+//	                                 Vehicles within meters of the location,
+//	                                 nearest first.
+//	/vehicles/nearest?lat=&lon=&k=&meters=
+//	/vehicles/nearest?stop=&k=&meters=
+//	                                 The k (default 5) vehicles nearest to
+//	                                 the location or stop (requires Agency),
+//	                                 within meters (default 5000).
+type Handler struct {
+	Index *VehicleIndex
+	// Optional; used to find stops by tag.
+	Agency *nextbus.Agency
+	mux    *http.ServeMux
+}
+
+func NewHandler(index *VehicleIndex, agency *nextbus.Agency) *Handler {
+	p := &Handler{Index: index, Agency: agency, mux: http.NewServeMux()}
+	p.mux.HandleFunc("/vehicles", p.serveVehicles)
+	p.mux.HandleFunc("/vehicles/near", p.serveNear)
+	p.mux.HandleFunc("/vehicles/nearest", p.serveNearest)
+	return p
+}
+
+func (p *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mux.ServeHTTP(w, r)
+}
+
+// Parses the named query parameters; if a parameter is missing, its default
+// value is used, else (if there is no default) an error is returned.
+type queryParser struct {
+	r   *http.Request
+	err error
+}
+
+func (q *queryParser) fail(err error) {
+	if q.err == nil {
+		q.err = err
+	}
+}
+
+func (q *queryParser) float(name string, defaultValue *float64) float64 {
+	s := q.r.FormValue(name)
+	if s == "" {
+		if defaultValue != nil {
+			return *defaultValue
+		}
+		q.fail(fmt.Errorf("Missing parameter: %s", name))
+		return 0
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		q.fail(fmt.Errorf("Invalid %s: %q", name, s))
+	}
+	return v
+}
+
+func (q *queryParser) location() geo.Location {
+	lat := q.float("lat", nil)
+	lon := q.float("lon", nil)
+	if q.err != nil {
+		return geo.Location{}
+	}
+	loc, err := geo.LocationFromFloat64s(lat, lon)
+	if err != nil {
+		q.fail(err)
+	}
+	return loc
+}
+
+func defaultValue(v float64) *float64 {
+	return &v
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(append(data, '\n')); err != nil {
+		glog.Warningf("Error writing response: %v", err)
+	}
+}
+
+func (p *Handler) serveVehicles(w http.ResponseWriter, r *http.Request) {
+	var vls []*nextbus.VehicleLocation
+	if r.FormValue("south") == "" {
+		vls = p.Index.GetAllVehicles()
+	} else {
+		q := &queryParser{r: r}
+		rect := geo.Rect{
+			South: geo.Latitude(q.float("south", nil)),
+			North: geo.Latitude(q.float("north", nil)),
+			West:  geo.Longitude(q.float("west", nil)),
+			East:  geo.Longitude(q.float("east", nil)),
+		}
+		if q.err != nil {
+			http.Error(w, q.err.Error(), http.StatusBadRequest)
+			return
+		}
+		vls = p.Index.InRect(rect)
+	}
+	result := make([]*vehicleJson, len(vls))
+	for i, vl := range vls {
+		result[i] = toVehicleJson(vl)
+	}
+	writeJson(w, result)
+}
+
+func (p *Handler) serveNear(w http.ResponseWriter, r *http.Request) {
+	q := &queryParser{r: r}
+	loc := q.location()
+	meters := q.float("meters", nil)
+	if q.err != nil {
+		http.Error(w, q.err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJson(w, toVehicleJsons(p.Index.WithinDistance(loc, meters)))
+}
+
+func (p *Handler) serveNearest(w http.ResponseWriter, r *http.Request) {
+	q := &queryParser{r: r}
+	k := int(q.float("k", defaultValue(5)))
+	meters := q.float("meters", defaultValue(5000))
+	var loc geo.Location
+	if tag := r.FormValue("stop"); tag != "" {
+		var stop *nextbus.Stop
+		if p.Agency != nil {
+			stop = p.Agency.Stops[tag]
+		}
+		if stop == nil || stop.Location == nil {
+			http.Error(w, fmt.Sprintf("Unknown stop: %q", tag), http.StatusNotFound)
+			return
+		}
+		loc = stop.Location.Location
+	} else {
+		loc = q.location()
+	}
+	if q.err != nil {
+		http.Error(w, q.err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJson(w, toVehicleJsons(p.Index.Nearest(loc, k, meters)))
+}
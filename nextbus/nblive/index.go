@@ -0,0 +1,227 @@
+// Package nblive maintains an in-memory spatial index of the latest position
+// of every vehicle, as reported to a nblocations.VehicleAggregator, for
+// answering questions such as "which vehicles are near this stop?". Positions
+// are indexed in metric coordinates (meters from the center of the index, see
+// geogeom.MakeLocalTransverseMercator), so distances are in meters.
+package nblive
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jamessynge/transit_tools/geo"
+	"github.com/jamessynge/transit_tools/geo/geogeom"
+	"github.com/jamessynge/transit_tools/geom"
+	"github.com/jamessynge/transit_tools/nextbus"
+)
+
+// Vehicles further than this from the center of the index are ignored.
+const DefaultMaxRadiusMeters = 200 * 1000
+
+// A vehicle in the quadtree.
+type indexedVehicle struct {
+	vl *nextbus.VehicleLocation
+	pt geom.Point
+}
+
+func (p *indexedVehicle) IntersectBounds(r geom.Rect) (geom.Rect, bool) {
+	if r.MinX <= p.pt.X && p.pt.X <= r.MaxX && r.MinY <= p.pt.Y && p.pt.Y <= r.MaxY {
+		return geom.Rect{MinX: p.pt.X, MaxX: p.pt.X, MinY: p.pt.Y, MaxY: p.pt.Y}, false
+	}
+	return geom.Rect{}, true
+}
+
+func (p *indexedVehicle) Intersects(r geom.Rect) bool {
+	_, empty := p.IntersectBounds(r)
+	return !empty
+}
+
+func (p *indexedVehicle) UniqueId() interface{} {
+	return p.vl.VehicleId
+}
+
+func vehicleDistance(ib geom.IntersectBounder, pt geom.Point) float64 {
+	return ib.(*indexedVehicle).pt.Distance(pt)
+}
+
+// A vehicle found by a search, with its distance (meters) from the point
+// searched for (zero for rectangle searches).
+type VehicleDistance struct {
+	Vehicle *nextbus.VehicleLocation
+	Meters  float64
+}
+
+// Safe for concurrent use (e.g. updated by the aggregator's goroutine, and
+// queried by HTTP handlers).
+type VehicleIndex struct {
+	mu        sync.RWMutex
+	center    geo.Location
+	maxRadius float64
+	transform geogeom.CoordTransform
+	tree      geom.QuadTree
+	vehicles  map[string]*indexedVehicle
+}
+
+// NewVehicleIndex creates an index centered on center, which should be near
+// the middle of the agency's service area.
+func NewVehicleIndex(center geo.Location) *VehicleIndex {
+	p := &VehicleIndex{
+		center:    center,
+		maxRadius: DefaultMaxRadiusMeters,
+		transform: geogeom.MakeLocalTransverseMercator(center),
+		vehicles:  make(map[string]*indexedVehicle),
+	}
+	r := p.maxRadius
+	p.tree = geom.NewQuadTree(geom.Rect{MinX: -r, MaxX: r, MinY: -r, MaxY: r})
+	return p
+}
+
+func (p *VehicleIndex) Center() geo.Location {
+	return p.center
+}
+
+// Insert updates the positions of the vehicles, ignoring reports older than
+// the vehicle's current report.
+func (p *VehicleIndex) Insert(locations []*nextbus.VehicleLocation) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, vl := range locations {
+		if vl == nil {
+			continue
+		}
+		old := p.vehicles[vl.VehicleId]
+		if old != nil {
+			if vl.Time.Before(old.vl.Time) {
+				continue
+			}
+			p.tree.Remove(old)
+			delete(p.vehicles, vl.VehicleId)
+		}
+		iv := &indexedVehicle{vl: vl, pt: p.transform.ToPoint(vl.Location)}
+		if !p.tree.Bounds().ContainsPoint(iv.pt) {
+			// Outside of the region covered by the index (e.g. a GPS glitch at
+			// 0,0). Checked first because QuadTree.Insert adds the datum even
+			// when it returns an error, and it then couldn't be removed.
+			continue
+		}
+		if p.tree.Insert(iv) != nil {
+			continue
+		}
+		p.vehicles[vl.VehicleId] = iv
+	}
+}
+
+// Expire removes the vehicles whose latest report is before t (e.g. vehicles
+// that have gone out of service); returns the number removed.
+func (p *VehicleIndex) Expire(t time.Time) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	count := 0
+	for id, iv := range p.vehicles {
+		if iv.vl.Time.Before(t) {
+			p.tree.Remove(iv)
+			delete(p.vehicles, id)
+			count++
+		}
+	}
+	return count
+}
+
+func (p *VehicleIndex) Len() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return len(p.vehicles)
+}
+
+// GetVehicle returns the latest report for the vehicle, or nil if unknown.
+func (p *VehicleIndex) GetVehicle(id string) *nextbus.VehicleLocation {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if iv := p.vehicles[id]; iv != nil {
+		return iv.vl
+	}
+	return nil
+}
+
+// GetAllVehicles returns the latest report for every vehicle, sorted by id.
+func (p *VehicleIndex) GetAllVehicles() []*nextbus.VehicleLocation {
+	p.mu.RLock()
+	result := make([]*nextbus.VehicleLocation, 0, len(p.vehicles))
+	for _, iv := range p.vehicles {
+		result = append(result, iv.vl)
+	}
+	p.mu.RUnlock()
+	nextbus.SortVehicleLocationsById(result)
+	return result
+}
+
+// Nearest returns up to k vehicles nearest to loc, and at most maxMeters
+// from it, nearest first.
+func (p *VehicleIndex) Nearest(
+	loc geo.Location, k int, maxMeters float64) []VehicleDistance {
+	pt := p.transform.ToPoint(loc)
+	p.mu.RLock()
+	neighbors := p.tree.Nearest(pt, k, maxMeters, vehicleDistance)
+	p.mu.RUnlock()
+	result := make([]VehicleDistance, len(neighbors))
+	for i, n := range neighbors {
+		result[i] = VehicleDistance{n.Datum.(*indexedVehicle).vl, n.Distance}
+	}
+	return result
+}
+
+// WithinDistance returns the vehicles at most meters from loc, nearest first.
+func (p *VehicleIndex) WithinDistance(
+	loc geo.Location, meters float64) []VehicleDistance {
+	return p.Nearest(loc, p.Len(), meters)
+}
+
+type vehicleCollector struct {
+	r      geo.Rect
+	result []*nextbus.VehicleLocation
+}
+
+func (c *vehicleCollector) Visit(ib geom.IntersectBounder) {
+	vl := ib.(*indexedVehicle).vl
+	if c.r.South <= vl.Lat && vl.Lat <= c.r.North &&
+		c.r.West <= vl.Lon && vl.Lon <= c.r.East {
+		c.result = append(c.result, vl)
+	}
+}
+
+// InRect returns the vehicles inside r, sorted by id.
+func (p *VehicleIndex) InRect(r geo.Rect) []*nextbus.VehicleLocation {
+	r.Normalize()
+	// The projection of r isn't quite a rectangle, so search the bounds of
+	// points around its edge, then check the locations of the vehicles found.
+	var bounds geom.Rect
+	midLat, midLon := (r.South+r.North)/2, (r.West+r.East)/2
+	for i, lat := range []geo.Latitude{r.South, midLat, r.North} {
+		for j, lon := range []geo.Longitude{r.West, midLon, r.East} {
+			pt := p.transform.ToPoint(geo.Location{Lat: lat, Lon: lon})
+			if i == 0 && j == 0 {
+				bounds = geom.Rect{MinX: pt.X, MaxX: pt.X, MinY: pt.Y, MaxY: pt.Y}
+			} else {
+				bounds = bounds.Union(geom.Rect{MinX: pt.X, MaxX: pt.X, MinY: pt.Y, MaxY: pt.Y})
+			}
+		}
+	}
+	// Allow for the curvature of the edges, and make the rectangle non-empty.
+	bounds = bounds.AddBorder(1+bounds.Width()/100, 1+bounds.Height()/100)
+	c := &vehicleCollector{r: r}
+	p.mu.RLock()
+	p.tree.Visit(bounds, c)
+	p.mu.RUnlock()
+	nextbus.SortVehicleLocationsById(c.result)
+	return c.result
+}
+
+// Returns the vehicles nearest to the stop (e.g. for predicting arrivals),
+// or nil if the stop has no location.
+func (p *VehicleIndex) NearestToStop(
+	stop *nextbus.Stop, k int, maxMeters float64) []VehicleDistance {
+	if stop == nil || stop.Location == nil {
+		return nil
+	}
+	return p.Nearest(stop.Location.Location, k, maxMeters)
+}
@@ -0,0 +1,232 @@
+package nblive
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jamessynge/transit_tools/geo"
+	"github.com/jamessynge/transit_tools/geom"
+	"github.com/jamessynge/transit_tools/nextbus"
+	"github.com/jamessynge/transit_tools/nextbus/nblocations"
+)
+
+var center = geo.Location{Lat: 42.358, Lon: -71.064}
+
+// Returns a report for a vehicle north and east of center by the specified
+// number of meters.
+func makeReport(id string, north, east float64, t time.Time) *nextbus.VehicleLocation {
+	loc := center.AtDistanceAndHeading(geo.Meters(north), 0)
+	loc = loc.AtDistanceAndHeading(geo.Meters(east), 90)
+	return &nextbus.VehicleLocation{
+		VehicleId: id,
+		RouteTag:  "1",
+		DirTag:    "1_0_var0",
+		Time:      t,
+		Location:  loc,
+		Heading:   90,
+	}
+}
+
+func vehicleIds(vls []*nextbus.VehicleLocation) string {
+	var ids []string
+	for _, vl := range vls {
+		ids = append(ids, vl.VehicleId)
+	}
+	return fmt.Sprint(ids)
+}
+
+func distanceIds(vds []VehicleDistance) string {
+	var ids []string
+	for _, vd := range vds {
+		ids = append(ids, vd.Vehicle.VehicleId)
+	}
+	return fmt.Sprint(ids)
+}
+
+func makeIndex(t0 time.Time) *VehicleIndex {
+	index := NewVehicleIndex(center)
+	index.Insert([]*nextbus.VehicleLocation{
+		makeReport("a", 0, 100, t0),
+		makeReport("b", 0, -300, t0),
+		makeReport("c", 1000, 0, t0),
+		makeReport("d", -2000, 2000, t0),
+	})
+	return index
+}
+
+func TestVehicleIndexQueries(t *testing.T) {
+	t0 := time.Unix(1400000000, 0)
+	index := makeIndex(t0)
+	if got := vehicleIds(index.GetAllVehicles()); got != "[a b c d]" {
+		t.Errorf("GetAllVehicles() = %s", got)
+	}
+	if got := distanceIds(index.WithinDistance(center, 500)); got != "[a b]" {
+		t.Errorf("WithinDistance(500) = %s", got)
+	}
+	vds := index.Nearest(center, 3, 100000)
+	if got := distanceIds(vds); got != "[a b c]" {
+		t.Errorf("Nearest(3) = %s", got)
+	} else if vds[0].Meters < 95 || vds[0].Meters > 105 {
+		t.Errorf("Distance to a is %v, expected ~100", vds[0].Meters)
+	}
+	r := center.RectCenteredAt(2500, 800)
+	if got := vehicleIds(index.InRect(r)); got != "[a b c]" {
+		t.Errorf("InRect(%s) = %s", r, got)
+	}
+	stop := &nextbus.Stop{Tag: "s", Location: &nextbus.Location{
+		Location: makeReport("", 1000, 10, t0).Location}}
+	if got := distanceIds(index.NearestToStop(stop, 1, 100)); got != "[c]" {
+		t.Errorf("NearestToStop() = %s", got)
+	}
+}
+
+func TestVehicleIndexMoveAndExpire(t *testing.T) {
+	t0 := time.Unix(1400000000, 0)
+	index := makeIndex(t0)
+	t1 := t0.Add(10 * time.Second)
+	// a moves far away, b reports an old location (ignored).
+	index.Insert([]*nextbus.VehicleLocation{
+		makeReport("a", 5000, 5000, t1),
+		makeReport("b", 0, 0, t0.Add(-time.Second)),
+	})
+	if got := distanceIds(index.WithinDistance(center, 500)); got != "[b]" {
+		t.Errorf("WithinDistance(500) after moving = %s", got)
+	}
+	if vl := index.GetVehicle("a"); vl == nil || !vl.Time.Equal(t1) {
+		t.Errorf("GetVehicle(a) = %v", vl)
+	}
+	if n := index.Expire(t1); n != 3 {
+		t.Errorf("Expire() removed %d vehicles, expected 3", n)
+	}
+	if got := vehicleIds(index.GetAllVehicles()); got != "[a]" {
+		t.Errorf("GetAllVehicles() after Expire = %s", got)
+	}
+}
+
+type countingVisitor int
+
+func (p *countingVisitor) Visit(datum geom.IntersectBounder) {
+	*p++
+}
+
+func TestVehicleIndexOutOfRegion(t *testing.T) {
+	index := NewVehicleIndex(center)
+	t0 := time.Unix(1400000000, 0)
+	var vls []*nextbus.VehicleLocation
+	for i := 0; i < 100; i++ {
+		// GPS glitches at 0,0, thousands of kilometers from center.
+		vls = append(vls, &nextbus.VehicleLocation{
+			VehicleId: fmt.Sprint("v", i), Time: t0, Heading: -1})
+	}
+	index.Insert(vls)
+	if n := index.Len(); n != 0 {
+		t.Errorf("Len() = %d, expected 0", n)
+	}
+	var count countingVisitor
+	index.tree.Visit(index.tree.Bounds(), &count)
+	pt := index.transform.ToPoint(geo.Location{})
+	index.tree.Visit(geom.Rect{MinX: pt.X, MaxX: pt.X, MinY: pt.Y, MaxY: pt.Y}, &count)
+	if count != 0 {
+		t.Errorf("Tree has %d entries, expected none", count)
+	}
+	if nearest := index.tree.Nearest(geom.Point{}, 1000, math.Inf(1),
+		vehicleDistance); len(nearest) != 0 {
+		t.Errorf("Tree has %d entries, expected none", len(nearest))
+	}
+}
+
+func TestIndexingAggregator(t *testing.T) {
+	index := NewVehicleIndex(center)
+	va := MakeIndexingAggregator(nblocations.MakeVehicleAggregator(), index)
+	va.Insert([]*nextbus.VehicleLocation{
+		makeReport("x", 10, 10, time.Unix(1400000000, 0))})
+	if index.GetVehicle("x") == nil || va.GetVehicle("x") == nil {
+		t.Errorf("Vehicle not inserted into both the index and aggregator")
+	}
+}
+
+func TestHandler(t *testing.T) {
+	agency := nextbus.NewAgency("test")
+	agency.Stops["s"] = &nextbus.Stop{Tag: "s", Location: &nextbus.Location{
+		Location: makeReport("", 1000, 10, time.Time{}).Location}}
+	h := NewHandler(makeIndex(time.Unix(1400000000, 0)), agency)
+	testCases := []struct {
+		url  string
+		code int
+		ids  string
+	}{
+		{"/vehicles", 200, "[a b c d]"},
+		{"/vehicles/near?lat=42.358&lon=-71.064&meters=500", 200, "[a b]"},
+		{"/vehicles/nearest?lat=42.358&lon=-71.064&k=1", 200, "[a]"},
+		{"/vehicles/nearest?stop=s&k=2", 200, "[c a]"},
+		{"/vehicles/nearest?stop=zz", 404, ""},
+		{"/vehicles/near?lat=42.358", 400, ""},
+	}
+	for _, tc := range testCases {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", tc.url, nil))
+		if w.Code != tc.code {
+			t.Errorf("%s: status %d, expected %d", tc.url, w.Code, tc.code)
+			continue
+		}
+		if tc.code != 200 {
+			continue
+		}
+		var vehicles []vehicleJson
+		if err := json.Unmarshal(w.Body.Bytes(), &vehicles); err != nil {
+			t.Errorf("%s: %v", tc.url, err)
+			continue
+		}
+		var ids []string
+		for _, v := range vehicles {
+			ids = append(ids, v.Id)
+		}
+		if got := fmt.Sprint(ids); got != tc.ids {
+			t.Errorf("%s: got %s, expected %s", tc.url, got, tc.ids)
+		}
+	}
+}
+
+// Stop 10 is about 1km north of center, as in TestHandler.
+const testRouteConfig = `<?xml version="1.0" encoding="utf-8" ?>
+<body copyright="All data copyright MBTA 2013.">
+<route tag="1" title="1" latMin="42.358" latMax="42.367" lonMin="-71.064" lonMax="-71.064">
+<stop tag="10" title="North" lat="42.367" lon="-71.064"/>
+<stop tag="11" title="Center" lat="42.358" lon="-71.064"/>
+<direction tag="1_0" title="Inbound" name="Inbound" useForUI="true">
+<stop tag="10" /><stop tag="11" />
+</direction>
+</route>
+</body>`
+
+func TestHandlerStopOfRouteConfig(t *testing.T) {
+	agency := nextbus.NewAgency("test")
+	if _, err := nextbus.ParseRouteConfigXml(agency, []byte(testRouteConfig)); err != nil {
+		t.Fatal(err)
+	}
+	index := makeIndex(time.Unix(1400000000, 0))
+	get := func(h *Handler, url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		return w
+	}
+	w := get(NewHandler(index, agency), "/vehicles/nearest?stop=10&k=2")
+	var vehicles []vehicleJson
+	if w.Code != 200 {
+		t.Fatalf("Status %d: %s", w.Code, w.Body.String())
+	} else if err := json.Unmarshal(w.Body.Bytes(), &vehicles); err != nil {
+		t.Fatal(err)
+	}
+	if len(vehicles) != 2 || vehicles[0].Id != "c" || vehicles[1].Id != "a" {
+		t.Errorf("Wrong vehicles nearest stop 10: %v", vehicles)
+	}
+
+	// Without an agency, stops can't be resolved.
+	if w := get(NewHandler(index, nil), "/vehicles/nearest?stop=10"); w.Code != 404 {
+		t.Errorf("Status %d without an agency, expected 404", w.Code)
+	}
+}
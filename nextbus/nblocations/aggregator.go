@@ -27,7 +27,7 @@ type VehicleAggregator interface {
 	// Get latest report for the specified vehicle
 	GetVehicle(id string) *nextbus.VehicleLocation
 
-	// Get latest report for every vehicle.
+	// Get latest report for every vehicle, sorted by vehicle id.
 	GetAllVehicles() []*nextbus.VehicleLocation
 
 	// Remove reports where we know this isn't the latest report for the vehicle.
@@ -336,12 +336,13 @@ func (va *vehicleAggregator) GetVehicle(id string) *nextbus.VehicleLocation {
 	return va.latestReports[id]
 }
 
-// Get latest report for every vehicle.
+// Get latest report for every vehicle, sorted by vehicle id.
 func (va *vehicleAggregator) GetAllVehicles() []*nextbus.VehicleLocation {
 	result := make([]*nextbus.VehicleLocation, 0, len(va.latestReports))
 	for _, p := range va.latestReports {
 		result = append(result, p)
 	}
+	nextbus.SortVehicleLocationsById(result)
 	return result
 }
 
@@ -0,0 +1,131 @@
+package nblocations
+
+// Support for writing the aggregated location reports to columnar files (see
+// package nbcolumnar), an alternative to the gzipped CSV files.
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/jamessynge/transit_tools/nextbus"
+	"github.com/jamessynge/transit_tools/nextbus/nbcolumnar"
+	"github.com/jamessynge/transit_tools/util"
+)
+
+type ColumnarArchiveOpener interface {
+	OpenColumnarArchiveFor(t time.Time) (string, io.WriteCloser, error)
+}
+
+type ColumnarArchiveSplitterOpener interface {
+	ArchiveSplitPoint
+	ColumnarArchiveOpener
+}
+
+func openColumnarArchive(dir, base string) (string, io.WriteCloser, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", nil, fmt.Errorf("Unable to create directory: %q\nError: %v", dir, err)
+	}
+	f, path, err := util.OpenUniqueFile(dir, base, nbcolumnar.Extension, 0755, 0444)
+	if err != nil {
+		return "", nil, err
+	}
+	glog.Info("Created ", path)
+	return path, f, nil
+}
+
+// Same layout as the CSV archives: root/2006/01/2006-01-02.vlc
+func (root_dir dailyArchiveSplitterOpener) OpenColumnarArchiveFor(t time.Time) (
+	string, io.WriteCloser, error) {
+	dir := filepath.Join(string(root_dir), t.Format("2006"), t.Format("01"))
+	return openColumnarArchive(dir, t.Format("2006-01-02"))
+}
+
+func (root_dir debugArchiveSplitterOpener) OpenColumnarArchiveFor(t time.Time) (
+	string, io.WriteCloser, error) {
+	dir := filepath.Join(string(root_dir),
+		t.Format("2006"), t.Format("01"), t.Format("02"), t.Format("15"))
+	return openColumnarArchive(dir, t.Format("2006-01-02_1504"))
+}
+
+type columnarArchiver struct {
+	opener   ColumnarArchiveOpener
+	splitter ArchiveSplitPoint
+
+	nextArchiveTime time.Time
+	file            io.WriteCloser
+	writer          *nbcolumnar.Writer
+	path            string
+}
+
+// MakeColumnarArchiver returns a CSVArchiver (i.e. the archiver interface used
+// by the aggregator) that writes columnar files instead of CSV files.
+func MakeColumnarArchiver(
+	opener ColumnarArchiveOpener, splitter ArchiveSplitPoint) CSVArchiver {
+	return &columnarArchiver{
+		opener:   opener,
+		splitter: splitter,
+	}
+}
+
+func (p *columnarArchiver) Close() error {
+	if p.writer == nil {
+		return nil
+	}
+	err := p.writer.Close()
+	if err2 := p.file.Close(); err == nil {
+		err = err2
+	}
+	glog.Infof("Closed %s", p.path)
+	p.writer, p.file, p.path = nil, nil, ""
+	return err
+}
+
+func (p *columnarArchiver) Flush() error {
+	if p.writer != nil {
+		return p.writer.Flush()
+	}
+	return nil
+}
+
+// Writes out the pending locations as a (possibly short) block, so that the
+// file is complete up to this point if the fetcher is killed. The aggregator
+// calls this every few minutes, so the short blocks are few.
+func (p *columnarArchiver) PartialFlush() error {
+	if p.writer != nil {
+		return p.writer.Flush()
+	}
+	return nil
+}
+
+func (p *columnarArchiver) Write(location *nextbus.VehicleLocation) error {
+	if p.writer == nil || p.nextArchiveTime.Before(location.Time) {
+		p.Close()
+		path, file, err := p.opener.OpenColumnarArchiveFor(location.Time)
+		if err != nil {
+			return err
+		}
+		p.file = file
+		p.writer = nbcolumnar.NewWriter(file)
+		p.path = path
+		p.nextArchiveTime = p.splitter.NextArchiveSplitPoint(location.Time)
+	}
+	return p.writer.Write(location)
+}
+
+func (p *columnarArchiver) WriteLocations(locations []*nextbus.VehicleLocation) error {
+	var errors []error
+	for _, location := range locations {
+		if err := p.Write(location); err != nil {
+			errors = append(errors, err)
+		}
+	}
+	if len(errors) > 0 {
+		return fmt.Errorf("WriteLocations failed:\n%s", util.JoinErrors(errors, "\n"))
+	}
+	return nil
+}
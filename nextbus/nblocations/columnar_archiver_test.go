@@ -0,0 +1,62 @@
+package nblocations
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jamessynge/transit_tools/geo"
+	"github.com/jamessynge/transit_tools/nextbus"
+	"github.com/jamessynge/transit_tools/nextbus/nbcolumnar"
+)
+
+func TestColumnarArchiverPartialFlush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "columnar_archiver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	opener := MakeDailyArchiveSplitterOpener(dir)
+	archiver := MakeColumnarArchiver(
+		opener.(ColumnarArchiveOpener), opener).(*columnarArchiver)
+
+	// Far fewer than a block of locations.
+	start := time.Date(2014, 5, 13, 12, 0, 0, 0, time.Local)
+	var vls []*nextbus.VehicleLocation
+	for i := 0; i < 10; i++ {
+		vls = append(vls, &nextbus.VehicleLocation{
+			VehicleId: "0123",
+			RouteTag:  "1",
+			DirTag:    "1_0_var0",
+			Time:      start.Add(time.Duration(i) * time.Minute),
+			Location:  geo.Location{Lat: 42.35, Lon: geo.Longitude(-71.06 + float64(i)*0.001)},
+			Heading:   90,
+		})
+	}
+	if err := archiver.WriteLocations(vls); err != nil {
+		t.Fatal(err)
+	}
+	if err := archiver.PartialFlush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Read back without closing the archiver, as if the fetcher had been
+	// killed.
+	n, err := nbcolumnar.ReadVehicleLocationsFile(archiver.path, nil,
+		func(source string, vl *nextbus.VehicleLocation, recordNum int,
+			err error) error {
+			if err == nil && !vl.Time.Equal(vls[recordNum].Time) {
+				t.Errorf("Location %d has time %v, expected %v", recordNum,
+					vl.Time, vls[recordNum].Time)
+			}
+			return err
+		})
+	if err != nil || n != len(vls) {
+		t.Errorf("Read %d locations from %s, expected %d; error %v",
+			n, archiver.path, len(vls), err)
+	}
+	if err := archiver.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
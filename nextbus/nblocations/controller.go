@@ -9,6 +9,16 @@ import (
 	"time"
 )
 
+var archiveFormatFlag = flag.String(
+	"archive_format", "csv",
+	"Format of the processed location archives: csv (gzipped CSV files) or "+
+		"columnar (see package nbcolumnar).")
+
+// If set (before StartFetchAndArchive), wraps the aggregator of the fetched
+// vehicle locations; e.g. to also insert them into a live index (see package
+// nblive).
+var WrapVehicleAggregator func(VehicleAggregator) VehicleAggregator
+
 // DEBUG flags:
 
 var debugArchivingFlag = flag.Bool(
@@ -34,6 +44,10 @@ func StartFetchAndArchive(
 	fetcher util.HttpFetcher,
 	agencyRootDir string,
 	stopFetchAndArchiveCh chan chan bool) {
+	if *archiveFormatFlag != "csv" && *archiveFormatFlag != "columnar" {
+		glog.Fatalf("Invalid --archive_format: %q (must be csv or columnar)",
+			*archiveFormatFlag)
+	}
 	// Root directory for saved vehicleLocations responses: compressed tar file
 	// of xml responses (almost raw: we add a comment with metadata about the
 	// request and response; and for failures, we store files of other types).
@@ -154,8 +168,17 @@ func (p *locationFetchAndArchiveState) RunAggegator() {
 	} else {
 		splitterOpener = MakeDailyArchiveSplitterOpener(p.processedRootDir)
 	}
-	archiver := MakeCSVArchiver(splitterOpener, splitterOpener)
+	var archiver CSVArchiver
+	if *archiveFormatFlag == "columnar" {
+		archiver = MakeColumnarArchiver(
+			splitterOpener.(ColumnarArchiveOpener), splitterOpener)
+	} else {
+		archiver = MakeCSVArchiver(splitterOpener, splitterOpener)
+	}
 	aggregator := MakeVehicleAggregator()
+	if WrapVehicleAggregator != nil {
+		aggregator = WrapVehicleAggregator(aggregator)
+	}
 
 	doClose := func() {
 		if aggregator != nil {
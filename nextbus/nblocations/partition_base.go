@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/xml"
 	"fmt"
+	"image/color"
 	"io"
 	"io/ioutil"
 	"path/filepath"
@@ -14,6 +15,7 @@ import (
 	"github.com/golang/glog"
 
 	"github.com/jamessynge/transit_tools/geo"
+	"github.com/jamessynge/transit_tools/nextbus/nbimage"
 	"github.com/jamessynge/transit_tools/util"
 )
 
@@ -646,6 +648,47 @@ func SavePartitionsIndex(dir string, a *AgencyPartitioner) {
 		glog.Fatalf("Unable to save html map of partitions: %s", err)
 	}
 	glog.Infof("Saved partitions map to %s", fp)
+
+	// An offline alternative to the html map, which requires network access.
+	fp = filepath.Join(dir, "partitions.svg")
+	err = GeneratePartitionsImage(a, 2048, 2048).SaveToFile(fp)
+	if err != nil {
+		glog.Fatalf("Unable to save image of partitions: %s", err)
+	}
+}
+
+// PartitionRegions returns the regions of the leaf partitions under p.
+func PartitionRegions(p Partitioner) (regions []geo.Rect) {
+	switch t := p.(type) {
+	case *AgencyPartitioner:
+		return PartitionRegions(t.RootPartitioner)
+	case *SouthNorthPartitioners:
+		for _, sp := range t.SubPartitions {
+			regions = append(regions, PartitionRegions(sp)...)
+		}
+	case *WestEastPartitioners:
+		for _, sp := range t.SubPartitions {
+			regions = append(regions, PartitionRegions(sp)...)
+		}
+	default:
+		west, east, south, north := p.Region()
+		regions = append(regions,
+			geo.Rect{South: south, North: north, West: west, East: east})
+	}
+	return
+}
+
+// GeneratePartitionsImage returns an image with the outlines of the leaf
+// partitions, no larger than maxWidth x maxHeight pixels.
+func GeneratePartitionsImage(
+	a *AgencyPartitioner, maxWidth, maxHeight int) *nbimage.Image {
+	west, east, south, north := a.Region()
+	region := geo.Rect{South: south, North: north, West: west, East: east}
+	img := nbimage.NewImageForRegion(region, maxWidth, maxHeight)
+	c := color.NRGBA{0, 0, 192, 255}
+	img.AddGeoRects(PartitionRegions(a), c)
+	img.AddLegend(fmt.Sprintf("%s partitions", a.Agency), c)
+	return img
 }
 
 func ReadPartitionsIndex(dir string) *AgencyPartitioner {
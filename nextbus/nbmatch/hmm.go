@@ -0,0 +1,249 @@
+package nbmatch
+
+// Hidden-Markov map matching of vehicle tracks to the paths of an agency.
+// The reports of a vehicle are the observations, and the candidates (a path
+// and an offset along it) near each report are the states. The most likely
+// sequence of states is found by Viterbi decoding, where the emission
+// probability depends upon the distance and angle between report and path,
+// and the transition probability upon how well the distance travelled along
+// the paths agrees with the straight line distance between the reports
+// (see Newson & Krumm, "Hidden Markov Map Matching Through Noise and
+// Sparseness", 2009).
+//
+// Paths are connected where they share a waypoint (i.e. the same
+// *nextbus.Location in Agency.Locations); only transitions between the same
+// path, or directly between two connected paths, are considered. Where no
+// transition is feasible the track is broken, and matching starts afresh.
+
+import (
+	"math"
+	"time"
+
+	"github.com/jamessynge/transit_tools/geom"
+	"github.com/jamessynge/transit_tools/nextbus"
+)
+
+var kNegativeInfinity = math.Inf(-1)
+
+// The match for a single report of a track; Candidate is nil if no path
+// could be matched to the report.
+type Match struct {
+	Report *nextbus.VehicleLocation
+	*Candidate
+}
+
+// Matches tracks (time ordered reports of a single vehicle) to paths.
+type TrackMatcher struct {
+	*Matcher
+	// Standard deviation (meters) of the error in reported locations.
+	SigmaZ float64
+	// Scale (meters) of the difference between the distance along the paths
+	// and the straight line distance between consecutive reports.
+	Beta float64
+	// Weight of the heading in the emission log-probability (i.e. a report
+	// heading at right angles to a path has a log-probability lower by
+	// HeadingKappa than one heading along the path).
+	HeadingKappa float64
+	// Transitions implying a speed (meters/second) greater than this are
+	// considered impossible.
+	MaxSpeed float64
+	// Maximum number of candidates (paths) considered for each report.
+	MaxCandidates int
+	// Vehicles may appear to move backwards a little along a path due to
+	// location errors; moving backwards further than this (meters) is
+	// considered impossible.
+	BacktrackTolerance float64
+
+	// For each path, the waypoints of the path, indexed by Location.
+	waypointIndices map[*nextbus.Path]map[*nextbus.Location][]int
+}
+
+// NewTrackMatcher returns a TrackMatcher using m to find candidates.
+func NewTrackMatcher(m *Matcher) *TrackMatcher {
+	p := &TrackMatcher{
+		Matcher:            m,
+		SigmaZ:             10,
+		Beta:               50,
+		HeadingKappa:       2,
+		MaxSpeed:           35,
+		MaxCandidates:      8,
+		BacktrackTolerance: 20,
+		waypointIndices:    make(map[*nextbus.Path]map[*nextbus.Location][]int),
+	}
+	for path := range m.offsets {
+		indices := make(map[*nextbus.Location][]int)
+		for i, loc := range path.WayPoints {
+			indices[loc] = append(indices[loc], i)
+		}
+		p.waypointIndices[path] = indices
+	}
+	return p
+}
+
+// SplitIntoTracks sorts the reports by vehicle and time, and splits them into
+// tracks, one per vehicle, except that a track is split where there are no
+// reports for longer than maxGap (if maxGap is positive). Consecutive
+// reports with the same location are dropped (they add no information).
+func SplitIntoTracks(vls []*nextbus.VehicleLocation,
+	maxGap time.Duration) (tracks [][]*nextbus.VehicleLocation) {
+	vls = append([]*nextbus.VehicleLocation(nil), vls...)
+	nextbus.SortVehicleLocationsByIdAndDate(vls)
+	var track []*nextbus.VehicleLocation
+	for _, vl := range vls {
+		if len(track) > 0 {
+			last := track[len(track)-1]
+			if last.VehicleId != vl.VehicleId ||
+				(maxGap > 0 && vl.Time.Sub(last.Time) > maxGap) {
+				tracks = append(tracks, track)
+				track = nil
+			} else if last.Location.SameLocation(vl.Location) {
+				continue
+			}
+		}
+		track = append(track, vl)
+	}
+	if len(track) > 0 {
+		tracks = append(tracks, track)
+	}
+	return
+}
+
+// Log-probability of the report being emitted from the candidate.
+func (p *TrackMatcher) emission(c *Candidate) float64 {
+	z := c.Distance / p.SigmaZ
+	lp := -0.5 * z * z
+	if c.AngleOk {
+		lp += p.HeadingKappa * (math.Cos(c.Angle) - 1)
+	}
+	return lp
+}
+
+// Distance (meters) travelled along the paths from a to b, if b can be
+// reached from a.
+func (p *TrackMatcher) routeDistance(a, b *Candidate) (float64, bool) {
+	if a.Path == b.Path {
+		d := b.Offset - a.Offset
+		if d < -p.BacktrackTolerance {
+			return 0, false
+		}
+		return math.Abs(d), true
+	}
+	aOffsets := p.offsets[a.Path]
+	bOffsets := p.offsets[b.Path]
+	bIndices := p.waypointIndices[b.Path]
+	best := math.Inf(1)
+	for i, loc := range a.Path.WayPoints {
+		if _, ok := loc.Paths[b.Path.Index]; !ok {
+			continue
+		}
+		da := aOffsets[i] - a.Offset
+		if da < -p.BacktrackTolerance {
+			continue
+		}
+		for _, j := range bIndices[loc] {
+			db := b.Offset - bOffsets[j]
+			if db < -p.BacktrackTolerance {
+				continue
+			}
+			if d := math.Max(0, da) + math.Max(0, db); d < best {
+				best = d
+			}
+		}
+	}
+	return best, !math.IsInf(best, 1)
+}
+
+// Log-probability of the transition from candidate a of report u to candidate
+// b of report v, where straight is the distance between the reports.
+func (p *TrackMatcher) transition(u, v *nextbus.VehicleLocation,
+	a, b *Candidate, straight float64) float64 {
+	d, ok := p.routeDistance(a, b)
+	if !ok {
+		return kNegativeInfinity
+	}
+	if dt := v.Time.Sub(u.Time).Seconds(); dt > 0 && d/dt > p.MaxSpeed {
+		return kNegativeInfinity
+	}
+	return -math.Abs(d-straight) / p.Beta
+}
+
+func argMax(values []float64) (best int) {
+	for i, v := range values {
+		if v > values[best] {
+			best = i
+		}
+	}
+	return
+}
+
+// MatchTrack returns the most likely match for each report of track, which
+// must be time ordered reports of a single vehicle.
+func (p *TrackMatcher) MatchTrack(track []*nextbus.VehicleLocation) []Match {
+	n := len(track)
+	candidates := make([][]*Candidate, n)
+	points := make([]geom.Point, n)
+	scores := make([][]float64, n)
+	// back[i][s] is the index of the best predecessor state, or -1 if state s
+	// starts a new chain.
+	back := make([][]int, n)
+	prev := -1 // Index of the previous report with candidates.
+	for i, vl := range track {
+		points[i] = p.Transform.ToPoint(vl.Location)
+		cs := p.KNearest(vl, p.MaxCandidates)
+		candidates[i] = cs
+		if len(cs) == 0 {
+			prev = -1
+			continue
+		}
+		scores[i] = make([]float64, len(cs))
+		back[i] = make([]int, len(cs))
+		reachable := false
+		for s, c := range cs {
+			scores[i][s] = kNegativeInfinity
+			back[i][s] = -1
+			if prev < 0 {
+				continue
+			}
+			straight := points[prev].Distance(points[i])
+			for r, pc := range candidates[prev] {
+				if math.IsInf(scores[prev][r], -1) {
+					continue
+				}
+				score := scores[prev][r] +
+					p.transition(track[prev], vl, pc, c, straight)
+				if score > scores[i][s] {
+					scores[i][s] = score
+					back[i][s] = r
+				}
+			}
+			if back[i][s] >= 0 {
+				scores[i][s] += p.emission(c)
+				reachable = true
+			}
+		}
+		if !reachable {
+			// Start a new chain.
+			for s, c := range cs {
+				scores[i][s] = p.emission(c)
+				back[i][s] = -1
+			}
+		}
+		prev = i
+	}
+
+	result := make([]Match, n)
+	state := -1
+	for i := n - 1; i >= 0; i-- {
+		result[i].Report = track[i]
+		if len(candidates[i]) == 0 {
+			state = -1
+			continue
+		}
+		if state < 0 {
+			state = argMax(scores[i])
+		}
+		result[i].Candidate = candidates[i][state]
+		state = back[i][state]
+	}
+	return result
+}
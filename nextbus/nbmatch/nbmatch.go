@@ -0,0 +1,309 @@
+// Package nbmatch matches vehicle location reports to the nearby paths of an
+// agency, taking into account the heading of the vehicle as well as the
+// distance to the path (i.e. a report a few meters from a path, but heading
+// in the opposite direction, is a worse match than one a bit further away
+// heading in the same direction as the path).
+package nbmatch
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/golang/glog"
+
+	"github.com/jamessynge/transit_tools/geo"
+	"github.com/jamessynge/transit_tools/geo/geogeom"
+	"github.com/jamessynge/transit_tools/geom"
+	"github.com/jamessynge/transit_tools/nextbus"
+	"github.com/jamessynge/transit_tools/nextbus/busgeom"
+)
+
+const (
+	halfPi = math.Pi / 2
+)
+
+// AngleWeight maps the angle (radians) between the heading of a vehicle and
+// the direction of a segment to a weight from 1 (same direction) to
+// 0 (perpendicular or opposite).
+func AngleWeight(angleBetween float64) float64 {
+	v := math.Min(halfPi, angleBetween) / halfPi
+	return 1 - v
+}
+
+// DistanceWeight maps a distance between a vehicle and a segment to a weight
+// from 1 (within 1 unit) towards 0 (far away).
+func DistanceWeight(distanceBetween float64) float64 {
+	if distanceBetween <= 0 {
+		return 1
+	}
+	return math.Min(1, 1/distanceBetween)
+}
+
+// A candidate path (and segment of that path) for a vehicle location report.
+type Candidate struct {
+	Path *nextbus.Path
+	// Index of the segment within the path (i.e. the segment starts at
+	// Path.WayPoints[SegmentIndex]).
+	SegmentIndex int
+	// Distance (meters) along the path from the first waypoint to NearestPoint.
+	Offset float64
+	// Distance (meters) from the report to NearestPoint.
+	Distance float64
+	// Angle (radians, 0 to Pi) between the heading of the vehicle and the
+	// direction of the segment; AngleOk is false if the report has no valid
+	// heading, in which case Angle is meaningless.
+	Angle   float64
+	AngleOk bool
+	// The point on the segment nearest to the report, in the metric plane of
+	// the Matcher's Transform.
+	NearestPoint geom.Point
+	// Combined score, from 0 (bad) to 1 (perfect).
+	Score float64
+}
+
+// Segment of a path, as inserted into the quadtree.
+type pathSegment struct {
+	*busgeom.PathSegment
+	path *nextbus.Path
+}
+
+// Finds the paths near a vehicle location report. Safe for use from multiple
+// go routines once created.
+type Matcher struct {
+	// Transform from geographic coordinates to the metric plane in which
+	// distances are measured.
+	Transform geogeom.CoordTransform
+	// Only segments within this distance (meters) of a report are considered.
+	MaxDistance float64
+	// Distances are divided by this (meters) before being passed to
+	// DistanceWeight (i.e. reports within this distance of a segment aren't
+	// penalized for distance).
+	DistanceScale float64
+	// Weight used in place of AngleWeight when a report has no heading.
+	UnknownHeadingWeight float64
+	// Only return candidates whose path is used by the route of the report
+	// (when the route of the report is known to the agency).
+	RestrictToRoute bool
+	// Candidates with a lower score aren't returned by FindPaths.
+	MinScore float64
+	// Maximum number of paths returned by FindPaths.
+	MaxPaths int
+
+	agency *nextbus.Agency
+	qt     geom.QuadTree
+	// Distance along each path from the first waypoint to each waypoint.
+	offsets map[*nextbus.Path][]float64
+}
+
+// NewMatcher returns a Matcher for the paths of agency, with the transform to
+// the metric plane centered on the paths. Returns an error if there are no
+// paths.
+func NewMatcher(agency *nextbus.Agency) (*Matcher, error) {
+	min, max, ok := agency.GetPathBounds()
+	if !ok {
+		return nil, fmt.Errorf("Agency %s has no paths", agency.Tag)
+	}
+	center := geo.Location{
+		Lat: (min.Lat + max.Lat) / 2,
+		Lon: (min.Lon + max.Lon) / 2,
+	}
+	return NewMatcherWithTransform(
+		agency, geogeom.MakeLocalTransverseMercator(center)), nil
+}
+
+// NewMatcherWithTransform returns a Matcher for the paths of agency, using xf
+// to transform locations to the metric plane.
+func NewMatcherWithTransform(
+	agency *nextbus.Agency, xf geogeom.CoordTransform) *Matcher {
+	p := &Matcher{
+		Transform:            xf,
+		MaxDistance:          100,
+		DistanceScale:        10,
+		UnknownHeadingWeight: 0.5,
+		MinScore:             0.05,
+		MaxPaths:             3,
+		agency:               agency,
+		offsets:              make(map[*nextbus.Path][]float64),
+	}
+	var segs []*pathSegment
+	paths := nextbus.PathsSlice(agency.GetPaths())
+	sort.Sort(paths)
+	for _, path := range paths {
+		if len(path.WayPoints) < 2 {
+			continue
+		}
+		points := geogeom.LocationsCollectionToPoints(
+			len(path.WayPoints),
+			func(index int) geo.Location { return path.WayPoints[index].Location },
+			xf)
+		pathSegs := busgeom.MakePathSegments(points, nil)
+		offsets := make([]float64, len(points))
+		for _, ps := range pathSegs {
+			segs = append(segs, &pathSegment{PathSegment: ps, path: path})
+			offsets[ps.Index()+1] = ps.OffsetFromStart() + ps.Length()
+		}
+		p.offsets[path] = offsets
+	}
+	if len(segs) == 0 {
+		glog.Error("Agency has no path segments!")
+		return nil
+	}
+	bounds := segs[0].Bounds()
+	for _, seg := range segs[1:] {
+		bounds = bounds.Union(seg.Bounds())
+	}
+	bounds = geom.NewRect(
+		math.Floor(bounds.MinX), math.Ceil(bounds.MaxX),
+		math.Floor(bounds.MinY), math.Ceil(bounds.MaxY))
+	p.qt = geom.NewQuadTree(bounds)
+	for _, seg := range segs {
+		if err := p.qt.Insert(seg); err != nil {
+			glog.Errorf("Unable to insert segment %d of path %d: %v",
+				seg.Index(), seg.path.Index, err)
+		}
+	}
+	glog.Infof("Created matcher with %d segments of %d paths, bounds: %v",
+		len(segs), len(paths), p.qt.Bounds())
+	return p
+}
+
+type segmentCollector struct {
+	segs []*pathSegment
+}
+
+func (p *segmentCollector) Visit(datum geom.IntersectBounder) {
+	seg, ok := datum.(*pathSegment)
+	if !ok {
+		glog.Fatalf("Wrong datum type: %T\nValue: %#v", datum, datum)
+	}
+	p.segs = append(p.segs, seg)
+}
+
+// Score combines the distance and angle into a value from 0 (bad) to 1.
+func (p *Matcher) Score(distance, angle float64, angleOk bool) float64 {
+	score := DistanceWeight(distance / p.DistanceScale)
+	if angleOk {
+		score *= AngleWeight(angle)
+	} else {
+		score *= p.UnknownHeadingWeight
+	}
+	return score
+}
+
+// Does the report's route (or the route of the report's direction) use path?
+// If the route isn't known, all paths are acceptable.
+func (p *Matcher) isPathOfReportRoute(
+	vl *nextbus.VehicleLocation, path *nextbus.Path) bool {
+	known := false
+	if _, ok := p.agency.Routes[vl.RouteTag]; ok {
+		known = true
+		if _, ok := path.Routes[vl.RouteTag]; ok {
+			return true
+		}
+	}
+	if dir, ok := p.agency.Directions[vl.DirTag]; ok && dir.Route != nil {
+		known = true
+		if _, ok := path.Routes[dir.Route.Tag]; ok {
+			return true
+		}
+	}
+	return !known
+}
+
+// KNearest returns up to k candidates for the report, best score first, with
+// at most one candidate (the best segment) per path.
+func (p *Matcher) KNearest(vl *nextbus.VehicleLocation, k int) []*Candidate {
+	pt := p.Transform.ToPoint(vl.Location)
+	direction := geom.InvalidDirection()
+	if radians, err := p.Transform.GeoHeadingToDirection(vl.Heading); err == nil {
+		direction = geom.MakeDirection(radians)
+	}
+	return p.kNearest(vl, pt, direction, k)
+}
+
+// KNearestToPoint is like KNearest, but for a point in the metric plane and a
+// direction (which may be invalid, i.e. unknown), without any restriction
+// to the paths of a route.
+func (p *Matcher) KNearestToPoint(
+	pt geom.Point, direction geom.Direction, k int) []*Candidate {
+	return p.kNearest(nil, pt, direction, k)
+}
+
+func (p *Matcher) kNearest(vl *nextbus.VehicleLocation, pt geom.Point,
+	direction geom.Direction, k int) []*Candidate {
+	headingOk := direction.DirectionIsValid()
+	visitor := &segmentCollector{}
+	p.qt.Visit(pt.ToRect(p.MaxDistance, p.MaxDistance), visitor)
+
+	best := make(map[*nextbus.Path]*Candidate)
+	for _, seg := range visitor.segs {
+		if p.RestrictToRoute && vl != nil && !p.isPathOfReportRoute(vl, seg.path) {
+			continue
+		}
+		nearest, _ := seg.ClosestPointTo(pt)
+		distance := pt.Distance(nearest)
+		if distance > p.MaxDistance {
+			continue
+		}
+		c := &Candidate{
+			Path:         seg.path,
+			SegmentIndex: seg.Index(),
+			Offset:       seg.OffsetFromStart() + seg.Pt1.Distance(nearest),
+			Distance:     distance,
+			NearestPoint: nearest,
+		}
+		if headingOk && seg.Direction.DirectionIsValid() {
+			c.Angle = seg.Direction.AngleBetween(direction)
+			c.AngleOk = true
+		}
+		c.Score = p.Score(c.Distance, c.Angle, c.AngleOk)
+		if prev, ok := best[seg.path]; ok && !candidateLess(c, prev) {
+			continue
+		}
+		best[seg.path] = c
+	}
+	result := make([]*Candidate, 0, len(best))
+	for _, c := range best {
+		result = append(result, c)
+	}
+	sort.Sort(candidatesSlice(result))
+	if k > 0 && len(result) > k {
+		result = result[0:k]
+	}
+	return result
+}
+
+// FindPaths returns the paths of the best candidates for the report (at most
+// MaxPaths, and only those with a score of at least MinScore).
+func (p *Matcher) FindPaths(vl *nextbus.VehicleLocation) (paths []*nextbus.Path) {
+	for _, c := range p.KNearest(vl, p.MaxPaths) {
+		if c.Score < p.MinScore {
+			break
+		}
+		paths = append(paths, c.Path)
+	}
+	return
+}
+
+// Is a a better candidate than b? Higher scores are better, and for equal
+// scores closer candidates are better; remaining ties are broken by path
+// index and segment index so that the order is deterministic.
+func candidateLess(a, b *Candidate) bool {
+	if a.Score != b.Score {
+		return a.Score > b.Score
+	}
+	if a.Distance != b.Distance {
+		return a.Distance < b.Distance
+	}
+	if a.Path.Index != b.Path.Index {
+		return a.Path.Index < b.Path.Index
+	}
+	return a.SegmentIndex < b.SegmentIndex
+}
+
+type candidatesSlice []*Candidate
+
+func (p candidatesSlice) Len() int           { return len(p) }
+func (p candidatesSlice) Less(i, j int) bool { return candidateLess(p[i], p[j]) }
+func (p candidatesSlice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
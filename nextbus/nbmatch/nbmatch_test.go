@@ -0,0 +1,301 @@
+package nbmatch
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jamessynge/transit_tools/geo"
+	"github.com/jamessynge/transit_tools/nextbus"
+)
+
+// Two parallel paths about 22 meters apart: path 1 is eastbound on route 1,
+// path 2 is westbound on route 2.
+const testPathsXml = `<?xml version="1.0" encoding="utf-8" ?>
+<body agency="test">
+	<path>
+		<route tag="1" title="One">
+			<direction tag="1_0" title="East"/>
+		</route>
+		<point lat="42.35" lon="-71.07"/>
+		<point lat="42.35" lon="-71.065"/>
+		<point lat="42.35" lon="-71.055"/>
+	</path>
+	<path>
+		<route tag="2" title="Two">
+			<direction tag="2_1" title="West"/>
+		</route>
+		<point lat="42.3502" lon="-71.055"/>
+		<point lat="42.3502" lon="-71.07"/>
+	</path>
+</body>`
+
+func makeTestMatcher(t *testing.T) *Matcher {
+	agency, err := nextbus.ReadPaths(strings.NewReader(testPathsXml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewMatcher(agency)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func makeTestReport(heading geo.HeadingInt, routeTag string) *nextbus.VehicleLocation {
+	return &nextbus.VehicleLocation{
+		VehicleId: "v1",
+		RouteTag:  routeTag,
+		Location:  geo.Location{Lat: 42.35012, Lon: -71.06},
+		Heading:   heading,
+	}
+}
+
+func TestWeights(t *testing.T) {
+	if w := AngleWeight(0); w != 1 {
+		t.Errorf("AngleWeight(0) = %v", w)
+	}
+	if w := AngleWeight(math.Pi / 4); math.Abs(w-0.5) > 1e-9 {
+		t.Errorf("AngleWeight(Pi/4) = %v", w)
+	}
+	if w := AngleWeight(math.Pi); w != 0 {
+		t.Errorf("AngleWeight(Pi) = %v", w)
+	}
+	if w := DistanceWeight(0.5); w != 1 {
+		t.Errorf("DistanceWeight(0.5) = %v", w)
+	}
+	if w := DistanceWeight(4); w != 0.25 {
+		t.Errorf("DistanceWeight(4) = %v", w)
+	}
+}
+
+func TestKNearestPrefersSameHeading(t *testing.T) {
+	m := makeTestMatcher(t)
+	// Heading east, but closer to the westbound path.
+	candidates := m.KNearest(makeTestReport(90, ""), 0)
+	if len(candidates) != 2 {
+		t.Fatalf("Expected 2 candidates, not %d", len(candidates))
+	}
+	c := candidates[0]
+	if c.Path.Index != 1 || c.SegmentIndex != 1 {
+		t.Errorf("Wrong best candidate: path %d, segment %d",
+			c.Path.Index, c.SegmentIndex)
+	}
+	if !c.AngleOk || c.Angle > 0.01 {
+		t.Errorf("Wrong angle: %v (ok=%v)", c.Angle, c.AngleOk)
+	}
+	if c.Distance < 12 || c.Distance > 14 {
+		t.Errorf("Wrong distance: %v", c.Distance)
+	}
+	wp := c.Path.WayPoints
+	pt0 := m.Transform.ToPoint(wp[0].Location)
+	pt1 := m.Transform.ToPoint(wp[1].Location)
+	expected := pt0.Distance(pt1) + pt1.Distance(c.NearestPoint)
+	if math.Abs(c.Offset-expected) > 0.01 {
+		t.Errorf("Wrong offset: %v, expected %v", c.Offset, expected)
+	}
+	if candidates[1].Path.Index != 2 || candidates[1].Score != 0 {
+		t.Errorf("Wrong second candidate: %#v", candidates[1])
+	}
+
+	// Without a heading the nearer path is best.
+	candidates = m.KNearest(makeTestReport(-1, ""), 1)
+	if len(candidates) != 1 || candidates[0].Path.Index != 2 {
+		t.Errorf("Expected path 2 to be nearest: %#v", candidates)
+	}
+}
+
+func TestFindPaths(t *testing.T) {
+	m := makeTestMatcher(t)
+	paths := m.FindPaths(makeTestReport(90, ""))
+	if len(paths) != 1 || paths[0].Index != 1 {
+		t.Errorf("Expected only path 1, got %v", paths)
+	}
+	paths = m.FindPaths(makeTestReport(-1, ""))
+	if len(paths) != 2 {
+		t.Errorf("Expected both paths, got %v", paths)
+	}
+
+	// Restricted to route 2, only path 2 is a candidate, and it is in the
+	// opposite direction.
+	m.RestrictToRoute = true
+	paths = m.FindPaths(makeTestReport(90, "2"))
+	if len(paths) != 0 {
+		t.Errorf("Expected no paths, got %v", paths)
+	}
+	paths = m.FindPaths(makeTestReport(-1, "2"))
+	if len(paths) != 1 || paths[0].Index != 2 {
+		t.Errorf("Expected only path 2, got %v", paths)
+	}
+
+	if m, err := NewMatcher(nextbus.NewAgency("empty")); err == nil {
+		t.Errorf("Expected an error for an agency without paths: %v", m)
+	}
+}
+
+// Path 1 is westbound, path 2 is eastbound along the same street, and path 3
+// continues north from the end of path 2.
+const testTrackPathsXml = `<?xml version="1.0" encoding="utf-8" ?>
+<body agency="test">
+	<path>
+		<route tag="1" title="One"/>
+		<point lat="42.35" lon="-71.06"/>
+		<point lat="42.35" lon="-71.07"/>
+	</path>
+	<path>
+		<route tag="2" title="Two"/>
+		<point lat="42.35" lon="-71.07"/>
+		<point lat="42.35" lon="-71.06"/>
+	</path>
+	<path>
+		<route tag="2" title="Two"/>
+		<point lat="42.35" lon="-71.06"/>
+		<point lat="42.355" lon="-71.06"/>
+	</path>
+</body>`
+
+func TestMatchTrack(t *testing.T) {
+	agency, err := nextbus.ReadPaths(strings.NewReader(testTrackPathsXml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewMatcher(agency)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tm := NewTrackMatcher(m)
+
+	// A vehicle without a heading moving east, then north, at 10 m/s.
+	start := time.Unix(1400000000, 0)
+	var track []*nextbus.VehicleLocation
+	add := func(lat, lon float64) {
+		track = append(track, &nextbus.VehicleLocation{
+			VehicleId: "v1",
+			Time:      start.Add(time.Duration(len(track)) * 10 * time.Second),
+			Location:  geo.Location{Lat: geo.Latitude(lat), Lon: geo.Longitude(lon)},
+			Heading:   -1,
+		})
+	}
+	for lon := -71.069; lon < -71.0605; lon += 0.0012 {
+		add(42.35002, lon)
+	}
+	add(42.351, -71.06)
+	add(42.352, -71.06)
+
+	// Matching reports individually can't distinguish paths 1 and 2.
+	if c := m.KNearest(track[0], 1); len(c) != 1 || c[0].Path.Index != 1 {
+		t.Fatalf("Expected path 1 to be nearest to the first report: %v", c)
+	}
+
+	matches := tm.MatchTrack(track)
+	if len(matches) != len(track) {
+		t.Fatalf("Expected %d matches, not %d", len(track), len(matches))
+	}
+	lastOffset := -1.0
+	for i, match := range matches {
+		if match.Report != track[i] {
+			t.Errorf("Wrong report for match %d", i)
+		}
+		if match.Candidate == nil {
+			t.Errorf("Report %d not matched", i)
+			continue
+		}
+		expected := 2
+		if i >= len(track)-2 {
+			expected = 3
+			lastOffset = -1
+		}
+		if match.Path.Index != expected {
+			t.Errorf("Report %d matched to path %d, expected %d",
+				i, match.Path.Index, expected)
+		}
+		if match.Offset <= lastOffset {
+			t.Errorf("Report %d offset %v not after %v", i, match.Offset, lastOffset)
+		}
+		lastOffset = match.Offset
+	}
+}
+
+func TestRouteDistanceAcrossJunction(t *testing.T) {
+	agency, err := nextbus.ReadPaths(strings.NewReader(testTrackPathsXml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p1, p2, p3 := agency.GetPath(1), agency.GetPath(2), agency.GetPath(3)
+	// The east end of the street is shared by all three paths.
+	junction := p2.WayPoints[1]
+	if p1.WayPoints[0] != junction || p3.WayPoints[0] != junction {
+		t.Fatalf("Paths don't share the junction location")
+	}
+	for _, path := range []*nextbus.Path{p1, p2, p3} {
+		if junction.Paths[path.Index] != path {
+			t.Errorf("Junction paths %v don't include path %d", junction.Paths,
+				path.Index)
+		}
+	}
+	if len(p2.WayPoints[0].Paths) != 2 || len(p3.WayPoints[1].Paths) != 1 {
+		t.Errorf("Wrong paths at the ends of paths 2 and 3")
+	}
+
+	m, err := NewMatcher(agency)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tm := NewTrackMatcher(m)
+	length2 := tm.offsets[p2][1]
+	a := &Candidate{Path: p2, Offset: length2 - 100}
+	b := &Candidate{Path: p3, Offset: 50}
+	if d, ok := tm.routeDistance(a, b); !ok || math.Abs(d-150) > 1e-6 {
+		t.Errorf("Route distance from path 2 to path 3: %v, %v", d, ok)
+	}
+	// Path 3 leads away from the junction, so path 2 can't be reached from it.
+	if d, ok := tm.routeDistance(b, a); ok {
+		t.Errorf("Route distance from path 3 to path 2: %v", d)
+	}
+	// Path 1 starts at the junction, so path 3 can only be reached from near its
+	// start (within the backtrack tolerance).
+	if d, ok := tm.routeDistance(&Candidate{Path: p1, Offset: 100}, b); ok {
+		t.Errorf("Route distance from path 1 to path 3: %v", d)
+	}
+	if d, ok := tm.routeDistance(&Candidate{Path: p1, Offset: 10}, b); !ok ||
+		math.Abs(d-50) > 1e-6 {
+		t.Errorf("Route distance from the start of path 1 to path 3: %v, %v", d, ok)
+	}
+	// The paths are only connected via the locations they share.
+	delete(junction.Paths, p3.Index)
+	if d, ok := tm.routeDistance(a, b); ok {
+		t.Errorf("Route distance without the junction: %v", d)
+	}
+}
+
+func TestSplitIntoTracks(t *testing.T) {
+	start := time.Unix(1400000000, 0)
+	newVL := func(id string, secs int, lat float64) *nextbus.VehicleLocation {
+		return &nextbus.VehicleLocation{
+			VehicleId: id,
+			Time:      start.Add(time.Duration(secs) * time.Second),
+			Location:  geo.Location{Lat: geo.Latitude(lat), Lon: -71},
+		}
+	}
+	vls := []*nextbus.VehicleLocation{
+		newVL("b", 0, 42.1),
+		newVL("a", 20, 42.2),
+		newVL("a", 0, 42.1),
+		newVL("a", 10, 42.1), // Same location as the previous report.
+		newVL("a", 1000, 42.3),
+	}
+	tracks := SplitIntoTracks(vls, 5*time.Minute)
+	if len(tracks) != 3 {
+		t.Fatalf("Expected 3 tracks, not %d", len(tracks))
+	}
+	if len(tracks[0]) != 2 || tracks[0][1].Lat != 42.2 {
+		t.Errorf("Wrong first track: %v", tracks[0])
+	}
+	if len(tracks[1]) != 1 || tracks[1][0].Lat != 42.3 {
+		t.Errorf("Wrong second track: %v", tracks[1])
+	}
+	if len(tracks[2]) != 1 || tracks[2][0].VehicleId != "b" {
+		t.Errorf("Wrong third track: %v", tracks[2])
+	}
+}
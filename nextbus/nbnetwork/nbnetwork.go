@@ -0,0 +1,461 @@
+// Package nbnetwork builds a graph of the route network of an agency from its
+// paths. Nodes are placed at the endpoints of paths and at waypoints shared
+// between paths (Agency.Locations dedupes those), with nodes closer together
+// than a merge distance combined into one. Edges are the portions of the
+// paths between consecutive nodes, directed in the direction of the path.
+//
+// The graph supports shortest path queries (between nodes, arbitrary
+// positions on the network, or stops), and detection of fragments (sets of
+// nodes that aren't connected to the rest of the network).
+package nbnetwork
+
+import (
+	"container/heap"
+	"math"
+	"sort"
+
+	"github.com/golang/glog"
+
+	"github.com/jamessynge/transit_tools/geo"
+	"github.com/jamessynge/transit_tools/geo/geogeom"
+	"github.com/jamessynge/transit_tools/geom"
+	"github.com/jamessynge/transit_tools/nextbus"
+)
+
+type Node struct {
+	Index int
+	// The waypoints merged into this node.
+	Locations []*nextbus.Location
+	// Average of the locations, in the metric plane of the Graph's Transform.
+	Point geom.Point
+	// Edges leaving and entering the node.
+	Out, In []*Edge
+}
+
+// A portion of a path between two nodes.
+type Edge struct {
+	Index    int
+	From, To *Node
+	Path     *nextbus.Path
+	// Indices into Path.WayPoints of the first and last waypoints of the edge.
+	FromWayPoint, ToWayPoint int
+	// Distance (meters) along the path from its first waypoint to FromWayPoint.
+	Offset float64
+	// Length (meters) of the edge.
+	Length float64
+	// The waypoints of the edge, in the metric plane.
+	Points []geom.Point
+	bounds geom.Rect
+}
+
+// A position on the network: Offset meters along Edge.
+type Position struct {
+	Edge   *Edge
+	Offset float64
+	// Point at the position, and distance to it from the located point (see
+	// Graph.Locate).
+	Point    geom.Point
+	Distance float64
+}
+
+type Graph struct {
+	Transform geogeom.CoordTransform
+	Nodes     []*Node
+	Edges     []*Edge
+
+	nodeOfLocation map[*nextbus.Location]*Node
+	pathEdges      map[*nextbus.Path][]*Edge
+}
+
+// NewGraph returns the network of the paths of agency, with the transform to
+// the metric plane centered on the paths, and with nodes closer than
+// mergeDistance (meters) combined. Returns nil if the agency has no paths.
+func NewGraph(agency *nextbus.Agency, mergeDistance float64) *Graph {
+	min, max, ok := agency.GetPathBounds()
+	if !ok {
+		glog.Error("Agency has no paths!")
+		return nil
+	}
+	center := geo.Location{
+		Lat: (min.Lat + max.Lat) / 2,
+		Lon: (min.Lon + max.Lon) / 2,
+	}
+	return NewGraphWithTransform(
+		agency, geogeom.MakeLocalTransverseMercator(center), mergeDistance)
+}
+
+// NewGraphWithTransform is like NewGraph, but uses xf to transform locations
+// to the metric plane.
+func NewGraphWithTransform(agency *nextbus.Agency,
+	xf geogeom.CoordTransform, mergeDistance float64) *Graph {
+	g := &Graph{
+		Transform:      xf,
+		nodeOfLocation: make(map[*nextbus.Location]*Node),
+		pathEdges:      make(map[*nextbus.Path][]*Edge),
+	}
+	paths := nextbus.PathsSlice(agency.GetPaths())
+	sort.Sort(paths)
+
+	// Find the waypoints that are to be nodes, in a deterministic order.
+	var nodeLocs []*nextbus.Location
+	isNodeLoc := make(map[*nextbus.Location]bool)
+	addNodeLoc := func(loc *nextbus.Location) {
+		if !isNodeLoc[loc] {
+			isNodeLoc[loc] = true
+			nodeLocs = append(nodeLocs, loc)
+		}
+	}
+	for _, path := range paths {
+		last := len(path.WayPoints) - 1
+		for i, loc := range path.WayPoints {
+			if i == 0 || i == last || len(loc.Paths) > 1 {
+				addNodeLoc(loc)
+			}
+		}
+	}
+
+	// Merge those that are near each other.
+	points := make([]geom.Point, len(nodeLocs))
+	for i, loc := range nodeLocs {
+		points[i] = xf.ToPoint(loc.Location)
+	}
+	groups := mergeNearbyPoints(points, mergeDistance)
+	for _, group := range groups {
+		node := &Node{Index: len(g.Nodes)}
+		var sumX, sumY float64
+		for _, i := range group {
+			node.Locations = append(node.Locations, nodeLocs[i])
+			g.nodeOfLocation[nodeLocs[i]] = node
+			sumX += points[i].X
+			sumY += points[i].Y
+		}
+		n := float64(len(group))
+		node.Point = geom.Point{X: sumX / n, Y: sumY / n}
+		g.Nodes = append(g.Nodes, node)
+	}
+
+	// Split the paths into edges at the nodes.
+	for _, path := range paths {
+		if len(path.WayPoints) < 2 {
+			continue
+		}
+		var edge *Edge
+		offset := 0.0
+		var prevPt geom.Point
+		for i, loc := range path.WayPoints {
+			pt := xf.ToPoint(loc.Location)
+			if i > 0 {
+				d := prevPt.Distance(pt)
+				offset += d
+				edge.Length += d
+				edge.Points = append(edge.Points, pt)
+			}
+			prevPt = pt
+			node := g.nodeOfLocation[loc]
+			if node == nil {
+				continue
+			}
+			if edge != nil {
+				edge.To = node
+				edge.ToWayPoint = i
+				g.addEdge(edge, mergeDistance)
+			}
+			edge = &Edge{
+				From:         node,
+				Path:         path,
+				FromWayPoint: i,
+				Offset:       offset,
+				Points:       []geom.Point{pt},
+			}
+		}
+	}
+	glog.Infof("Created network with %d nodes and %d edges from %d paths",
+		len(g.Nodes), len(g.Edges), len(paths))
+	return g
+}
+
+func (g *Graph) addEdge(edge *Edge, mergeDistance float64) {
+	if edge.From == edge.To && edge.Length <= mergeDistance {
+		// Between two waypoints that were merged into the same node.
+		return
+	}
+	edge.Index = len(g.Edges)
+	edge.bounds = geom.PointsBounds(edge.Points)
+	edge.From.Out = append(edge.From.Out, edge)
+	edge.To.In = append(edge.To.In, edge)
+	g.Edges = append(g.Edges, edge)
+	g.pathEdges[edge.Path] = append(g.pathEdges[edge.Path], edge)
+}
+
+// Groups the points such that each point is within mergeDistance of at least
+// one other point in its group (single linkage clustering). Groups are
+// ordered by their lowest index.
+func mergeNearbyPoints(points []geom.Point, mergeDistance float64) [][]int {
+	uf := newUnionFind(len(points))
+	if mergeDistance > 0 {
+		// Bucket the points into cells of size mergeDistance, so that only
+		// points in adjacent cells need to be compared.
+		type cell struct{ x, y int64 }
+		toCell := func(pt geom.Point) cell {
+			return cell{int64(math.Floor(pt.X / mergeDistance)),
+				int64(math.Floor(pt.Y / mergeDistance))}
+		}
+		cells := make(map[cell][]int)
+		for i, pt := range points {
+			c := toCell(pt)
+			for dx := int64(-1); dx <= 1; dx++ {
+				for dy := int64(-1); dy <= 1; dy++ {
+					for _, j := range cells[cell{c.x + dx, c.y + dy}] {
+						if pt.Distance(points[j]) <= mergeDistance {
+							uf.union(i, j)
+						}
+					}
+				}
+			}
+			cells[c] = append(cells[c], i)
+		}
+	}
+	return uf.groups()
+}
+
+// NodeOfLocation returns the node at loc, or nil if loc isn't a node.
+func (g *Graph) NodeOfLocation(loc *nextbus.Location) *Node {
+	return g.nodeOfLocation[loc]
+}
+
+// PathEdges returns the edges of path, in order along the path.
+func (g *Graph) PathEdges(path *nextbus.Path) []*Edge {
+	return g.pathEdges[path]
+}
+
+// ConnectedPaths returns a map from each path to the paths that might follow
+// it, i.e. those that leave a node on the path (other than its first node).
+func (g *Graph) ConnectedPaths() map[*nextbus.Path][]*nextbus.Path {
+	result := make(map[*nextbus.Path][]*nextbus.Path)
+	for path, edges := range g.pathEdges {
+		seen := map[*nextbus.Path]bool{path: true}
+		var next []*nextbus.Path
+		for _, edge := range edges {
+			for _, out := range edge.To.Out {
+				if !seen[out.Path] {
+					seen[out.Path] = true
+					next = append(next, out.Path)
+				}
+			}
+		}
+		sort.Sort(nextbus.PathsSlice(next))
+		result[path] = next
+	}
+	return result
+}
+
+// Locate returns the position on the network nearest to loc, if there is one
+// within maxDistance (meters).
+func (g *Graph) Locate(loc geo.Location, maxDistance float64) (Position, bool) {
+	return g.LocatePoint(g.Transform.ToPoint(loc), maxDistance)
+}
+
+// LocatePoint is like Locate, but for a point in the metric plane.
+func (g *Graph) LocatePoint(pt geom.Point, maxDistance float64) (
+	best Position, ok bool) {
+	best.Distance = maxDistance
+	query := pt.ToRect(maxDistance, maxDistance)
+	for _, edge := range g.Edges {
+		if !edge.bounds.Intersects(query) {
+			continue
+		}
+		offset := 0.0
+		for i := 1; i < len(edge.Points); i++ {
+			seg := geom.NewDirectedSegment(edge.Points[i-1], edge.Points[i])
+			nearest, _ := seg.ClosestPointTo(pt)
+			if d := pt.Distance(nearest); d < best.Distance || (!ok && d == best.Distance) {
+				best = Position{
+					Edge:     edge,
+					Offset:   offset + edge.Points[i-1].Distance(nearest),
+					Point:    nearest,
+					Distance: d,
+				}
+				ok = true
+			}
+			offset += seg.Length()
+		}
+	}
+	return
+}
+
+// ShortestPath returns the edges of a shortest route from node from to node
+// to, and its length; ok is false if to isn't reachable from from.
+func (g *Graph) ShortestPath(from, to *Node) (
+	edges []*Edge, distance float64, ok bool) {
+	dist, via := g.dijkstra(from, to)
+	distance, ok = dist[to]
+	if !ok {
+		return
+	}
+	for node := to; node != from; {
+		edge := via[node]
+		edges = append(edges, edge)
+		node = edge.From
+	}
+	for i, j := 0, len(edges)-1; i < j; i, j = i+1, j-1 {
+		edges[i], edges[j] = edges[j], edges[i]
+	}
+	return
+}
+
+// ShortestPathBetweenPositions returns the edges of a shortest route from a
+// to b (starting with a.Edge and ending with b.Edge), and its length.
+func (g *Graph) ShortestPathBetweenPositions(a, b Position) (
+	edges []*Edge, distance float64, ok bool) {
+	if a.Edge == b.Edge && a.Offset <= b.Offset {
+		return []*Edge{a.Edge}, b.Offset - a.Offset, true
+	}
+	middle, d, ok := g.ShortestPath(a.Edge.To, b.Edge.From)
+	if !ok {
+		return
+	}
+	edges = append(append([]*Edge{a.Edge}, middle...), b.Edge)
+	distance = (a.Edge.Length - a.Offset) + d + b.Offset
+	return
+}
+
+// ShortestPathBetweenStops locates the stops on the network (each must be
+// within maxDistance of an edge), and returns the shortest route between them.
+func (g *Graph) ShortestPathBetweenStops(a, b *nextbus.Stop,
+	maxDistance float64) (edges []*Edge, distance float64, ok bool) {
+	if a.Location == nil || b.Location == nil {
+		return
+	}
+	pa, ok := g.Locate(a.Location.Location, maxDistance)
+	if !ok {
+		return
+	}
+	pb, ok := g.Locate(b.Location.Location, maxDistance)
+	if !ok {
+		return
+	}
+	return g.ShortestPathBetweenPositions(pa, pb)
+}
+
+// Fragments returns the weakly connected components of the network (i.e.
+// ignoring the direction of edges), largest (most nodes) first. A network
+// without gaps has a single fragment.
+func (g *Graph) Fragments() [][]*Node {
+	uf := newUnionFind(len(g.Nodes))
+	for _, edge := range g.Edges {
+		uf.union(edge.From.Index, edge.To.Index)
+	}
+	var result [][]*Node
+	for _, group := range uf.groups() {
+		nodes := make([]*Node, len(group))
+		for i, n := range group {
+			nodes[i] = g.Nodes[n]
+		}
+		result = append(result, nodes)
+	}
+	sort.Stable(fragmentsSlice(result))
+	return result
+}
+
+type fragmentsSlice [][]*Node
+
+func (p fragmentsSlice) Len() int           { return len(p) }
+func (p fragmentsSlice) Less(i, j int) bool { return len(p[i]) > len(p[j]) }
+func (p fragmentsSlice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// Single source shortest paths, stopping once target (if not nil) is reached.
+func (g *Graph) dijkstra(source, target *Node) (
+	dist map[*Node]float64, via map[*Node]*Edge) {
+	dist = map[*Node]float64{source: 0}
+	via = make(map[*Node]*Edge)
+	done := make(map[*Node]bool)
+	q := &nodeQueue{}
+	heap.Push(q, nodeQueueItem{source, 0})
+	for q.Len() > 0 {
+		item := heap.Pop(q).(nodeQueueItem)
+		if done[item.node] {
+			continue
+		}
+		done[item.node] = true
+		if item.node == target {
+			break
+		}
+		for _, edge := range item.node.Out {
+			d := item.distance + edge.Length
+			if prev, ok := dist[edge.To]; !ok || d < prev {
+				dist[edge.To] = d
+				via[edge.To] = edge
+				heap.Push(q, nodeQueueItem{edge.To, d})
+			}
+		}
+	}
+	return
+}
+
+type nodeQueueItem struct {
+	node     *Node
+	distance float64
+}
+
+type nodeQueue []nodeQueueItem
+
+func (q nodeQueue) Len() int { return len(q) }
+func (q nodeQueue) Less(i, j int) bool {
+	if q[i].distance != q[j].distance {
+		return q[i].distance < q[j].distance
+	}
+	return q[i].node.Index < q[j].node.Index
+}
+func (q nodeQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *nodeQueue) Push(x interface{}) { *q = append(*q, x.(nodeQueueItem)) }
+func (q *nodeQueue) Pop() interface{} {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
+
+type unionFind struct {
+	parent []int
+}
+
+func newUnionFind(n int) *unionFind {
+	p := &unionFind{parent: make([]int, n)}
+	for i := range p.parent {
+		p.parent[i] = i
+	}
+	return p
+}
+
+func (p *unionFind) find(i int) int {
+	for p.parent[i] != i {
+		p.parent[i] = p.parent[p.parent[i]]
+		i = p.parent[i]
+	}
+	return i
+}
+
+func (p *unionFind) union(i, j int) {
+	ri, rj := p.find(i), p.find(j)
+	if ri < rj {
+		p.parent[rj] = ri
+	} else if rj < ri {
+		p.parent[ri] = rj
+	}
+}
+
+// Returns the sets, each in increasing order, ordered by their lowest member.
+func (p *unionFind) groups() (result [][]int) {
+	index := make(map[int]int)
+	for i := range p.parent {
+		r := p.find(i)
+		n, ok := index[r]
+		if !ok {
+			n = len(result)
+			index[r] = n
+			result = append(result, nil)
+		}
+		result[n] = append(result[n], i)
+	}
+	return
+}
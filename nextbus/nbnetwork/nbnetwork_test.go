@@ -0,0 +1,244 @@
+package nbnetwork
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/jamessynge/transit_tools/geo"
+	"github.com/jamessynge/transit_tools/nextbus"
+)
+
+// Paths 1, 2 and 4 are connected (path 4 starts a couple of meters from the
+// end of path 2), while path 3 is off on its own.
+const testPathsXml = `<?xml version="1.0" encoding="utf-8" ?>
+<body agency="test">
+	<path>
+		<route tag="1" title="One"/>
+		<point lat="42.35" lon="-71.07"/>
+		<point lat="42.35" lon="-71.065"/>
+		<point lat="42.35" lon="-71.06"/>
+	</path>
+	<path>
+		<route tag="1" title="One"/>
+		<point lat="42.35" lon="-71.06"/>
+		<point lat="42.355" lon="-71.06"/>
+	</path>
+	<path>
+		<route tag="2" title="Two"/>
+		<point lat="42.36" lon="-71.05"/>
+		<point lat="42.365" lon="-71.05"/>
+	</path>
+	<path>
+		<route tag="1" title="One"/>
+		<point lat="42.35502" lon="-71.06"/>
+		<point lat="42.355" lon="-71.05"/>
+	</path>
+</body>`
+
+func makeTestGraph(t *testing.T) (*nextbus.Agency, *Graph) {
+	agency, err := nextbus.ReadPaths(strings.NewReader(testPathsXml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := NewGraph(agency, 10)
+	if g == nil {
+		t.Fatal("NewGraph returned nil")
+	}
+	return agency, g
+}
+
+func nodeAt(g *Graph, agency *nextbus.Agency, lat, lon float64) *Node {
+	loc := agency.Locations[geo.Location{
+		Lat: geo.Latitude(lat), Lon: geo.Longitude(lon)}]
+	if loc == nil {
+		return nil
+	}
+	return g.NodeOfLocation(loc)
+}
+
+func TestGraphStructure(t *testing.T) {
+	agency, g := makeTestGraph(t)
+	if len(g.Nodes) != 6 || len(g.Edges) != 4 {
+		t.Fatalf("Expected 6 nodes and 4 edges, not %d and %d",
+			len(g.Nodes), len(g.Edges))
+	}
+	// The intermediate waypoint of path 1 isn't a node.
+	if n := nodeAt(g, agency, 42.35, -71.065); n != nil {
+		t.Errorf("Unexpected node: %#v", n)
+	}
+	// The end of path 2 and the start of path 4 are merged.
+	c := nodeAt(g, agency, 42.355, -71.06)
+	if c == nil || c != nodeAt(g, agency, 42.35502, -71.06) {
+		t.Errorf("Nearby nodes not merged")
+	}
+	path1 := agency.GetPath(1)
+	edges := g.PathEdges(path1)
+	if len(edges) != 1 || edges[0].FromWayPoint != 0 ||
+		edges[0].ToWayPoint != 2 || len(edges[0].Points) != 3 {
+		t.Errorf("Wrong edges for path 1: %#v", edges)
+	}
+
+	connected := g.ConnectedPaths()
+	expected := map[int][]int{1: {2}, 2: {4}, 3: nil, 4: nil}
+	for index, next := range expected {
+		actual := connected[agency.GetPath(index)]
+		if len(actual) != len(next) {
+			t.Errorf("Path %d: expected %v, got %v", index, next, actual)
+			continue
+		}
+		for i := range next {
+			if actual[i].Index != next[i] {
+				t.Errorf("Path %d: expected %v, got %v", index, next, actual)
+			}
+		}
+	}
+
+	fragments := g.Fragments()
+	if len(fragments) != 2 || len(fragments[0]) != 4 || len(fragments[1]) != 2 {
+		t.Errorf("Wrong fragments: %v", fragments)
+	}
+}
+
+func TestShortestPath(t *testing.T) {
+	agency, g := makeTestGraph(t)
+	a := nodeAt(g, agency, 42.35, -71.07)
+	f := nodeAt(g, agency, 42.355, -71.05)
+	edges, distance, ok := g.ShortestPath(a, f)
+	if !ok || len(edges) != 3 {
+		t.Fatalf("Expected a route of 3 edges: %v, %v", edges, ok)
+	}
+	sum := 0.0
+	for i, edge := range edges {
+		if edge.Path.Index != []int{1, 2, 4}[i] {
+			t.Errorf("Wrong path for edge %d: %d", i, edge.Path.Index)
+		}
+		sum += edge.Length
+	}
+	if math.Abs(sum-distance) > 0.001 {
+		t.Errorf("Distance %v isn't the sum of the edge lengths %v", distance, sum)
+	}
+	// Edges are directed.
+	if _, _, ok := g.ShortestPath(f, a); ok {
+		t.Errorf("Unexpected route from f to a")
+	}
+	// Not connected.
+	d := nodeAt(g, agency, 42.36, -71.05)
+	if _, _, ok := g.ShortestPath(a, d); ok {
+		t.Errorf("Unexpected route from a to d")
+	}
+}
+
+func TestShortestPathBetweenStops(t *testing.T) {
+	_, g := makeTestGraph(t)
+	makeStop := func(tag string, lat, lon float64) *nextbus.Stop {
+		stop := nextbus.NewStop(tag)
+		stop.Location = &nextbus.Location{Location: geo.Location{
+			Lat: geo.Latitude(lat), Lon: geo.Longitude(lon)}}
+		return stop
+	}
+	// Half way along path 1, and half way along path 4.
+	s1 := makeStop("s1", 42.35005, -71.065)
+	s2 := makeStop("s2", 42.355, -71.055)
+
+	p1, ok := g.Locate(s1.Location.Location, 20)
+	if !ok || p1.Edge.Path.Index != 1 || math.Abs(p1.Distance-5.56) > 0.1 {
+		t.Fatalf("Wrong position for s1: %#v", p1)
+	}
+	if math.Abs(p1.Offset-p1.Edge.Length/2) > 0.5 {
+		t.Errorf("Wrong offset for s1: %v of %v", p1.Offset, p1.Edge.Length)
+	}
+
+	edges, distance, ok := g.ShortestPathBetweenStops(s1, s2, 20)
+	if !ok || len(edges) != 3 {
+		t.Fatalf("Expected a route of 3 edges: %v, %v", edges, ok)
+	}
+	expected := edges[0].Length/2 + edges[1].Length + edges[2].Length/2
+	if math.Abs(distance-expected) > 1 {
+		t.Errorf("Distance %v, expected about %v", distance, expected)
+	}
+	if _, _, ok := g.ShortestPathBetweenStops(s2, s1, 20); ok {
+		t.Errorf("Unexpected route from s2 to s1")
+	}
+	if _, _, ok := g.ShortestPathBetweenStops(
+		s1, makeStop("far", 42.4, -71.0), 20); ok {
+		t.Errorf("Unexpected route to a stop far from the network")
+	}
+}
+
+// Path 1 runs east, and path 2 north, crossing at an interior waypoint of
+// each.
+const testCrossingPathsXml = `<?xml version="1.0" encoding="utf-8" ?>
+<body agency="test">
+	<path>
+		<route tag="1" title="One"/>
+		<point lat="42.35" lon="-71.07"/>
+		<point lat="42.35" lon="-71.06"/>
+		<point lat="42.35" lon="-71.05"/>
+	</path>
+	<path>
+		<route tag="2" title="Two"/>
+		<point lat="42.345" lon="-71.06"/>
+		<point lat="42.35" lon="-71.06"/>
+		<point lat="42.355" lon="-71.06"/>
+	</path>
+</body>`
+
+func TestCrossingPaths(t *testing.T) {
+	agency, err := nextbus.ReadPaths(strings.NewReader(testCrossingPathsXml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := NewGraph(agency, 10)
+	if g == nil {
+		t.Fatal("NewGraph returned nil")
+	}
+	if len(g.Nodes) != 5 || len(g.Edges) != 4 {
+		t.Fatalf("Expected 5 nodes and 4 edges, not %d and %d",
+			len(g.Nodes), len(g.Edges))
+	}
+	junction := nodeAt(g, agency, 42.35, -71.06)
+	if junction == nil || len(junction.Locations) != 1 ||
+		len(junction.In) != 2 || len(junction.Out) != 2 {
+		t.Fatalf("Wrong junction node: %#v", junction)
+	}
+	path1, path2 := agency.GetPath(1), agency.GetPath(2)
+	for _, path := range []*nextbus.Path{path1, path2} {
+		edges := g.PathEdges(path)
+		if len(edges) != 2 || edges[0].To != junction ||
+			edges[1].From != junction || edges[1].FromWayPoint != 1 {
+			t.Errorf("Path %d not split at the junction: %#v", path.Index, edges)
+		}
+	}
+	connected := g.ConnectedPaths()
+	if next := connected[path1]; len(next) != 1 || next[0] != path2 {
+		t.Errorf("Paths following path 1: %v", next)
+	}
+	if next := connected[path2]; len(next) != 1 || next[0] != path1 {
+		t.Errorf("Paths following path 2: %v", next)
+	}
+
+	// West to north, turning at the junction.
+	west := nodeAt(g, agency, 42.35, -71.07)
+	north := nodeAt(g, agency, 42.355, -71.06)
+	edges, distance, ok := g.ShortestPath(west, north)
+	if !ok || len(edges) != 2 {
+		t.Fatalf("Expected a route of 2 edges: %v, %v", edges, ok)
+	}
+	if edges[0].Path != path1 || edges[0].To != junction ||
+		edges[1].Path != path2 || edges[1].From != junction {
+		t.Errorf("Route doesn't turn at the junction: %#v", edges)
+	}
+	// About 822 meters east, then 556 meters north.
+	if math.Abs(distance-1378) > 5 {
+		t.Errorf("Wrong distance: %v", distance)
+	}
+	// Edges are directed, so there is no route to the south end of path 2.
+	south := nodeAt(g, agency, 42.345, -71.06)
+	if _, _, ok := g.ShortestPath(west, south); ok {
+		t.Errorf("Unexpected route from west to south")
+	}
+	if fragments := g.Fragments(); len(fragments) != 1 {
+		t.Errorf("Wrong fragments: %v", fragments)
+	}
+}
@@ -0,0 +1,411 @@
+// Package nbparquet exports vehicle location CSV files (the daily files
+// written by the fetcher, the leaf files of a partitioning, or the per-path
+// files of locations_to_nearest_paths) to Parquet files partitioned by date,
+// for analysis with tools such as DuckDB and pandas.
+//
+// The schema follows the CSV columns named by nextbus.VehicleCSVFieldNames:
+// each known column is given a type (e.g. unix_ms becomes a timestamp column),
+// the redundant "date time" column is dropped, and any column not known here
+// is exported as a nullable string, so that adding a CSV column doesn't break
+// the export. When the CSV file contains the locations matched to a single
+// path, the path index (and config snapshot, if known) are added as columns.
+package nbparquet
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/jamessynge/transit_tools/nextbus"
+	"github.com/jamessynge/transit_tools/parquet"
+	"github.com/jamessynge/transit_tools/util"
+)
+
+// Names of the columns for the matched path fields.
+const (
+	PathIndexColumn      = "path_index"
+	ConfigSnapshotColumn = "config_snapshot"
+)
+
+// Converts a CSV field to the value of a column; returns nil for a null, or
+// an error if the record should be skipped.
+type fieldConverter func(field string) (interface{}, error)
+
+type knownField struct {
+	column  parquet.Column
+	convert fieldConverter
+}
+
+func nullIfEmpty(field string) (interface{}, error) {
+	if len(field) == 0 {
+		return nil, nil
+	}
+	return field, nil
+}
+
+func parseTimestamp(field string) (interface{}, error) {
+	ms, err := strconv.ParseInt(field, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	if ms < nextbus.Jan_1_2000_UTC || ms > nextbus.Jan_1_2100_UTC {
+		return nil, fmt.Errorf("Timestamp out of range: %d", ms)
+	}
+	return ms, nil
+}
+
+func parseHeading(field string) (interface{}, error) {
+	// As in CSVFieldsIntoVehicleLocation, a bad heading isn't a reason to
+	// discard the record.
+	v, err := strconv.ParseInt(field, 10, 32)
+	if err != nil || v < 0 {
+		return nil, nil
+	}
+	return int32(v), nil
+}
+
+func parseDouble(field string) (interface{}, error) {
+	return strconv.ParseFloat(field, 64)
+}
+
+// The CSV fields with a known type, by the name in VehicleCSVFieldNames. A
+// field mapped to nil is omitted from the export.
+var knownFields = map[string]*knownField{
+	"unix_ms": {
+		parquet.Column{Name: "timestamp", Type: parquet.Int64,
+			ConvertedType: parquet.TimestampMillis},
+		parseTimestamp,
+	},
+	"date time": nil,
+	"vehicle id": {
+		parquet.StringColumn("vehicle_id", false),
+		func(field string) (interface{}, error) { return field, nil },
+	},
+	"route tag":     {parquet.StringColumn("route_tag", true), nullIfEmpty},
+	"direction tag": {parquet.StringColumn("dir_tag", true), nullIfEmpty},
+	"heading": {
+		parquet.Column{Name: "heading", Type: parquet.Int32,
+			ConvertedType: parquet.NoConvertedType, Optional: true},
+		parseHeading,
+	},
+	"latitude": {
+		parquet.Column{Name: "lat", Type: parquet.Double,
+			ConvertedType: parquet.NoConvertedType},
+		parseDouble,
+	},
+	"longitude": {
+		parquet.Column{Name: "lon", Type: parquet.Double,
+			ConvertedType: parquet.NoConvertedType},
+		parseDouble,
+	},
+}
+
+var nonAlnumRE = regexp.MustCompile("[^a-z0-9]+")
+
+// Returns the column name for a CSV field name (e.g. "vehicle id" becomes
+// vehicle_id).
+func ColumnName(fieldName string) string {
+	return strings.Trim(nonAlnumRE.ReplaceAllString(
+		strings.ToLower(fieldName), "_"), "_")
+}
+
+// Describes how a CSV record is converted to a row.
+type Schema struct {
+	Columns []parquet.Column
+	// Index of the CSV field for each column, or -1 for a column whose value
+	// is constant for the file (i.e. the matched path fields).
+	fieldIndices []int
+	converters   []fieldConverter
+	numFields    int
+}
+
+// NewSchema returns the schema for CSV files with the fields named (usually
+// nextbus.VehicleCSVFieldNames()); if withMatchedPath is true, columns for
+// the matched path fields are added.
+func NewSchema(fieldNames []string, withMatchedPath bool) *Schema {
+	p := &Schema{numFields: len(fieldNames)}
+	for i, name := range fieldNames {
+		known, ok := knownFields[name]
+		if ok && known == nil {
+			continue
+		}
+		if !ok {
+			known = &knownField{
+				parquet.StringColumn(ColumnName(name), true), nullIfEmpty}
+		}
+		p.Columns = append(p.Columns, known.column)
+		p.fieldIndices = append(p.fieldIndices, i)
+		p.converters = append(p.converters, known.convert)
+	}
+	if withMatchedPath {
+		p.Columns = append(p.Columns,
+			parquet.Column{Name: PathIndexColumn, Type: parquet.Int32,
+				ConvertedType: parquet.NoConvertedType, Optional: true},
+			parquet.StringColumn(ConfigSnapshotColumn, true))
+		p.fieldIndices = append(p.fieldIndices, -1, -1)
+		p.converters = append(p.converters, nil, nil)
+	}
+	return p
+}
+
+// Index of the timestamp column, used for partitioning by date.
+func (p *Schema) timestampColumn() int {
+	for i, col := range p.Columns {
+		if col.ConvertedType == parquet.TimestampMillis {
+			return i
+		}
+	}
+	return -1
+}
+
+// ToRow converts a CSV record into a row; constants holds the values of the
+// columns that don't come from the record.
+func (p *Schema) ToRow(record []string, constants []interface{}) (
+	[]interface{}, error) {
+	if len(record) != p.numFields {
+		return nil, fmt.Errorf("Expected %d fields, not %d", p.numFields,
+			len(record))
+	}
+	row := make([]interface{}, len(p.Columns))
+	c := 0
+	for i, fieldIndex := range p.fieldIndices {
+		if fieldIndex < 0 {
+			row[i] = constants[c]
+			c++
+			continue
+		}
+		v, err := p.converters[i](record[fieldIndex])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s: %v", p.Columns[i].Name, err)
+		}
+		row[i] = v
+	}
+	return row, nil
+}
+
+var perPathFileRE = regexp.MustCompile(
+	`^path_(\d+|unknown)_locations\.csv(\.gz)?$`)
+
+// MatchedPathOf returns the path index of a per-path locations file written
+// by locations_to_nearest_paths (nil for the file of unmatched locations),
+// and the name of the config snapshot of the paths if the file is in a
+// directory named for the snapshot; ok is false for other files.
+func MatchedPathOf(filePath string) (pathIndex, snapshot interface{}, ok bool) {
+	m := perPathFileRE.FindStringSubmatch(filepath.Base(filePath))
+	if m == nil {
+		return nil, nil, false
+	}
+	if m[1] != "unknown" {
+		if n, err := strconv.ParseInt(m[1], 10, 32); err == nil {
+			pathIndex = int32(n)
+		}
+	}
+	dir := filepath.Base(filepath.Dir(filePath))
+	if _, err := time.Parse("2006-01-02_1504", dir); err == nil {
+		snapshot = dir
+	}
+	return pathIndex, snapshot, true
+}
+
+// Writes the locations of CSV files into Parquet files partitioned by date:
+// the locations of foo.csv.gz on date D are written to
+// OutputDir/date=D/foo.parquet (the layout understood as "hive partitioning"
+// by DuckDB, pandas and Spark).
+type Exporter struct {
+	OutputDir string
+	// If set, the Parquet files of a CSV file under InputDir are named for
+	// the path of the CSV file relative to InputDir (e.g. the locations of
+	// InputDir/a/b/foo.csv.gz are written to a_b_foo.parquet), so that CSV
+	// files with the same name in different directories don't overwrite
+	// each other.
+	InputDir string
+	// Time zone in which dates are determined.
+	Location     *time.Location
+	Codec        parquet.Codec
+	RowGroupSize int
+	// If false, existing Parquet files are left as they are.
+	Overwrite bool
+	// The names of the fields of the CSV files.
+	FieldNames []string
+}
+
+func NewExporter(outputDir string) *Exporter {
+	return &Exporter{
+		OutputDir:    outputDir,
+		Location:     time.Local,
+		Codec:        parquet.Gzip,
+		RowGroupSize: parquet.DefaultRowGroupSize,
+		FieldNames:   nextbus.VehicleCSVFieldNames(),
+	}
+}
+
+// The file being written for one date.
+type partitionFile struct {
+	path    string
+	tmpPath string
+	f       *os.File
+	w       *parquet.Writer
+}
+
+// ParquetName returns the name of the Parquet files for a CSV file. If the
+// CSV file is in a subdirectory of InputDir, the name starts with that
+// directory (with the separators replaced by underscores). Per-path files of
+// different config snapshots have the same base names, so otherwise the
+// snapshot is included.
+func (p *Exporter) ParquetName(csvPath string) string {
+	name := filepath.Base(csvPath)
+	name = strings.TrimSuffix(strings.TrimSuffix(name, ".gz"), ".csv")
+	dir := ""
+	if len(p.InputDir) > 0 {
+		rel, err := filepath.Rel(p.InputDir, filepath.Dir(csvPath))
+		if err == nil && rel != "." && rel != ".." &&
+			!strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			dir = strings.Replace(filepath.ToSlash(rel), "/", "_", -1)
+		}
+	}
+	if len(dir) > 0 {
+		name = dir + "_" + name
+	} else if _, snapshot, ok := MatchedPathOf(csvPath); ok && snapshot != nil {
+		name = snapshot.(string) + "_" + name
+	}
+	return name + ".parquet"
+}
+
+func (p *Exporter) partitionPath(date, name string) string {
+	return filepath.Join(p.OutputDir, "date="+date, name)
+}
+
+func (p *Exporter) openPartition(
+	schema *Schema, filePath, csvPath string) (*partitionFile, error) {
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return nil, err
+	}
+	pf := &partitionFile{path: filePath, tmpPath: filePath + ".tmp"}
+	var err error
+	if pf.f, err = os.Create(pf.tmpPath); err != nil {
+		return nil, err
+	}
+	pf.w = parquet.NewWriter(pf.f, schema.Columns)
+	pf.w.Codec = p.Codec
+	pf.w.RowGroupSize = p.RowGroupSize
+	pf.w.Metadata = map[string]string{
+		"source":          filepath.Base(csvPath),
+		"csv_field_names": strings.Join(p.FieldNames, ","),
+	}
+	return pf, nil
+}
+
+func (pf *partitionFile) close() error {
+	err := pf.w.Close()
+	if err2 := pf.f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(pf.tmpPath, pf.path)
+	}
+	if err != nil {
+		os.Remove(pf.tmpPath)
+	}
+	return err
+}
+
+// ExportCsvFile writes the locations in the CSV file to the Parquet files of
+// the dates on which they occurred; returns the number of rows written, and
+// the paths of the files written. Records that can't be converted are logged
+// and skipped.
+func (p *Exporter) ExportCsvFile(csvPath string) (
+	numRows int, written []string, err error) {
+	pathIndex, snapshot, matched := MatchedPathOf(csvPath)
+	schema := NewSchema(p.FieldNames, matched)
+	tsColumn := schema.timestampColumn()
+	if tsColumn < 0 {
+		return 0, nil, fmt.Errorf("No timestamp field in %v", p.FieldNames)
+	}
+	var constants []interface{}
+	if matched {
+		constants = []interface{}{pathIndex, snapshot}
+	}
+	name := p.ParquetName(csvPath)
+	partitions := make(map[string]*partitionFile)
+	skipped := make(map[string]bool)
+	closeAll := func() {
+		for _, pf := range partitions {
+			pf.w.Close()
+			pf.f.Close()
+			os.Remove(pf.tmpPath)
+		}
+	}
+	numBad := 0
+	fn := func(source string, record []string, recordNum int, err error) error {
+		if _, ok := err.(*csv.ParseError); ok {
+			numBad++
+			glog.V(1).Infof("Skipping record %d of %s: %v", recordNum+1, source, err)
+			return nil
+		} else if err != nil {
+			return err
+		}
+		row, err := schema.ToRow(record, constants)
+		if err != nil {
+			numBad++
+			glog.V(1).Infof("Skipping record %d of %s: %v", recordNum+1, source, err)
+			return nil
+		}
+		ms := row[tsColumn].(int64)
+		date := util.UnixMillisToTime(ms).In(p.Location).Format("2006-01-02")
+		pf := partitions[date]
+		if pf == nil {
+			if skipped[date] {
+				return nil
+			}
+			filePath := p.partitionPath(date, name)
+			if !p.Overwrite && util.Exists(filePath) {
+				glog.Infof("Skipping existing file %s", filePath)
+				skipped[date] = true
+				return nil
+			}
+			if pf, err = p.openPartition(schema, filePath, csvPath); err != nil {
+				return err
+			}
+			partitions[date] = pf
+		}
+		if err := pf.w.AppendRow(row...); err != nil {
+			return err
+		}
+		numRows++
+		return nil
+	}
+	if _, err = util.ReadCsvFileToFn(csvPath, fn); err != nil {
+		closeAll()
+		return 0, nil, err
+	}
+	if numBad > 0 {
+		glog.Warningf("Skipped %d bad records in %s", numBad, csvPath)
+	}
+	errs := util.NewErrors()
+	for _, date := range sortedDates(partitions) {
+		pf := partitions[date]
+		if err := pf.close(); err != nil {
+			errs.AddError(err)
+		} else {
+			written = append(written, pf.path)
+		}
+	}
+	return numRows, written, errs.ToError()
+}
+
+func sortedDates(partitions map[string]*partitionFile) []string {
+	var dates []string
+	for date := range partitions {
+		dates = append(dates, date)
+	}
+	sort.Strings(dates)
+	return dates
+}
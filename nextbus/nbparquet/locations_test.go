@@ -0,0 +1,184 @@
+package nbparquet
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jamessynge/transit_tools/nextbus"
+	"github.com/jamessynge/transit_tools/parquet"
+	"github.com/jamessynge/transit_tools/util"
+)
+
+func TestSchema(t *testing.T) {
+	schema := NewSchema(nextbus.VehicleCSVFieldNames(), false)
+	var names []string
+	for _, col := range schema.Columns {
+		names = append(names, col.Name)
+	}
+	expected := []string{"timestamp", "vehicle_id", "route_tag", "dir_tag",
+		"heading", "lat", "lon"}
+	if len(names) != len(expected) {
+		t.Fatalf("Wrong columns: %v", names)
+	}
+	for i := range names {
+		if names[i] != expected[i] {
+			t.Errorf("Wrong columns: %v", names)
+		}
+	}
+	if schema.Columns[0].ConvertedType != parquet.TimestampMillis {
+		t.Errorf("Wrong timestamp column: %v", schema.Columns[0])
+	}
+
+	row, err := schema.ToRow([]string{"1400000000123", "20140513 125320",
+		"0123", "39", "", "-4", "42.3", "-71.1"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if row[0] != int64(1400000000123) || row[1] != "0123" || row[2] != "39" ||
+		row[3] != nil || row[4] != nil || row[5] != 42.3 || row[6] != -71.1 {
+		t.Errorf("Wrong row: %#v", row)
+	}
+	if _, err := schema.ToRow([]string{"x", "", "", "", "", "", "", ""}, nil); err == nil {
+		t.Error("Expected error for invalid timestamp")
+	}
+	if _, err := schema.ToRow([]string{"1400000000123"}, nil); err == nil {
+		t.Error("Expected error for missing fields")
+	}
+
+	// Unknown fields (e.g. added to the CSV files later) become strings.
+	fieldNames := append(nextbus.VehicleCSVFieldNames(), "Speed (km/hr)")
+	schema = NewSchema(fieldNames, true)
+	n := len(schema.Columns)
+	if n != 10 || schema.Columns[7].Name != "speed_km_hr" ||
+		schema.Columns[8].Name != PathIndexColumn ||
+		schema.Columns[9].Name != ConfigSnapshotColumn {
+		t.Errorf("Wrong columns: %v", schema.Columns)
+	}
+	row, err = schema.ToRow([]string{"1400000000123", "20140513 125320",
+		"0123", "39", "39_0_var0", "90", "42.3", "-71.1", "12"},
+		[]interface{}{int32(7), "2014-05-01_0300"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if row[4] != int32(90) || row[7] != "12" || row[8] != int32(7) ||
+		row[9] != "2014-05-01_0300" {
+		t.Errorf("Wrong row: %#v", row)
+	}
+}
+
+func TestMatchedPathOf(t *testing.T) {
+	pathIndex, snapshot, ok := MatchedPathOf(
+		"/out/2014-05-01_0300/path_0012_locations.csv.gz")
+	if !ok || pathIndex != int32(12) || snapshot != "2014-05-01_0300" {
+		t.Errorf("Wrong result: %v %v %v", pathIndex, snapshot, ok)
+	}
+	pathIndex, snapshot, ok = MatchedPathOf("/out/path_unknown_locations.csv.gz")
+	if !ok || pathIndex != nil || snapshot != nil {
+		t.Errorf("Wrong result: %v %v %v", pathIndex, snapshot, ok)
+	}
+	if _, _, ok = MatchedPathOf("/processed/2014/05/2014-05-01.csv.gz"); ok {
+		t.Error("Expected daily file not to be matched")
+	}
+}
+
+func TestParquetName(t *testing.T) {
+	exporter := NewExporter("/out")
+	for csvPath, expected := range map[string]string{
+		"/processed/2014/05/2014-05-01.csv.gz":                "2014-05-01.parquet",
+		"/nearest/2014-05-01_0300/path_0012_locations.csv.gz": "2014-05-01_0300_path_0012_locations.parquet",
+	} {
+		if actual := exporter.ParquetName(csvPath); actual != expected {
+			t.Errorf("ParquetName(%s) is %s, expected %s", csvPath, actual, expected)
+		}
+	}
+
+	// Files with the same name in different directories under InputDir get
+	// different names.
+	exporter.InputDir = "/partitions"
+	for csvPath, expected := range map[string]string{
+		"/partitions/a/0/locations.csv.gz":                       "a_0_locations.parquet",
+		"/partitions/a/1/locations.csv.gz":                       "a_1_locations.parquet",
+		"/partitions/locations.csv":                              "locations.parquet",
+		"/elsewhere/locations.csv":                               "locations.parquet",
+		"/partitions/2014-05-01_0300/path_0012_locations.csv.gz": "2014-05-01_0300_path_0012_locations.parquet",
+	} {
+		if actual := exporter.ParquetName(csvPath); actual != expected {
+			t.Errorf("ParquetName(%s) is %s, expected %s", csvPath, actual, expected)
+		}
+	}
+}
+
+func TestExportCsvFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nbparquet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	csvPath := filepath.Join(dir, "2014-05-01.csv.gz")
+	cwc, err := util.OpenCsvWriteCloser(csvPath, true, true, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := nextbus.VehicleCSVFieldNames()
+	header[0] = "# " + header[0]
+	cwc.Write(header)
+	loc := time.UTC
+	start := time.Date(2014, 5, 1, 23, 58, 0, 0, loc)
+	for i := 0; i < 5; i++ {
+		vl := &nextbus.VehicleLocation{
+			VehicleId: "0123",
+			RouteTag:  "39",
+			DirTag:    "39_0_var0",
+			Time:      start.Add(time.Duration(i) * time.Minute),
+		}
+		vl.Lat, vl.Lon = 42.3, -71.1
+		cwc.Write(vl.ToCSVFields())
+	}
+	cwc.Write([]string{"bad", "", "", "", "", "", "", ""})
+	if err := cwc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	outDir := filepath.Join(dir, "parquet")
+	exporter := NewExporter(outDir)
+	exporter.Location = loc
+	numRows, written, err := exporter.ExportCsvFile(csvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if numRows != 5 {
+		t.Errorf("Wrote %d rows, expected 5", numRows)
+	}
+	expected := []string{
+		filepath.Join(outDir, "date=2014-05-01", "2014-05-01.parquet"),
+		filepath.Join(outDir, "date=2014-05-02", "2014-05-01.parquet"),
+	}
+	if len(written) != 2 || written[0] != expected[0] ||
+		written[1] != expected[1] {
+		t.Fatalf("Wrote %v, expected %v", written, expected)
+	}
+	for _, fp := range written {
+		data, err := ioutil.ReadFile(fp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data[:4]) != "PAR1" || string(data[len(data)-4:]) != "PAR1" {
+			t.Errorf("Not a Parquet file: %s", fp)
+		}
+	}
+
+	// Existing files are skipped unless overwriting.
+	numRows, written, err = exporter.ExportCsvFile(csvPath)
+	if err != nil || numRows != 0 || len(written) != 0 {
+		t.Errorf("Unexpected result: %d %v %v", numRows, written, err)
+	}
+	exporter.Overwrite = true
+	numRows, written, err = exporter.ExportCsvFile(csvPath)
+	if err != nil || numRows != 5 || len(written) != 2 {
+		t.Errorf("Unexpected result: %d %v %v", numRows, written, err)
+	}
+}
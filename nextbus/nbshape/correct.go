@@ -0,0 +1,228 @@
+// Package nbshape corrects the shapes of paths (as published by the agency)
+// using the locations reported by vehicles travelling those paths: a line is
+// fit to the reports near each segment of a path, and the fitted lines are
+// stitched together at the joins to produce the corrected vertices.
+package nbshape
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+
+	"github.com/golang/glog"
+
+	"github.com/jamessynge/transit_tools/fit"
+	"github.com/jamessynge/transit_tools/geo"
+	"github.com/jamessynge/transit_tools/geo/geogeom"
+	"github.com/jamessynge/transit_tools/geom"
+	"github.com/jamessynge/transit_tools/nextbus"
+	"github.com/jamessynge/transit_tools/nextbus/busgeom"
+)
+
+// Lines whose angles differ by less than this (radians) are considered
+// parallel when stitching.
+const kParallelAngle = math.Pi / 36
+
+// Closest point to pt on the lines (the average if more than one line).
+func projectOntoLines(pt geom.Point, lines ...geom.Line) (geom.Point, bool) {
+	var sumX, sumY float64
+	n := 0
+	for _, line := range lines {
+		if line == nil {
+			continue
+		}
+		np := line.NearestPointTo(pt)
+		sumX += np.X
+		sumY += np.Y
+		n++
+	}
+	if n == 0 {
+		return pt, false
+	}
+	return geom.Point{X: sumX / float64(n), Y: sumY / float64(n)}, true
+}
+
+func nearlyParallel(a, b geom.Line) bool {
+	d := math.Abs(a.Angle() - b.Angle())
+	d = math.Min(d, math.Abs(d-math.Pi))
+	return d < kParallelAngle
+}
+
+// StitchLines computes the corrected vertices of a path from the lines fit
+// to each of its segments (see FitLinesForPath); lines[i] is the line for the
+// segment from points[i] to points[i+1], or nil if there is none. Interior
+// vertices are placed at the intersection of the lines of the adjacent
+// segments, unless the lines are nearly parallel or intersect more than
+// maxShift from the original vertex, in which case the vertex is projected
+// onto the lines instead. A vertex that would move more than maxShift isn't
+// moved at all. The result has the same number of vertices as points.
+func StitchLines(points []geom.Point, lines []geom.Line,
+	maxShift float64) []geom.Point {
+	result := make([]geom.Point, len(points))
+	last := len(points) - 1
+	for i, pt := range points {
+		var before, after geom.Line
+		if i > 0 && i-1 < len(lines) {
+			before = lines[i-1]
+		}
+		if i < last && i < len(lines) {
+			after = lines[i]
+		}
+		corrected, ok := pt, false
+		if before != nil && after != nil && !nearlyParallel(before, after) {
+			corrected, ok = before.Intersection(after)
+			if ok && corrected.Distance(pt) > maxShift {
+				ok = false
+			}
+		}
+		if !ok {
+			corrected, ok = projectOntoLines(pt, before, after)
+		}
+		if !ok || corrected.Distance(pt) > maxShift {
+			corrected = pt
+		}
+		result[i] = corrected
+	}
+	return result
+}
+
+// Corrects the shapes of paths.
+type Corrector struct {
+	// Only reports within this distance (meters) of a segment are used when
+	// fitting a line to the segment.
+	MaxDistance float64
+	// Fits the lines to the reports near each segment; if nil, orthogonal
+	// regression is used, which is sensitive to outliers.
+	LineFitter fit.LineFitter
+	// Vertices are moved at most this far (meters) in each round.
+	MaxShift float64
+	// Number of rounds of fitting and stitching.
+	Rounds int
+	// Minimum number of reports required to correct a path.
+	MinReports int
+}
+
+func NewCorrector() *Corrector {
+	return &Corrector{
+		MaxDistance: 20,
+		LineFitter:  fit.NewTukeyFitter(),
+		MaxShift:    20,
+		Rounds:      5,
+		MinReports:  10,
+	}
+}
+
+// CorrectPoints returns the corrected vertices of the path through points,
+// based on reports, which must be in the same metric plane as points.
+func (p *Corrector) CorrectPoints(
+	points []geom.Point, reports []*busgeom.Report) []geom.Point {
+	for round := 1; round <= p.Rounds; round++ {
+		glog.V(1).Infof("Fitting round %d", round)
+		lines := FitLinesForPath(points, reports, p.MaxDistance, p.LineFitter)
+		points = StitchLines(points, lines, p.MaxShift)
+	}
+	return points
+}
+
+// The original and corrected shape of a path.
+type Correction struct {
+	Path      *nextbus.Path
+	Original  []geo.Location
+	Corrected []geo.Location
+	// Distance (meters) each vertex was moved.
+	Displacements []float64
+	// Number of reports used to correct the path.
+	NumReports int
+}
+
+// MaxDisplacement returns the largest distance (meters) a vertex was moved.
+func (p *Correction) MaxDisplacement() (max float64) {
+	for _, d := range p.Displacements {
+		max = math.Max(max, d)
+	}
+	return
+}
+
+// CorrectPath corrects the shape of path using reports, which must be
+// reports of vehicles travelling the path, in the metric plane of xf.
+func (p *Corrector) CorrectPath(path *nextbus.Path,
+	reports []*busgeom.Report, xf geogeom.CoordTransform) (*Correction, error) {
+	if len(path.WayPoints) < 2 {
+		return nil, fmt.Errorf("Path %d has too few waypoints (%d)",
+			path.Index, len(path.WayPoints))
+	}
+	if len(reports) < p.MinReports {
+		return nil, fmt.Errorf("Path %d has too few reports (%d, need %d)",
+			path.Index, len(reports), p.MinReports)
+	}
+	c := &Correction{
+		Path:          path,
+		Original:      make([]geo.Location, len(path.WayPoints)),
+		Corrected:     make([]geo.Location, len(path.WayPoints)),
+		Displacements: make([]float64, len(path.WayPoints)),
+		NumReports:    len(reports),
+	}
+	for i, loc := range path.WayPoints {
+		c.Original[i] = loc.Location
+	}
+	points := geogeom.LocationsCollectionToPoints(
+		len(c.Original), func(index int) geo.Location { return c.Original[index] },
+		xf)
+	corrected := p.CorrectPoints(points, reports)
+	for i, pt := range corrected {
+		c.Displacements[i] = pt.Distance(points[i])
+		if c.Displacements[i] == 0 {
+			// Avoid introducing rounding errors.
+			c.Corrected[i] = c.Original[i]
+			continue
+		}
+		loc, err := xf.FromPoint(pt)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"Unable to convert vertex %d of path %d to a location: %v",
+				i, path.Index, err)
+		}
+		c.Corrected[i] = loc
+	}
+	glog.Infof("Corrected path %d using %d reports; max displacement %.1fm",
+		path.Index, len(reports), c.MaxDisplacement())
+	return c, nil
+}
+
+// ApplyCorrections replaces the waypoints of the corrected paths of agency,
+// so that the corrected paths can be written with nextbus.WritePaths.
+func ApplyCorrections(agency *nextbus.Agency, corrections []*Correction) {
+	for _, c := range corrections {
+		agency.ReplacePathWayPoints(c.Path, c.Corrected)
+	}
+}
+
+func formatFloat(v float64, prec int) string {
+	return strconv.FormatFloat(v, 'f', prec, 64)
+}
+
+// WriteDisplacementsCsv writes a CSV file with a record per vertex of each
+// corrected path, with the original and corrected locations of the vertex,
+// and the distance (meters) between them.
+func WriteDisplacementsCsv(w io.Writer, corrections []*Correction) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"path", "vertex", "origLat", "origLon",
+		"newLat", "newLon", "displacement"})
+	for _, c := range corrections {
+		for i := range c.Original {
+			cw.Write([]string{
+				strconv.Itoa(c.Path.Index),
+				strconv.Itoa(i),
+				formatFloat(float64(c.Original[i].Lat), -1),
+				formatFloat(float64(c.Original[i].Lon), -1),
+				formatFloat(float64(c.Corrected[i].Lat), 7),
+				formatFloat(float64(c.Corrected[i].Lon), 7),
+				formatFloat(c.Displacements[i], 2),
+			})
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
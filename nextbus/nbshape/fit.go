@@ -0,0 +1,178 @@
+package nbshape
+
+// Fitting of lines to the reports near each segment of a path.
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/golang/glog"
+
+	"github.com/jamessynge/transit_tools/fit"
+	"github.com/jamessynge/transit_tools/geom"
+	"github.com/jamessynge/transit_tools/nextbus/busgeom"
+)
+
+const (
+	halfPi = math.Pi / 2
+)
+
+func FormatSeg(p *geom.DirectedSegment) string {
+	return fmt.Sprintf("{%.1f, %.1f} => {%.1f, %.1f}   (direction %d, length %.1f)",
+		p.Pt1.X, p.Pt1.Y, p.Pt2.X, p.Pt2.Y,
+		int(geom.ToDegrees(p.Direction.Direction())+0.5),
+		p.Length())
+}
+
+//func CosineSimilarity(a, b geom.Segment) {}
+
+// Fits a line to the reports near seg, weighted by weightFunc, using fitter
+// (orthogonal regression if nil).
+func FitLineForPathSegment(
+	seg *busgeom.PathSegment, weightFunc busgeom.WeightFunction3,
+	fitter fit.LineFitter) geom.Line {
+	d2s := seg.MakeData2DSource(weightFunc)
+	if d2s.Len() == 0 {
+		glog.Warningf("TOO FEW REPORTS to compute a fit for segment: %#v", seg)
+		return nil
+	}
+
+	if fitter == nil {
+		fitter = fit.OrthogonalFitter{}
+	}
+	lineFit, err := fitter.FitLine(d2s)
+	if err != nil {
+		glog.Warningf("Error fitting line for segment: %#v\n    Error: %v",
+			seg, err)
+		return nil
+	}
+	line := lineFit.Line
+
+	if glog.V(1) {
+		pt1 := line.NearestPointTo(seg.Pt1)
+		pt2 := line.NearestPointTo(seg.Pt2)
+		newSeg := geom.NewDirectedSegment(pt1, pt2)
+		glog.Infof("OLD SEG: %v", FormatSeg(seg.DirectedSegment))
+		glog.Infof("NEW SEG: %v", FormatSeg(newSeg))
+
+		numReports := d2s.Len()
+		sumWeight := 0.0
+		for ndx := 0; ndx < numReports; ndx++ {
+			sumWeight += d2s.Weight(ndx)
+		}
+
+		glog.Infof("Computed from %d points with an average weight of %.2f",
+			numReports, sumWeight/float64(numReports))
+		glog.Infof("Fit diagnostics: %v\n\n", &lineFit.FitDiagnostics)
+	}
+
+	return line
+}
+
+// Given a sequence of points, produces a segment between each pair, computes
+// a linear fit for nearby points, and returns the linear fit corresponding
+// to each segment (nil for those segments for which a line couldn't be fit).
+// The lines are fit by fitter (orthogonal regression if nil); a robust fitter
+// (e.g. fit.NewTukeyFitter()) discounts reports within maxDistance of the
+// path which are nonetheless outliers (e.g. GPS glitches).
+func FitLinesForPath(
+	pathPts []geom.Point, reports []*busgeom.Report,
+	maxDistance float64, fitter fit.LineFitter) (result []geom.Line) {
+	// Make segments.
+	segs := busgeom.MakePathSegments(pathPts, nil)
+
+	// Link segments and nearby points.
+	busgeom.LinkReportsToSegments(reports, segs, maxDistance)
+
+	// Fit a line for each segment of the path.
+	lastNdx := len(segs) - 1
+	for ndx, seg := range segs {
+		// What is the likely slope of the line we'll fit to the points near seg?
+		haveManyNearReports := (seg.NumNearReports() >= 50)
+		weightFunc := func(seg *busgeom.PathSegment,
+			report *busgeom.Report,
+			rns *busgeom.ReportNearSegment) (weight float64) {
+			if rns.Distance > maxDistance {
+				return 0
+			}
+
+			weight = 1
+			if !rns.IsPerpendicular {
+				if haveManyNearReports {
+					weight *= 0.5
+				}
+				if ndx == 0 || ndx == lastNdx {
+					weight *= 0.5
+				}
+			}
+			return weight
+		}
+		reportsDirection, ok := seg.MedianWeightedReportDirection(weightFunc)
+		if !ok {
+			reportsDirection = seg.Direction
+		}
+
+		// Define function for weighting points when fitting a line to the points.
+
+		// TODO, maybe: For computing distance portion of weight, define a line that
+		// goes through the midpoint of seg, with the slope from direction, and
+		// compute distances between reports and that line.
+
+		// If the median reports direction is close to that of the segment, then
+		// we can use the IsPerpendicular value in rns.
+		trustIsPerpendicular := reportsDirection.AngleBetween(seg.Direction) < (math.Pi / 8)
+
+		weightFunc = func(seg *busgeom.PathSegment,
+			report *busgeom.Report,
+			rns *busgeom.ReportNearSegment) (weight float64) {
+			// Ignore points from before the beginning of, or after the end of,
+			// the path.
+			if trustIsPerpendicular {
+				if ndx == 0 && rns.NearestPoint == seg.Pt1 {
+					return 0
+				}
+				if ndx == lastNdx && rns.NearestPoint == seg.Pt2 {
+					return 0
+				}
+			}
+
+			weight = 1
+
+			// Reports going the opposite direction are discarded, and those going
+			// "adrift" are given lower weight.
+			angleBetween := 0.0
+			if report.DirectionIsValid() {
+				angleBetween = reportsDirection.AngleBetween(report.Direction)
+				if angleBetween >= halfPi {
+					return 0
+				}
+				weight *= (1 - (angleBetween/halfPi)*0.3)
+			}
+
+			// Reports further away are given less weight.
+			if rns.Distance > maxDistance {
+				return 0
+			}
+			weight *= (1 - (rns.Distance/maxDistance)*0.3)
+
+			if trustIsPerpendicular && !rns.IsPerpendicular {
+				// Give less weight to those not perpendicular to the line segment
+				// (i.e. we can't draw a line perpendicular to the line segment that
+				// goes through the report point).
+				weight *= 0.5
+			}
+
+			return weight
+		}
+
+		// Compute the line best fitting the points near the segment.
+
+		line := FitLineForPathSegment(seg, weightFunc, fitter)
+		if line == nil {
+			glog.Warningf("Unable to fit line to path segment #%d", ndx)
+		}
+		result = append(result, line)
+	}
+
+	return
+}
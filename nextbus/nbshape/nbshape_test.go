@@ -0,0 +1,172 @@
+package nbshape
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/jamessynge/transit_tools/geo"
+	"github.com/jamessynge/transit_tools/geo/geogeom"
+	"github.com/jamessynge/transit_tools/geom"
+	"github.com/jamessynge/transit_tools/nextbus"
+	"github.com/jamessynge/transit_tools/nextbus/busgeom"
+)
+
+func near(a, b geom.Point, tolerance float64) bool {
+	return a.Distance(b) <= tolerance
+}
+
+func TestStitchLines(t *testing.T) {
+	points := []geom.Point{{X: 0, Y: 0}, {X: 100, Y: 0}, {X: 100, Y: 100}, {X: 200, Y: 100}}
+	lines := []geom.Line{
+		geom.LineFromTwoPoints(geom.Point{X: 0, Y: 3}, geom.Point{X: 100, Y: 3}),
+		geom.LineFromTwoPoints(geom.Point{X: 98, Y: 0}, geom.Point{X: 98, Y: 100}),
+		nil,
+	}
+	result := StitchLines(points, lines, 10)
+	if len(result) != len(points) {
+		t.Fatalf("Wrong number of points: %d", len(result))
+	}
+	expected := []geom.Point{{X: 0, Y: 3}, {X: 98, Y: 3}, {X: 98, Y: 100}, {X: 200, Y: 100}}
+	for i := range expected {
+		if !near(result[i], expected[i], 0.001) {
+			t.Errorf("Point %d: expected %v, got %v", i, expected[i], result[i])
+		}
+	}
+
+	// Shifts larger than maxShift are ignored; if the intersection is too far
+	// away, the vertex is projected onto the lines instead.
+	result = StitchLines(points, lines, 2.5)
+	expected = []geom.Point{{X: 0, Y: 0}, {X: 99, Y: 1.5}, {X: 98, Y: 100}, {X: 200, Y: 100}}
+	for i := range expected {
+		if !near(result[i], expected[i], 0.001) {
+			t.Errorf("Point %d: expected %v, got %v", i, expected[i], result[i])
+		}
+	}
+}
+
+const testPathsXml = `<?xml version="1.0" encoding="utf-8" ?>
+<body agency="test">
+	<path>
+		<route tag="1" title="One"/>
+		<point lat="42.35" lon="-71.07"/>
+		<point lat="42.35" lon="-71.065"/>
+		<point lat="42.35" lon="-71.06"/>
+	</path>
+</body>`
+
+func TestCorrectPath(t *testing.T) {
+	agency, err := nextbus.ReadPaths(strings.NewReader(testPathsXml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := agency.GetPath(1)
+	xf := geogeom.MakeMetricCoordTransform(path.WayPoints[0].Location)
+	end := xf.ToPoint(path.WayPoints[2].Location)
+
+	// The vehicles actually travel 4 meters north of the published path.
+	var reports []*busgeom.Report
+	for x := 1.0; x < end.X; x += 5 {
+		for _, dy := range []float64{-1, 0, 1} {
+			reports = append(reports, &busgeom.Report{
+				Point:     geom.Point{X: x, Y: 4 + dy},
+				Direction: geom.MakeDirection(0),
+			})
+		}
+	}
+
+	c, err := NewCorrector().CorrectPath(path, reports, xf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, loc := range c.Corrected {
+		pt := xf.ToPoint(loc)
+		orig := xf.ToPoint(c.Original[i])
+		if math.Abs(pt.Y-4) > 0.1 || math.Abs(pt.X-orig.X) > 0.1 {
+			t.Errorf("Vertex %d: expected (%.1f, 4), got %v", i, orig.X, pt)
+		}
+		if math.Abs(c.Displacements[i]-4) > 0.1 {
+			t.Errorf("Vertex %d: wrong displacement %v", i, c.Displacements[i])
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := WriteDisplacementsCsv(&buf, []*Correction{c}); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[1], "1,0,42.35,-71.07,") ||
+		!strings.HasSuffix(lines[1], ",4.00") {
+		t.Errorf("Wrong displacements csv:\n%s", buf.String())
+	}
+
+	// The corrected path round trips through the all-paths format.
+	ApplyCorrections(agency, []*Correction{c})
+	buf.Reset()
+	nextbus.WritePaths(agency, &buf)
+	agency2, err := nextbus.ReadPaths(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path2 := agency2.GetPath(1)
+	if path2 == nil || len(path2.WayPoints) != 3 || path2.Routes["1"] == nil {
+		t.Fatalf("Wrong path after round trip: %#v", path2)
+	}
+	for i, loc := range path2.WayPoints {
+		if loc.Location != c.Corrected[i] {
+			t.Errorf("Vertex %d: expected %v, got %v",
+				i, c.Corrected[i], loc.Location)
+		}
+		if loc.Paths[1] != path2 {
+			t.Errorf("Vertex %d isn't linked to the path", i)
+		}
+	}
+	if old := agency.Locations[geo.Location{Lat: 42.35, Lon: -71.065}]; old != nil &&
+		len(old.Paths) != 0 {
+		t.Errorf("Original waypoint still linked to the path")
+	}
+}
+
+// Reports of a vehicle on a parallel street, within MaxDistance of the path,
+// pull an orthogonal regression fit towards them, but not a robust fit.
+func TestCorrectPathWithOutliers(t *testing.T) {
+	agency, err := nextbus.ReadPaths(strings.NewReader(testPathsXml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := agency.GetPath(1)
+	xf := geogeom.MakeMetricCoordTransform(path.WayPoints[0].Location)
+	end := xf.ToPoint(path.WayPoints[2].Location)
+	var reports []*busgeom.Report
+	for x := 1.0; x < end.X; x += 5 {
+		for _, y := range []float64{3, 4, 5, 4, 16} {
+			reports = append(reports, &busgeom.Report{
+				Point:     geom.Point{X: x, Y: y},
+				Direction: geom.MakeDirection(0),
+			})
+		}
+	}
+	robust := NewCorrector()
+	plain := NewCorrector()
+	plain.LineFitter = nil
+	for _, test := range []struct {
+		corrector *Corrector
+		pulled    bool
+	}{
+		{robust, false},
+		{plain, true},
+	} {
+		c, err := test.corrector.CorrectPath(path, reports, xf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, loc := range c.Corrected {
+			pt := xf.ToPoint(loc)
+			if pulled := math.Abs(pt.Y-4) > 1; pulled != test.pulled ||
+				!test.pulled && math.Abs(pt.Y-4) > 0.1 {
+				t.Errorf("Vertex %d: expected pulled == %v, got %v", i, test.pulled, pt)
+			}
+		}
+	}
+}
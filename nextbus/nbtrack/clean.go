@@ -0,0 +1,189 @@
+// Package nbtrack turns the raw reports of a vehicle into clean, uniformly
+// sampled tracks for downstream analyses (e.g. of speeds, headways and
+// dwell times): reports with reversed or duplicate times, and implausible
+// jumps ("teleports"), are dropped and flagged; the remaining reports are
+// resampled at a fixed interval, interpolating along the vehicle's path where
+// it is known (see nbmatch.TrackMatcher) and along the great circle
+// otherwise; and, optionally, positions and speeds are smoothed with a
+// Kalman filter.
+package nbtrack
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jamessynge/transit_tools/nextbus"
+)
+
+type AnomalyType int
+
+const (
+	// The report is older than the previous report (the aggregator sometimes
+	// sees old reports reappear after newer ones); dropped.
+	ReversedTime AnomalyType = iota
+	// The report has the same time as the previous report, but a different
+	// location; dropped.
+	DuplicateTime
+	// The report implies the vehicle moved implausibly fast since the previous
+	// report. Dropped if the following report doesn't confirm the jump (i.e. a
+	// GPS glitch); otherwise kept, but the track is split at the jump (e.g. a
+	// bus towed to the garage, or a wrong vehicle id), so there is no
+	// interpolation across it.
+	Teleport
+)
+
+func (t AnomalyType) String() string {
+	switch t {
+	case ReversedTime:
+		return "reversed_time"
+	case DuplicateTime:
+		return "duplicate_time"
+	case Teleport:
+		return "teleport"
+	}
+	return fmt.Sprintf("AnomalyType(%d)", int(t))
+}
+
+// An implausible report, relative to the previous report that was kept.
+type Anomaly struct {
+	Type     AnomalyType
+	Report   *nextbus.VehicleLocation
+	Previous *nextbus.VehicleLocation
+	// Distance (meters) and speed (meters/second) from Previous to Report
+	// (speed is zero for reversed or duplicate times).
+	Distance float64
+	Speed    float64
+	// True if the report was kept (a confirmed Teleport).
+	Kept bool
+}
+
+func (a *Anomaly) String() string {
+	return fmt.Sprintf("%s %s at %s (%.0fm, %.1fm/s from %s); kept: %v",
+		a.Report.VehicleId, a.Type, a.Report.Time.Format("20060102 150405"),
+		a.Distance, a.Speed, a.Previous.Time.Format("150405"), a.Kept)
+}
+
+// Parameters for cleaning and resampling tracks.
+type Resampler struct {
+	// Time between samples.
+	Interval time.Duration
+	// Tracks are split where there are no reports for longer than this, and
+	// no samples are produced for the gap.
+	MaxGap time.Duration
+	// Reports implying a speed (meters/second) greater than this since the
+	// previous report are teleports...
+	MaxSpeed float64
+	// ... unless within this distance (meters) of where the vehicle could
+	// have reached, to allow for location errors.
+	JumpTolerance float64
+	// Reports further than this (meters) from their matched path are
+	// interpolated along the great circle rather than along the path.
+	MaxPathDistance float64
+	// If not nil, the resampled positions and speeds are smoothed.
+	Smoothing *KalmanConfig
+}
+
+func NewResampler() *Resampler {
+	return &Resampler{
+		Interval:        5 * time.Second,
+		MaxGap:          5 * time.Minute,
+		MaxSpeed:        35,
+		JumpTolerance:   100,
+		MaxPathDistance: 50,
+	}
+}
+
+// Returns the distance and implied speed between two reports.
+func distanceAndSpeed(a, b *nextbus.VehicleLocation) (distance, speed float64) {
+	d, _ := a.Location.DistanceAndHeadingTo(b.Location)
+	distance = float64(d)
+	if dt := b.Time.Sub(a.Time).Seconds(); dt > 0 {
+		speed = distance / dt
+	}
+	return
+}
+
+func (p *Resampler) isJump(a, b *nextbus.VehicleLocation) bool {
+	distance, _ := distanceAndSpeed(a, b)
+	return distance > p.MaxSpeed*b.Time.Sub(a.Time).Seconds()+p.JumpTolerance
+}
+
+// Clean splits the reports of a single vehicle (in the order received; they
+// are not sorted) into pieces which can be interpolated: in each piece the
+// reports are in increasing time order, without implausible jumps, or gaps
+// longer than MaxGap. Consecutive reports of the same location and time are
+// silently dropped; the other dropped reports, and confirmed teleports, are
+// returned as anomalies.
+func (p *Resampler) Clean(reports []*nextbus.VehicleLocation) (
+	pieces [][]*nextbus.VehicleLocation, anomalies []*Anomaly) {
+	var piece []*nextbus.VehicleLocation
+	// A teleport awaiting confirmation by the next report.
+	var pending *Anomaly
+	endPiece := func() {
+		if len(piece) > 0 {
+			pieces = append(pieces, piece)
+		}
+		piece = nil
+	}
+	for _, vl := range reports {
+		if vl == nil {
+			continue
+		}
+		if len(piece) == 0 {
+			piece = append(piece, vl)
+			continue
+		}
+		last := piece[len(piece)-1]
+		if pending != nil {
+			if !vl.Time.After(pending.Report.Time) {
+				// Not later than the unconfirmed teleport; compare with last.
+			} else if !p.isJump(pending.Report, vl) && p.isJump(last, vl) {
+				// Confirmed: the vehicle really is over there now.
+				pending.Kept = true
+				anomalies = append(anomalies, pending)
+				endPiece()
+				piece = append(piece, pending.Report)
+				last = pending.Report
+				pending = nil
+			} else {
+				// A glitch; drop it.
+				anomalies = append(anomalies, pending)
+				pending = nil
+			}
+		}
+		dt := vl.Time.Sub(last.Time)
+		switch {
+		case dt < 0:
+			anomalies = append(anomalies, &Anomaly{
+				Type: ReversedTime, Report: vl, Previous: last})
+			continue
+		case dt == 0:
+			if !vl.Location.SameLocation(last.Location) {
+				distance, _ := distanceAndSpeed(last, vl)
+				anomalies = append(anomalies, &Anomaly{
+					Type: DuplicateTime, Report: vl, Previous: last, Distance: distance})
+			}
+			continue
+		case p.MaxGap > 0 && dt > p.MaxGap:
+			endPiece()
+		case p.isJump(last, vl):
+			if pending != nil {
+				// Another jump from last, no later than the unconfirmed teleport,
+				// so that can't be confirmed by it; drop the earlier one.
+				anomalies = append(anomalies, pending)
+			}
+			distance, speed := distanceAndSpeed(last, vl)
+			pending = &Anomaly{
+				Type: Teleport, Report: vl, Previous: last,
+				Distance: distance, Speed: speed}
+			continue
+		}
+		piece = append(piece, vl)
+	}
+	if pending != nil {
+		// Can't be confirmed.
+		anomalies = append(anomalies, pending)
+	}
+	endPiece()
+	return
+}
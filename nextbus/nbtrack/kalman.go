@@ -0,0 +1,118 @@
+package nbtrack
+
+// Smoothing with a constant velocity Kalman filter, followed by a
+// Rauch-Tung-Striebel backward pass, so that each smoothed value depends on
+// both earlier and later samples. The coordinates (e.g. x and y in a metric
+// plane) are smoothed independently.
+
+// Parameters of the Kalman filter.
+type KalmanConfig struct {
+	// Standard deviation (meters) of the error in the positions.
+	PositionSigma float64
+	// Standard deviation (meters/second²) of the accelerations, which are
+	// treated as noise; larger values follow the positions more closely.
+	AccelerationSigma float64
+	// Standard deviation (meters/second) of the speed before the first
+	// sample.
+	InitialSpeedSigma float64
+}
+
+func NewKalmanConfig() *KalmanConfig {
+	return &KalmanConfig{
+		PositionSigma:     8,
+		AccelerationSigma: 0.5,
+		InitialSpeedSigma: 10,
+	}
+}
+
+type vec2 [2]float64
+type mat2 [2][2]float64
+
+func (a mat2) mul(b mat2) (c mat2) {
+	for i := 0; i < 2; i++ {
+		for j := 0; j < 2; j++ {
+			c[i][j] = a[i][0]*b[0][j] + a[i][1]*b[1][j]
+		}
+	}
+	return
+}
+
+func (a mat2) mulVec(v vec2) vec2 {
+	return vec2{a[0][0]*v[0] + a[0][1]*v[1], a[1][0]*v[0] + a[1][1]*v[1]}
+}
+
+func (a mat2) transpose() mat2 {
+	return mat2{{a[0][0], a[1][0]}, {a[0][1], a[1][1]}}
+}
+
+func (a mat2) inverse() mat2 {
+	det := a[0][0]*a[1][1] - a[0][1]*a[1][0]
+	return mat2{{a[1][1] / det, -a[0][1] / det}, {-a[1][0] / det, a[0][0] / det}}
+}
+
+// Smooth returns the smoothed positions and velocities given the positions
+// at the times (seconds, increasing).
+func (c *KalmanConfig) Smooth(times, positions []float64) (
+	smoothed, velocities []float64) {
+	n := len(positions)
+	if n == 0 {
+		return nil, nil
+	}
+	r := c.PositionSigma * c.PositionSigma
+	qa := c.AccelerationSigma * c.AccelerationSigma
+
+	// Filtered state and covariance, and the predictions (from the previous
+	// state) and transitions used to reach each state.
+	xf := make([]vec2, n)
+	pf := make([]mat2, n)
+	xp := make([]vec2, n)
+	pp := make([]mat2, n)
+	fs := make([]mat2, n)
+
+	xf[0] = vec2{positions[0], 0}
+	pf[0] = mat2{{r, 0}, {0, c.InitialSpeedSigma * c.InitialSpeedSigma}}
+	for k := 1; k < n; k++ {
+		dt := times[k] - times[k-1]
+		f := mat2{{1, dt}, {0, 1}}
+		q := mat2{
+			{qa * dt * dt * dt * dt / 4, qa * dt * dt * dt / 2},
+			{qa * dt * dt * dt / 2, qa * dt * dt},
+		}
+		fs[k] = f
+		xp[k] = f.mulVec(xf[k-1])
+		p := f.mul(pf[k-1]).mul(f.transpose())
+		for i := range p {
+			for j := range p[i] {
+				p[i][j] += q[i][j]
+			}
+		}
+		pp[k] = p
+
+		// Update with the measured position.
+		s := p[0][0] + r
+		gain := vec2{p[0][0] / s, p[1][0] / s}
+		innovation := positions[k] - xp[k][0]
+		xf[k] = vec2{xp[k][0] + gain[0]*innovation, xp[k][1] + gain[1]*innovation}
+		for i := 0; i < 2; i++ {
+			for j := 0; j < 2; j++ {
+				pf[k][i][j] = p[i][j] - gain[i]*p[0][j]
+			}
+		}
+	}
+
+	xs := make([]vec2, n)
+	xs[n-1] = xf[n-1]
+	for k := n - 2; k >= 0; k-- {
+		gain := pf[k].mul(fs[k+1].transpose()).mul(pp[k+1].inverse())
+		d := vec2{xs[k+1][0] - xp[k+1][0], xs[k+1][1] - xp[k+1][1]}
+		correction := gain.mulVec(d)
+		xs[k] = vec2{xf[k][0] + correction[0], xf[k][1] + correction[1]}
+	}
+
+	smoothed = make([]float64, n)
+	velocities = make([]float64, n)
+	for k, x := range xs {
+		smoothed[k], velocities[k] = x[0], x[1]
+	}
+	return
+}
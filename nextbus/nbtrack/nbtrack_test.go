@@ -0,0 +1,322 @@
+package nbtrack
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jamessynge/transit_tools/geo"
+	"github.com/jamessynge/transit_tools/nextbus"
+	"github.com/jamessynge/transit_tools/nextbus/nbmatch"
+)
+
+// An L shaped path: about 823 meters east, then about 823 meters north.
+const testPathsXml = `<?xml version="1.0" encoding="utf-8" ?>
+<body agency="test">
+	<path>
+		<route tag="1" title="One"/>
+		<point lat="42.35" lon="-71.07"/>
+		<point lat="42.35" lon="-71.06"/>
+		<point lat="42.3574" lon="-71.06"/>
+	</path>
+</body>`
+
+// A multiple of 5 seconds.
+var t0 = time.Unix(1400000000, 0)
+
+// Degrees of longitude per meter at latitude 42.35.
+const lonPerMeter = 1 / 82270.0
+
+func makeTestPath(t *testing.T) *nextbus.Path {
+	agency, err := nextbus.ReadPaths(strings.NewReader(testPathsXml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return agency.GetPath(1)
+}
+
+func makeReport(seconds, lat, lon float64) *nextbus.VehicleLocation {
+	return &nextbus.VehicleLocation{
+		VehicleId: "v1",
+		Time:      t0.Add(time.Duration(seconds * float64(time.Second))),
+		Location:  geo.Location{Lat: geo.Latitude(lat), Lon: geo.Longitude(lon)},
+		Heading:   -1,
+	}
+}
+
+// Report of a vehicle x meters east of the start of the path.
+func makeEastReport(seconds, x float64) *nextbus.VehicleLocation {
+	return makeReport(seconds, 42.35, -71.07+x*lonPerMeter)
+}
+
+func headingDiff(a, b geo.HeadingF) float64 {
+	d := math.Mod(math.Abs(float64(a-b)), 360)
+	return math.Min(d, 360-d)
+}
+
+func TestClean(t *testing.T) {
+	vls := []*nextbus.VehicleLocation{
+		makeEastReport(0, 0),
+		makeEastReport(10, 100),
+		makeEastReport(5, 50),    // Reversed time.
+		makeEastReport(10, 150),  // Duplicate time.
+		makeEastReport(10, 100),  // Repeat; silently dropped.
+		makeEastReport(20, 5000), // Glitch.
+		makeEastReport(30, 300),
+		makeEastReport(40, 20000), // Confirmed teleport.
+		makeEastReport(50, 20100),
+		makeEastReport(650, 20100), // After a gap.
+	}
+	p := NewResampler()
+	pieces, anomalies := p.Clean(vls)
+	expectedPieces := [][]*nextbus.VehicleLocation{
+		{vls[0], vls[1], vls[6]},
+		{vls[7], vls[8]},
+		{vls[9]},
+	}
+	if !reflect.DeepEqual(pieces, expectedPieces) {
+		t.Errorf("Pieces: %v\nExpected: %v", pieces, expectedPieces)
+	}
+	expected := []struct {
+		anomalyType AnomalyType
+		report      *nextbus.VehicleLocation
+		kept        bool
+	}{
+		{ReversedTime, vls[2], false},
+		{DuplicateTime, vls[3], false},
+		{Teleport, vls[5], false},
+		{Teleport, vls[7], true},
+	}
+	if len(anomalies) != len(expected) {
+		t.Fatalf("Anomalies: %v", anomalies)
+	}
+	for i, e := range expected {
+		a := anomalies[i]
+		if a.Type != e.anomalyType || a.Report != e.report || a.Kept != e.kept {
+			t.Errorf("Anomaly %d: %v", i, a)
+		}
+	}
+	if a := anomalies[3]; math.Abs(a.Distance-19700) > 100 || math.Abs(a.Speed-1970) > 10 {
+		t.Errorf("Teleport distance and speed: %v", a)
+	}
+
+	// An unconfirmable teleport at the end is dropped.
+	pieces, anomalies = p.Clean([]*nextbus.VehicleLocation{
+		makeEastReport(0, 0), makeEastReport(10, 100), makeEastReport(20, 9000)})
+	if len(pieces) != 1 || len(pieces[0]) != 2 || len(anomalies) != 1 ||
+		anomalies[0].Kept {
+		t.Errorf("Pieces: %v, anomalies: %v", pieces, anomalies)
+	}
+
+	// Two teleports in a row, the second no later than the first: both are
+	// reported, and neither is kept.
+	vls = []*nextbus.VehicleLocation{
+		makeEastReport(0, 0),
+		makeEastReport(10, 100),
+		makeEastReport(30, 9000),
+		makeEastReport(25, -9000),
+		makeEastReport(40, 400),
+	}
+	pieces, anomalies = p.Clean(vls)
+	expectedPieces = [][]*nextbus.VehicleLocation{{vls[0], vls[1], vls[4]}}
+	if !reflect.DeepEqual(pieces, expectedPieces) {
+		t.Errorf("Pieces: %v\nExpected: %v", pieces, expectedPieces)
+	}
+	if len(anomalies) != 2 || anomalies[0].Report != vls[2] ||
+		anomalies[1].Report != vls[3] {
+		t.Fatalf("Anomalies: %v", anomalies)
+	}
+	for _, a := range anomalies {
+		if a.Type != Teleport || a.Kept || a.Previous != vls[1] {
+			t.Errorf("Anomaly: %v", a)
+		}
+	}
+}
+
+// Reports at the start of the path, and 1233 meters along it (on the north
+// leg) 150 seconds later.
+func makeCornerReports() []*nextbus.VehicleLocation {
+	return []*nextbus.VehicleLocation{
+		makeReport(0, 42.35, -71.07),
+		makeReport(150, 42.3537, -71.06),
+	}
+}
+
+func checkAlongPath(t *testing.T, track *Track, path *nextbus.Path) {
+	if len(track.Samples) != 31 || track.VehicleId != "v1" {
+		t.Fatalf("Track: %d samples of %q", len(track.Samples), track.VehicleId)
+	}
+	for i, s := range track.Samples {
+		if !s.Time.Equal(t0.Add(time.Duration(i) * 5 * time.Second)) {
+			t.Errorf("Sample %d time: %v", i, s.Time)
+		}
+		if s.Path != path || s.Piece != 0 {
+			t.Errorf("Sample %d: %+v", i, s)
+		}
+		if math.Abs(s.Speed-8.2) > 0.2 {
+			t.Errorf("Sample %d speed: %v", i, s.Speed)
+		}
+	}
+	// On the east leg.
+	s := track.Samples[10]
+	if math.Abs(float64(s.Lat)-42.35) > 1e-6 || headingDiff(s.Heading, 90) > 1 ||
+		math.Abs(s.Offset-411) > 10 {
+		t.Errorf("Sample at 50s: %+v", s)
+	}
+	// On the north leg.
+	s = track.Samples[25]
+	if math.Abs(float64(s.Lon)+71.06) > 1e-6 || headingDiff(s.Heading, 0) > 1 {
+		t.Errorf("Sample at 125s: %+v", s)
+	}
+}
+
+func TestResampleAlongPath(t *testing.T) {
+	path := makeTestPath(t)
+	track := NewResampler().Resample(makeCornerReports(), path)
+	checkAlongPath(t, track, path)
+
+	fields := track.Samples[10].ToCSVFields("v1")
+	if len(fields) != 9 || fields[0] != "1400000050000" || fields[2] != "v1" ||
+		fields[6] != "90.0" || fields[7] != "1" {
+		t.Errorf("CSV fields: %v", fields)
+	}
+}
+
+func TestResampleGreatCircle(t *testing.T) {
+	track := NewResampler().Resample(makeCornerReports(), nil)
+	if len(track.Samples) != 31 {
+		t.Fatalf("Track: %d samples", len(track.Samples))
+	}
+	// Cuts the corner, at about 6.1 m/s.
+	s := track.Samples[15]
+	if s.Path != nil || math.Abs(float64(s.Lat)-42.35185) > 1e-5 ||
+		math.Abs(float64(s.Lon)+71.065) > 1e-5 || math.Abs(s.Speed-6.1) > 0.1 ||
+		headingDiff(s.Heading, 63.4) > 1 {
+		t.Errorf("Sample at 75s: %v, speed %v, heading %v", s.Location, s.Speed, s.Heading)
+	}
+	fields := s.ToCSVFields("v1")
+	if fields[7] != "-1" {
+		t.Errorf("CSV fields: %v", fields)
+	}
+
+	// A single report yields a single sample if its time is a multiple of the
+	// interval.
+	track = NewResampler().Resample([]*nextbus.VehicleLocation{
+		makeEastReport(0, 0), makeEastReport(1000, 5)}, nil)
+	if len(track.Samples) != 2 || track.Samples[1].Piece != 1 ||
+		!track.Samples[1].Location.SameLocation(makeEastReport(0, 5).Location) {
+		t.Errorf("Samples: %v", track.Samples)
+	}
+}
+
+func TestResampleMatches(t *testing.T) {
+	path := makeTestPath(t)
+	vls := makeCornerReports()
+	matches := []nbmatch.Match{
+		{Report: vls[0], Candidate: &nbmatch.Candidate{Path: path}},
+		{Report: vls[1], Candidate: &nbmatch.Candidate{Path: path}},
+	}
+	checkAlongPath(t, NewResampler().ResampleMatches(matches), path)
+
+	// Unmatched, so interpolated along the great circle.
+	matches[1].Candidate = nil
+	track := NewResampler().ResampleMatches(matches)
+	if len(track.Samples) != 31 || track.Samples[15].Path != nil {
+		t.Errorf("Samples: %v", track.Samples)
+	}
+}
+
+func TestResampleMatchedPieces(t *testing.T) {
+	r := NewResampler()
+	vls := []*nextbus.VehicleLocation{
+		makeEastReport(0, 0),
+		makeEastReport(30, 300),
+		makeEastReport(40, 20000), // Confirmed teleport.
+		makeEastReport(60, 20200),
+	}
+	pieces, anomalies := r.Clean(vls)
+	if len(pieces) != 2 || len(anomalies) != 1 {
+		t.Fatalf("Pieces: %v, anomalies: %v", pieces, anomalies)
+	}
+	var matched [][]nbmatch.Match
+	for _, piece := range pieces {
+		var matches []nbmatch.Match
+		for _, vl := range piece {
+			matches = append(matches, nbmatch.Match{Report: vl})
+		}
+		matched = append(matched, matches)
+	}
+	track := r.ResampleMatchedPieces(matched)
+	// The pieces aren't cleaned again, so the teleport isn't reported again.
+	if len(track.Anomalies) != 0 {
+		t.Errorf("Anomalies: %v", track.Anomalies)
+	}
+	if len(track.Samples) != 12 || track.Samples[6].Piece != 0 ||
+		track.Samples[7].Piece != 1 || !track.Samples[7].Time.Equal(vls[2].Time) {
+		t.Errorf("Samples: %v", track.Samples)
+	}
+}
+
+func TestKalmanSmooth(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	var times, positions, truth []float64
+	for i := 0; i < 200; i++ {
+		ts := float64(i * 5)
+		x := 7 * ts
+		times = append(times, ts)
+		truth = append(truth, x)
+		positions = append(positions, x+rng.NormFloat64()*8)
+	}
+	smoothed, velocities := NewKalmanConfig().Smooth(times, positions)
+	rms := func(values []float64) float64 {
+		var sum float64
+		for i, v := range values {
+			sum += (v - truth[i]) * (v - truth[i])
+		}
+		return math.Sqrt(sum / float64(len(values)))
+	}
+	if raw, s := rms(positions), rms(smoothed); s > raw*0.7 {
+		t.Errorf("RMS error: raw %v, smoothed %v", raw, s)
+	}
+	// Accelerations are allowed, so the velocity wanders a little.
+	var sum float64
+	for _, v := range velocities {
+		sum += v
+	}
+	if mean := sum / float64(len(velocities)); math.Abs(mean-7) > 0.2 {
+		t.Errorf("Mean velocity: %v", mean)
+	}
+	if s, v := NewKalmanConfig().Smooth(nil, nil); s != nil || v != nil {
+		t.Errorf("Smooth of nothing: %v, %v", s, v)
+	}
+}
+
+func TestResampleSmoothed(t *testing.T) {
+	path := makeTestPath(t)
+	rng := rand.New(rand.NewSource(2))
+	// Eastbound at 5 m/s, with noisy locations.
+	var vls []*nextbus.VehicleLocation
+	for i := 0; i <= 15; i++ {
+		x := float64(i * 50)
+		vls = append(vls, makeReport(float64(i*10),
+			42.35+rng.NormFloat64()*8/111130, -71.07+(x+rng.NormFloat64()*8)*lonPerMeter))
+	}
+	p := NewResampler()
+	p.Smoothing = NewKalmanConfig()
+	track := p.Resample(vls, path)
+	if len(track.Samples) != 31 {
+		t.Fatalf("Track: %d samples", len(track.Samples))
+	}
+	for i, s := range track.Samples {
+		// Snapped back onto the path.
+		if s.Path != path || math.Abs(float64(s.Lat)-42.35) > 1e-6 {
+			t.Errorf("Sample %d: %+v", i, s)
+		}
+		if math.Abs(s.Speed-5) > 1 || headingDiff(s.Heading, 90) > 10 {
+			t.Errorf("Sample %d speed and heading: %v, %v", i, s.Speed, s.Heading)
+		}
+	}
+}
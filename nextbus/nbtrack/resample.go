@@ -0,0 +1,302 @@
+package nbtrack
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/jamessynge/transit_tools/geo"
+	"github.com/jamessynge/transit_tools/geo/geogeom"
+	"github.com/jamessynge/transit_tools/geom"
+	"github.com/jamessynge/transit_tools/nextbus"
+	"github.com/jamessynge/transit_tools/nextbus/nbmatch"
+)
+
+// A point of a resampled track.
+type Sample struct {
+	Time time.Time
+	geo.Location
+	// Meters/second, and degrees (north = 0, east = 90).
+	Speed   float64
+	Heading geo.HeadingF
+	// The path along which the location was interpolated, and the offset
+	// (meters) along it; Path is nil if interpolated along the great circle.
+	Path   *nextbus.Path
+	Offset float64
+	// Index of the piece of the track (see Resampler.Clean); there are no
+	// samples in the gap between pieces.
+	Piece int
+}
+
+// Fields for a CSV file of samples: unix milliseconds, time (as in the
+// processed location CSV files), vehicle id, latitude, longitude, speed,
+// heading, path index (-1 if none) and offset.
+func (s *Sample) ToCSVFields(vehicleId string) []string {
+	pathIndex := -1
+	if s.Path != nil {
+		pathIndex = s.Path.Index
+	}
+	return []string{
+		fmt.Sprintf("%d", s.Time.UnixNano()/int64(time.Millisecond)),
+		s.Time.Format("20060102 150405"),
+		vehicleId,
+		fmt.Sprint(s.Lat),
+		fmt.Sprint(s.Lon),
+		fmt.Sprintf("%.2f", s.Speed),
+		fmt.Sprintf("%.1f", s.Heading),
+		fmt.Sprint(pathIndex),
+		fmt.Sprintf("%.1f", s.Offset),
+	}
+}
+
+// The resampled track of a vehicle.
+type Track struct {
+	VehicleId string
+	Samples   []*Sample
+	// The dropped reports, and confirmed teleports.
+	Anomalies []*Anomaly
+}
+
+// Resample cleans (see Clean) and resamples the reports of a single vehicle,
+// interpolating along path if it isn't nil, else along the great circle.
+func (p *Resampler) Resample(
+	reports []*nextbus.VehicleLocation, path *nextbus.Path) *Track {
+	return p.resample(reports, func(*nextbus.VehicleLocation) *nextbus.Path {
+		return path
+	})
+}
+
+// ResampleMatches is like Resample, but interpolates along the matched path
+// of each report (see nbmatch.TrackMatcher.MatchTrack) where consecutive
+// reports are matched to the same path.
+func (p *Resampler) ResampleMatches(matches []nbmatch.Match) *Track {
+	reports := make([]*nextbus.VehicleLocation, len(matches))
+	paths := make(map[*nextbus.VehicleLocation]*nextbus.Path)
+	for i, m := range matches {
+		reports[i] = m.Report
+		if m.Candidate != nil {
+			paths[m.Report] = m.Candidate.Path
+		}
+	}
+	return p.resample(reports, func(vl *nextbus.VehicleLocation) *nextbus.Path {
+		return paths[vl]
+	})
+}
+
+// ResampleMatchedPieces is like ResampleMatches, but for pieces already
+// produced by Clean (e.g. so that each piece could be matched separately):
+// they aren't cleaned again, so the track has no anomalies (those are the
+// ones returned by Clean).
+func (p *Resampler) ResampleMatchedPieces(pieces [][]nbmatch.Match) *Track {
+	var reportPieces [][]*nextbus.VehicleLocation
+	paths := make(map[*nextbus.VehicleLocation]*nextbus.Path)
+	for _, matches := range pieces {
+		var reports []*nextbus.VehicleLocation
+		for _, m := range matches {
+			reports = append(reports, m.Report)
+			if m.Candidate != nil {
+				paths[m.Report] = m.Candidate.Path
+			}
+		}
+		if len(reports) > 0 {
+			reportPieces = append(reportPieces, reports)
+		}
+	}
+	return p.resamplePieces(&Track{}, reportPieces,
+		func(vl *nextbus.VehicleLocation) *nextbus.Path {
+			return paths[vl]
+		})
+}
+
+// A report, and where it is along its path.
+type anchor struct {
+	vl     *nextbus.VehicleLocation
+	pt     geom.Point
+	path   *nextbus.Path // nil if no path, or too far from it.
+	offset float64
+}
+
+type resampling struct {
+	*Resampler
+	projection geogeom.Projection
+	polylines  map[*nextbus.Path]geom.Polyline
+	track      *Track
+}
+
+func (p *Resampler) resample(reports []*nextbus.VehicleLocation,
+	pathOf func(*nextbus.VehicleLocation) *nextbus.Path) *Track {
+	pieces, anomalies := p.Clean(reports)
+	return p.resamplePieces(&Track{Anomalies: anomalies}, pieces, pathOf)
+}
+
+// Adds the samples of the cleaned pieces to track.
+func (p *Resampler) resamplePieces(track *Track,
+	pieces [][]*nextbus.VehicleLocation,
+	pathOf func(*nextbus.VehicleLocation) *nextbus.Path) *Track {
+	if len(pieces) == 0 {
+		return track
+	}
+	track.VehicleId = pieces[0][0].VehicleId
+	r := &resampling{
+		Resampler:  p,
+		projection: geogeom.MakeLocalTransverseMercator(pieces[0][0].Location),
+		polylines:  make(map[*nextbus.Path]geom.Polyline),
+		track:      track,
+	}
+	for i, piece := range pieces {
+		start := len(track.Samples)
+		r.resamplePiece(i, r.anchors(piece, pathOf))
+		if p.Smoothing != nil {
+			r.smooth(track.Samples[start:])
+		}
+	}
+	return track
+}
+
+func (r *resampling) polyline(path *nextbus.Path) geom.Polyline {
+	pl, ok := r.polylines[path]
+	if !ok {
+		pl = path.ToPolyline(r.projection)
+		r.polylines[path] = pl
+	}
+	return pl
+}
+
+func (r *resampling) anchors(piece []*nextbus.VehicleLocation,
+	pathOf func(*nextbus.VehicleLocation) *nextbus.Path) []anchor {
+	result := make([]anchor, len(piece))
+	for i, vl := range piece {
+		a := anchor{vl: vl, pt: r.projection.ToPoint(vl.Location)}
+		if path := pathOf(vl); path != nil && len(path.WayPoints) >= 2 {
+			pos, distance := r.polyline(path).Project(a.pt)
+			if distance <= r.MaxPathDistance {
+				a.path, a.offset = path, pos.Offset
+			}
+		}
+		result[i] = a
+	}
+	return result
+}
+
+// Returns true if the vehicle can be interpolated along the path from a to b,
+// adjusting b's offset if it appears to have moved backwards.
+func (r *resampling) alongPath(a anchor, b *anchor) bool {
+	if a.path == nil || a.path != b.path {
+		return false
+	}
+	if b.offset < a.offset {
+		// Vehicles don't go backwards along their path; this is location error.
+		b.offset = a.offset
+	}
+	// Too far along (e.g. the report was projected onto a later part of a
+	// path that loops back on itself).
+	dt := b.vl.Time.Sub(a.vl.Time).Seconds()
+	return b.offset-a.offset <= r.MaxSpeed*dt+r.JumpTolerance
+}
+
+func (r *resampling) headingAlong(pl geom.Polyline, pos geom.PolylinePosition,
+	loc geo.Location) geo.HeadingF {
+	i := pos.Index
+	if i >= len(pl)-1 {
+		i = len(pl) - 2
+	}
+	direction := pl[i].DirectionTo(pl[i+1])
+	return geo.HeadingF(r.projection.HeadingTransformAt(loc).FromDirection(direction))
+}
+
+// Appends the samples at multiples of Interval between the first and last
+// anchors.
+func (r *resampling) resamplePiece(piece int, anchors []anchor) {
+	first, last := anchors[0].vl.Time, anchors[len(anchors)-1].vl.Time
+	t := first.Truncate(r.Interval)
+	if t.Before(first) {
+		t = t.Add(r.Interval)
+	}
+	j := 0
+	for ; !t.After(last); t = t.Add(r.Interval) {
+		// Find the reports a and b such that a.Time < t <= b.Time (or t is the
+		// time of the first report).
+		for j+1 < len(anchors)-1 && anchors[j+1].vl.Time.Before(t) {
+			j++
+		}
+		s := &Sample{Time: t, Piece: piece}
+		if len(anchors) == 1 {
+			s.Location = anchors[0].vl.Location
+			r.track.Samples = append(r.track.Samples, s)
+			continue
+		}
+		a, b := anchors[j], &anchors[j+1]
+		dt := b.vl.Time.Sub(a.vl.Time).Seconds()
+		f := t.Sub(a.vl.Time).Seconds() / dt
+		if r.alongPath(a, b) {
+			pl := r.polyline(a.path)
+			s.Path = a.path
+			s.Offset = a.offset + f*(b.offset-a.offset)
+			pos := pl.PositionAtOffset(s.Offset)
+			loc, err := r.projection.FromPoint(pos.Point)
+			if err != nil {
+				glog.Warningf("Unable to unproject %v: %v", pos.Point, err)
+				continue
+			}
+			s.Location = loc
+			s.Speed = (b.offset - a.offset) / dt
+			s.Heading = r.headingAlong(pl, pos, loc)
+		} else {
+			distance, heading := a.vl.Location.DistanceAndHeadingTo(b.vl.Location)
+			s.Location = a.vl.Location.AtDistanceAndHeading(
+				distance*geo.Meters(f), heading)
+			s.Speed = float64(distance) / dt
+			if distance == 0 {
+				if a.vl.Heading.IsValid() {
+					s.Heading = geo.HeadingF(a.vl.Heading)
+				}
+			} else if remaining := distance * geo.Meters(1-f); remaining > 1 {
+				_, s.Heading = s.Location.DistanceAndHeadingTo(b.vl.Location)
+			} else {
+				s.Heading = heading
+			}
+		}
+		r.track.Samples = append(r.track.Samples, s)
+	}
+}
+
+// Replaces the locations, speeds and headings of the samples (of one piece)
+// with smoothed values; samples on a path are snapped back onto the path.
+func (r *resampling) smooth(samples []*Sample) {
+	if len(samples) < 2 {
+		return
+	}
+	times := make([]float64, len(samples))
+	xs := make([]float64, len(samples))
+	ys := make([]float64, len(samples))
+	t0 := samples[0].Time
+	for i, s := range samples {
+		pt := r.projection.ToPoint(s.Location)
+		times[i] = s.Time.Sub(t0).Seconds()
+		xs[i], ys[i] = pt.X, pt.Y
+	}
+	xs, vxs := r.Smoothing.Smooth(times, xs)
+	ys, vys := r.Smoothing.Smooth(times, ys)
+	for i, s := range samples {
+		pt := geom.Point{X: xs[i], Y: ys[i]}
+		if s.Path != nil {
+			pos, _ := r.polyline(s.Path).Project(pt)
+			pt, s.Offset = pos.Point, pos.Offset
+		}
+		loc, err := r.projection.FromPoint(pt)
+		if err != nil {
+			glog.Warningf("Unable to unproject %v: %v", pt, err)
+			continue
+		}
+		s.Location = loc
+		s.Speed = math.Hypot(vxs[i], vys[i])
+		if s.Speed > 0.5 {
+			// Below walking pace, the direction of the velocity is mostly noise.
+			direction := math.Atan2(vys[i], vxs[i])
+			s.Heading = geo.HeadingF(
+				r.projection.HeadingTransformAt(loc).FromDirection(direction))
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package nbverify
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// ManifestSuffix is appended to the name of a file to produce the name of its
+// manifest.
+const ManifestSuffix = ".manifest.json"
+
+// Sidecar describing a verified file.
+type Manifest struct {
+	Size       int64  `json:"size"`
+	Sha256     string `json:"sha256"`
+	NumEntries int    `json:"entries"`
+	LastGood   string `json:"last_good"`
+}
+
+func ManifestPath(filePath string) string {
+	return filePath + ManifestSuffix
+}
+
+func ReadManifest(filePath string) (*Manifest, error) {
+	data, err := ioutil.ReadFile(ManifestPath(filePath))
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %v", ManifestPath(filePath), err)
+	}
+	return m, nil
+}
+
+// WriteManifest writes the manifest of a file that has been verified.
+func WriteManifest(result *Result) error {
+	if !result.OK() {
+		return fmt.Errorf("Not writing manifest of corrupt file: %s", result.Path)
+	}
+	m := &Manifest{
+		Size:       result.Size,
+		Sha256:     result.Sha256,
+		NumEntries: result.NumEntries,
+		LastGood:   result.LastGood,
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	filePath := ManifestPath(result.Path)
+	f, err := ioutil.TempFile(filepath.Dir(filePath), ".tmp-")
+	if err != nil {
+		return err
+	}
+	tmpPath := f.Name()
+	_, err = f.Write(append(data, '\n'))
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, filePath)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+	}
+	return err
+}
+
+// Compares the size and checksum of the file with its manifest.
+func checkManifest(filePath string, m *Manifest) *Result {
+	result := &Result{
+		Path:            filePath,
+		Kind:            KindOf(filePath),
+		NumEntries:      m.NumEntries,
+		LastGood:        m.LastGood,
+		MatchedManifest: true,
+	}
+	f, err := os.Open(filePath)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	defer f.Close()
+	h := sha256.New()
+	if result.Size, err = io.Copy(h, f); err != nil {
+		result.Err = err
+		return result
+	}
+	result.Sha256 = fmt.Sprintf("%x", h.Sum(nil))
+	if result.Size != m.Size || result.Sha256 != m.Sha256 {
+		result.MatchedManifest = false
+		result.Err = fmt.Errorf("File doesn't match its manifest (size %d, "+
+			"expected %d; sha256 %s, expected %s)", result.Size, m.Size,
+			result.Sha256, m.Sha256)
+	}
+	return result
+}
@@ -0,0 +1,350 @@
+// Package nbverify checks the integrity of the files written under an agency
+// root by the fetcher: the raw tars (.tar.gz) of XML reports, and the
+// compressed CSV files (.csv.gz) of vehicle locations. A file truncated (e.g.
+// because the fetcher was killed before the gzip trailer was written) can be
+// repaired by rewriting it with all of the entries or records that can be
+// recovered. A sidecar manifest records the checksum of a verified file, so
+// that later verification can detect any change without decompressing it.
+package nbverify
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/csv"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+type Kind int
+
+const (
+	Unknown Kind = iota
+	Tar          // .tar or .tar.gz: entries are files.
+	Csv          // .csv or .csv.gz: entries are records (lines).
+)
+
+func KindOf(filePath string) Kind {
+	switch {
+	case strings.HasSuffix(filePath, ".tar"), strings.HasSuffix(filePath, ".tar.gz"):
+		return Tar
+	case strings.HasSuffix(filePath, ".csv"), strings.HasSuffix(filePath, ".csv.gz"):
+		return Csv
+	}
+	return Unknown
+}
+
+// Outcome of verifying (or repairing) a file.
+type Result struct {
+	Path string
+	Kind Kind
+	Size int64
+	// Hex encoded SHA-256 of the file.
+	Sha256 string
+	// Number of good entries (tar) or records (csv).
+	NumEntries int
+	// Number of csv records (lines) that couldn't be parsed.
+	NumBadRecords int
+	// Name of the last good tar entry, or number (1-based) of the last good
+	// csv record.
+	LastGood string
+	// Error reading the file, after which nothing more could be recovered.
+	Err error
+	// True if the checksum matched an existing manifest, in which case the
+	// contents weren't examined.
+	MatchedManifest bool
+}
+
+func (p *Result) OK() bool {
+	return p.Err == nil && p.NumBadRecords == 0
+}
+
+func (p *Result) String() string {
+	if p.OK() {
+		return fmt.Sprintf("OK: %s (%d entries)", p.Path, p.NumEntries)
+	}
+	s := fmt.Sprintf("CORRUPT: %s (%d good entries, last good: %q",
+		p.Path, p.NumEntries, p.LastGood)
+	if p.NumBadRecords > 0 {
+		s += fmt.Sprintf(", %d bad records", p.NumBadRecords)
+	}
+	if p.Err != nil {
+		s += fmt.Sprintf(", error: %v", p.Err)
+	}
+	return s + ")"
+}
+
+// Reads a file, computing its checksum and decompressing it if it is gzipped.
+type fileReader struct {
+	f      *os.File
+	hash   hash.Hash
+	raw    io.Reader // The file, hashed as it is read.
+	reader io.Reader // The decompressed contents.
+	size   int64
+}
+
+func openFileReader(filePath string) (*fileReader, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	p := &fileReader{f: f, hash: sha256.New()}
+	p.raw = io.TeeReader(bufio.NewReaderSize(f, 64*1024), p.hash)
+	p.reader = p.raw
+	if strings.HasSuffix(filePath, ".gz") {
+		gr, err := gzip.NewReader(p.raw)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		p.reader = gr
+	}
+	return p, nil
+}
+
+// Reads the rest of the decompressed contents (detecting a bad gzip trailer),
+// then the rest of the file, so that the checksum covers the whole file.
+func (p *fileReader) finish(result *Result) {
+	if _, err := io.Copy(ioutil.Discard, p.reader); err != nil && result.Err == nil {
+		result.Err = err
+	}
+	if _, err := io.Copy(ioutil.Discard, p.raw); err != nil && result.Err == nil {
+		result.Err = err
+	}
+	if info, err := p.f.Stat(); err == nil {
+		result.Size = info.Size()
+	}
+	result.Sha256 = fmt.Sprintf("%x", p.hash.Sum(nil))
+	p.f.Close()
+}
+
+// Called with each good tar entry.
+type tarEntryFn func(header *tar.Header, body []byte) error
+
+func readTar(filePath string, fn tarEntryFn) *Result {
+	result := &Result{Path: filePath, Kind: Tar}
+	fr, err := openFileReader(filePath)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	defer fr.finish(result)
+	tr := tar.NewReader(fr.reader)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return result
+		} else if err != nil {
+			result.Err = fmt.Errorf("Error reading header of entry %d: %v",
+				result.NumEntries+1, err)
+			return result
+		}
+		body, err := ioutil.ReadAll(tr)
+		if err != nil {
+			result.Err = fmt.Errorf("Error reading entry %s: %v", header.Name, err)
+			return result
+		}
+		if fn != nil {
+			if err := fn(header, body); err != nil {
+				result.Err = err
+				return result
+			}
+		}
+		result.NumEntries++
+		result.LastGood = header.Name
+	}
+}
+
+// Called with each good csv line (including comments), with its newline.
+type csvLineFn func(line []byte) error
+
+// Reads the lines of a csv file, parsing each separately (the files written
+// by the fetcher don't have quoted newlines). An incomplete last line
+// (without a newline) is treated as part of the truncation.
+func readCsv(filePath string, fn csvLineFn) *Result {
+	result := &Result{Path: filePath, Kind: Csv}
+	fr, err := openFileReader(filePath)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	defer fr.finish(result)
+	br := bufio.NewReaderSize(fr.reader, 64*1024)
+	lineNum := 0
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return result
+		} else if err == io.EOF {
+			result.Err = fmt.Errorf("Incomplete last line: %q", line)
+			return result
+		} else if err != nil {
+			result.Err = err
+			return result
+		}
+		lineNum++
+		if line[0] != '#' && len(bytes.TrimSpace(line)) > 0 {
+			r := csv.NewReader(bytes.NewReader(line))
+			r.FieldsPerRecord = -1
+			if _, err := r.Read(); err != nil {
+				glog.Warningf("Bad record at line %d of %s: %v", lineNum, filePath, err)
+				result.NumBadRecords++
+				continue
+			}
+			result.NumEntries++
+			result.LastGood = fmt.Sprintf("line %d", lineNum)
+		}
+		if fn != nil {
+			if err := fn(line); err != nil {
+				result.Err = err
+				return result
+			}
+		}
+	}
+}
+
+// Verify reads all of the entries or records of the file. If useManifest is
+// true and the file has a manifest, only the checksum is compared.
+func Verify(filePath string, useManifest bool) *Result {
+	if useManifest {
+		if m, err := ReadManifest(filePath); err == nil {
+			return checkManifest(filePath, m)
+		} else if !os.IsNotExist(err) {
+			glog.Warningf("Unable to read manifest of %s: %v", filePath, err)
+		}
+	}
+	switch KindOf(filePath) {
+	case Tar:
+		return readTar(filePath, nil)
+	case Csv:
+		return readCsv(filePath, nil)
+	}
+	return &Result{Path: filePath,
+		Err: fmt.Errorf("Unsupported file type: %s", filePath)}
+}
+
+// Writes the repaired copy of a file.
+type repairWriter struct {
+	f  *os.File
+	bw *bufio.Writer
+	gw *gzip.Writer
+	w  io.Writer
+}
+
+func createRepairWriter(filePath, tmpPath string) (*repairWriter, error) {
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	p := &repairWriter{f: f, bw: bufio.NewWriterSize(f, 64*1024)}
+	p.w = p.bw
+	if strings.HasSuffix(filePath, ".gz") {
+		p.gw = gzip.NewWriter(p.bw)
+		p.w = p.gw
+	}
+	return p, nil
+}
+
+func (p *repairWriter) close(err error) error {
+	if p.gw != nil {
+		if err2 := p.gw.Close(); err == nil {
+			err = err2
+		}
+	}
+	if err2 := p.bw.Flush(); err == nil {
+		err = err2
+	}
+	if err2 := p.f.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// CorruptSuffix is appended to the name of a file that has been replaced by
+// a repaired copy.
+const CorruptSuffix = ".corrupt"
+
+// Repair rewrites a corrupt file with all of the entries or records that can
+// be recovered from it, after renaming the original by appending
+// CorruptSuffix. The result describes the original file. Returns an error if
+// unable to write the repaired file; the original is then left in place.
+func Repair(filePath string) (*Result, error) {
+	tmpPath := filepath.Join(filepath.Dir(filePath),
+		".repair-"+filepath.Base(filePath))
+	rw, err := createRepairWriter(filePath, tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	var result *Result
+	var writeErr error
+	switch KindOf(filePath) {
+	case Tar:
+		tw := tar.NewWriter(rw.w)
+		result = readTar(filePath, func(header *tar.Header, body []byte) error {
+			if writeErr = tw.WriteHeader(header); writeErr == nil {
+				_, writeErr = tw.Write(body)
+			}
+			return writeErr
+		})
+		if writeErr == nil {
+			writeErr = tw.Close()
+		}
+	case Csv:
+		result = readCsv(filePath, func(line []byte) error {
+			_, writeErr = rw.w.Write(line)
+			return writeErr
+		})
+	default:
+		writeErr = fmt.Errorf("Unsupported file type: %s", filePath)
+	}
+	if err := rw.close(writeErr); err != nil {
+		os.Remove(tmpPath)
+		return result, err
+	}
+	if result.OK() {
+		// Nothing to repair.
+		os.Remove(tmpPath)
+		return result, nil
+	}
+	if err := os.Rename(filePath, filePath+CorruptSuffix); err != nil {
+		os.Remove(tmpPath)
+		return result, err
+	}
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		return result, err
+	}
+	glog.Infof("Repaired %s, keeping %d entries", filePath, result.NumEntries)
+	return result, nil
+}
+
+// FindFiles returns the paths of the tar and csv files under root, skipping
+// those modified within minAge (which may still be being written).
+func FindFiles(root string, minAge time.Duration) ([]string, error) {
+	var result []string
+	cutoff := time.Now().Add(-minAge)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || KindOf(path) == Unknown {
+			return nil
+		}
+		if info.ModTime().After(cutoff) {
+			glog.V(1).Infof("Skipping recently modified file: %s", path)
+			return nil
+		}
+		result = append(result, path)
+		return nil
+	})
+	return result, err
+}
@@ -0,0 +1,176 @@
+package nbverify
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func tarGzBytes(t *testing.T, n int) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for i := 0; i < n; i++ {
+		// Vary the bodies, so the compressed file grows with each entry.
+		body := []byte(fmt.Sprintf("<body time=\"%d\">%x</body>\n", i, i*i*7919))
+		body = bytes.Repeat(body, 50+i)
+		hdr := &tar.Header{
+			Name:    fmt.Sprintf("%03d.xml", i),
+			Size:    int64(len(body)),
+			Mode:    0444,
+			ModTime: time.Unix(1400000000+int64(i), 0),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write(body)
+	}
+	tw.Close()
+	gw.Close()
+	return buf.Bytes()
+}
+
+func csvGzBytes(lines string) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.Write([]byte(lines))
+	gw.Close()
+	return buf.Bytes()
+}
+
+func writeTemp(t *testing.T, dir, name string, data []byte) string {
+	filePath := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(filePath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filePath
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "nbverify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestVerifyAndManifest(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	filePath := writeTemp(t, dir, "good.tar.gz", tarGzBytes(t, 10))
+	result := Verify(filePath, true)
+	if !result.OK() || result.NumEntries != 10 || result.LastGood != "009.xml" {
+		t.Fatalf("Verify(good) = %s, last good %q", result, result.LastGood)
+	}
+	if err := WriteManifest(result); err != nil {
+		t.Fatal(err)
+	}
+	result = Verify(filePath, true)
+	if !result.OK() || !result.MatchedManifest || result.NumEntries != 10 {
+		t.Errorf("Verify with manifest = %s, matched %v", result,
+			result.MatchedManifest)
+	}
+	// Modify the file; the manifest must detect that.
+	data, _ := ioutil.ReadFile(filePath)
+	data[len(data)/2] ^= 0xff
+	writeTemp(t, dir, "good.tar.gz", data)
+	if result = Verify(filePath, true); result.OK() {
+		t.Errorf("Modified file should fail to match its manifest")
+	}
+}
+
+func TestRepairTruncatedTar(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	data := tarGzBytes(t, 20)
+	filePath := writeTemp(t, dir, "raw.tar.gz", data[:len(data)*2/3])
+	result := Verify(filePath, false)
+	if result.OK() || result.NumEntries == 0 || result.NumEntries >= 20 {
+		t.Fatalf("Verify(truncated) = %s", result)
+	}
+	numGood, lastGood := result.NumEntries, result.LastGood
+	result, err := Repair(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.NumEntries != numGood {
+		t.Errorf("Repair kept %d entries, expected %d", result.NumEntries, numGood)
+	}
+	if _, err := os.Stat(filePath + CorruptSuffix); err != nil {
+		t.Errorf("Original not kept: %v", err)
+	}
+	result = Verify(filePath, false)
+	if !result.OK() || result.NumEntries != numGood || result.LastGood != lastGood {
+		t.Errorf("Verify(repaired) = %s, last good %q, expected %q", result,
+			result.LastGood, lastGood)
+	}
+}
+
+func TestRepairCsv(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	lines := "# comment\n1,a,b\n2,\"c\"x,d\n3,e,f\n4,g,"
+	filePath := writeTemp(t, dir, "locations.csv.gz", csvGzBytes(lines))
+	result := Verify(filePath, false)
+	if result.OK() || result.NumEntries != 2 || result.NumBadRecords != 1 ||
+		result.LastGood != "line 4" {
+		t.Fatalf("Verify(csv) = %s", result)
+	}
+	if _, err := Repair(filePath); err != nil {
+		t.Fatal(err)
+	}
+	rc, err := os.Open(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	gr, err := gzip.NewReader(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := ioutil.ReadAll(gr)
+	if want := "# comment\n1,a,b\n3,e,f\n"; string(got) != want {
+		t.Errorf("Repaired csv is %q, expected %q", got, want)
+	}
+}
+
+func TestRepairGoodFile(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	filePath := writeTemp(t, dir, "good.tar.gz", tarGzBytes(t, 3))
+	result, err := Repair(filePath)
+	if err != nil || !result.OK() {
+		t.Fatalf("Repair(good) = %s, %v", result, err)
+	}
+	if _, err := os.Stat(filePath + CorruptSuffix); err == nil {
+		t.Errorf("Good file should not have been replaced")
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("Expected only the original file, found %d files", len(files))
+	}
+}
+
+func TestFindFiles(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "locations", "raw", "2014", "11"), 0755)
+	old := writeTemp(t, dir, "locations/raw/2014/11/2014-11-04.tar.gz", nil)
+	writeTemp(t, dir, "locations/raw/2014/11/2014-11-05.tar.gz", nil)
+	writeTemp(t, dir, "locations/raw/2014/11/notes.txt", nil)
+	then := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(old, then, then)
+	files, err := FindFiles(dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0] != old {
+		t.Errorf("FindFiles() = %v, expected [%s]", files, old)
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"encoding/xml"
 	"fmt"
 	"github.com/jamessynge/transit_tools/geo"
+	"github.com/jamessynge/transit_tools/geo/geogeom"
+	"github.com/jamessynge/transit_tools/geom"
 	"io"
 	"log"
 	"os"
@@ -50,6 +52,15 @@ func (p *Path) Bounds() (min, max geo.Location) {
 	return
 }
 
+// Returns the waypoints of the path, projected by transform.
+func (p *Path) ToPolyline(transform geogeom.CoordTransform) geom.Polyline {
+	result := make(geom.Polyline, len(p.WayPoints))
+	for i, loc := range p.WayPoints {
+		result[i] = transform.ToPoint(loc.Location)
+	}
+	return result
+}
+
 func BoundsOfPaths(paths []*Path) (min, max geo.Location, ok bool) {
 	if len(paths) == 0 {
 		return
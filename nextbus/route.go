@@ -49,6 +49,29 @@ func (p *Route) getOrAddDirectionByTag(tag string) *Direction {
 	return direction
 }
 
+// GetOrAddDirection returns the direction of the route with the tag, adding
+// it (to the route and the agency) if necessary.
+func (p *Route) GetOrAddDirection(tag string) *Direction {
+	return p.getOrAddDirectionByTag(tag)
+}
+
+// AddStop adds the stop (which must be a stop of the route's agency) to the
+// route.
+func (p *Route) AddStop(stop *Stop) {
+	p.Stops[stop.Tag] = stop
+	stop.Routes[p.Tag] = p
+}
+
+// AddPath adds the path (which must be a path of the route's agency) to the
+// route, if not already present.
+func (p *Route) AddPath(path *Path) {
+	if _, ok := path.Routes[p.Tag]; ok {
+		return
+	}
+	path.Routes[p.Tag] = p
+	p.Paths = append(p.Paths, path)
+}
+
 //func (p *Route) getOrAddStopByTag(tag string) *Stop {
 //	stop, ok := p.Stops[tag]
 //	if !ok {
@@ -70,6 +93,7 @@ func (p *Route) parseRouteConfigStopDefs(re *RouteElement, errors *[]error) {
 		}
 		if stop != nil {
 			p.Stops[se.Tag] = stop
+			stop.Routes[p.Tag] = p
 		}
 	}
 	//	log.Printf("Route.parseRouteConfigStopDefs DONE for route '%s' (tag %s)", p.Title, p.Tag)
@@ -90,7 +114,7 @@ func (p *Route) parseRouteConfigDirectionDefs(re *RouteElement, errors *[]error)
 			*errors = append(*errors, err)
 		}
 		firstError := true
-		for ndx, stopElem := range re.Stops {
+		for ndx, stopElem := range elem.Stops {
 			//			log.Printf("  Adding stop with tag %s", stopElem.Tag)
 			stop, ok := p.Stops[stopElem.Tag]
 			if ok {
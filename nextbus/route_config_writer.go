@@ -0,0 +1,192 @@
+package nextbus
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/jamessynge/transit_tools/geo"
+)
+
+// Writes routeConfig XML (i.e. the response to command=routeConfig for a
+// single route, as parsed by ParseRouteConfigXml) from the model, so that
+// corrected or merged models can be read by the tools that read routeConfig
+// files. The map based parts of the model don't preserve the order of the
+// original file, so directions are written in tag order, and the stops of the
+// route in the order they are first visited by those directions (any other
+// stops follow, in tag order).
+
+func formatCoord(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// Returns the bounds declared for the route, or if not set (e.g. for a
+// route created by merging), the bounds of its stops and paths.
+func routeConfigBounds(route *Route) (min, max geo.Location) {
+	if route.BoundsInitialized() {
+		min = geo.Location{Lat: route.LatMin, Lon: route.LonMin}
+		max = geo.Location{Lat: route.LatMax, Lon: route.LonMax}
+		return
+	}
+	first := true
+	extend := func(loc geo.Location) {
+		if first {
+			min, max = loc, loc
+			first = false
+			return
+		}
+		if loc.Lat < min.Lat {
+			min.Lat = loc.Lat
+		}
+		if loc.Lat > max.Lat {
+			max.Lat = loc.Lat
+		}
+		if loc.Lon < min.Lon {
+			min.Lon = loc.Lon
+		}
+		if loc.Lon > max.Lon {
+			max.Lon = loc.Lon
+		}
+	}
+	for _, stop := range route.Stops {
+		if stop.Location != nil {
+			extend(stop.Location.Location)
+		}
+	}
+	for _, path := range route.Paths {
+		for _, location := range path.WayPoints {
+			extend(location.Location)
+		}
+	}
+	return
+}
+
+func sortedDirections(route *Route) []*Direction {
+	var tags []string
+	for tag := range route.Directions {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	result := make([]*Direction, len(tags))
+	for i, tag := range tags {
+		result[i] = route.Directions[tag]
+	}
+	return result
+}
+
+func sortedRouteStops(route *Route, directions []*Direction) []*Stop {
+	var result []*Stop
+	seen := make(map[string]bool)
+	for _, direction := range directions {
+		for _, stop := range direction.Stops {
+			if !seen[stop.Tag] && route.Stops[stop.Tag] != nil {
+				seen[stop.Tag] = true
+				result = append(result, stop)
+			}
+		}
+	}
+	var others []string
+	for tag := range route.Stops {
+		if !seen[tag] {
+			others = append(others, tag)
+		}
+	}
+	sort.Strings(others)
+	for _, tag := range others {
+		result = append(result, route.Stops[tag])
+	}
+	return result
+}
+
+func writeOptionalAttr(w io.Writer, name, value string) {
+	if len(value) > 0 {
+		fmt.Fprintf(w, ` %s="%s"`, name, Escape(value))
+	}
+}
+
+// WriteRouteConfig writes the route as routeConfig XML.
+func WriteRouteConfig(route *Route, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, `<?xml version="1.0" encoding="utf-8" ?>`)
+	fmt.Fprintln(bw, `<body>`)
+	fmt.Fprintf(bw, `<route tag="%s" title="%s"`, Escape(route.Tag),
+		Escape(route.Title))
+	writeOptionalAttr(bw, "shortTitle", route.ShortTitle)
+	writeOptionalAttr(bw, "color", route.Color)
+	writeOptionalAttr(bw, "oppositeColor", route.OppColor)
+	min, max := routeConfigBounds(route)
+	fmt.Fprintf(bw, ` latMin="%s" latMax="%s" lonMin="%s" lonMax="%s">`,
+		formatCoord(float64(min.Lat)), formatCoord(float64(max.Lat)),
+		formatCoord(float64(min.Lon)), formatCoord(float64(max.Lon)))
+	fmt.Fprintln(bw)
+
+	directions := sortedDirections(route)
+	for _, stop := range sortedRouteStops(route, directions) {
+		fmt.Fprintf(bw, `<stop tag="%s" title="%s"`, Escape(stop.Tag),
+			Escape(stop.Title))
+		writeOptionalAttr(bw, "shortTitle", stop.ShortTitle)
+		if stop.Location != nil {
+			fmt.Fprintf(bw, ` lat="%s" lon="%s"`,
+				formatCoord(float64(stop.Location.Lat)),
+				formatCoord(float64(stop.Location.Lon)))
+		}
+		writeOptionalAttr(bw, "stopId", stop.Id)
+		fmt.Fprintln(bw, `/>`)
+	}
+	for _, direction := range directions {
+		fmt.Fprintf(bw, `<direction tag="%s" title="%s"`, Escape(direction.Tag),
+			Escape(direction.Title))
+		writeOptionalAttr(bw, "name", direction.Name)
+		fmt.Fprintf(bw, ` useForUI="%v">`, direction.UseForUI)
+		fmt.Fprintln(bw)
+		for _, stop := range direction.Stops {
+			fmt.Fprintf(bw, `  <stop tag="%s" />`, Escape(stop.Tag))
+			fmt.Fprintln(bw)
+		}
+		fmt.Fprintln(bw, `</direction>`)
+	}
+	for _, path := range route.Paths {
+		fmt.Fprintln(bw, `<path>`)
+		for _, location := range path.WayPoints {
+			fmt.Fprintf(bw, `<point lat="%s" lon="%s"/>`,
+				formatCoord(float64(location.Lat)), formatCoord(float64(location.Lon)))
+			fmt.Fprintln(bw)
+		}
+		fmt.Fprintln(bw, `</path>`)
+	}
+	fmt.Fprintln(bw, `</route>`)
+	fmt.Fprintln(bw, `</body>`)
+	return bw.Flush()
+}
+
+func WriteRouteConfigToFile(route *Route, filePath string) error {
+	f, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	if err := WriteRouteConfig(route, f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// WriteRouteConfigsDir writes a routeConfig file (<route tag>.xml) for each
+// route of the agency into dirPath, which can be read by
+// ParseRouteConfigsDir.
+func WriteRouteConfigsDir(agency *Agency, dirPath string) error {
+	if err := os.MkdirAll(dirPath, 0755); err != nil {
+		return err
+	}
+	for tag, route := range agency.Routes {
+		filePath := filepath.Join(dirPath, tag+".xml")
+		if err := WriteRouteConfigToFile(route, filePath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package nextbus
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+const routeConfig76 = `<?xml version="1.0" encoding="utf-8" ?>
+<body copyright="All data copyright MBTA 2013.">
+<route tag="76" title="76" shortTitle="76 Lex" color="9933cc" oppositeColor="ffffff"
+  latMin="42.3954299" latMax="42.4628099" lonMin="-71.29118" lonMax="-71.14248">
+<stop tag="2480" title="Rt 2 &amp; &quot;Bridge&quot;" lat="42.3991199" lon="-71.1462" stopId="02480"/>
+<stop tag="141" title="Alewife Station Busway" lat="42.3954299" lon="-71.14248" stopId="00141"/>
+<stop tag="99" title="Unused" shortTitle="U" lat="42.41" lon="-71.2"/>
+<direction tag="76_1_var0" title="Alewife Station via Lexington Center" name="Inbound" useForUI="false">
+  <stop tag="2480" />
+  <stop tag="141" />
+</direction>
+<direction tag="76_0_var0" title="Hanscom Civil Airport via Lexington Center" name="Outbound" useForUI="true">
+  <stop tag="141" />
+  <stop tag="2480" />
+</direction>
+<path>
+<point lat="42.39912" lon="-71.1461999"/>
+<point lat="42.4003" lon="-71.15035"/>
+</path>
+<path>
+<point lat="42.40541" lon="-71.16511"/>
+<point lat="42.40529" lon="-71.1645"/>
+</path>
+</route>
+</body>`
+
+func checkRoutesEqual(t *testing.T, r1, r2 *Route) {
+	if r1.Tag != r2.Tag || r1.Title != r2.Title || r1.ShortTitle != r2.ShortTitle ||
+		r1.Color != r2.Color || r1.OppColor != r2.OppColor ||
+		r1.LatMin != r2.LatMin || r1.LatMax != r2.LatMax ||
+		r1.LonMin != r2.LonMin || r1.LonMax != r2.LonMax {
+		t.Errorf("Routes differ:\n%#v\n%#v", r1, r2)
+	}
+	if len(r1.Stops) != len(r2.Stops) {
+		t.Errorf("Wrong number of stops: %d, %d", len(r1.Stops), len(r2.Stops))
+	}
+	for tag, s1 := range r1.Stops {
+		s2 := r2.Stops[tag]
+		if s2 == nil || s1.Title != s2.Title || s1.ShortTitle != s2.ShortTitle ||
+			s1.Id != s2.Id || s1.Location.Location != s2.Location.Location {
+			t.Errorf("Stops differ:\n%#v\n%#v", s1, s2)
+		}
+	}
+	if len(r1.Directions) != len(r2.Directions) {
+		t.Errorf("Wrong number of directions: %d, %d",
+			len(r1.Directions), len(r2.Directions))
+	}
+	for tag, d1 := range r1.Directions {
+		d2 := r2.Directions[tag]
+		if d2 == nil || d1.Title != d2.Title || d1.Name != d2.Name ||
+			d1.UseForUI != d2.UseForUI || len(d1.Stops) != len(d2.Stops) {
+			t.Errorf("Directions differ:\n%#v\n%#v", d1, d2)
+			continue
+		}
+		for i := range d1.Stops {
+			if d1.Stops[i].Tag != d2.Stops[i].Tag {
+				t.Errorf("Direction %s stop %d differs: %s, %s",
+					tag, i, d1.Stops[i].Tag, d2.Stops[i].Tag)
+			}
+		}
+	}
+	if len(r1.Paths) != len(r2.Paths) {
+		t.Fatalf("Wrong number of paths: %d, %d", len(r1.Paths), len(r2.Paths))
+	}
+	for i := range r1.Paths {
+		w1, w2 := r1.Paths[i].WayPoints, r2.Paths[i].WayPoints
+		if len(w1) != len(w2) {
+			t.Errorf("Path %d differs: %v, %v", i, w1, w2)
+			continue
+		}
+		for j := range w1 {
+			if w1[j].Location != w2[j].Location {
+				t.Errorf("Path %d point %d differs: %v, %v",
+					i, j, w1[j].Location, w2[j].Location)
+			}
+		}
+	}
+}
+
+func TestWriteRouteConfigRoundTrip(t *testing.T) {
+	agency1 := NewAgency("mbta")
+	route1, err := ParseRouteConfigXml(agency1, []byte(routeConfig76))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := WriteRouteConfig(route1, &buf); err != nil {
+		t.Fatal(err)
+	}
+	written := buf.String()
+
+	agency2 := NewAgency("mbta")
+	route2, err := ParseRouteConfigXml(agency2, buf.Bytes())
+	if err != nil {
+		t.Fatalf("Unable to parse written config: %v\n%s", err, written)
+	}
+	checkRoutesEqual(t, route1, route2)
+
+	// Writing is deterministic, so writing the parsed config produces the
+	// same XML.
+	buf.Reset()
+	if err := WriteRouteConfig(route2, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != written {
+		t.Errorf("Second write differs:\n%s\nfirst:\n%s", buf.String(), written)
+	}
+
+	// Stops are in the order visited by the directions (in tag order).
+	i141 := bytes.Index([]byte(written), []byte(`<stop tag="141" title`))
+	i2480 := bytes.Index([]byte(written), []byte(`<stop tag="2480" title`))
+	i99 := bytes.Index([]byte(written), []byte(`<stop tag="99" title`))
+	if !(0 <= i141 && i141 < i2480 && i2480 < i99) {
+		t.Errorf("Wrong stop order:\n%s", written)
+	}
+}
+
+func TestWriteRouteConfigsDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "route_config_writer_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	agency1 := NewAgency("mbta")
+	route1, err := ParseRouteConfigXml(agency1, []byte(routeConfig76))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Bounds are computed if not set.
+	route1.LatMin, route1.LatMax, route1.LonMin, route1.LonMax = 0, 0, 0, 0
+	if err := WriteRouteConfigsDir(agency1, dir); err != nil {
+		t.Fatal(err)
+	}
+	agency2 := NewAgency("mbta")
+	if err := ParseRouteConfigsDir(agency2, dir); err != nil {
+		t.Fatal(err)
+	}
+	route2 := agency2.Routes["76"]
+	if route2 == nil {
+		t.Fatalf("Route not found: %v", agency2.Routes)
+	}
+	if route2.LatMin != 42.3954299 || route2.LatMax != 42.41 ||
+		route2.LonMin != -71.2 || route2.LonMax != -71.14248 {
+		t.Errorf("Wrong bounds: %v %v %v %v",
+			route2.LatMin, route2.LatMax, route2.LonMin, route2.LonMax)
+	}
+	route2.LatMin, route2.LatMax, route2.LonMin, route2.LonMax = 0, 0, 0, 0
+	checkRoutesEqual(t, route1, route2)
+	if agency2.NumPaths() != agency1.NumPaths() {
+		t.Errorf("Wrong number of paths: %d", agency2.NumPaths())
+	}
+}
@@ -0,0 +1,470 @@
+package parquet
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// Generic decoding of the Thrift compact protocol, for checking the encoding
+// of the metadata: structs are decoded as maps from field id to value, lists
+// as slices, integers as int64, binary as []byte.
+type thriftDecoder struct {
+	t   *testing.T
+	buf []byte
+}
+
+func (p *thriftDecoder) byte() byte {
+	if len(p.buf) == 0 {
+		p.t.Fatal("Thrift data truncated")
+	}
+	b := p.buf[0]
+	p.buf = p.buf[1:]
+	return b
+}
+
+func (p *thriftDecoder) uvarint() uint64 {
+	v, n := binary.Uvarint(p.buf)
+	if n <= 0 {
+		p.t.Fatal("Bad uvarint")
+	}
+	p.buf = p.buf[n:]
+	return v
+}
+
+func (p *thriftDecoder) varint() int64 {
+	v, n := binary.Varint(p.buf)
+	if n <= 0 {
+		p.t.Fatal("Bad varint")
+	}
+	p.buf = p.buf[n:]
+	return v
+}
+
+func (p *thriftDecoder) value(typ byte) interface{} {
+	switch typ {
+	case 1:
+		return true
+	case 2:
+		return false
+	case 5, 6:
+		return p.varint()
+	case 8:
+		n := int(p.uvarint())
+		v := p.buf[:n]
+		p.buf = p.buf[n:]
+		return v
+	case 9:
+		h := p.byte()
+		size, elemType := int(h>>4), h&0x0f
+		if size == 15 {
+			size = int(p.uvarint())
+		}
+		var result []interface{}
+		for i := 0; i < size; i++ {
+			result = append(result, p.value(elemType))
+		}
+		return result
+	case 12:
+		return p.structValue()
+	}
+	p.t.Fatalf("Unsupported thrift type: %d", typ)
+	return nil
+}
+
+func (p *thriftDecoder) structValue() map[int16]interface{} {
+	result := make(map[int16]interface{})
+	var id int16
+	for {
+		h := p.byte()
+		if h == 0 {
+			return result
+		}
+		if delta := int16(h >> 4); delta != 0 {
+			id += delta
+		} else {
+			id = int16(p.varint())
+		}
+		result[id] = p.value(h & 0x0f)
+	}
+}
+
+func writeTestFile(t *testing.T, codec Codec, rowGroupSize int) []byte {
+	columns := []Column{
+		{Name: "ts", Type: Int64, ConvertedType: TimestampMillis},
+		{Name: "n", Type: Int32, ConvertedType: NoConvertedType, Optional: true},
+		{Name: "x", Type: Double, ConvertedType: NoConvertedType},
+		StringColumn("s", true),
+	}
+	var buf bytes.Buffer
+	w := NewWriter(&buf, columns)
+	w.Codec = codec
+	w.RowGroupSize = rowGroupSize
+	w.Metadata = map[string]string{"source": "test"}
+	for i := 0; i < 10; i++ {
+		var n, s interface{}
+		if i%3 != 0 {
+			n = int32(i * 10)
+			s = string(rune('a' + i))
+		}
+		if err := w.AppendRow(int64(1400000000000+i), n, float64(i)/4, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.AppendRow(int64(1), nil, nil, nil); err == nil {
+		t.Error("Expected error for null in required column")
+	}
+	if err := w.AppendRow(int64(1), "x", 1.0, nil); err == nil {
+		t.Error("Expected error for wrong type")
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func readFooter(t *testing.T, data []byte) map[int16]interface{} {
+	if string(data[:4]) != kMagic || string(data[len(data)-4:]) != kMagic {
+		t.Fatal("Missing magic")
+	}
+	size := int(binary.LittleEndian.Uint32(data[len(data)-8:]))
+	d := &thriftDecoder{t, data[len(data)-8-size : len(data)-8]}
+	footer := d.structValue()
+	if len(d.buf) != 0 {
+		t.Errorf("%d bytes left after footer", len(d.buf))
+	}
+	return footer
+}
+
+// Snappy isn't written, but is used by the golden file.
+const kSnappy Codec = 1
+
+// Decodes a snappy block (https://github.com/google/snappy/blob/main/format_description.txt).
+func snappyDecode(t *testing.T, src []byte) []byte {
+	size, n := binary.Uvarint(src)
+	if n <= 0 {
+		t.Fatal("Bad snappy length")
+	}
+	src = src[n:]
+	var dst []byte
+	for len(src) > 0 {
+		tag := src[0]
+		var length, offset int
+		switch tag & 3 {
+		case 0:
+			length = int(tag>>2) + 1
+			src = src[1:]
+			if length > 60 {
+				numBytes := length - 60
+				length = 1
+				for i := 0; i < numBytes; i++ {
+					length += int(src[i]) << uint(8*i)
+				}
+				src = src[numBytes:]
+			}
+			dst = append(dst, src[:length]...)
+			src = src[length:]
+			continue
+		case 1:
+			length = 4 + int(tag>>2)&7
+			offset = int(tag&0xe0)<<3 | int(src[1])
+			src = src[2:]
+		case 2:
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[1:]))
+			src = src[3:]
+		case 3:
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[1:]))
+			src = src[5:]
+		}
+		if offset <= 0 || offset > len(dst) {
+			t.Fatalf("Bad snappy copy offset %d", offset)
+		}
+		for i := 0; i < length; i++ {
+			dst = append(dst, dst[len(dst)-offset])
+		}
+	}
+	if uint64(len(dst)) != size {
+		t.Fatalf("Snappy block decoded to %d bytes, not %d", len(dst), size)
+	}
+	return dst
+}
+
+// Returns the headers and the uncompressed contents of the data pages of a
+// column chunk (just one, as written here).
+func readDataPages(t *testing.T, data []byte, chunk map[int16]interface{}) (
+	headers []map[int16]interface{}, pages [][]byte) {
+	meta := chunk[3].(map[int16]interface{})
+	d := &thriftDecoder{t, data[meta[9].(int64):]}
+	for numValues := int64(0); numValues < meta[5].(int64); {
+		header := d.structValue()
+		page := d.buf[:header[3].(int64)]
+		d.buf = d.buf[len(page):]
+		switch Codec(meta[4].(int64)) {
+		case Gzip:
+			gr, err := gzip.NewReader(bytes.NewReader(page))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if page, err = ioutil.ReadAll(gr); err != nil {
+				t.Fatal(err)
+			}
+		case kSnappy:
+			page = snappyDecode(t, page)
+		}
+		if int64(len(page)) != header[2].(int64) {
+			t.Errorf("Uncompressed size is %d, not %d", len(page), header[2])
+		}
+		headers = append(headers, header)
+		pages = append(pages, page)
+		numValues += header[5].(map[int16]interface{})[1].(int64)
+	}
+	return
+}
+
+// Decodes the values of a column chunk into a slice, with nil for nulls.
+func readColumnChunk(t *testing.T, data []byte, chunk map[int16]interface{},
+	typ Type, optional bool) (result []interface{}) {
+	headers, pages := readDataPages(t, data, chunk)
+	for i, header := range headers {
+		result = append(result, decodePage(t, header, pages[i], typ, optional)...)
+	}
+	return
+}
+
+// Decodes the values of a data page.
+func decodePage(t *testing.T, header map[int16]interface{}, page []byte,
+	typ Type, optional bool) []interface{} {
+	numValues := int(header[5].(map[int16]interface{})[1].(int64))
+	var defLevels []byte
+	if optional {
+		size := binary.LittleEndian.Uint32(page)
+		runs := page[4 : 4+size]
+		page = page[4+size:]
+		for len(runs) > 0 {
+			h, n := binary.Uvarint(runs)
+			if h&1 != 0 {
+				t.Fatal("Unexpected bit-packed run")
+			}
+			for i := 0; i < int(h>>1); i++ {
+				defLevels = append(defLevels, runs[n])
+			}
+			runs = runs[n+1:]
+		}
+		if len(defLevels) != numValues {
+			t.Fatalf("%d definition levels, expected %d", len(defLevels), numValues)
+		}
+	}
+	var result []interface{}
+	for i := 0; i < numValues; i++ {
+		if optional && defLevels[i] == 0 {
+			result = append(result, nil)
+			continue
+		}
+		switch typ {
+		case Int32:
+			result = append(result, int32(binary.LittleEndian.Uint32(page)))
+			page = page[4:]
+		case Int64:
+			result = append(result, int64(binary.LittleEndian.Uint64(page)))
+			page = page[8:]
+		case Double:
+			result = append(result,
+				math.Float64frombits(binary.LittleEndian.Uint64(page)))
+			page = page[8:]
+		case ByteArray:
+			n := binary.LittleEndian.Uint32(page)
+			result = append(result, string(page[4:4+n]))
+			page = page[4+n:]
+		}
+	}
+	if len(page) != 0 {
+		t.Errorf("%d bytes left in page", len(page))
+	}
+	return result
+}
+
+func TestWriteRead(t *testing.T) {
+	for _, codec := range []Codec{Uncompressed, Gzip} {
+		for _, rowGroupSize := range []int{4, 100} {
+			data := writeTestFile(t, codec, rowGroupSize)
+			footer := readFooter(t, data)
+			if footer[3].(int64) != 10 {
+				t.Errorf("num_rows is %v", footer[3])
+			}
+			schema := footer[2].([]interface{})
+			if len(schema) != 5 {
+				t.Fatalf("Schema has %d elements", len(schema))
+			}
+			root := schema[0].(map[int16]interface{})
+			if string(root[4].([]byte)) != "schema" || root[5].(int64) != 4 {
+				t.Errorf("Wrong schema root: %v", root)
+			}
+			types := []Type{Int64, Int32, Double, ByteArray}
+			optional := []bool{false, true, false, true}
+			for i, name := range []string{"ts", "n", "x", "s"} {
+				elem := schema[i+1].(map[int16]interface{})
+				if string(elem[4].([]byte)) != name ||
+					Type(elem[1].(int64)) != types[i] ||
+					(elem[3].(int64) == kOptional) != optional[i] {
+					t.Errorf("Wrong schema element: %v", elem)
+				}
+			}
+			if string(footer[6].([]byte)) == "" {
+				t.Error("Missing created_by")
+			}
+			kv := footer[5].([]interface{})[0].(map[int16]interface{})
+			if string(kv[1].([]byte)) != "source" || string(kv[2].([]byte)) != "test" {
+				t.Errorf("Wrong key-value metadata: %v", kv)
+			}
+
+			rowGroups := footer[4].([]interface{})
+			expectedGroups := 1
+			if rowGroupSize == 4 {
+				expectedGroups = 3
+			}
+			if len(rowGroups) != expectedGroups {
+				t.Fatalf("%d row groups, expected %d", len(rowGroups), expectedGroups)
+			}
+			var columns [4][]interface{}
+			for _, rgv := range rowGroups {
+				rg := rgv.(map[int16]interface{})
+				for i, cv := range rg[1].([]interface{}) {
+					columns[i] = append(columns[i], readColumnChunk(
+						t, data, cv.(map[int16]interface{}), types[i], optional[i])...)
+				}
+			}
+			for i := 0; i < 10; i++ {
+				if columns[0][i] != int64(1400000000000+i) ||
+					columns[2][i] != float64(i)/4 {
+					t.Errorf("Wrong values in row %d: %v %v", i, columns[0][i],
+						columns[2][i])
+				}
+				if i%3 == 0 {
+					if columns[1][i] != nil || columns[3][i] != nil {
+						t.Errorf("Expected nulls in row %d", i)
+					}
+				} else if columns[1][i] != int32(i*10) ||
+					columns[3][i] != string(rune('a'+i)) {
+					t.Errorf("Wrong values in row %d: %v %v", i, columns[1][i],
+						columns[3][i])
+				}
+			}
+
+			// Statistics of the timestamp column of the first row group.
+			rg := rowGroups[0].(map[int16]interface{})
+			meta := rg[1].([]interface{})[0].(map[int16]interface{})[3].(map[int16]interface{})
+			stats := meta[12].(map[int16]interface{})
+			if binary.LittleEndian.Uint64(stats[6].([]byte)) != 1400000000000 {
+				t.Errorf("Wrong min: %v", stats[6])
+			}
+		}
+	}
+}
+
+// Compares the file written for the columns of testdata/flat.parquet.snappy
+// that it can write (those with PLAIN encoding: age, id and day) with that
+// file, which was written by an independent implementation
+// (github.com/xitongsys/parquet-go, which uses snappy, and also writes
+// columns of types, encodings and statistics not supported here).
+func TestGoldenFile(t *testing.T) {
+	golden, err := ioutil.ReadFile("testdata/flat.parquet.snappy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	goldenFooter := readFooter(t, golden)
+	goldenSchema := goldenFooter[2].([]interface{})
+	goldenChunks := goldenFooter[4].([]interface{})[0].(map[int16]interface{})[1].([]interface{})
+	if goldenFooter[3].(int64) != 10 || len(goldenSchema) != 7 ||
+		len(goldenChunks) != 6 {
+		t.Fatalf("Unexpected golden file metadata: %v", goldenFooter)
+	}
+
+	// Indices of the columns in the golden file, their types, and their
+	// values there.
+	indices := []int{1, 2, 5}
+	columns := []Column{
+		{Name: "age", Type: Int32, ConvertedType: NoConvertedType},
+		{Name: "id", Type: Int64, ConvertedType: NoConvertedType},
+		{Name: "day", Type: Int32, ConvertedType: Date},
+	}
+	var values [3][]interface{}
+	for i, index := range indices {
+		chunk := goldenChunks[index].(map[int16]interface{})
+		values[i] = readColumnChunk(t, golden, chunk, columns[i].Type, false)
+	}
+	var buf bytes.Buffer
+	w := NewWriter(&buf, columns)
+	for row := 0; row < 10; row++ {
+		if err := w.AppendRow(values[0][row], values[1][row], values[2][row]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	footer := readFooter(t, data)
+	if footer[3] != goldenFooter[3] {
+		t.Errorf("num_rows is %v, expected %v", footer[3], goldenFooter[3])
+	}
+	schema := footer[2].([]interface{})
+	chunks := footer[4].([]interface{})[0].(map[int16]interface{})[1].([]interface{})
+	for i, index := range indices {
+		// SchemaElement: type, repetition_type, name, converted_type.
+		elem := schema[i+1].(map[int16]interface{})
+		goldenElem := goldenSchema[index+1].(map[int16]interface{})
+		for _, id := range []int16{1, 3, 4, 6} {
+			if !reflect.DeepEqual(elem[id], goldenElem[id]) {
+				t.Errorf("Schema element %s field %d is %v, expected %v",
+					columns[i].Name, id, elem[id], goldenElem[id])
+			}
+		}
+
+		// ColumnMetaData: type, path_in_schema, num_values, and the deprecated
+		// max and min of the statistics.
+		chunk := chunks[i].(map[int16]interface{})
+		goldenChunk := goldenChunks[index].(map[int16]interface{})
+		meta := chunk[3].(map[int16]interface{})
+		goldenMeta := goldenChunk[3].(map[int16]interface{})
+		for _, id := range []int16{1, 3, 5} {
+			if !reflect.DeepEqual(meta[id], goldenMeta[id]) {
+				t.Errorf("Column %s metadata field %d is %v, expected %v",
+					columns[i].Name, id, meta[id], goldenMeta[id])
+			}
+		}
+		stats := meta[12].(map[int16]interface{})
+		goldenStats := goldenMeta[12].(map[int16]interface{})
+		for _, id := range []int16{1, 2} {
+			if !bytes.Equal(stats[id].([]byte), goldenStats[id].([]byte)) {
+				t.Errorf("Column %s statistics field %d is %v, expected %v",
+					columns[i].Name, id, stats[id], goldenStats[id])
+			}
+		}
+
+		// The data pages (the golden file has several per column chunk): the
+		// encodings of their headers, and their uncompressed contents.
+		headers, pages := readDataPages(t, data, chunk)
+		goldenHeaders, goldenPages := readDataPages(t, golden, goldenChunk)
+		page, goldenPage := bytes.Join(pages, nil), bytes.Join(goldenPages, nil)
+		for _, goldenHeader := range goldenHeaders {
+			for _, id := range []int16{2, 3, 4} {
+				actual := headers[0][5].(map[int16]interface{})[id]
+				expected := goldenHeader[5].(map[int16]interface{})[id]
+				if headers[0][1] != goldenHeader[1] || actual != expected {
+					t.Errorf("Column %s page header is %v, expected %v",
+						columns[i].Name, headers[0], goldenHeader)
+				}
+			}
+		}
+		if !bytes.Equal(page, goldenPage) {
+			t.Errorf("Column %s page is:\n%v\nexpected:\n%v", columns[i].Name,
+				page, goldenPage)
+		}
+	}
+}
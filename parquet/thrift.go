@@ -0,0 +1,100 @@
+package parquet
+
+// Minimal encoder for the Thrift compact protocol, which Parquet uses for its
+// page headers and file metadata. Only what the writer needs is supported.
+
+import (
+	"encoding/binary"
+)
+
+const (
+	tStop   = 0
+	tI32    = 5
+	tI64    = 6
+	tBinary = 8
+	tList   = 9
+	tStruct = 12
+)
+
+type thriftEncoder struct {
+	buf []byte
+	// Id of the last field written in each open struct.
+	lastIds []int16
+	scratch [binary.MaxVarintLen64]byte
+}
+
+func (p *thriftEncoder) putUvarint(v uint64) {
+	n := binary.PutUvarint(p.scratch[:], v)
+	p.buf = append(p.buf, p.scratch[:n]...)
+}
+
+func (p *thriftEncoder) putVarint(v int64) {
+	n := binary.PutVarint(p.scratch[:], v)
+	p.buf = append(p.buf, p.scratch[:n]...)
+}
+
+func (p *thriftEncoder) fieldHeader(id int16, fieldType byte) {
+	last := &p.lastIds[len(p.lastIds)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		p.buf = append(p.buf, byte(delta)<<4|fieldType)
+	} else {
+		p.buf = append(p.buf, fieldType)
+		p.putVarint(int64(id))
+	}
+	*last = id
+}
+
+func (p *thriftEncoder) structBegin() {
+	p.lastIds = append(p.lastIds, 0)
+}
+
+func (p *thriftEncoder) structEnd() {
+	p.buf = append(p.buf, tStop)
+	p.lastIds = p.lastIds[:len(p.lastIds)-1]
+}
+
+func (p *thriftEncoder) fieldStruct(id int16) {
+	p.fieldHeader(id, tStruct)
+	p.structBegin()
+}
+
+func (p *thriftEncoder) fieldI32(id int16, v int32) {
+	p.fieldHeader(id, tI32)
+	p.putVarint(int64(v))
+}
+
+func (p *thriftEncoder) fieldI64(id int16, v int64) {
+	p.fieldHeader(id, tI64)
+	p.putVarint(v)
+}
+
+func (p *thriftEncoder) fieldBinary(id int16, v []byte) {
+	p.fieldHeader(id, tBinary)
+	p.putUvarint(uint64(len(v)))
+	p.buf = append(p.buf, v...)
+}
+
+func (p *thriftEncoder) fieldString(id int16, v string) {
+	p.fieldBinary(id, []byte(v))
+}
+
+// fieldList writes the header of a list field; the caller then writes the
+// size elements (e.g. with listI32, or structBegin ... structEnd for each).
+func (p *thriftEncoder) fieldList(id int16, elemType byte, size int) {
+	p.fieldHeader(id, tList)
+	if size < 15 {
+		p.buf = append(p.buf, byte(size)<<4|elemType)
+	} else {
+		p.buf = append(p.buf, 0xf0|elemType)
+		p.putUvarint(uint64(size))
+	}
+}
+
+func (p *thriftEncoder) listI32(v int32) {
+	p.putVarint(int64(v))
+}
+
+func (p *thriftEncoder) listString(v string) {
+	p.putUvarint(uint64(len(v)))
+	p.buf = append(p.buf, v...)
+}
@@ -0,0 +1,508 @@
+// Package parquet implements a small writer of Apache Parquet files, enough
+// for exporting flat tables (no nesting or repetition) of numbers, strings and
+// timestamps for analysis with tools such as DuckDB and pandas. Values are
+// stored with PLAIN encoding in one data page per column chunk, optionally
+// compressed with gzip.
+package parquet
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// Physical types.
+type Type int32
+
+const (
+	Int32     Type = 1
+	Int64     Type = 2
+	Double    Type = 5
+	ByteArray Type = 6
+)
+
+// Converted (logical) types, which tell readers how to interpret a physical
+// type.
+type ConvertedType int32
+
+const (
+	NoConvertedType ConvertedType = -1
+	UTF8            ConvertedType = 0
+	Date            ConvertedType = 6 // Int32, days since the unix epoch.
+	TimestampMillis ConvertedType = 9 // Int64, ms since the unix epoch (UTC).
+)
+
+type Codec int32
+
+const (
+	Uncompressed Codec = 0
+	Gzip         Codec = 2
+)
+
+const (
+	kMagic = "PAR1"
+
+	kRequired = 0
+	kOptional = 1
+
+	kPlainEncoding = 0
+	kRLEEncoding   = 3
+	kDataPage      = 0
+
+	DefaultRowGroupSize = 1000000
+)
+
+type Column struct {
+	Name          string
+	Type          Type
+	ConvertedType ConvertedType
+	// If true, values may be nil.
+	Optional bool
+}
+
+func StringColumn(name string, optional bool) Column {
+	return Column{Name: name, Type: ByteArray, ConvertedType: UTF8,
+		Optional: optional}
+}
+
+// Accumulates the values of one column of a row group.
+type columnChunk struct {
+	values    bytes.Buffer
+	defLevels []byte // 1 if present, 0 if null; only for optional columns.
+	numNulls  int64
+	// Statistics of the non-null values (not kept for strings).
+	hasStats   bool
+	minI, maxI int64
+	minF, maxF float64
+	scratch    [8]byte
+}
+
+func (p *columnChunk) reset() {
+	p.values.Reset()
+	p.defLevels = p.defLevels[:0]
+	p.numNulls = 0
+	p.hasStats = false
+}
+
+func (p *columnChunk) updateInt(v int64) {
+	if !p.hasStats {
+		p.minI, p.maxI, p.hasStats = v, v, true
+	} else if v < p.minI {
+		p.minI = v
+	} else if v > p.maxI {
+		p.maxI = v
+	}
+}
+
+func (p *columnChunk) updateFloat(v float64) {
+	if math.IsNaN(v) {
+		return
+	}
+	if !p.hasStats {
+		p.minF, p.maxF, p.hasStats = v, v, true
+	} else if v < p.minF {
+		p.minF = v
+	} else if v > p.maxF {
+		p.maxF = v
+	}
+}
+
+// Writes a Parquet file. Rows are buffered in memory until RowGroupSize rows
+// have been appended, at which point they are written as a row group.
+type Writer struct {
+	Codec        Codec
+	RowGroupSize int
+	CreatedBy    string
+	// Key-value metadata to be stored in the file footer.
+	Metadata map[string]string
+
+	columns   []Column
+	w         *bufio.Writer
+	offset    int64
+	chunks    []*columnChunk
+	numRows   int64 // In the current row group.
+	rowGroups []*rowGroupMeta
+	totalRows int64
+	closed    bool
+}
+
+type columnMeta struct {
+	dataPageOffset   int64
+	uncompressedSize int64
+	compressedSize   int64
+	numValues        int64
+	numNulls         int64
+	hasStats         bool
+	min, max         []byte
+}
+
+type rowGroupMeta struct {
+	numRows   int64
+	totalSize int64
+	columns   []*columnMeta
+}
+
+func NewWriter(w io.Writer, columns []Column) *Writer {
+	p := &Writer{
+		Codec:        Gzip,
+		RowGroupSize: DefaultRowGroupSize,
+		CreatedBy:    "transit_tools parquet writer",
+		columns:      columns,
+		w:            bufio.NewWriter(w),
+	}
+	for range columns {
+		p.chunks = append(p.chunks, &columnChunk{})
+	}
+	return p
+}
+
+func (p *Writer) Columns() []Column {
+	return p.columns
+}
+
+// NumRows returns the number of rows appended so far.
+func (p *Writer) NumRows() int64 {
+	return p.totalRows + p.numRows
+}
+
+func (p *Writer) write(b []byte) error {
+	n, err := p.w.Write(b)
+	p.offset += int64(n)
+	return err
+}
+
+// AppendRow appends a row with one value per column: int32 for Int32
+// columns, int64 for Int64 columns, float64 for Double columns, and string or
+// []byte for ByteArray columns; nil for a null value in an optional column.
+func (p *Writer) AppendRow(values ...interface{}) error {
+	if p.closed {
+		return fmt.Errorf("Writer is closed")
+	}
+	if len(values) != len(p.columns) {
+		return fmt.Errorf("Expected %d values, not %d", len(p.columns),
+			len(values))
+	}
+	// Check all the values before appending any, so that a bad row doesn't
+	// leave the columns with different numbers of values.
+	for i, v := range values {
+		if err := checkValue(&p.columns[i], v); err != nil {
+			return err
+		}
+	}
+	for i, v := range values {
+		p.appendValue(&p.columns[i], p.chunks[i], v)
+	}
+	p.numRows++
+	if p.RowGroupSize > 0 && p.numRows >= int64(p.RowGroupSize) {
+		return p.writeRowGroup()
+	}
+	return nil
+}
+
+func checkValue(col *Column, v interface{}) error {
+	ok := false
+	switch v.(type) {
+	case nil:
+		ok = col.Optional
+	case int32:
+		ok = col.Type == Int32
+	case int64:
+		ok = col.Type == Int64
+	case float64:
+		ok = col.Type == Double
+	case string, []byte:
+		ok = col.Type == ByteArray
+	}
+	if !ok {
+		return fmt.Errorf("Invalid value for column %s: %#v", col.Name, v)
+	}
+	return nil
+}
+
+func (p *Writer) appendValue(col *Column, chunk *columnChunk, v interface{}) {
+	if v == nil {
+		chunk.defLevels = append(chunk.defLevels, 0)
+		chunk.numNulls++
+		return
+	}
+	if col.Optional {
+		chunk.defLevels = append(chunk.defLevels, 1)
+	}
+	b := chunk.scratch[:]
+	switch t := v.(type) {
+	case int32:
+		binary.LittleEndian.PutUint32(b, uint32(t))
+		chunk.values.Write(b[:4])
+		chunk.updateInt(int64(t))
+	case int64:
+		binary.LittleEndian.PutUint64(b, uint64(t))
+		chunk.values.Write(b)
+		chunk.updateInt(t)
+	case float64:
+		binary.LittleEndian.PutUint64(b, math.Float64bits(t))
+		chunk.values.Write(b)
+		chunk.updateFloat(t)
+	case string:
+		binary.LittleEndian.PutUint32(b, uint32(len(t)))
+		chunk.values.Write(b[:4])
+		chunk.values.WriteString(t)
+	case []byte:
+		binary.LittleEndian.PutUint32(b, uint32(len(t)))
+		chunk.values.Write(b[:4])
+		chunk.values.Write(t)
+	}
+}
+
+// Encodes the definition levels (bit width 1) with the RLE/bit-packing
+// hybrid encoding, using only RLE runs, preceded by the length.
+func encodeDefLevels(levels []byte) []byte {
+	var runs []byte
+	var scratch [binary.MaxVarintLen64]byte
+	for i := 0; i < len(levels); {
+		j := i + 1
+		for j < len(levels) && levels[j] == levels[i] {
+			j++
+		}
+		n := binary.PutUvarint(scratch[:], uint64(j-i)<<1)
+		runs = append(runs, scratch[:n]...)
+		runs = append(runs, levels[i])
+		i = j
+	}
+	result := make([]byte, 4, 4+len(runs))
+	binary.LittleEndian.PutUint32(result, uint32(len(runs)))
+	return append(result, runs...)
+}
+
+func (p *Writer) compress(data []byte) ([]byte, error) {
+	switch p.Codec {
+	case Uncompressed:
+		return data, nil
+	case Gzip:
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		if _, err := gw.Write(data); err != nil {
+			return nil, err
+		}
+		if err := gw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, fmt.Errorf("Unsupported codec: %d", p.Codec)
+}
+
+func (p *Writer) statsBytes(col *Column, chunk *columnChunk) (min, max []byte) {
+	switch col.Type {
+	case Int32:
+		min, max = make([]byte, 4), make([]byte, 4)
+		binary.LittleEndian.PutUint32(min, uint32(chunk.minI))
+		binary.LittleEndian.PutUint32(max, uint32(chunk.maxI))
+	case Int64:
+		min, max = make([]byte, 8), make([]byte, 8)
+		binary.LittleEndian.PutUint64(min, uint64(chunk.minI))
+		binary.LittleEndian.PutUint64(max, uint64(chunk.maxI))
+	case Double:
+		min, max = make([]byte, 8), make([]byte, 8)
+		binary.LittleEndian.PutUint64(min, math.Float64bits(chunk.minF))
+		binary.LittleEndian.PutUint64(max, math.Float64bits(chunk.maxF))
+	}
+	return
+}
+
+func (p *Writer) writeHeader() error {
+	if p.offset == 0 {
+		return p.write([]byte(kMagic))
+	}
+	return nil
+}
+
+func (p *Writer) writeColumnChunk(
+	col *Column, chunk *columnChunk) (*columnMeta, error) {
+	var page []byte
+	if col.Optional {
+		page = encodeDefLevels(chunk.defLevels)
+	}
+	page = append(page, chunk.values.Bytes()...)
+	compressed, err := p.compress(page)
+	if err != nil {
+		return nil, err
+	}
+	te := &thriftEncoder{}
+	te.structBegin()
+	te.fieldI32(1, kDataPage)
+	te.fieldI32(2, int32(len(page)))
+	te.fieldI32(3, int32(len(compressed)))
+	te.fieldStruct(5) // DataPageHeader
+	te.fieldI32(1, int32(p.numRows))
+	te.fieldI32(2, kPlainEncoding)
+	te.fieldI32(3, kRLEEncoding)
+	te.fieldI32(4, kRLEEncoding)
+	te.structEnd()
+	te.structEnd()
+
+	meta := &columnMeta{
+		dataPageOffset:   p.offset,
+		uncompressedSize: int64(len(te.buf) + len(page)),
+		compressedSize:   int64(len(te.buf) + len(compressed)),
+		numValues:        p.numRows,
+		numNulls:         chunk.numNulls,
+		hasStats:         chunk.hasStats,
+	}
+	if chunk.hasStats {
+		meta.min, meta.max = p.statsBytes(col, chunk)
+	}
+	if err := p.write(te.buf); err != nil {
+		return nil, err
+	}
+	if err := p.write(compressed); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+func (p *Writer) writeRowGroup() error {
+	if err := p.writeHeader(); err != nil {
+		return err
+	}
+	if p.numRows == 0 {
+		return nil
+	}
+	rg := &rowGroupMeta{numRows: p.numRows}
+	for i := range p.columns {
+		meta, err := p.writeColumnChunk(&p.columns[i], p.chunks[i])
+		if err != nil {
+			return err
+		}
+		rg.columns = append(rg.columns, meta)
+		rg.totalSize += meta.uncompressedSize
+		p.chunks[i].reset()
+	}
+	p.rowGroups = append(p.rowGroups, rg)
+	p.totalRows += p.numRows
+	p.numRows = 0
+	return nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (p *Writer) encodeFileMetadata() []byte {
+	te := &thriftEncoder{}
+	te.structBegin()
+	te.fieldI32(1, 1) // version
+	te.fieldList(2, tStruct, len(p.columns)+1)
+	// The root of the schema.
+	te.structBegin()
+	te.fieldString(4, "schema")
+	te.fieldI32(5, int32(len(p.columns)))
+	te.structEnd()
+	for _, col := range p.columns {
+		te.structBegin()
+		te.fieldI32(1, int32(col.Type))
+		if col.Optional {
+			te.fieldI32(3, kOptional)
+		} else {
+			te.fieldI32(3, kRequired)
+		}
+		te.fieldString(4, col.Name)
+		if col.ConvertedType != NoConvertedType {
+			te.fieldI32(6, int32(col.ConvertedType))
+		}
+		te.structEnd()
+	}
+	te.fieldI64(3, p.totalRows)
+	te.fieldList(4, tStruct, len(p.rowGroups))
+	for _, rg := range p.rowGroups {
+		te.structBegin()
+		te.fieldList(1, tStruct, len(rg.columns))
+		for i, cm := range rg.columns {
+			col := &p.columns[i]
+			te.structBegin() // ColumnChunk
+			te.fieldI64(2, cm.dataPageOffset)
+			te.fieldStruct(3) // ColumnMetaData
+			te.fieldI32(1, int32(col.Type))
+			te.fieldList(2, tI32, 2)
+			te.listI32(kPlainEncoding)
+			te.listI32(kRLEEncoding)
+			te.fieldList(3, tBinary, 1)
+			te.listString(col.Name)
+			te.fieldI32(4, int32(p.Codec))
+			te.fieldI64(5, cm.numValues)
+			te.fieldI64(6, cm.uncompressedSize)
+			te.fieldI64(7, cm.compressedSize)
+			te.fieldI64(9, cm.dataPageOffset)
+			te.fieldStruct(12) // Statistics
+			te.fieldI64(3, cm.numNulls)
+			if cm.hasStats {
+				// Both the deprecated and current fields, for older readers; the
+				// orders are the same for the signed numeric types.
+				te.fieldBinary(1, cm.max)
+				te.fieldBinary(2, cm.min)
+				te.fieldBinary(5, cm.max)
+				te.fieldBinary(6, cm.min)
+			}
+			te.structEnd()
+			te.structEnd()
+			te.structEnd()
+		}
+		te.fieldI64(2, rg.totalSize)
+		te.fieldI64(3, rg.numRows)
+		te.structEnd()
+	}
+	if len(p.Metadata) > 0 {
+		keys := sortedKeys(p.Metadata)
+		te.fieldList(5, tStruct, len(keys))
+		for _, k := range keys {
+			te.structBegin()
+			te.fieldString(1, k)
+			te.fieldString(2, p.Metadata[k])
+			te.structEnd()
+		}
+	}
+	if len(p.CreatedBy) > 0 {
+		te.fieldString(6, p.CreatedBy)
+	}
+	// The sort order used for the statistics of each column: the order defined
+	// by its type (TypeDefinedOrder, an empty struct).
+	te.fieldList(7, tStruct, len(p.columns))
+	for range p.columns {
+		te.structBegin()
+		te.fieldStruct(1)
+		te.structEnd()
+		te.structEnd()
+	}
+	te.structEnd()
+	return te.buf
+}
+
+// Close writes the remaining rows and the file footer; it doesn't close the
+// underlying writer.
+func (p *Writer) Close() error {
+	if p.closed {
+		return nil
+	}
+	if err := p.writeRowGroup(); err != nil {
+		return err
+	}
+	p.closed = true
+	footer := p.encodeFileMetadata()
+	var size [4]byte
+	binary.LittleEndian.PutUint32(size[:], uint32(len(footer)))
+	footer = append(footer, size[:]...)
+	footer = append(footer, kMagic...)
+	if err := p.write(footer); err != nil {
+		return err
+	}
+	return p.w.Flush()
+}
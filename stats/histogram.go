@@ -0,0 +1,163 @@
+package stats
+
+import (
+	"fmt"
+	"math"
+)
+
+// A histogram with a fixed number of bins spanning [Min, Max), either of
+// equal width, or (if Log is true) of equal width on a log scale, which suits
+// values spanning orders of magnitude (e.g. headways from seconds to hours).
+// Samples outside the range are counted in Underflow or Overflow.
+// The fields are exported so that it can be serialized (e.g. as JSON).
+type Histogram struct {
+	Log       bool
+	Min, Max  float64
+	Counts    []float64
+	Underflow float64
+	Overflow  float64
+}
+
+func NewLinearHistogram(min, max float64, numBins int) (*Histogram, error) {
+	if !(min < max) || numBins < 1 {
+		return nil, fmt.Errorf("Invalid histogram range [%v, %v) or bins %d",
+			min, max, numBins)
+	}
+	return &Histogram{Min: min, Max: max, Counts: make([]float64, numBins)}, nil
+}
+
+// min must be positive.
+func NewLogHistogram(min, max float64, numBins int) (*Histogram, error) {
+	if !(min > 0) {
+		return nil, fmt.Errorf("Log histogram min must be positive: %v", min)
+	}
+	h, err := NewLinearHistogram(min, max, numBins)
+	if err != nil {
+		return nil, err
+	}
+	h.Log = true
+	return h, nil
+}
+
+func (h *Histogram) NumBins() int {
+	return len(h.Counts)
+}
+
+// Maps v to the scale on which the bins are of equal width.
+func (h *Histogram) toScale(v float64) float64 {
+	if h.Log {
+		return math.Log(v)
+	}
+	return v
+}
+
+func (h *Histogram) fromScale(s float64) float64 {
+	if h.Log {
+		return math.Exp(s)
+	}
+	return s
+}
+
+// BinIndex returns the index of the bin containing v, -1 if v is below Min
+// (or NaN), or NumBins() if v is at or above Max.
+func (h *Histogram) BinIndex(v float64) int {
+	if !(v >= h.Min) {
+		return -1
+	}
+	if v >= h.Max {
+		return len(h.Counts)
+	}
+	lo, hi := h.toScale(h.Min), h.toScale(h.Max)
+	i := int(float64(len(h.Counts)) * (h.toScale(v) - lo) / (hi - lo))
+	if i >= len(h.Counts) {
+		// Rounding.
+		i = len(h.Counts) - 1
+	}
+	return i
+}
+
+// BinBounds returns the range [lo, hi) of values in bin i.
+func (h *Histogram) BinBounds(i int) (lo, hi float64) {
+	sMin, sMax := h.toScale(h.Min), h.toScale(h.Max)
+	width := (sMax - sMin) / float64(len(h.Counts))
+	lo = h.fromScale(sMin + width*float64(i))
+	hi = h.fromScale(sMin + width*float64(i+1))
+	if i == 0 {
+		lo = h.Min
+	}
+	if i == len(h.Counts)-1 {
+		hi = h.Max
+	}
+	return
+}
+
+func (h *Histogram) Add(v float64) {
+	h.AddWeighted(v, 1)
+}
+
+func (h *Histogram) AddWeighted(v, weight float64) {
+	switch i := h.BinIndex(v); {
+	case i < 0:
+		h.Underflow += weight
+	case i >= len(h.Counts):
+		h.Overflow += weight
+	default:
+		h.Counts[i] += weight
+	}
+}
+
+// Total weight of the samples, including those out of range.
+func (h *Histogram) Total() float64 {
+	var sum KahanSum
+	sum.Add(h.Underflow)
+	for _, c := range h.Counts {
+		sum.Add(c)
+	}
+	sum.Add(h.Overflow)
+	return sum.Sum
+}
+
+// Merge adds the counts of o to h; they must have the same bins.
+func (h *Histogram) Merge(o *Histogram) error {
+	if h.Log != o.Log || h.Min != o.Min || h.Max != o.Max ||
+		len(h.Counts) != len(o.Counts) {
+		return fmt.Errorf("Can't merge histograms with different bins")
+	}
+	for i, c := range o.Counts {
+		h.Counts[i] += c
+	}
+	h.Underflow += o.Underflow
+	h.Overflow += o.Overflow
+	return nil
+}
+
+// Quantile returns an estimate of the value below which the fraction q of the
+// weight of the samples falls, assuming samples are spread evenly (on the
+// histogram's scale) within each bin. Returns Min if the quantile is among
+// the underflow, Max if among the overflow, and NaN if there are no samples.
+func (h *Histogram) Quantile(q float64) float64 {
+	total := h.Total()
+	if !(total > 0) || math.IsNaN(q) {
+		return math.NaN()
+	}
+	target := q * total
+	cumulative := h.Underflow
+	if target <= cumulative && h.Underflow > 0 {
+		return h.Min
+	}
+	for i, c := range h.Counts {
+		if c > 0 && cumulative+c >= target {
+			lo, hi := h.BinBounds(i)
+			f := math.Max(0, (target-cumulative)/c)
+			return h.fromScale(h.toScale(lo) + f*(h.toScale(hi)-h.toScale(lo)))
+		}
+		cumulative += c
+	}
+	return h.Max
+}
+
+func (h *Histogram) String() string {
+	return fmt.Sprintf(
+		"{Range: [%v, %v); Bins: %d; Log: %v; Total: %v; Under: %v; Over: %v}",
+		h.Min, h.Max, len(h.Counts), h.Log, h.Total(), h.Underflow, h.Overflow)
+}
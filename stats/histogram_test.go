@@ -0,0 +1,102 @@
+package stats
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestLinearHistogram(t *testing.T) {
+	h, err := NewLinearHistogram(0, 100, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []float64{-1, 0, 9.99, 10, 55, 99.9, 100, 1000, math.NaN()} {
+		h.Add(v)
+	}
+	expected := []float64{2, 1, 0, 0, 0, 1, 0, 0, 0, 1}
+	if !reflect.DeepEqual(h.Counts, expected) || h.Underflow != 2 ||
+		h.Overflow != 2 || h.Total() != 9 {
+		t.Errorf("Histogram: %v %v", h, h.Counts)
+	}
+	if lo, hi := h.BinBounds(3); lo != 30 || hi != 40 {
+		t.Errorf("BinBounds(3) = %v, %v", lo, hi)
+	}
+
+	for _, bad := range [][3]float64{{0, 0, 1}, {1, 0, 1}, {0, 1, 0}} {
+		if _, err := NewLinearHistogram(bad[0], bad[1], int(bad[2])); err == nil {
+			t.Errorf("Expected an error for %v", bad)
+		}
+	}
+}
+
+func TestLogHistogram(t *testing.T) {
+	// Bins of a factor of 10: [1, 10), [10, 100), [100, 1000).
+	h, err := NewLogHistogram(1, 1000, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		v     float64
+		index int
+	}{
+		{0.5, -1}, {1, 0}, {9.99, 0}, {10, 1}, {99, 1}, {100, 2}, {999, 2}, {1000, 3},
+	} {
+		if i := h.BinIndex(test.v); i != test.index {
+			t.Errorf("BinIndex(%v) = %d, expected %d", test.v, i, test.index)
+		}
+	}
+	if lo, hi := h.BinBounds(1); math.Abs(lo-10) > 1e-9 || math.Abs(hi-100) > 1e-9 {
+		t.Errorf("BinBounds(1) = %v, %v", lo, hi)
+	}
+	if _, err := NewLogHistogram(0, 1000, 3); err == nil {
+		t.Errorf("Expected an error for a zero min")
+	}
+}
+
+func TestHistogramQuantileAndMerge(t *testing.T) {
+	h1, _ := NewLinearHistogram(0, 10, 10)
+	h2, _ := NewLinearHistogram(0, 10, 10)
+	for i := 0; i < 500; i++ {
+		h1.Add(float64(i%50) / 10)   // Uniform on [0, 5)
+		h2.Add(5 + float64(i%50)/10) // Uniform on [5, 10)
+	}
+	h2.AddWeighted(20, 0)
+	if err := h1.Merge(h2); err != nil {
+		t.Fatal(err)
+	}
+	if h1.Total() != 1000 {
+		t.Errorf("Merged: %v", h1)
+	}
+	for _, q := range []float64{0.1, 0.25, 0.5, 0.9} {
+		if v := h1.Quantile(q); math.Abs(v-10*q) > 0.1 {
+			t.Errorf("Quantile(%v) = %v", q, v)
+		}
+	}
+	if v := h1.Quantile(1); v != 10 {
+		t.Errorf("Quantile(1) = %v", v)
+	}
+
+	log1, _ := NewLogHistogram(1, 1000, 3)
+	if err := h1.Merge(log1); err == nil {
+		t.Errorf("Expected an error merging different bins")
+	}
+	empty, _ := NewLinearHistogram(0, 1, 1)
+	if !math.IsNaN(empty.Quantile(0.5)) {
+		t.Errorf("Quantile of empty histogram: %v", empty.Quantile(0.5))
+	}
+
+	// Round trip through JSON, and merge.
+	data, err := json.Marshal(h1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var h3 Histogram
+	if err := json.Unmarshal(data, &h3); err != nil {
+		t.Fatal(err)
+	}
+	if err := h3.Merge(h1); err != nil || h3.Total() != 2000 {
+		t.Errorf("After JSON round trip: %v, %v", &h3, err)
+	}
+}
@@ -7,6 +7,8 @@ import (
 	"math"
 )
 
+// Returns the weighted median of the values, and its index. Requires all of
+// the data in memory; see TDigest for an estimate from a stream of values.
 func Data1DWeightedMedian(source Data1DSource) (value float64, index int) {
 	index = -1
 	totalWeight := 0.0
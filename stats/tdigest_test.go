@@ -0,0 +1,214 @@
+package stats
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// The exact quantile of sorted samples, interpolating as TDigest does for
+// singletons.
+func exactQuantile(sorted []float64, q float64) float64 {
+	target := q*float64(len(sorted)) - 0.5
+	if target <= 0 {
+		return sorted[0]
+	}
+	i := int(target)
+	if i >= len(sorted)-1 {
+		return sorted[len(sorted)-1]
+	}
+	return sorted[i] + (sorted[i+1]-sorted[i])*(target-float64(i))
+}
+
+func TestTDigestSmall(t *testing.T) {
+	d := NewTDigest(DefaultTDigestCompression)
+	if !math.IsNaN(d.Quantile(0.5)) || !math.IsNaN(d.CDF(1)) || !math.IsNaN(d.Min()) {
+		t.Errorf("Empty digest: %v", d)
+	}
+	for i := 100; i >= 1; i-- {
+		d.Add(float64(i))
+	}
+	d.AddWeighted(1000, 0) // Ignored.
+	d.Add(math.NaN())      // Ignored.
+	if d.Count() != 100 || d.Min() != 1 || d.Max() != 100 {
+		t.Errorf("Digest: %v", d)
+	}
+	for _, test := range []struct{ q, v float64 }{
+		{0, 1}, {0.005, 1}, {0.5, 50.5}, {0.25, 25.5}, {0.995, 100}, {1, 100},
+	} {
+		if v := d.Quantile(test.q); math.Abs(v-test.v) > 0.5 {
+			t.Errorf("Quantile(%v) = %v, expected %v", test.q, v, test.v)
+		}
+	}
+	if c := d.CDF(0); c != 0 {
+		t.Errorf("CDF(0) = %v", c)
+	}
+	if c := d.CDF(100); c != 1 {
+		t.Errorf("CDF(100) = %v", c)
+	}
+	if c := d.CDF(50.5); math.Abs(c-0.5) > 0.01 {
+		t.Errorf("CDF(50.5) = %v", c)
+	}
+}
+
+func TestTDigestAccuracy(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	d := NewTDigest(DefaultTDigestCompression)
+	var samples []float64
+	for i := 0; i < 100000; i++ {
+		// Skewed, like headways or delays.
+		v := rng.ExpFloat64() * 300
+		samples = append(samples, v)
+		d.Add(v)
+	}
+	sort.Float64s(samples)
+	if n := d.NumCentroids(); n > 2*DefaultTDigestCompression {
+		t.Errorf("Too many centroids: %d", n)
+	}
+	for _, q := range []float64{0.001, 0.01, 0.1, 0.25, 0.5, 0.75, 0.9, 0.99, 0.999} {
+		expected := exactQuantile(samples, q)
+		got := d.Quantile(q)
+		// Compare by rank, which is how t-digest accuracy is stated.
+		rank := float64(sort.SearchFloat64s(samples, got)) / float64(len(samples))
+		if math.Abs(rank-q) > 0.01*math.Min(q, 1-q)+0.0005 {
+			t.Errorf("Quantile(%v) = %v (rank %v), expected %v", q, got, rank, expected)
+		}
+		if c := d.CDF(expected); math.Abs(c-q) > 0.01*math.Min(q, 1-q)+0.0005 {
+			t.Errorf("CDF(%v) = %v, expected %v", expected, c, q)
+		}
+	}
+}
+
+func TestTDigestMerge(t *testing.T) {
+	// Each goroutine fills its own digest; they're merged at the end.
+	var wg sync.WaitGroup
+	digests := make([]*TDigest, 8)
+	for i := range digests {
+		digests[i] = NewTDigest(DefaultTDigestCompression)
+		wg.Add(1)
+		go func(d *TDigest, offset float64) {
+			defer wg.Done()
+			for j := 0; j < 10000; j++ {
+				d.Add(offset + float64(j)/10000)
+			}
+		}(digests[i], float64(i))
+	}
+	wg.Wait()
+	all := NewTDigest(DefaultTDigestCompression)
+	for _, d := range digests {
+		all.Merge(d)
+	}
+	all.Merge(NewTDigest(DefaultTDigestCompression))
+	if all.Count() != 80000 || all.Min() != 0 || all.Max() != 7.9999 {
+		t.Errorf("Merged: %v", all)
+	}
+	// Uniform on [0, 8).
+	for _, q := range []float64{0.01, 0.1, 0.5, 0.9, 0.99} {
+		if v := all.Quantile(q); math.Abs(v-8*q) > 0.01 {
+			t.Errorf("Quantile(%v) = %v, expected %v", q, v, 8*q)
+		}
+	}
+	if digests[0].Count() != 10000 || digests[0].Max() != 0.9999 {
+		t.Errorf("Merge changed its argument: %v", digests[0])
+	}
+}
+
+func TestTDigestSerialization(t *testing.T) {
+	d := NewTDigest(50)
+	for i := 0; i < 1000; i++ {
+		d.AddWeighted(float64(i%97), float64(1+i%3))
+	}
+	data, err := d.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var d2 TDigest
+	if err := d2.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if d2.Count() != d.Count() || d2.Min() != d.Min() || d2.Max() != d.Max() ||
+		d2.Compression() != 50 || d2.NumCentroids() != d.NumCentroids() {
+		t.Errorf("Decoded: %v, expected %v", &d2, d)
+	}
+	for _, q := range []float64{0, 0.1, 0.5, 0.9, 1} {
+		if d2.Quantile(q) != d.Quantile(q) {
+			t.Errorf("Quantile(%v): %v, expected %v", q, d2.Quantile(q), d.Quantile(q))
+		}
+	}
+	// The decoded digest can continue to accumulate.
+	d2.Add(1000)
+	if d2.Max() != 1000 {
+		t.Errorf("Max after Add: %v", d2.Max())
+	}
+
+	// Also via gob, e.g. in a struct of per-route digests.
+	var buf bytes.Buffer
+	in := map[string]*TDigest{"1": d}
+	if err := gob.NewEncoder(&buf).Encode(in); err != nil {
+		t.Fatal(err)
+	}
+	var out map[string]*TDigest
+	if err := gob.NewDecoder(&buf).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	if out["1"] == nil || out["1"].Quantile(0.5) != d.Quantile(0.5) {
+		t.Errorf("gob round trip: %v", out)
+	}
+
+	for _, bad := range [][]byte{nil, {2}, data[:len(data)-1]} {
+		if err := d2.UnmarshalBinary(bad); err == nil {
+			t.Errorf("Expected error decoding %v", bad)
+		}
+	}
+}
+
+func TestTDigestUnmarshalCorruptHeader(t *testing.T) {
+	d := NewTDigest(50)
+	for i := 0; i < 100; i++ {
+		d.Add(float64(i))
+	}
+	data, err := d.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The header follows the version byte: compression, min, max (float64s).
+	corrupt := func(offset int, v float64) []byte {
+		result := append([]byte(nil), data...)
+		binary.BigEndian.PutUint64(result[offset:], math.Float64bits(v))
+		return result
+	}
+	for name, bad := range map[string][]byte{
+		"NaN compression":      corrupt(1, math.NaN()),
+		"infinite compression": corrupt(1, math.Inf(1)),
+		"huge compression":     corrupt(1, 1e300),
+		"small compression":    corrupt(1, 5),
+		"negative compression": corrupt(1, -100),
+		"min above max":        corrupt(9, 1000),
+		"NaN min":              corrupt(9, math.NaN()),
+		"NaN max":              corrupt(17, math.NaN()),
+	} {
+		var d2 TDigest
+		if err := d2.UnmarshalBinary(bad); err == nil {
+			t.Errorf("Expected error decoding digest with %s", name)
+		}
+	}
+
+	// An empty digest has min > max (+Inf and -Inf), which is fine.
+	data, err = NewTDigest(20).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var d2 TDigest
+	if err := d2.UnmarshalBinary(data); err != nil {
+		t.Errorf("Unable to decode an empty digest: %v", err)
+	}
+	d2.Add(3)
+	if d2.Min() != 3 || d2.Max() != 3 {
+		t.Errorf("Wrong range after Add: %v to %v", d2.Min(), d2.Max())
+	}
+}
@@ -24,3 +24,13 @@ func (grc *gzipReadCloser) Close() (err error) {
 	err = grc.gr.Close()
 	return
 }
+
+// NewGzipReadCloser returns a ReadCloser that decompresses src, and closes
+// src when closed.
+func NewGzipReadCloser(src io.ReadCloser) (io.ReadCloser, error) {
+	gr, err := gzip.NewReader(src)
+	if err != nil {
+		return nil, err
+	}
+	return &gzipReadCloser{src, gr}, nil
+}
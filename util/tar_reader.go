@@ -31,7 +31,7 @@ func ProcessTarEntries(tr *tar.Reader, ef EntryFunc) error {
 		}
 		thisName := header.Name
 		err = ef(header, tr)
-		if err == nil {
+		if err != nil {
 			if err == io.EOF {
 				return nil
 			}
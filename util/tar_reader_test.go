@@ -0,0 +1,77 @@
+package util
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func makeTestTar(t *testing.T, names ...string) *bytes.Buffer {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range names {
+		body := []byte("body of " + name)
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(body))}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestProcessTarEntries(t *testing.T) {
+	names := []string{"a.xml", "b.xml", "c.xml"}
+	var gotNames, gotBodies []string
+	err := ProcessTarEntries(tar.NewReader(makeTestTar(t, names...)),
+		func(header *tar.Header, body io.Reader) error {
+			b, err := ioutil.ReadAll(body)
+			gotNames = append(gotNames, header.Name)
+			gotBodies = append(gotBodies, string(b))
+			return err
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotNames, names) {
+		t.Errorf("Processed %v, expected %v", gotNames, names)
+	}
+	if gotBodies[2] != "body of c.xml" {
+		t.Errorf("Bodies: %v", gotBodies)
+	}
+
+	// io.EOF from the function stops processing without an error.
+	count := 0
+	err = ProcessTarEntries(tar.NewReader(makeTestTar(t, names...)),
+		func(header *tar.Header, body io.Reader) error {
+			count++
+			return io.EOF
+		})
+	if err != nil || count != 1 {
+		t.Errorf("After io.EOF: %d entries, error %v", count, err)
+	}
+
+	// Other errors stop processing, and are returned.
+	stop := errors.New("stop")
+	count = 0
+	err = ProcessTarEntries(tar.NewReader(makeTestTar(t, names...)),
+		func(header *tar.Header, body io.Reader) error {
+			count++
+			if count == 2 {
+				return stop
+			}
+			return nil
+		})
+	if err != stop || count != 2 {
+		t.Errorf("After error: %d entries, error %v", count, err)
+	}
+}
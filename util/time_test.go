@@ -6,8 +6,6 @@ import (
 	"testing"
 	"time"
 
-	"reflect"
-
 	"github.com/jamessynge/transit_tools/compare"
 )
 